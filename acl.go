@@ -0,0 +1,82 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// parseNets parses a comma separated list of CIDRs, plain addresses are
+// taken as a single host.
+func parseNets(list string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, s := range strings.Split(list, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		if !strings.Contains(s, "/") {
+			if ip := net.ParseIP(s); ip != nil && ip.To4() != nil {
+				s += "/32"
+			} else {
+				s += "/128"
+			}
+		}
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// allowed tells if addr may connect: it must not be in -deny and, when
+// -allow is given, must be in -allow.
+func (b *bridge) allowed(addr net.Addr) bool {
+	b.mu.Lock()
+	allowNets, denyNets := b.allowNets, b.denyNets
+	b.mu.Unlock()
+	if len(allowNets) == 0 && len(denyNets) == 0 {
+		return true
+	}
+	var ip net.IP
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		ip = a.IP
+	case *net.UDPAddr:
+		ip = a.IP
+	default:
+		// unix sockets and named pipes are local, their permissions apply
+		return true
+	}
+	if containsIP(denyNets, ip) {
+		return false
+	}
+	return len(allowNets) == 0 || containsIP(allowNets, ip)
+}
+
+// remoteAddr is the client address of an http request, nil when it isn't
+// an ip address, e.g. on a unix socket.
+func remoteAddr(r *http.Request) net.Addr {
+	host, port, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return nil
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil
+	}
+	p, _ := strconv.Atoi(port)
+	return &net.TCPAddr{IP: ip, Port: p}
+}
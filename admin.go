@@ -0,0 +1,375 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type clientStatus struct {
+	ID              uint64    `json:"id"`
+	Addr            string    `json:"addr"`
+	Since           time.Time `json:"since"`
+	ToSerialBytes   uint64    `json:"to_serial_bytes"`
+	FromSerialBytes uint64    `json:"from_serial_bytes"`
+	Observer        bool      `json:"observer,omitempty"`
+	Control         bool      `json:"control,omitempty"`
+}
+
+// modemStatus is shown with -modem-poll.
+type modemStatus struct {
+	CTS bool `json:"cts"`
+	DSR bool `json:"dsr"`
+	DCD bool `json:"dcd"`
+	RI  bool `json:"ri"`
+}
+
+// frameStatus is shown with -framing, the errors are the frames that were
+// dropped.
+type frameStatus struct {
+	FromSerial       uint64 `json:"from_serial"`
+	FromSerialErrors uint64 `json:"from_serial_errors"`
+	ToSerial         uint64 `json:"to_serial"`
+	ToSerialErrors   uint64 `json:"to_serial_errors"`
+}
+
+type bridgeStatus struct {
+	Name            string         `json:"name"`
+	Listen          string         `json:"listen"`
+	Device          string         `json:"device"`
+	BaudRate        int            `json:"baudRate"`
+	DataBits        int            `json:"dataBits"`
+	StopBits        string         `json:"stopBits"`
+	Parity          string         `json:"parity"`
+	Flow            string         `json:"flow"`
+	Serial          bool           `json:"serial"`
+	Listening       bool           `json:"listening"`
+	DTR             bool           `json:"dtr"`
+	RTS             bool           `json:"rts"`
+	Modem           *modemStatus   `json:"modem,omitempty"`
+	Frames          *frameStatus   `json:"frames,omitempty"`
+	ToSerialBytes   uint64         `json:"to_serial_bytes"`
+	FromSerialBytes uint64         `json:"from_serial_bytes"`
+	ToSerialDropped uint64         `json:"to_serial_dropped"`
+	Clients         []clientStatus `json:"clients"`
+}
+
+// serialSettings is the body of POST /api/bridges/<name>/serial, the
+// fields left out stay as they are.
+type serialSettings struct {
+	BaudRate *int    `json:"baudRate"`
+	DataBits *int    `json:"dataBits"`
+	StopBits *string `json:"stopBits"`
+	Parity   *string `json:"parity"`
+	Flow     *string `json:"flow"`
+}
+
+// lineSettings is the body of POST /api/bridges/<name>/lines.
+type lineSettings struct {
+	DTR   *bool `json:"dtr"`
+	RTS   *bool `json:"rts"`
+	Break *bool `json:"break"`
+}
+
+// adminName is how the bridge of the command line flags, which has no
+// name, is addressed.
+const adminName = "default"
+
+func (b *bridge) status() bridgeStatus {
+	conf := b.config()
+	st := bridgeStatus{
+		Name:     conf.Name,
+		Listen:   conf.Listen,
+		Device:   conf.Device,
+		BaudRate: conf.BaudRate,
+		DataBits: conf.DataBits,
+		StopBits: conf.StopBits,
+		Parity:   conf.Parity,
+		Flow:     conf.Flow,
+		Clients:  []clientStatus{},
+	}
+	if st.Name == "" {
+		st.Name = adminName
+	}
+	st.Serial, st.Listening = b.health()
+	st.ToSerialBytes, st.FromSerialBytes = b.stats.load()
+	st.ToSerialDropped = b.stats.dropped()
+
+	b.mu.Lock()
+	serialConn := b.serial
+	b.mu.Unlock()
+	if serialConn != nil {
+		st.DTR, st.RTS = serialConn.Lines()
+		// autobaud and RFC 2217 clients change the settings behind conf
+		live := serialConn.Config()
+		st.BaudRate, st.DataBits = live.Baud, int(live.Size)
+		st.StopBits, st.Parity = configNames(live)
+	}
+	if state, known := b.modemState(); known {
+		st.Modem = &modemStatus{
+			CTS: state&modemCTS != 0,
+			DSR: state&modemDSR != 0,
+			DCD: state&modemDCD != 0,
+			RI:  state&modemRI != 0,
+		}
+	}
+	if conf.Framing != "" {
+		st.Frames = &frameStatus{}
+		st.Frames.FromSerial, st.Frames.FromSerialErrors = b.frames.fromSerial.load()
+		st.Frames.ToSerial, st.Frames.ToSerialErrors = b.frames.toSerial.load()
+	}
+	writer := b.clients.controller()
+	for _, c := range b.clients.list() {
+		cs := clientStatus{ID: c.id, Addr: c.addr, Since: c.since, Observer: c.observer, Control: c == writer}
+		cs.ToSerialBytes, cs.FromSerialBytes = c.stats.load()
+		st.Clients = append(st.Clients, cs)
+	}
+	return st
+}
+
+func (s *supervisor) lookup(name string) *bridge {
+	for _, b := range s.list() {
+		if b.conf.Name == name || (b.conf.Name == "" && name == adminName) {
+			return b
+		}
+	}
+	return nil
+}
+
+// serveAdmin serves the management API:
+//
+//	GET    /api/bridges                              status of all bridges
+//	GET    /api/bridges/<name>                       status of one bridge
+//	POST   /api/bridges/<name>/serial                change the line settings live
+//	POST   /api/bridges/<name>/lines                 set DTR, RTS and break
+//	POST   /api/bridges/<name>/reopen                reopen the serial port
+//	DELETE /api/bridges/<name>/clients/<id>          disconnect a client
+//	POST   /api/bridges/<name>/clients/<id>/control  give a client the control token
+//	DELETE /api/bridges/<name>/control               free the control token
+//	GET    /api/logs                                 recent log lines
+//
+// and the dashboard on /. With a token every api request needs an
+// "Authorization: Bearer <token>" header. A POST needs a json body, see
+// adminSameSite.
+func (s *supervisor) serveAdmin(addr, token string) error {
+	if token == "" && !loopbackAddr(addr) {
+		stdLogger.Warn("admin api without -admin-token is open to everyone who reaches it, bind it to loopback", "addr", addr)
+	}
+	return http.ListenAndServe(addr, s.adminHandler(token))
+}
+
+// loopbackAddr reports whether addr listens on loopback only.
+func loopbackAddr(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// adminSameSite turns away the requests that change something and that a
+// web page in the browser of an operator could send without asking, to a
+// token-less api on loopback too: those with the Origin of another site
+// and a POST that isn't json, which needs no CORS preflight.
+func adminSameSite(r *http.Request) (int, error) {
+	if r.Method == http.MethodGet || r.Method == http.MethodHead {
+		return 0, nil
+	}
+	if origin := r.Header.Get("Origin"); origin != "" {
+		u, err := url.Parse(origin)
+		if err != nil || !strings.EqualFold(u.Host, r.Host) {
+			return http.StatusForbidden, errors.New("cross-origin request")
+		}
+	}
+	if r.Method == http.MethodPost {
+		mt, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		if err != nil || mt != "application/json" {
+			return http.StatusUnsupportedMediaType, errors.New("content type must be application/json")
+		}
+	}
+	return 0, nil
+}
+
+// adminHandler is the management API of serveAdmin, the -mux admin
+// streams get it too.
+func (s *supervisor) adminHandler(token string) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/bridges", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			adminError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+			return
+		}
+		sts := []bridgeStatus{}
+		for _, b := range s.list() {
+			sts = append(sts, b.status())
+		}
+		adminReply(w, sts)
+	})
+	mux.HandleFunc("/api/bridges/", s.handleAdminBridge)
+	mux.HandleFunc("/api/logs", func(w http.ResponseWriter, r *http.Request) {
+		adminReply(w, logHistory.recent())
+	})
+	mux.Handle("/", dashboardHandler())
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.URL.Path, "/api/") {
+			// the dashboard itself is static, it asks for the token
+			mux.ServeHTTP(w, r)
+			return
+		}
+		if code, err := adminSameSite(r); err != nil {
+			adminError(w, code, err)
+			return
+		}
+		if token != "" {
+			auth := r.Header.Get("Authorization")
+			if subtle.ConstantTimeCompare([]byte(auth), []byte("Bearer "+token)) != 1 {
+				adminError(w, http.StatusUnauthorized, errAuthFailed)
+				return
+			}
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+func (s *supervisor) handleAdminBridge(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/bridges/"), "/"), "/")
+	b := s.lookup(parts[0])
+	if b == nil {
+		adminError(w, http.StatusNotFound, errors.New("no such bridge"))
+		return
+	}
+
+	switch {
+	case len(parts) == 1 && r.Method == http.MethodGet:
+		adminReply(w, b.status())
+
+	case len(parts) == 2 && parts[1] == "serial" && r.Method == http.MethodPost:
+		var settings serialSettings
+		if err := json.NewDecoder(r.Body).Decode(&settings); err != nil {
+			adminError(w, http.StatusBadRequest, err)
+			return
+		}
+		conf := b.config()
+		if settings.BaudRate != nil {
+			conf.BaudRate = *settings.BaudRate
+		}
+		if settings.DataBits != nil {
+			conf.DataBits = *settings.DataBits
+		}
+		if settings.StopBits != nil {
+			conf.StopBits = *settings.StopBits
+		}
+		if settings.Parity != nil {
+			conf.Parity = *settings.Parity
+		}
+		if settings.Flow != nil {
+			conf.Flow = *settings.Flow
+		}
+		if err := b.update(conf); err != nil {
+			adminError(w, http.StatusBadRequest, err)
+			return
+		}
+		adminReply(w, b.status())
+
+	case len(parts) == 2 && parts[1] == "lines" && r.Method == http.MethodPost:
+		var lines lineSettings
+		if err := json.NewDecoder(r.Body).Decode(&lines); err != nil {
+			adminError(w, http.StatusBadRequest, err)
+			return
+		}
+		b.mu.Lock()
+		serialConn := b.serial
+		b.mu.Unlock()
+		if serialConn == nil {
+			adminError(w, http.StatusConflict, errors.New("serial port is not open"))
+			return
+		}
+		var err error
+		if lines.DTR != nil {
+			err = serialConn.SetDTR(*lines.DTR)
+		}
+		if lines.RTS != nil && err == nil {
+			err = serialConn.SetRTS(*lines.RTS)
+		}
+		if lines.Break != nil && err == nil {
+			err = serialConn.SetBreak(*lines.Break)
+		}
+		if err != nil {
+			adminError(w, http.StatusInternalServerError, err)
+			return
+		}
+		adminReply(w, b.status())
+
+	case len(parts) == 2 && parts[1] == "reopen" && r.Method == http.MethodPost:
+		b.mu.Lock()
+		serialConn := b.serial
+		b.mu.Unlock()
+		if serialConn == nil {
+			adminError(w, http.StatusConflict, errors.New("serial port is not open"))
+			return
+		}
+		if err := serialConn.Reopen(); err != nil {
+			adminError(w, http.StatusInternalServerError, err)
+			return
+		}
+		adminReply(w, b.status())
+
+	case len(parts) == 3 && parts[1] == "clients" && r.Method == http.MethodDelete:
+		id, err := strconv.ParseUint(parts[2], 10, 64)
+		if err != nil {
+			adminError(w, http.StatusBadRequest, err)
+			return
+		}
+		if !b.clients.disconnect(id) {
+			adminError(w, http.StatusNotFound, errors.New("no such client"))
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	case len(parts) == 4 && parts[1] == "clients" && parts[3] == "control" && r.Method == http.MethodPost:
+		id, err := strconv.ParseUint(parts[2], 10, 64)
+		if err != nil {
+			adminError(w, http.StatusBadRequest, err)
+			return
+		}
+		if !b.config().ControlToken {
+			adminError(w, http.StatusConflict, errors.New("control-token is off"))
+			return
+		}
+		if !b.clients.giveControl(id) {
+			adminError(w, http.StatusNotFound, errors.New("no such client"))
+			return
+		}
+		adminReply(w, b.status())
+
+	case len(parts) == 2 && parts[1] == "control" && r.Method == http.MethodDelete:
+		b.clients.releaseControl(nil)
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		adminError(w, http.StatusNotFound, errors.New("not found"))
+	}
+}
+
+func adminReply(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+func adminError(w http.ResponseWriter, code int, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+}
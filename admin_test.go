@@ -0,0 +1,62 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAdminSameSite(t *testing.T) {
+	for _, token := range []string{"", "secret"} {
+		handler := newSupervisor().adminHandler(token)
+		tests := []struct {
+			name, method, path, origin, contentType string
+			want                                    int
+		}{
+			{"status", "GET", "/api/bridges", "", "", http.StatusOK},
+			{"status from another site", "GET", "/api/bridges", "https://evil.example.com", "", http.StatusOK},
+			{"json post", "POST", "/api/bridges/x/serial", "", "application/json", http.StatusNotFound},
+			{"json post with charset", "POST", "/api/bridges/x/serial", "", "application/json; charset=utf-8", http.StatusNotFound},
+			{"json post from the dashboard", "POST", "/api/bridges/x/serial", "http://admin.test", "application/json", http.StatusNotFound},
+			{"text post", "POST", "/api/bridges/x/serial", "", "text/plain", http.StatusUnsupportedMediaType},
+			{"form post", "POST", "/api/bridges/x/lines", "", "application/x-www-form-urlencoded", http.StatusUnsupportedMediaType},
+			{"post without a body", "POST", "/api/bridges/x/reopen", "", "", http.StatusUnsupportedMediaType},
+			{"json post from another site", "POST", "/api/bridges/x/serial", "https://evil.example.com", "application/json", http.StatusForbidden},
+			{"delete from another site", "DELETE", "/api/bridges/x/control", "https://evil.example.com", "", http.StatusForbidden},
+			{"origin null", "POST", "/api/bridges/x/reopen", "null", "application/json", http.StatusForbidden},
+		}
+		for _, tt := range tests {
+			r := httptest.NewRequest(tt.method, "http://admin.test"+tt.path, strings.NewReader("{}"))
+			if tt.origin != "" {
+				r.Header.Set("Origin", tt.origin)
+			}
+			if tt.contentType != "" {
+				r.Header.Set("Content-Type", tt.contentType)
+			}
+			if token != "" {
+				r.Header.Set("Authorization", "Bearer "+token)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+			if w.Code != tt.want {
+				t.Errorf("token %q, %v: status %v, want %v", token, tt.name, w.Code, tt.want)
+			}
+		}
+	}
+}
+
+func TestLoopbackAddr(t *testing.T) {
+	for addr, want := range map[string]bool{
+		"127.0.0.1:8081": true,
+		"[::1]:8081":     true,
+		"localhost:8081": true,
+		":8081":          false,
+		"0.0.0.0:8081":   false,
+		"10.0.0.1:8081":  false,
+	} {
+		if got := loopbackAddr(addr); got != want {
+			t.Errorf("loopbackAddr(%v) = %v, want %v", addr, got, want)
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+var errAuthFailed = errors.New("authentication failed")
+
+// loadAuthSecret returns the shared secret from -token or -token-file,
+// empty when authentication is off.
+func loadAuthSecret(token string, tokenFile string) (string, error) {
+	secret := token
+	if tokenFile != "" {
+		b, err := os.ReadFile(tokenFile)
+		if err != nil {
+			return "", err
+		}
+		secret = strings.TrimSpace(string(b))
+	}
+	if secret == "" && (token != "" || tokenFile != "") {
+		return "", errors.New("empty token")
+	}
+	return secret, nil
+}
+
+// readLine reads up to '\n' a byte at a time, so nothing after the line is
+// swallowed before the relay starts.
+func readLine(conn Conn, max int) (string, error) {
+	var line []byte
+	var b [1]byte
+	for len(line) < max {
+		n, err := conn.Read(b[:])
+		if err != nil {
+			return "", err
+		}
+		if n == 0 {
+			continue
+		}
+		if b[0] == '\n' {
+			return strings.TrimRight(string(line), "\r"), nil
+		}
+		line = append(line, b[0])
+	}
+	return "", errors.New("line too long")
+}
+
+// authenticate checks that the first line sent by the client is the
+// shared secret.
+func authenticate(conn Conn, secret string) error {
+	if secret == "" {
+		return nil
+	}
+	if tcpConn, ok := conn.(net.Conn); ok {
+		tcpConn.SetReadDeadline(time.Now().Add(10 * time.Second))
+		defer tcpConn.SetReadDeadline(time.Time{})
+	}
+
+	line, err := readLine(conn, 1024)
+	if err != nil {
+		return err
+	}
+	if subtle.ConstantTimeCompare([]byte(line), []byte(secret)) != 1 {
+		return errAuthFailed
+	}
+	return nil
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// how long each rate is listened to
+	autobaudWindow = 2 * time.Second
+	// bytes needed before a rate is judged
+	autobaudMinBytes = 8
+)
+
+// autobauder collects what the serial port reads while -autobaud is
+// looking for the rate, nothing gets to the clients until it locked.
+type autobauder struct {
+	rates  []int
+	probe  []byte
+	expect []byte
+
+	mu       sync.Mutex
+	seen     []byte
+	printing int
+	locked   bool
+	decided  chan struct{}
+}
+
+// autobaudRates parses the -autobaud list.
+func autobaudRates(s string) ([]int, error) {
+	var rates []int
+	for _, f := range strings.Split(s, ",") {
+		rate, err := strconv.Atoi(strings.TrimSpace(f))
+		if err != nil || rate <= 0 {
+			return nil, fmt.Errorf("invalid autobaud rate: %v", f)
+		}
+		rates = append(rates, rate)
+	}
+	return rates, nil
+}
+
+// unescape turns the \r, \n, \x00 escapes of a flag value into bytes.
+func unescape(s string) ([]byte, error) {
+	u, err := strconv.Unquote(`"` + strings.ReplaceAll(s, `"`, `\"`) + `"`)
+	return []byte(u), err
+}
+
+func newAutobauder(c *bridgeConfig) (*autobauder, error) {
+	rates, err := autobaudRates(c.Autobaud)
+	if err != nil {
+		return nil, err
+	}
+	a := &autobauder{rates: rates}
+	if a.probe, err = unescape(c.AutobaudProbe); err != nil {
+		return nil, fmt.Errorf("invalid autobaud probe: %v", err)
+	}
+	if a.expect, err = unescape(c.AutobaudExpect); err != nil {
+		return nil, fmt.Errorf("invalid autobaud expect: %v", err)
+	}
+	return a, nil
+}
+
+func (a *autobauder) isLocked() bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.locked
+}
+
+// feed takes the bytes read at the rate being tried.
+func (a *autobauder) feed(b []byte) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.seen = append(a.seen, b...)
+	for _, c := range b {
+		if (c >= 0x20 && c < 0x7f) || c == '\r' || c == '\n' || c == '\t' {
+			a.printing++
+		}
+	}
+	if a.good() && a.decided != nil {
+		close(a.decided)
+		a.decided = nil
+	}
+}
+
+// good reports whether the current rate looks right, the reply contains
+// -autobaud-expect or nine in ten bytes are text. a.mu must be held.
+func (a *autobauder) good() bool {
+	if len(a.expect) > 0 {
+		return bytes.Contains(a.seen, a.expect)
+	}
+	return len(a.seen) >= autobaudMinBytes && a.printing*10 >= len(a.seen)*9
+}
+
+func (a *autobauder) reset() chan struct{} {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.seen = a.seen[:0]
+	a.printing = 0
+	a.decided = make(chan struct{})
+	return a.decided
+}
+
+// run tries the rates in turn until one of them looks right.
+func (a *autobauder) run(ctx context.Context, port *serialPort, logger *Logger) {
+	for i := 0; ; i = (i + 1) % len(a.rates) {
+		rate := a.rates[i]
+		if err := port.SetBaudRate(rate); err != nil {
+			logger.Error("autobaud error", "baudRate", rate, "err", err)
+			return
+		}
+		decided := a.reset()
+		if len(a.probe) > 0 {
+			port.Write(a.probe)
+		}
+		logger.Debug("autobaud trying", "baudRate", rate)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-decided:
+		case <-time.After(autobaudWindow):
+		}
+		a.mu.Lock()
+		a.locked = a.good()
+		a.mu.Unlock()
+		if a.isLocked() {
+			logger.Info("autobaud locked", "baudRate", rate)
+			return
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"text/template"
+	"time"
+)
+
+// bannerData is what a -banner template can use, e.g.
+// {{.Name}} {{.Device}} {{.Settings}} on {{.Hostname}}.
+type bannerData struct {
+	Name     string
+	Device   string
+	Listen   string
+	Settings string
+	Hostname string
+	Client   string
+	Time     string
+}
+
+// parseBanner reads the -banner template, the escapes are turned into bytes
+// first.
+func parseBanner(text string) (*template.Template, error) {
+	u, err := unescape(text)
+	if err != nil {
+		return nil, err
+	}
+	t, err := template.New("banner").Parse(string(u))
+	if err != nil {
+		return nil, err
+	}
+	// a field that isn't there only fails when it is run
+	if err := t.Execute(io.Discard, bannerData{}); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// banner is the -banner text for c, nil without one.
+func (b *bridge) banner(c *client, conf bridgeConfig) []byte {
+	if conf.Banner == "" {
+		return nil
+	}
+	t, err := parseBanner(conf.Banner)
+	if err != nil {
+		b.logger.Warn("banner error", "err", err)
+		return nil
+	}
+	hostname, _ := os.Hostname()
+	data := bannerData{
+		Name:     conf.Name,
+		Device:   conf.Device,
+		Listen:   conf.Listen,
+		Settings: conf.settings(),
+		Hostname: hostname,
+		Client:   c.addr,
+		Time:     time.Now().Format(time.RFC3339),
+	}
+	var buf bytes.Buffer
+	if err := t.Execute(&buf, data); err != nil {
+		b.logger.Warn("banner error", "err", err)
+		return nil
+	}
+	return buf.Bytes()
+}
+
+// settings is the serial settings the usual way, e.g. 115200 8N1.
+func (c *bridgeConfig) settings() string {
+	parity := "N"
+	if c.Parity != "" {
+		parity = c.Parity[:1]
+	}
+	return fmt.Sprintf("%v %v%v%v", c.BaudRate, c.DataBits, parity, c.StopBits)
+}
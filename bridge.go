@@ -0,0 +1,551 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// bridge connects one serial port to its listeners and clients.
+type bridge struct {
+	// relayBeat is when the serial relay last came round, in unix
+	// nanoseconds, for the systemd watchdog. It comes first so that the
+	// atomics find it 64-bit aligned on 32-bit platforms.
+	relayBeat int64
+
+	logger  *Logger
+	clients *hub
+	stats   *trafficStats
+	frames  *frameStats
+
+	// mu guards the settings that can change while running, see update,
+	// and serial
+	mu         sync.Mutex
+	conf       bridgeConfig
+	allowNets  []*net.IPNet
+	denyNets   []*net.IPNet
+	authSecret string
+	serial     *serialPort
+	listening  bool
+	modem      byte
+	modemKnown bool
+	autobaud   *autobauder
+	serveCtx   context.Context
+	modbus     *modbusGateway
+	gpsd       *gpsdServer
+	slcan      *slcanAdapter
+	iec104     *iec104Server
+	elm327     *elm327Mux
+	chat       *chatSession
+
+	// closing is held while -close-send goes out, a new client waits
+	closing sync.Mutex
+
+	// capture is set before any relay starts
+	capture *pcapWriter
+
+	// modbusRoutes is -modbus-route, peer finds the bridges it names
+	modbusRoutes map[byte]string
+	peer         func(name string) *bridge
+
+	// gate holds the client data back until -user took effect
+	gate <-chan struct{}
+	// oneshot gets the exit code of the first session, see ended
+	oneshot chan<- int
+}
+
+func newBridge(conf bridgeConfig) (*bridge, error) {
+	if err := conf.validate(); err != nil {
+		return nil, err
+	}
+
+	b := &bridge{conf: conf, logger: stdLogger.named(conf.Name), stats: newTrafficStats(), frames: &frameStats{}}
+
+	var err error
+	if b.allowNets, err = parseNets(conf.Allow); err != nil {
+		return nil, err
+	}
+	if b.denyNets, err = parseNets(conf.Deny); err != nil {
+		return nil, err
+	}
+	if b.authSecret, err = loadAuthSecret(conf.Token, conf.TokenFile); err != nil {
+		return nil, err
+	}
+	if b.modbusRoutes, err = parseModbusRoutes(conf.ModbusRoute); err != nil {
+		return nil, err
+	}
+	b.clients = newHub(conf.MaxClients, conf.Takeover, b.logger)
+	b.clients.controlToken = conf.ControlToken
+	b.clients.replaySize = conf.Replay
+	if conf.Store > 0 {
+		if b.clients.store, err = newStore(conf.Store, conf.StoreFile, b.logger); err != nil {
+			return nil, err
+		}
+	}
+	return b, nil
+}
+
+func (b *bridge) config() bridgeConfig {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.conf
+}
+
+func (b *bridge) verbose() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.conf.Verbose
+}
+
+func (b *bridge) stripXon() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.conf.StripXon
+}
+
+func (b *bridge) dumpMode() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.conf.Dump
+}
+
+func (b *bridge) setListening(listening bool) {
+	b.mu.Lock()
+	b.listening = listening
+	b.mu.Unlock()
+}
+
+// health reports whether the serial port is open and the listener is
+// accepting.
+func (b *bridge) health() (serialOpen, listening bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.serial != nil && b.serial.IsOpen(), b.listening
+}
+
+func (b *bridge) secret() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.authSecret
+}
+
+// waitGate waits until the privileges are dropped, it reports false when
+// ctx is done first.
+func (b *bridge) waitGate(ctx context.Context) bool {
+	if b.gate == nil {
+		return true
+	}
+	select {
+	case <-b.gate:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// notifyLost tells the clients that the serial port went away or is back.
+func (b *bridge) notifyLost(lost bool) {
+	msg := "\r\n[tcp2serial: serial port reconnected]\r\n"
+	if lost {
+		msg = "\r\n[tcp2serial: serial port lost, reconnecting]\r\n"
+	}
+	b.clients.Write([]byte(msg))
+}
+
+// the backoff of -open-retry
+const (
+	openRetryMin = 500 * time.Millisecond
+	openRetryMax = 30 * time.Second
+)
+
+// openSerial opens the serial port. With -open-retry a device that isn't
+// there yet, e.g. a USB adapter still being enumerated at boot, is tried
+// again with backoff until ctx is done or -open-timeout has passed.
+func (b *bridge) openSerial(ctx context.Context, conf *bridgeConfig) (*serialPort, error) {
+	var deadline time.Time
+	if conf.OpenTimeout > 0 {
+		deadline = time.Now().Add(time.Duration(conf.OpenTimeout) * time.Second)
+	}
+	delay := openRetryMin
+	for {
+		serialConn, err := newSerialConn(conf, b.logger)
+		if err == nil || !conf.OpenRetry {
+			return serialConn, err
+		}
+		if !deadline.IsZero() {
+			left := time.Until(deadline)
+			if left <= 0 {
+				return nil, err
+			}
+			if delay > left {
+				delay = left
+			}
+		}
+		b.logger.Info("serial open retry", "in", delay.Round(time.Millisecond))
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(delay):
+		}
+		if delay *= 2; delay > openRetryMax {
+			delay = openRetryMax
+		}
+	}
+}
+
+// run opens the serial port and serves the listeners until ctx is done or
+// one of them fails.
+func (b *bridge) run(ctx context.Context) error {
+	conf := b.config()
+	_, openSpan := startSpan(ctx, "serial.open", spanKindInternal,
+		"bridge", conf.Name, "serial.device", conf.Device, "serial.baud", conf.BaudRate)
+	serialConn, err := b.openSerial(ctx, &conf)
+	openSpan.end(err)
+	if err != nil {
+		return err
+	}
+	if conf.ReconnectNotify && conf.Proto == "tcp" {
+		serialConn.onLost = b.notifyLost
+	}
+	serialConn.onDrop = b.stats.drop
+	b.mu.Lock()
+	b.serial = serialConn
+	b.mu.Unlock()
+	defer serialConn.Close()
+
+	parent := ctx
+	ctx, cancelCtx := context.WithCancel(ctx)
+	defer cancelCtx()
+
+	// the first failure stops the whole bridge
+	errc := make(chan error, 1)
+	fail := func(err error) {
+		select {
+		case errc <- err:
+		default:
+		}
+		cancelCtx()
+	}
+
+	var closers []io.Closer
+	// listeners are the closers new clients come through
+	var listeners []io.Closer
+	defer func() {
+		for _, c := range closers {
+			c.Close()
+		}
+	}()
+
+	if conf.Capture != "" {
+		capture, err := newPcapWriter(conf.Capture, conf.Device)
+		if err != nil {
+			b.logger.Error("capture error", "err", err)
+			return err
+		}
+		b.capture = capture
+		closers = append(closers, capture)
+	}
+
+	if conf.Autobaud != "" {
+		if b.autobaud, err = newAutobauder(&conf); err != nil {
+			return err
+		}
+		go b.autobaud.run(ctx, serialConn, b.logger)
+	}
+	if conf.ModemPoll > 0 {
+		go b.monitorModem(ctx, serialConn, time.Duration(conf.ModemPoll)*time.Millisecond)
+	}
+	if conf.Stats > 0 {
+		go b.stats.report(ctx, b.logger, "serial stats", time.Duration(conf.Stats)*time.Second)
+	}
+
+	if conf.Mode == modeModbusGateway {
+		gateway, err := newModbusGateway(ctx, serialConn, &conf, b.stats)
+		if err != nil {
+			return err
+		}
+		b.mu.Lock()
+		b.modbus = gateway
+		b.mu.Unlock()
+		defer func() {
+			b.mu.Lock()
+			b.modbus = nil
+			b.mu.Unlock()
+		}()
+		go func() {
+			fail(gateway.rx.wait())
+		}()
+		if len(gateway.blocks) > 0 {
+			go gateway.poll(ctx, time.Duration(conf.ModbusPollInterval)*time.Millisecond, b.logger)
+		}
+	}
+
+	var gpsd *gpsdServer
+	if conf.Mode == modeGpsd {
+		gpsd = newGpsdServer(b.clients, conf.Device, conf.BaudRate)
+		b.mu.Lock()
+		b.gpsd = gpsd
+		b.mu.Unlock()
+		defer func() {
+			b.mu.Lock()
+			b.gpsd = nil
+			b.mu.Unlock()
+		}()
+	}
+
+	var slcan *slcanAdapter
+	if conf.Mode == modeSlcan {
+		if slcan, err = newSlcanAdapter(serialConn, conf.SlcanBitrate, b.logger); err != nil {
+			return err
+		}
+		// an adapter that was unplugged comes back with its channel closed
+		notify := serialConn.onLost
+		serialConn.onLost = func(lost bool) {
+			if notify != nil {
+				notify(lost)
+			}
+			if !lost {
+				if err := slcan.openChannel(); err != nil {
+					b.logger.Warn("slcan open error", "err", err)
+				}
+			}
+		}
+		if conf.SocketCAN != "" {
+			if slcan.can, err = openCANSocket(conf.SocketCAN); err != nil {
+				b.logger.Error("socketcan error", "interface", conf.SocketCAN, "err", err)
+				return err
+			}
+			closers = append(closers, slcan.can)
+			go func() {
+				fail(slcan.relayCAN(ctx))
+			}()
+		}
+		b.mu.Lock()
+		b.slcan = slcan
+		b.mu.Unlock()
+		defer func() {
+			b.mu.Lock()
+			b.slcan = nil
+			b.mu.Unlock()
+		}()
+	}
+
+	var iec101 *iec101Link
+	if conf.Mode == modeIEC104 {
+		iec101 = newIEC101Link(serialConn, &conf, b.logger)
+		server := newIEC104Server(b.clients, iec101, &conf, b.logger)
+		iec101.deliver = server.deliver
+		b.mu.Lock()
+		b.iec104 = server
+		b.mu.Unlock()
+		defer func() {
+			b.mu.Lock()
+			b.iec104 = nil
+			b.mu.Unlock()
+		}()
+		go iec101.run(ctx)
+	}
+
+	var elm327 *elm327Mux
+	if conf.Mode == modeELM327 {
+		elm327 = newELM327Mux(serialConn, time.Duration(conf.ELM327Timeout)*time.Millisecond, b.logger)
+		b.mu.Lock()
+		b.elm327 = elm327
+		b.mu.Unlock()
+		defer func() {
+			b.mu.Lock()
+			b.elm327 = nil
+			b.mu.Unlock()
+		}()
+	}
+
+	var slip *slipTun
+	if conf.Mode == modeSlip {
+		tun, err := openTun(conf.Tun)
+		if err != nil {
+			b.logger.Error("tun error", "interface", conf.Tun, "err", err)
+			return err
+		}
+		closers = append(closers, tun)
+		slip = &slipTun{port: serialConn, tun: tun, logger: b.logger}
+		go func() {
+			fail(slip.relayTun(ctx))
+		}()
+	}
+
+	var serialDst io.Writer
+	if conf.Mode == modeDMX {
+		conn, err := b.listenDMX()
+		if err != nil {
+			return err
+		}
+		closers = append(closers, conn)
+		b.setListening(true)
+		defer b.setListening(false)
+		dmx := &dmxOutput{port: serialConn, universe: conf.DMXUniverse}
+		go func() {
+			fail(dmx.refresh(ctx, conf.DMXRate, b.stats))
+		}()
+		go func() {
+			fail(b.serveDMX(conn, dmx))
+		}()
+	} else if b.conf.Proto == "udp" {
+		udpConn, err := b.newUdpConn()
+		if err != nil {
+			return err
+		}
+		closers = append(closers, udpConn)
+		serialDst = udpConn
+		b.setListening(true)
+		defer b.setListening(false)
+		go func() {
+			if !b.waitGate(ctx) {
+				return
+			}
+			var dst io.Writer = serialConn
+			switch conf.Mode {
+			case modeNMEA:
+				dst = newNMEAWriter(serialConn, b.logger)
+			case modeKISS, modeSlip:
+				dst = newKISSWriter(serialConn, b.logger)
+			case modeSlcan:
+				dst = &canTextWriter{a: slcan}
+			case "raw":
+				dst = b.newDeframer(&conf, serialConn)
+			}
+			fail(b.connRelay(ctx, udpConn, dst, nil))
+		}()
+	} else if b.conf.Connect != "" {
+		serialDst = b.clients
+		defer b.clients.closeAll()
+		go b.dialLoop(ctx, b.conf.Connect)
+	} else {
+		l, err := b.newTcpListener(b.conf.Listen)
+		if err != nil {
+			return err
+		}
+		closers = append(closers, l)
+		listeners = append(listeners, l)
+		if b.conf.Observe != "" {
+			ol, err := b.newTcpListener(b.conf.Observe)
+			if err != nil {
+				return err
+			}
+			closers = append(closers, ol)
+			listeners = append(listeners, ol)
+			go func() {
+				err := b.acceptLoop(ctx, ol, true)
+				if ctx.Err() == nil {
+					b.logger.Error("observe accept error", "err", err)
+				}
+				fail(err)
+			}()
+		}
+		serialDst = b.clients
+		defer b.clients.closeAll()
+
+		if b.conf.SSH != "" {
+			sshConf, err := b.sshServerConfig()
+			if err != nil {
+				b.logger.Error("ssh config error", "err", err)
+				return err
+			}
+			sl, err := net.Listen("tcp", b.conf.SSH)
+			if err != nil {
+				b.logger.Error("ssh listen error", "addr", b.conf.SSH, "err", err)
+				return err
+			}
+			closers = append(closers, sl)
+			listeners = append(listeners, sl)
+			go func() {
+				err := b.serveSSH(ctx, sshConf, sl)
+				if ctx.Err() == nil {
+					b.logger.Error("ssh accept error", "err", err)
+				}
+				fail(err)
+			}()
+		}
+		b.setListening(true)
+		b.mu.Lock()
+		b.serveCtx = ctx
+		b.mu.Unlock()
+		defer func() {
+			b.mu.Lock()
+			b.serveCtx = nil
+			b.mu.Unlock()
+		}()
+		go func() {
+			defer b.setListening(false)
+			var err error
+			if b.conf.WsPath != "" {
+				err = b.serveWebSocket(ctx, l)
+			} else {
+				err = b.acceptLoop(ctx, l, false)
+			}
+			// closed by finish when the bridge is stopped
+			if ctx.Err() == nil {
+				b.logger.Error("accept error", "err", err)
+			}
+			fail(err)
+		}()
+	}
+
+	// the modbus gateway reads the port itself, a DMX interface sends
+	// nothing back
+	if conf.Mode != modeModbusGateway && conf.Mode != modeDMX {
+		var serialSrc Conn = serialConn
+		if conf.FrameGap > 0 {
+			serialSrc = newGapFramer(ctx, serialConn, time.Duration(conf.FrameGap)*time.Millisecond)
+		}
+		switch conf.Mode {
+		case "raw":
+			serialDst = b.newFramer(&conf, serialDst)
+		case modeNMEA:
+			serialDst = newNMEAWriter(serialDst, b.logger)
+		case modeKISS:
+			serialDst = newKISSWriter(serialDst, b.logger)
+		case modeSlcan:
+			slcan.clients = serialDst
+			serialDst = slcan
+		case modeSlip:
+			slip.clients = serialDst
+			serialDst = newKISSWriter(slip, b.logger)
+		case modeIEC104:
+			serialDst = iec101
+		case modeELM327:
+			// the answers go only to the client that asked
+			serialDst = elm327
+		case modeGpsd:
+			// the position goes only to the clients that watch it
+			serialDst = newNMEAWriter(gpsd, b.logger)
+		}
+		go func() {
+			relayCtx, relaySpan := startSpan(ctx, "serial.relay", spanKindInternal,
+				"bridge", conf.Name, "serial.device", conf.Device)
+			err := b.connRelay(relayCtx, serialSrc, serialDst, nil)
+			to, from := b.stats.load()
+			relaySpan.setAttributes("to_serial_bytes", to, "from_serial_bytes", from)
+			relaySpan.end(spanError(ctx, err))
+			fail(err)
+		}()
+	}
+
+	select {
+	case <-ctx.Done():
+	case <-serialConn.failure():
+		// a client write failed while the reads go on, the clients and
+		// the listeners go with the port
+		cancelCtx()
+	}
+	if err := serialConn.Err(); err != nil {
+		b.logger.Error("serial port error", "err", err)
+		return err
+	}
+	if parent.Err() != nil {
+		b.finish(listeners, serialConn)
+		return parent.Err()
+	}
+	return <-errc
+}
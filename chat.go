@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// how much of what the modem said the chat keeps to look for the strings in
+const chatBufferSize = 4096
+
+var errChatTimeout = errors.New("chat timeout")
+
+// chatStep waits for expect, unless it's empty, then sends send.
+type chatStep struct {
+	expect string
+	send   []byte
+}
+
+// chatScript is -chat, expect send pairs like those of chat(8), e.g.
+// "" AT&F OK ATDT5551234 CONNECT. An ABORT pair names a reply that fails
+// the script.
+type chatScript struct {
+	steps  []chatStep
+	aborts []string
+}
+
+// chatFields splits s at the spaces, ” and "" quote a field.
+func chatFields(s string) ([]string, error) {
+	var fields []string
+	var field strings.Builder
+	var quote rune
+	inField := false
+	for _, r := range s {
+		switch {
+		case quote != 0 && r == quote:
+			quote = 0
+		case quote != 0:
+			field.WriteRune(r)
+		case r == '\'' || r == '"':
+			quote, inField = r, true
+		case r == ' ' || r == '\t':
+			if inField {
+				fields = append(fields, field.String())
+				field.Reset()
+				inField = false
+			}
+		default:
+			field.WriteRune(r)
+			inField = true
+		}
+	}
+	if quote != 0 {
+		return nil, fmt.Errorf("unterminated quote in chat: %v", s)
+	}
+	if inField {
+		fields = append(fields, field.String())
+	}
+	return fields, nil
+}
+
+// parseChat parses -chat, an empty s is no script.
+func parseChat(s string) (*chatScript, error) {
+	fields, err := chatFields(s)
+	if err != nil || len(fields) == 0 {
+		return nil, err
+	}
+	script := &chatScript{}
+	for i := 0; i < len(fields); i += 2 {
+		expect, send := fields[i], ""
+		if i+1 < len(fields) {
+			send = fields[i+1]
+		}
+		if expect == "ABORT" {
+			if send == "" {
+				return nil, errors.New("chat ABORT needs a string")
+			}
+			script.aborts = append(script.aborts, send)
+			continue
+		}
+		step := chatStep{expect: expect}
+		if i+1 < len(fields) {
+			// a CR ends what is sent unless it ends in \c
+			cr := "\r"
+			if strings.HasSuffix(send, `\c`) {
+				send, cr = strings.TrimSuffix(send, `\c`), ""
+			}
+			if step.send, err = unescape(send + cr); err != nil {
+				return nil, fmt.Errorf("invalid chat string %v: %v", send, err)
+			}
+		}
+		script.steps = append(script.steps, step)
+	}
+	return script, nil
+}
+
+// chatSession collects what the serial port reads while the script runs,
+// none of it gets to the clients.
+type chatSession struct {
+	mu   sync.Mutex
+	seen []byte
+	more chan struct{}
+}
+
+func (s *chatSession) feed(b []byte) {
+	s.mu.Lock()
+	s.seen = append(s.seen, b...)
+	if len(s.seen) > chatBufferSize {
+		s.seen = s.seen[len(s.seen)-chatBufferSize:]
+	}
+	s.mu.Unlock()
+	select {
+	case s.more <- struct{}{}:
+	default:
+	}
+}
+
+// expect waits for want, what came before it is dropped.
+func (s *chatSession) expect(ctx context.Context, want string, aborts []string, timeout time.Duration) error {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		s.mu.Lock()
+		if i := bytes.Index(s.seen, []byte(want)); i >= 0 {
+			s.seen = s.seen[i+len(want):]
+			s.mu.Unlock()
+			return nil
+		}
+		for _, abort := range aborts {
+			if bytes.Contains(s.seen, []byte(abort)) {
+				s.mu.Unlock()
+				return fmt.Errorf("chat aborted on %v", abort)
+			}
+		}
+		s.mu.Unlock()
+		select {
+		case <-s.more:
+		case <-timer.C:
+			return errChatTimeout
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// chatting is the session of the running script, nil when there is none.
+func (b *bridge) chatting() *chatSession {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.chat
+}
+
+// runChat runs the -chat script against the serial port.
+func (b *bridge) runChat(ctx context.Context, script *chatScript, timeout time.Duration) error {
+	s := &chatSession{more: make(chan struct{}, 1)}
+	b.mu.Lock()
+	b.chat = s
+	b.mu.Unlock()
+	defer func() {
+		b.mu.Lock()
+		b.chat = nil
+		b.mu.Unlock()
+	}()
+
+	for _, step := range script.steps {
+		if step.expect != "" {
+			if err := s.expect(ctx, step.expect, script.aborts, timeout); err != nil {
+				return fmt.Errorf("expecting %v: %w", step.expect, err)
+			}
+			b.logger.Debug("chat got", "expect", step.expect)
+		}
+		if len(step.send) > 0 {
+			if _, err := b.serial.Write(step.send); err != nil {
+				return err
+			}
+			b.logger.Debug("chat sent", "data", string(step.send))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,756 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// bridgeConfig is the configuration of one serial port <-> listener
+// bridge. The command line flags fill in one, the -config file can define
+// several, with the flags as their defaults. The json names are the flag
+// names.
+type bridgeConfig struct {
+	Name string `json:"name"`
+
+	Listen        string `json:"listen"`
+	SocketMode    string `json:"socket-mode"`
+	SocketOwner   string `json:"socket-owner"`
+	PipeSDDL      string `json:"pipe-sddl"`
+	Proto         string `json:"proto"`
+	Mode          string `json:"mode"`
+	WsPath        string `json:"ws"`
+	WsOrigin      string `json:"ws-origin"`
+	Console       bool   `json:"console"`
+	ConsoleAssets string `json:"console-assets"`
+	UdpPeer       string `json:"peer"`
+	Connect       string `json:"connect"`
+
+	Keepalive         int  `json:"keepalive"`
+	KeepaliveInterval int  `json:"keepalive-interval"`
+	KeepaliveCount    int  `json:"keepalive-count"`
+	NoDelay           bool `json:"nodelay"`
+	SndBuf            int  `json:"sndbuf"`
+	RcvBuf            int  `json:"rcvbuf"`
+	ReuseAddr         bool `json:"reuseaddr"`
+
+	Device        string `json:"device"`
+	SerialBackend string `json:"serial-backend"`
+	Lock          string `json:"lock"`
+	BaudRate      int    `json:"baudRate"`
+	DataBits      int    `json:"dataBits"`
+	StopBits      string `json:"stopBits"`
+	Parity        string `json:"parity"`
+	Flow          string `json:"flow"`
+	StripXon      bool   `json:"strip-xonxoff"`
+	DTR           string `json:"dtr"`
+	RTS           string `json:"rts"`
+
+	ConnectReset      int    `json:"connect-reset"`
+	ConnectResetLevel string `json:"connect-reset-level"`
+	InitSend          string `json:"init-send"`
+	FlushOnConnect    bool   `json:"flush-on-connect"`
+	CloseSend         string `json:"close-send"`
+	CloseDelay        int    `json:"close-delay"`
+	Linger            int    `json:"linger"`
+
+	ReadTimeout  int `json:"read-timeout"`
+	WriteTimeout int `json:"write-timeout"`
+	BufferSize   int `json:"buffer-size"`
+
+	FrameGap      int    `json:"frame-gap"`
+	Framing       string `json:"framing"`
+	LineDelimiter string `json:"line-delimiter"`
+	LineInput     bool   `json:"line-input"`
+	LengthSize    int    `json:"length-size"`
+	STXStart      string `json:"stx-start"`
+	STXEnd        string `json:"stx-end"`
+	STXEscape     string `json:"stx-escape"`
+	STXTrailer    int    `json:"stx-trailer"`
+	COBSMax       int    `json:"cobs-max"`
+	NineBit       bool   `json:"nine-bit"`
+	Turnaround    int    `json:"turnaround"`
+	Pace          int    `json:"pace"`
+	TxCharDelay   int    `json:"tx-char-delay"`
+	TxLineDelay   int    `json:"tx-line-delay"`
+
+	ModbusTimeout int    `json:"modbus-timeout"`
+	ModbusFraming string `json:"modbus-framing"`
+	ModbusRoute   string `json:"modbus-route"`
+
+	ModbusPoll         string `json:"modbus-poll"`
+	ModbusPollInterval int    `json:"modbus-poll-interval"`
+
+	SlcanBitrate int    `json:"slcan-bitrate"`
+	SocketCAN    string `json:"socketcan"`
+
+	Tun string `json:"tun"`
+
+	DMXUniverse int `json:"dmx-universe"`
+	DMXRate     int `json:"dmx-rate"`
+
+	IEC101Address int    `json:"iec101-address"`
+	IEC101Sizes   string `json:"iec101-sizes"`
+	IEC101Timeout int    `json:"iec101-timeout"`
+
+	ELM327Timeout int `json:"elm327-timeout"`
+
+	RS485       string `json:"rs485"`
+	RS485Before int    `json:"rs485-delay-before"`
+	RS485After  int    `json:"rs485-delay-after"`
+	RS485RTSLow bool   `json:"rs485-rts-low"`
+
+	ModemPoll int  `json:"modem-poll"`
+	DCDDrop   bool `json:"dcd-drop"`
+
+	OpenRetry   bool `json:"open-retry"`
+	OpenTimeout int  `json:"open-timeout"`
+
+	Reconnect       int  `json:"reconnect"`
+	ReconnectNotify bool `json:"reconnect-notify"`
+	ReconnectError  bool `json:"reconnect-error"`
+
+	Autobaud       string `json:"autobaud"`
+	AutobaudProbe  string `json:"autobaud-probe"`
+	AutobaudExpect string `json:"autobaud-expect"`
+
+	Chat        string `json:"chat"`
+	ChatTimeout int    `json:"chat-timeout"`
+
+	Verbose       bool   `json:"verbose"`
+	Dump          string `json:"dump"`
+	Capture       string `json:"capture"`
+	Stats         int    `json:"stats-interval"`
+	Record        string `json:"record"`
+	RecordMode    string `json:"record-mode"`
+	MaxClients    int    `json:"max-clients"`
+	Takeover      string `json:"takeover"`
+	RejectMessage string `json:"reject-message"`
+	Banner        string `json:"banner"`
+	IdleTimeout   string `json:"idle-timeout"`
+	Observe       string `json:"observe"`
+	Replay        int    `json:"replay"`
+	Store         int    `json:"store"`
+	StoreFile     string `json:"store-file"`
+
+	ControlToken bool `json:"control-token"`
+
+	SSH               string `json:"ssh"`
+	SSHHostKey        string `json:"ssh-host-key"`
+	SSHAuthorizedKeys string `json:"ssh-authorized-keys"`
+
+	RFC2217         bool `json:"rfc2217"`
+	Telnet          bool `json:"telnet"`
+	RFC2217Coalesce int  `json:"rfc2217-coalesce"`
+
+	TLSCert     string `json:"tls-cert"`
+	TLSKey      string `json:"tls-key"`
+	TLSClientCA string `json:"tls-client-ca"`
+
+	Allow         string `json:"allow"`
+	Deny          string `json:"deny"`
+	ProxyProtocol bool   `json:"proxy-protocol"`
+	Token         string `json:"token"`
+	TokenFile     string `json:"token-file"`
+}
+
+var flagConfig bridgeConfig
+
+func init() {
+	c := &flagConfig
+	flag.StringVar(&c.Listen, "l", "0.0.0.0:1234", `listening address, several tcp ones comma separated as in [::1]:1234,10.0.0.5:1234, unix:/path/to/socket for a unix domain socket or \\.\pipe\name for a windows named pipe`)
+	flag.StringVar(&c.SocketMode, "socket-mode", "", "permissions of the unix socket file, e.g. 0660")
+	flag.StringVar(&c.SocketOwner, "socket-owner", "", "owner of the unix socket file, user[:group]")
+	flag.StringVar(&c.PipeSDDL, "pipe-sddl", "", "security descriptor of the windows named pipe in SDDL, e.g. D:P(A;;GA;;;BA)(A;;GA;;;SY)")
+	flag.StringVar(&c.Connect, "connect", "", "dial this host:port instead of listening and serve it like a client, dialled again with backoff when it drops")
+	flag.StringVar(&c.Proto, "proto", "tcp", "network protocol(tcp or udp)")
+	flag.StringVar(&c.Mode, "mode", "raw", "raw passes the bytes through, nmea passes on the NMEA 0183 sentences with a good checksum and merges in those of the clients, gpsd reports the position in the JSON of gpsd, kiss keeps the frames of a KISS TNC and its clients whole, slcan relays the CAN frames of an slcan adapter as cansend text, slip moves IP packets between SLIP on the serial port and -tun, dmx drives a DMX512 interface with the Art-Net or sACN levels of -dmx-universe, iec104 turns the balanced IEC 60870-5-101 link of the serial port into IEC 60870-5-104 for the clients, elm327 shares an ELM327 OBD-II adapter by sending the commands of the clients one at a time, modbus-gateway turns Modbus TCP from the clients into Modbus RTU on the serial port")
+	flag.StringVar(&c.ModbusFraming, "modbus-framing", "rtu", "what -mode modbus-gateway speaks on the serial port(rtu or ascii)")
+	flag.StringVar(&c.ModbusRoute, "modbus-route", "", "send the requests for these modbus units to the serial port of another bridge, e.g. 1-10=ttyUSB0,11-20=ttyUSB1")
+	flag.StringVar(&c.ModbusPoll, "modbus-poll", "", "read these unit:function:address:count ranges in the background and answer the reads within them from the cache, e.g. 1:3:0:10")
+	flag.IntVar(&c.ModbusPollInterval, "modbus-poll-interval", 1000, "milliseconds between the -modbus-poll reads, the cache is used for twice that")
+	flag.IntVar(&c.ModbusTimeout, "modbus-timeout", 1000, "milliseconds a modbus slave gets to answer in -mode modbus-gateway")
+	flag.IntVar(&c.SlcanBitrate, "slcan-bitrate", 500000, "CAN bitrate -mode slcan sets on the adapter")
+	flag.StringVar(&c.Tun, "tun", "", "TUN interface -mode slip moves the IP packets of the SLIP frames to and from, e.g. tun0 (linux)")
+	flag.IntVar(&c.DMXUniverse, "dmx-universe", 1, "Art-Net port address or sACN universe -mode dmx outputs")
+	flag.IntVar(&c.DMXRate, "dmx-rate", 40, "DMX512 packets a second -mode dmx sends, at most 44")
+	flag.IntVar(&c.IEC101Address, "iec101-address", 1, "link address of the IEC 101 station -mode iec104 talks to")
+	flag.StringVar(&c.IEC101Sizes, "iec101-sizes", "1:1:1:2", "octets of the IEC 101 link address, cause of transmission, common address and information object address")
+	flag.IntVar(&c.IEC101Timeout, "iec101-timeout", 1000, "milliseconds the IEC 101 station gets to confirm a frame before it is repeated")
+	flag.IntVar(&c.ELM327Timeout, "elm327-timeout", 5000, "milliseconds -mode elm327 waits for the prompt of the adapter after a command")
+	flag.StringVar(&c.SocketCAN, "socketcan", "", "also relay the CAN frames of -mode slcan to this SocketCAN interface, e.g. vcan0 (linux)")
+	flag.StringVar(&c.WsPath, "ws", "", "serve a WebSocket endpoint on this path instead of raw tcp, e.g. /serial")
+	flag.StringVar(&c.WsOrigin, "ws-origin", "", "comma separated origins of other web pages that may open the -ws endpoint, e.g. https://tools.example.com, without it only its own pages and clients that aren't browsers may")
+	flag.BoolVar(&c.Console, "console", false, "serve a browser terminal for the -ws endpoint on /console")
+	flag.StringVar(&c.ConsoleAssets, "console-assets", "https://cdn.jsdelivr.net/npm", "where the /console page loads xterm.js from, a mirror of the npm package layout")
+	flag.StringVar(&c.UdpPeer, "peer", "", "udp peer address, default is the sender of the last datagram")
+	flag.StringVar(&c.Device, "s", "/dev/ttyS1", "serial device name, or usb:<vid>:<pid> or usbserial:<serial number>")
+	flag.IntVar(&c.BaudRate, "baudRate", 9600, "serial baudRate")
+	flag.IntVar(&c.DataBits, "dataBits", 8, "serial dataBits(7 or 8)")
+	flag.StringVar(&c.StopBits, "stopBits", "1", "serial stopBits(1, 1.5 or 2)")
+	flag.StringVar(&c.Parity, "parity", "None", "serial Parity(None, Odd, Even, Mark or Space)")
+	flag.StringVar(&c.Lock, "lock", "flock", "how the serial device is locked against other programs(none, flock, uucp or flock,uucp)")
+	flag.StringVar(&c.SerialBackend, "serial-backend", "tarm", "serial port library(tarm or bugst)")
+	flag.StringVar(&c.Flow, "flow", "none", "serial flow control(none, rtscts or xonxoff)")
+	flag.BoolVar(&c.StripXon, "strip-xonxoff", false, "drop XON/XOFF characters from the data in both directions")
+	flag.StringVar(&c.DTR, "dtr", "on", "DTR line state after opening the serial port(on or off)")
+	flag.StringVar(&c.RTS, "rts", "on", "RTS line state after opening the serial port(on or off)")
+	flag.IntVar(&c.ConnectReset, "connect-reset", 0, "pulse DTR for this many milliseconds when a client connects, to reset an Arduino into its bootloader")
+	flag.StringVar(&c.ConnectResetLevel, "connect-reset-level", "off", "DTR state during the -connect-reset pulse(on or off)")
+	flag.StringVar(&c.InitSend, "init-send", "", "written to the serial port every time a tcp client connects, with \\r, \\n and \\x00 escapes, e.g. \\x1bREMOTE\\r")
+	flag.BoolVar(&c.FlushOnConnect, "flush-on-connect", false, "purge the serial input and output buffers when a tcp client connects and no other one is")
+	flag.StringVar(&c.CloseSend, "close-send", "", "written to the serial port when the last tcp client disconnects, with the escapes of -init-send, e.g. logout\\r")
+	flag.IntVar(&c.CloseDelay, "close-delay", 0, "milliseconds to wait after -close-send went out before the next client is served")
+	flag.IntVar(&c.Linger, "linger", 0, "milliseconds a client that shut down its sending side still gets the serial output, until the port was quiet that long, e.g. 500 for nc -N, 0 disconnects it at once")
+	flag.IntVar(&c.ReadTimeout, "read-timeout", 0, "serial read timeout in milliseconds, for the systemd watchdog to tell a quiet port from a stuck relay, 0 blocks until data arrives")
+	flag.IntVar(&c.WriteTimeout, "write-timeout", 3000, "milliseconds the relay may take to pass on what it read, 0 waits as long as it takes")
+	flag.IntVar(&c.BufferSize, "buffer-size", 4096, "bytes the relay reads at once in each direction, from 16 to 1048576, e.g. 65536 for a fast usb adapter")
+	flag.BoolVar(&c.NineBit, "nine-bit", false, "9-bit multidrop: the clients send 0xff 0x00 c for an address byte c, which goes out with Mark parity, and 0xff 0xff for 0xff, the rest goes with Space parity")
+	flag.IntVar(&c.FrameGap, "frame-gap", 0, "collect the serial data until it pauses for this many milliseconds and pass it on as one packet, 0 means pass it on as it comes")
+	flag.StringVar(&c.Framing, "framing", "", "pass on the serial data in messages in raw mode and take those of the clients apart(line for whole lines, stx for whole -stx-start to -stx-end frames, and for every read or -frame-gap frame length for a length in front, cobs for COBS and a 0x00, hex for a line of hex bytes, base64 for a line of base64), empty passes it on as it comes")
+	flag.StringVar(&c.LineDelimiter, "line-delimiter", "\\n", "what ends a line for -framing line, with the escapes of -init-send, e.g. \\r\\n or \\x03")
+	flag.IntVar(&c.LengthSize, "length-size", 2, "bytes of the big endian length of -framing length(2 or 4)")
+	flag.StringVar(&c.STXStart, "stx-start", "\\x02", "byte that starts a frame of -framing stx, with the escapes of -init-send")
+	flag.StringVar(&c.STXEnd, "stx-end", "\\x03", "byte that ends a frame of -framing stx")
+	flag.StringVar(&c.STXEscape, "stx-escape", "\\x10", "byte that -framing stx expects before a start, end or escape byte in the data of a frame, empty for none")
+	flag.IntVar(&c.STXTrailer, "stx-trailer", 0, "bytes after the end byte that belong to a frame of -framing stx, e.g. 1 for a BCC")
+	flag.IntVar(&c.COBSMax, "cobs-max", 1024, "bytes a frame of -framing cobs holds at most before it is encoded, longer ones from the clients are dropped")
+	flag.BoolVar(&c.LineInput, "line-input", false, "also pass on what a client sends to the serial port in whole lines with -framing line")
+	flag.IntVar(&c.Turnaround, "turnaround", 0, "wait this many milliseconds after the last byte from the serial port before sending to it")
+	flag.IntVar(&c.TxCharDelay, "tx-char-delay", 0, "milliseconds of silence on the line after every byte sent to the serial port, for slow PLC programming ports")
+	flag.IntVar(&c.TxLineDelay, "tx-line-delay", 0, "milliseconds of silence on the line after every line sent to the serial port, a \\r, \\n or \\r\\n, for old terminals")
+	flag.IntVar(&c.Pace, "pace", 0, "write to the serial port no faster than this percent of the line rate, e.g. 95 for a device without flow control, 0 as fast as the driver takes it")
+	flag.StringVar(&c.RS485, "rs485", "", "switch a half-duplex RS-485 transmitter with RTS while sending(rts to toggle it here, kernel to let the linux driver do it)")
+	flag.IntVar(&c.RS485Before, "rs485-delay-before", 0, "milliseconds between switching the RS-485 transmitter on and sending")
+	flag.IntVar(&c.RS485After, "rs485-delay-after", 0, "milliseconds between the end of sending and switching the RS-485 transmitter off")
+	flag.BoolVar(&c.RS485RTSLow, "rs485-rts-low", false, "the RS-485 transmitter is on while RTS is off")
+	flag.IntVar(&c.ModemPoll, "modem-poll", 0, "poll the CTS/DSR/DCD/RI lines every this many milliseconds, 0 means never")
+	flag.BoolVar(&c.DCDDrop, "dcd-drop", false, "disconnect the clients when DCD falls, needs -modem-poll")
+	flag.StringVar(&c.Autobaud, "autobaud", "", "baud rates to try in turn until the serial data looks right, e.g. 115200,57600,9600")
+	flag.StringVar(&c.AutobaudProbe, "autobaud-probe", "", "sent at every rate -autobaud tries, e.g. AT\\r")
+	flag.StringVar(&c.AutobaudExpect, "autobaud-expect", "", "lock onto the rate whose data contains this instead of the one that reads as text")
+	flag.StringVar(&c.Chat, "chat", "", "expect send pairs run on the serial port when the first client connects, e.g. \"ABORT BUSY '' AT&F OK ATDT5551234 CONNECT\"")
+	flag.IntVar(&c.ChatTimeout, "chat-timeout", 45, "seconds -chat waits for each expected string")
+	flag.BoolVar(&c.OpenRetry, "open-retry", false, "when the serial port can't be opened at start keep trying with backoff instead of stopping the bridge")
+	flag.IntVar(&c.OpenTimeout, "open-timeout", 0, "give up -open-retry after this many seconds, 0 means never")
+	flag.IntVar(&c.Reconnect, "reconnect", 0, "when the serial port is lost keep the clients and try to open it again every this many seconds, 0 means stop the bridge")
+	flag.BoolVar(&c.ReconnectNotify, "reconnect-notify", false, "tell the tcp clients when the serial port is lost and back, needs -reconnect")
+	flag.BoolVar(&c.ReconnectError, "reconnect-error", false, "disconnect a client that writes while the serial port is lost instead of dropping what it sent, needs -reconnect")
+	flag.BoolVar(&c.Verbose, "verbose", true, "log socket messages")
+	flag.StringVar(&c.Dump, "dump", "", "log the traffic as a dump instead(hex, ascii or mixed)")
+	flag.StringVar(&c.Capture, "capture", "", "write the traffic of both directions to this pcapng file")
+	flag.IntVar(&c.Stats, "stats-interval", 0, "log traffic statistics every this many seconds, 0 means never")
+	flag.StringVar(&c.Record, "record", "", "write a transcript of every tcp session to this directory")
+	flag.StringVar(&c.RecordMode, "record-mode", "interleaved", "transcript layout(interleaved or split per direction)")
+	flag.IntVar(&c.MaxClients, "max-clients", 0, "maximum number of tcp clients, 0 means no limit")
+	flag.StringVar(&c.Takeover, "takeover", "reject", "what to do with a new client when max-clients is reached(reject or kick the oldest)")
+	flag.BoolVar(&c.ControlToken, "control-token", false, "only the client holding the control token writes to the serial port, the others take it with Ctrl-E r, s to steal and l to release")
+	flag.IntVar(&c.Replay, "replay", 0, "bytes of the latest serial output every new client gets first, e.g. 65536 for the boot messages of a console")
+	flag.IntVar(&c.Store, "store", 0, "bytes of serial output kept while no client is connected and sent to the next one, instead of dropping it")
+	flag.StringVar(&c.StoreFile, "store-file", "", "keep the -store data in this file rather than in memory, so it outlives a restart")
+	flag.StringVar(&c.RejectMessage, "reject-message", "", "what a client turned away by max-clients gets in raw mode, with \\r, \\n and \\x00 escapes, the default says the port is busy")
+	flag.StringVar(&c.Banner, "banner", "", "text/template every tcp client gets first, with {{.Name}}, {{.Device}}, {{.Listen}}, {{.Settings}}, {{.Hostname}}, {{.Client}} and {{.Time}} and the \\r, \\n escapes")
+	flag.StringVar(&c.IdleTimeout, "idle-timeout", "", "disconnect a client that has neither sent nor received anything for this long, e.g. 30m")
+	flag.StringVar(&c.Observe, "observe", "", "also listen on this address for observers, they get the serial data but what they send is discarded, e.g. :1235")
+	flag.StringVar(&c.SSH, "ssh", "", "also serve ssh on this address, e.g. 0.0.0.0:2222")
+	flag.StringVar(&c.SSHHostKey, "ssh-host-key", "ssh_host_ed25519_key", "ssh host key file, generated when missing")
+	flag.StringVar(&c.SSHAuthorizedKeys, "ssh-authorized-keys", "", "authorized_keys file of the users allowed to ssh in")
+	flag.BoolVar(&c.RFC2217, "rfc2217", false, "serve RFC 2217 telnet COM port control to tcp clients")
+	flag.BoolVar(&c.Telnet, "telnet", false, "speak telnet to tcp clients without the COM port control of -rfc2217, so 0xff bytes get through a telnet client")
+	flag.IntVar(&c.RFC2217Coalesce, "rfc2217-coalesce", 0, "milliseconds within which the DTR and RTS changes of a client are applied together, 20 lets esptool reset an ESP32 into its bootloader")
+	flag.IntVar(&c.Keepalive, "keepalive", 0, "seconds a tcp client may be silent before keepalive probes are sent, 0 keeps the default of 15, -1 turns keepalive off")
+	flag.IntVar(&c.KeepaliveInterval, "keepalive-interval", 0, "seconds between the keepalive probes, 0 keeps the system default (linux only)")
+	flag.IntVar(&c.KeepaliveCount, "keepalive-count", 0, "unanswered keepalive probes before the client is dropped, 0 keeps the system default (linux only)")
+	flag.BoolVar(&c.NoDelay, "nodelay", true, "set TCP_NODELAY on the tcp clients, a keystroke goes out at once rather than waiting for Nagle")
+	flag.IntVar(&c.SndBuf, "sndbuf", 0, "send buffer bytes of the tcp clients, 0 keeps the system default")
+	flag.IntVar(&c.RcvBuf, "rcvbuf", 0, "receive buffer bytes of the tcp clients, 0 keeps the system default")
+	flag.BoolVar(&c.ReuseAddr, "reuseaddr", runtime.GOOS != "windows", "set SO_REUSEADDR on the tcp listener so a restart can bind the port while old connections linger, off on windows where it lets other programs bind it too")
+	flag.StringVar(&c.TLSCert, "tls-cert", "", "tls certificate file, enables tls on the listener together with -tls-key")
+	flag.StringVar(&c.TLSKey, "tls-key", "", "tls private key file")
+	flag.StringVar(&c.TLSClientCA, "tls-client-ca", "", "CA certificates file, clients must present a certificate signed by one of them")
+	flag.StringVar(&c.Allow, "allow", "", "comma separated CIDRs allowed to connect, e.g. 10.0.0.0/8,192.168.1.0/24")
+	flag.StringVar(&c.Deny, "deny", "", "comma separated CIDRs refused to connect")
+	flag.BoolVar(&c.ProxyProtocol, "proxy-protocol", false, "read the HAProxy PROXY protocol v1 or v2 header of every connection, for the client address behind a load balancer or stunnel")
+	flag.StringVar(&c.Token, "token", "", "shared secret a tcp client must send as its first line")
+	flag.StringVar(&c.TokenFile, "token-file", "", "read the shared secret from this file")
+}
+
+// envPrefix is prepended to the upper cased flag names, with - turned into
+// _, to find their environment variables, e.g. TCP2SERIAL_MAX_CLIENTS.
+const envPrefix = "TCP2SERIAL_"
+
+func envName(name string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+}
+
+// setFlagsFromEnv sets the flags from their environment variables. It runs
+// before flag.Parse so the command line still has the last word.
+func setFlagsFromEnv() error {
+	var err error
+	flag.VisitAll(func(f *flag.Flag) {
+		v, ok := os.LookupEnv(envName(f.Name))
+		if !ok || err != nil {
+			return
+		}
+		if serr := flag.Set(f.Name, v); serr != nil {
+			err = fmt.Errorf("%v: %v", envName(f.Name), serr)
+		}
+	})
+	return err
+}
+
+func (c *bridgeConfig) validate() error {
+	if c.Takeover != "reject" && c.Takeover != "kick" {
+		return fmt.Errorf("unknown takeover policy: %v", c.Takeover)
+	}
+	if _, err := unescape(c.RejectMessage); err != nil {
+		return fmt.Errorf("invalid reject-message: %v", err)
+	}
+	if c.Banner != "" {
+		if _, err := parseBanner(c.Banner); err != nil {
+			return fmt.Errorf("invalid banner: %v", err)
+		}
+		if c.Proto != "tcp" || c.Mode != "raw" {
+			return errors.New("banner needs a tcp listener in raw mode")
+		}
+	}
+	if c.IdleTimeout != "" {
+		if d, err := time.ParseDuration(c.IdleTimeout); err != nil || d <= 0 {
+			return fmt.Errorf("invalid idle timeout: %v", c.IdleTimeout)
+		}
+	}
+	if c.Replay < 0 {
+		return fmt.Errorf("invalid replay size: %v", c.Replay)
+	}
+	if c.Replay > 0 && (c.Proto != "tcp" || c.Mode != "raw") {
+		return errors.New("replay needs a tcp listener in raw mode")
+	}
+	if c.Store < 0 {
+		return fmt.Errorf("invalid store size: %v", c.Store)
+	}
+	if c.StoreFile != "" && c.Store == 0 {
+		return errors.New("store-file needs a store size")
+	}
+	if c.Store > 0 && (c.Proto != "tcp" || c.Mode != "raw") {
+		return errors.New("store needs a tcp listener in raw mode")
+	}
+	if c.ControlToken && (c.Proto != "tcp" || c.Mode != "raw") {
+		return errors.New("control-token needs a tcp listener in raw mode")
+	}
+	if c.Observe != "" && (c.Proto != "tcp" || c.Mode == modeModbusGateway || c.Mode == modeGpsd || c.Mode == modeIEC104 || c.Mode == modeELM327) {
+		return errors.New("observe needs a tcp listener in a mode that broadcasts the serial data")
+	}
+	if c.Dump != "" && c.Dump != "hex" && c.Dump != "ascii" && c.Dump != "mixed" {
+		return fmt.Errorf("unknown dump mode: %v", c.Dump)
+	}
+	if c.RecordMode != "interleaved" && c.RecordMode != "split" {
+		return fmt.Errorf("unknown record mode: %v", c.RecordMode)
+	}
+	for _, kind := range strings.Split(c.Lock, ",") {
+		if kind != "none" && kind != "flock" && kind != "uucp" {
+			return fmt.Errorf("unknown lock: %v", kind)
+		}
+	}
+	if _, ok := serialBackends[c.SerialBackend]; !ok {
+		return fmt.Errorf("unknown serial backend: %v", c.SerialBackend)
+	}
+	if c.Flow != "none" && c.Flow != "rtscts" && c.Flow != "xonxoff" {
+		return fmt.Errorf("unknown flow control: %v", c.Flow)
+	}
+	if (c.DTR != "on" && c.DTR != "off") || (c.RTS != "on" && c.RTS != "off") {
+		return errors.New("dtr and rts must be on or off")
+	}
+	if c.ConnectReset < 0 {
+		return fmt.Errorf("invalid connect reset: %v", c.ConnectReset)
+	}
+	if c.ConnectResetLevel != "on" && c.ConnectResetLevel != "off" {
+		return errors.New("connect-reset-level must be on or off")
+	}
+	if _, err := unescape(c.InitSend); err != nil {
+		return fmt.Errorf("invalid init-send: %v", err)
+	}
+	if _, err := unescape(c.CloseSend); err != nil {
+		return fmt.Errorf("invalid close-send: %v", err)
+	}
+	if (c.InitSend != "" || c.CloseSend != "") && c.Proto != "tcp" {
+		return errors.New("init-send and close-send need a tcp listener")
+	}
+	if c.Linger < 0 {
+		return fmt.Errorf("invalid linger: %v", c.Linger)
+	}
+	if c.CloseDelay < 0 {
+		return fmt.Errorf("invalid close delay: %v", c.CloseDelay)
+	}
+	if c.CloseDelay > 0 && c.CloseSend == "" {
+		return errors.New("close-delay needs close-send")
+	}
+	if c.Autobaud != "" {
+		if _, err := newAutobauder(c); err != nil {
+			return err
+		}
+	} else if c.AutobaudProbe != "" || c.AutobaudExpect != "" {
+		return errors.New("autobaud-probe and autobaud-expect need autobaud")
+	}
+	if _, err := parseChat(c.Chat); err != nil {
+		return err
+	}
+	if c.Chat != "" && (c.Proto != "tcp" || c.Mode != "raw") {
+		return errors.New("chat needs a tcp listener in mode raw")
+	}
+	if c.ChatTimeout <= 0 {
+		return fmt.Errorf("invalid chat timeout: %v", c.ChatTimeout)
+	}
+	if c.RFC2217Coalesce < 0 {
+		return fmt.Errorf("invalid rfc2217 coalesce: %v", c.RFC2217Coalesce)
+	}
+	if c.Telnet && (c.Proto != "tcp" || c.WsPath != "") {
+		return errors.New("telnet needs a tcp listener without ws")
+	}
+	if c.Connect != "" {
+		if _, _, err := net.SplitHostPort(c.Connect); err != nil {
+			return fmt.Errorf("invalid connect address: %v", err)
+		}
+		if c.Proto != "tcp" || c.WsPath != "" || c.Observe != "" || c.ProxyProtocol || c.TLSCert != "" || c.TLSKey != "" || c.TLSClientCA != "" {
+			return errors.New("connect needs tcp without ws, observe, proxy-protocol or tls")
+		}
+	}
+	for _, addr := range []string{c.Listen, c.Observe} {
+		if len(splitAddrs(addr)) > 1 && (c.Proto != "tcp" || strings.HasPrefix(addr, unixPrefix) || strings.HasPrefix(addr, pipePrefix)) {
+			return fmt.Errorf("several addresses need a tcp listener: %v", addr)
+		}
+	}
+	if c.SndBuf < 0 || c.RcvBuf < 0 {
+		return fmt.Errorf("invalid buffer size: sndbuf %v, rcvbuf %v", c.SndBuf, c.RcvBuf)
+	}
+	if c.Keepalive < -1 || c.KeepaliveInterval < 0 || c.KeepaliveCount < 0 {
+		return fmt.Errorf("invalid keepalive: %v, interval %v, count %v", c.Keepalive, c.KeepaliveInterval, c.KeepaliveCount)
+	}
+	if c.Keepalive < 0 && (c.KeepaliveInterval > 0 || c.KeepaliveCount > 0) {
+		return errors.New("keepalive-interval and keepalive-count need keepalive")
+	}
+	if c.ProxyProtocol && c.Proto != "tcp" {
+		return errors.New("proxy-protocol needs a tcp listener")
+	}
+	if c.RFC2217Coalesce > 0 && !c.RFC2217 {
+		return errors.New("rfc2217-coalesce needs rfc2217")
+	}
+	if c.OpenTimeout < 0 {
+		return fmt.Errorf("invalid open timeout: %v", c.OpenTimeout)
+	}
+	if c.OpenTimeout > 0 && !c.OpenRetry {
+		return errors.New("open-timeout needs open-retry")
+	}
+	if c.Reconnect < 0 {
+		return fmt.Errorf("invalid reconnect interval: %v", c.Reconnect)
+	}
+	if c.ReconnectNotify && c.Reconnect == 0 {
+		return errors.New("reconnect-notify needs reconnect")
+	}
+	if c.ReconnectError && c.Reconnect == 0 {
+		return errors.New("reconnect-error needs reconnect")
+	}
+	if c.ReadTimeout < 0 {
+		return fmt.Errorf("invalid read timeout: %v", c.ReadTimeout)
+	}
+	if c.WriteTimeout < 0 {
+		return fmt.Errorf("invalid write timeout: %v", c.WriteTimeout)
+	}
+	if c.BufferSize < minBufferSize || c.BufferSize > maxBufferSize {
+		return fmt.Errorf("invalid buffer size: %v, want %v to %v", c.BufferSize, minBufferSize, maxBufferSize)
+	}
+	if c.NineBit && (c.DataBits != 8 || (c.Parity != "None" && c.Parity != "Space")) {
+		return errors.New("nine-bit needs 8 dataBits and no parity of its own")
+	}
+	if c.FrameGap < 0 {
+		return fmt.Errorf("invalid frame gap: %v", c.FrameGap)
+	}
+	switch c.Framing {
+	case "":
+		if c.LineInput {
+			return errors.New("line-input needs framing line")
+		}
+	case framingLine:
+		if delim, err := unescape(c.LineDelimiter); err != nil || len(delim) == 0 {
+			return fmt.Errorf("invalid line delimiter: %q", c.LineDelimiter)
+		}
+	case framingLength:
+		if c.LengthSize != 2 && c.LengthSize != 4 {
+			return fmt.Errorf("invalid length size: %v, want 2 or 4", c.LengthSize)
+		}
+	case framingSTX:
+		start, err1 := unescape(c.STXStart)
+		end, err2 := unescape(c.STXEnd)
+		escape, err3 := unescape(c.STXEscape)
+		if err1 != nil || err2 != nil || err3 != nil || len(start) != 1 || len(end) != 1 || len(escape) > 1 {
+			return fmt.Errorf("invalid stx bytes: %q %q %q, want one byte each", c.STXStart, c.STXEnd, c.STXEscape)
+		}
+		if start[0] == end[0] || (len(escape) == 1 && (escape[0] == start[0] || escape[0] == end[0])) {
+			return errors.New("stx-start, stx-end and stx-escape need to differ")
+		}
+		if c.STXTrailer < 0 {
+			return fmt.Errorf("invalid stx trailer: %v", c.STXTrailer)
+		}
+	case framingCOBS:
+		if c.COBSMax <= 0 {
+			return fmt.Errorf("invalid cobs max: %v", c.COBSMax)
+		}
+	case framingHex, framingBase64:
+	default:
+		return fmt.Errorf("unknown framing: %v", c.Framing)
+	}
+	if c.Framing != "" && c.Mode != "raw" {
+		return errors.New("framing needs mode raw")
+	}
+	if c.ControlToken && (c.Framing == framingLength || c.Framing == framingSTX || c.Framing == framingCOBS) {
+		// a 0x05 in a frame would be taken for a command
+		return fmt.Errorf("control-token doesn't go with framing %v", c.Framing)
+	}
+	if c.TxCharDelay < 0 {
+		return fmt.Errorf("invalid tx char delay: %v", c.TxCharDelay)
+	}
+	if c.TxLineDelay < 0 {
+		return fmt.Errorf("invalid tx line delay: %v", c.TxLineDelay)
+	}
+	if c.Pace < 0 || c.Pace > 200 {
+		return fmt.Errorf("invalid pace: %v, want 0 to 200 percent", c.Pace)
+	}
+	if c.Turnaround < 0 {
+		return fmt.Errorf("invalid turnaround delay: %v", c.Turnaround)
+	}
+	if c.RS485 != "" && c.RS485 != "rts" && c.RS485 != "kernel" {
+		return fmt.Errorf("unknown rs485 mode: %v", c.RS485)
+	}
+	if c.RS485Before < 0 || c.RS485After < 0 {
+		return fmt.Errorf("invalid rs485 delay: %v/%v", c.RS485Before, c.RS485After)
+	}
+	if c.RS485 == "" && (c.RS485Before != 0 || c.RS485After != 0 || c.RS485RTSLow) {
+		return errors.New("rs485-delay-before, rs485-delay-after and rs485-rts-low need rs485")
+	}
+	if c.RS485 != "" && c.Flow == "rtscts" {
+		return errors.New("rs485 and flow rtscts both need RTS")
+	}
+	if c.ModemPoll < 0 {
+		return fmt.Errorf("invalid modem poll interval: %v", c.ModemPoll)
+	}
+	if c.DCDDrop && c.ModemPoll == 0 {
+		return errors.New("dcd-drop needs modem-poll")
+	}
+	if c.Proto != "tcp" && c.Proto != "udp" {
+		return fmt.Errorf("unknown proto: %v", c.Proto)
+	}
+	switch c.Mode {
+	case "raw", modeNMEA, modeKISS:
+	case modeSlip:
+		if c.Tun == "" {
+			return errors.New("mode slip needs tun")
+		}
+	case modeSlcan:
+		if _, ok := slcanBitrates[c.SlcanBitrate]; !ok {
+			return fmt.Errorf("unsupported slcan bitrate: %v", c.SlcanBitrate)
+		}
+	case modeDMX:
+		if c.Proto != "udp" {
+			return errors.New("mode dmx needs proto udp")
+		}
+		if c.DMXUniverse < 0 || c.DMXUniverse > 63999 {
+			return fmt.Errorf("invalid dmx universe: %v", c.DMXUniverse)
+		}
+		if c.DMXRate <= 0 || c.DMXRate > dmxMaxRate {
+			return fmt.Errorf("invalid dmx rate: %v", c.DMXRate)
+		}
+		if c.Autobaud != "" || c.NineBit {
+			return errors.New("mode dmx sets the line itself, without autobaud or nine-bit")
+		}
+	case modeIEC104:
+		linkSize, _, err := parseIEC101Sizes(c.IEC101Sizes)
+		if err != nil {
+			return err
+		}
+		if c.IEC101Address < 0 || uint32(c.IEC101Address) > maxAddress(linkSize) {
+			return fmt.Errorf("invalid iec101 address: %v", c.IEC101Address)
+		}
+		if c.IEC101Timeout <= 0 {
+			return fmt.Errorf("invalid iec101 timeout: %v", c.IEC101Timeout)
+		}
+		if c.Proto != "tcp" || c.RFC2217 || c.Telnet {
+			return errors.New("mode iec104 needs a tcp listener without rfc2217 or telnet")
+		}
+	case modeELM327:
+		if c.ELM327Timeout <= 0 {
+			return fmt.Errorf("invalid elm327 timeout: %v", c.ELM327Timeout)
+		}
+		if c.Proto != "tcp" || c.RFC2217 || c.Telnet {
+			return errors.New("mode elm327 needs a tcp listener without rfc2217 or telnet")
+		}
+	case modeModbusGateway:
+		if c.ModbusFraming != "rtu" && c.ModbusFraming != "ascii" {
+			return fmt.Errorf("unknown modbus framing: %v", c.ModbusFraming)
+		}
+		if _, err := parseModbusRoutes(c.ModbusRoute); err != nil {
+			return err
+		}
+		if _, err := parseModbusPolls(c.ModbusPoll); err != nil {
+			return err
+		}
+		if c.ModbusPollInterval <= 0 {
+			return fmt.Errorf("invalid modbus poll interval: %v", c.ModbusPollInterval)
+		}
+		if c.ModbusTimeout <= 0 {
+			return fmt.Errorf("invalid modbus timeout: %v", c.ModbusTimeout)
+		}
+		if c.Proto != "tcp" || c.RFC2217 || c.Telnet || c.WsPath != "" || c.SSH != "" || c.Autobaud != "" || c.NineBit || c.ReconnectNotify {
+			return errors.New("mode modbus-gateway needs a plain tcp listener, without rfc2217, telnet, ws, ssh, autobaud, nine-bit or reconnect-notify")
+		}
+	case modeGpsd:
+		if c.Proto != "tcp" || c.RFC2217 || c.Telnet {
+			return errors.New("mode gpsd needs a tcp listener without rfc2217 or telnet")
+		}
+	default:
+		return fmt.Errorf("unknown mode: %v", c.Mode)
+	}
+	if c.Tun != "" && c.Mode != modeSlip {
+		return errors.New("tun needs mode slip")
+	}
+	if c.SocketCAN != "" && c.Mode != modeSlcan {
+		return errors.New("socketcan needs mode slcan")
+	}
+	if (c.ModbusRoute != "" || c.ModbusPoll != "") && c.Mode != modeModbusGateway {
+		return errors.New("modbus-route and modbus-poll need mode modbus-gateway")
+	}
+	if _, err := parseWsOrigins(c.WsOrigin); err != nil {
+		return err
+	}
+	if c.WsOrigin != "" && c.WsPath == "" {
+		return errors.New("ws-origin needs ws")
+	}
+	if c.Console && (c.WsPath == "" || c.WsPath == "/console") {
+		return errors.New("console needs a ws path other than /console")
+	}
+	if c.Proto == "udp" && c.SSH != "" {
+		return errors.New("ssh needs proto tcp")
+	}
+	return nil
+}
+
+// expandDevices turns a -s list of devices into one bridge per device, the
+// n-th one listening on the -l port plus n and named after its device.
+func expandDevices(c bridgeConfig) ([]bridgeConfig, error) {
+	devices := strings.Split(c.Device, ",")
+	if len(devices) == 1 {
+		return []bridgeConfig{c}, nil
+	}
+	// check the addresses before the bridges are made
+	if _, err := shiftPorts(c.Listen, 0); err != nil {
+		return nil, fmt.Errorf("several devices need a tcp listen address: %v", err)
+	}
+	// the observers of every device get their own port too
+	if c.Observe != "" {
+		if _, err := shiftPorts(c.Observe, 0); err != nil {
+			return nil, fmt.Errorf("several devices need an observe port number: %v", err)
+		}
+	}
+	if c.Connect != "" {
+		if _, err := shiftPorts(c.Connect, 0); err != nil {
+			return nil, fmt.Errorf("several devices need a connect port number: %v", err)
+		}
+	}
+	var confs []bridgeConfig
+	for i, device := range devices {
+		conf := c
+		conf.Device = device
+		conf.Listen, _ = shiftPorts(c.Listen, i)
+		if c.Observe != "" {
+			conf.Observe, _ = shiftPorts(c.Observe, i)
+		}
+		if c.Connect != "" {
+			conf.Connect, _ = shiftPorts(c.Connect, i)
+		}
+		conf.Name = filepath.Base(device)
+		if c.Name != "" {
+			conf.Name = c.Name + "-" + conf.Name
+		}
+		if c.StoreFile != "" {
+			conf.StoreFile = c.StoreFile + "." + conf.Name
+		}
+		confs = append(confs, conf)
+	}
+	return confs, nil
+}
+
+// idleTimeout is -idle-timeout, 0 when there is none.
+func (c *bridgeConfig) idleTimeout() time.Duration {
+	d, _ := time.ParseDuration(c.IdleTimeout)
+	return d
+}
+
+// shiftPorts adds n to the port of every address of addr, the listen
+// address of the nth device.
+func shiftPorts(addr string, n int) (string, error) {
+	var shifted []string
+	for _, a := range splitAddrs(addr) {
+		host, port, err := net.SplitHostPort(a)
+		if err != nil {
+			return "", err
+		}
+		p, err := strconv.Atoi(port)
+		if err != nil {
+			return "", fmt.Errorf("no port number: %v", a)
+		}
+		shifted = append(shifted, net.JoinHostPort(host, strconv.Itoa(p+n)))
+	}
+	return strings.Join(shifted, ","), nil
+}
+
+// configFile is the layout of the -config file.
+type configFile struct {
+	Bridges []json.RawMessage `json:"bridges"`
+}
+
+// loadConfig reads the bridges of a -config file, every bridge starts out
+// with the values of the command line flags. A file that isn't json is
+// read as a ser2net.conf.
+func loadConfig(path string, defaults bridgeConfig) ([]bridgeConfig, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.HasPrefix(bytes.TrimSpace(b), []byte("{")) {
+		return parseSer2net(path, string(b), defaults)
+	}
+	var file configFile
+	if err := json.Unmarshal(b, &file); err != nil {
+		return nil, fmt.Errorf("%v: %v", path, err)
+	}
+	if len(file.Bridges) == 0 {
+		return nil, fmt.Errorf("%v: no bridges", path)
+	}
+
+	names := make(map[string]bool)
+	var confs []bridgeConfig
+	for i, raw := range file.Bridges {
+		conf := defaults
+		dec := json.NewDecoder(bytes.NewReader(raw))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&conf); err != nil {
+			return nil, fmt.Errorf("%v: bridge %v: %v", path, i, err)
+		}
+		if conf.Name == "" {
+			conf.Name = filepath.Base(conf.Device)
+		}
+		if names[conf.Name] {
+			return nil, fmt.Errorf("%v: duplicate bridge name %v", path, conf.Name)
+		}
+		names[conf.Name] = true
+		confs = append(confs, conf)
+	}
+	return confs, nil
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"math/rand"
+	"net"
+	"time"
+)
+
+// the backoff of -connect between two attempts, it starts over after a
+// connection that was up for connectRetryMax
+const (
+	connectRetryMin = 500 * time.Millisecond
+	connectRetryMax = 60 * time.Second
+)
+
+// dialLoop is -connect: rather than listening, the bridge dials addr and
+// serves the connection like an accepted client. When it drops or can't be
+// made it is dialled again with backoff and jitter, so many field units
+// don't all come back at once, while the serial port stays open.
+func (b *bridge) dialLoop(ctx context.Context, addr string) {
+	delay := connectRetryMin
+	jitter := rand.New(rand.NewSource(time.Now().UnixNano()))
+	for {
+		dialer := net.Dialer{Timeout: connectRetryMax}
+		conn, err := dialer.DialContext(ctx, "tcp", addr)
+		if err == nil {
+			b.logger.Info("connected out", "addr", addr)
+			b.setListening(true)
+			start := time.Now()
+			b.handleConn(ctx, conn, false)
+			b.setListening(false)
+			if time.Since(start) >= connectRetryMax {
+				delay = connectRetryMin
+			}
+		} else if ctx.Err() == nil {
+			b.logger.Warn("connect error", "addr", addr, "err", err)
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		// somewhere between half the delay and all of it
+		wait := delay/2 + time.Duration(jitter.Int63n(int64(delay/2)+1))
+		b.logger.Info("connect retry", "addr", addr, "in", wait.Round(time.Millisecond))
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+		if delay *= 2; delay > connectRetryMax {
+			delay = connectRetryMax
+		}
+	}
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"html/template"
+	"net/http"
+)
+
+var consoleTemplate = template.Must(template.ParseFS(webFiles, "web/console.html"))
+
+// serveConsole serves the xterm.js page that opens the -ws endpoint as
+// an interactive terminal.
+func (b *bridge) serveConsole(w http.ResponseWriter, r *http.Request) {
+	if !b.allowed(remoteAddr(r)) {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+	conf := b.config()
+	title := conf.Name
+	if title == "" {
+		title = conf.Device
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	err := consoleTemplate.Execute(w, struct {
+		Title     string
+		AssetsURL string
+		WsPath    string
+	}{title, conf.ConsoleAssets, conf.WsPath})
+	if err != nil {
+		b.logger.Warn("console page error", "addr", r.RemoteAddr, "err", err)
+	}
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"fmt"
+	"io"
+)
+
+// with -control-token a client types Ctrl-E and one of the commands, a
+// doubled Ctrl-E is sent as one
+const controlEscape = 0x05
+
+// the in-band commands after controlEscape
+const (
+	controlRequest = 'r'
+	controlSteal   = 's'
+	controlRelease = 'l'
+	controlStatus  = '?'
+)
+
+// notice queues a line for c alone, in brackets so it stands out from the
+// serial data. h.mu must be held.
+func (h *hub) notice(c *client, format string, args ...interface{}) {
+	if _, ok := h.clients[c]; !ok {
+		return
+	}
+	select {
+	case c.queue <- []byte("\r\n[" + fmt.Sprintf(format, args...) + "]\r\n"):
+	default:
+	}
+}
+
+// holds reports whether c may write to the serial port. A free token goes
+// to the first client that writes.
+func (h *hub) holds(c *client) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if !h.controlToken {
+		return true
+	}
+	if h.writer == nil && !c.observer {
+		h.setWriter(c)
+	}
+	return h.writer == c
+}
+
+// setWriter hands the token to c, nil frees it. h.mu must be held.
+func (h *hub) setWriter(c *client) {
+	old := h.writer
+	h.writer = c
+	if c != nil {
+		h.logger.Info("control taken", "addr", c.addr)
+		h.notice(c, "control: you have it")
+	}
+	if old != nil && c != nil && old != c {
+		h.notice(old, "control: taken by %v", c.addr)
+	}
+	if c == nil && old != nil {
+		h.logger.Info("control released", "addr", old.addr)
+		for o := range h.clients {
+			if !o.observer {
+				h.notice(o, "control: free")
+			}
+		}
+	}
+}
+
+// takeControl gives c the token if it's free or steal is set, otherwise
+// the holder is told that c asks for it.
+func (h *hub) takeControl(c *client, steal bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	switch {
+	case c.observer:
+		h.notice(c, "control: observers can't write")
+	case h.writer == c:
+		h.notice(c, "control: you have it")
+	case h.writer == nil || steal:
+		h.setWriter(c)
+	default:
+		h.notice(c, "control: held by %v, ^E s to steal it", h.writer.addr)
+		h.notice(h.writer, "control: %v asks for it, ^E l to release it", c.addr)
+	}
+}
+
+// giveControl hands the token to the client with the id, for the admin
+// API. It reports whether there was one.
+func (h *hub) giveControl(id uint64) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for c := range h.clients {
+		if c.id == id && !c.observer {
+			h.setWriter(c)
+			return true
+		}
+	}
+	return false
+}
+
+// releaseControl frees the token if c holds it, a nil c frees it whoever
+// holds it.
+func (h *hub) releaseControl(c *client) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.writer != nil && (c == nil || h.writer == c) {
+		h.setWriter(nil)
+	}
+}
+
+// controller is the client holding the token, nil when it's free.
+func (h *hub) controller() *client {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.writer
+}
+
+// controlStatus tells c who holds the token.
+func (h *hub) controlStatus(c *client) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	switch h.writer {
+	case nil:
+		h.notice(c, "control: free, ^E r to take it")
+	case c:
+		h.notice(c, "control: you have it, ^E l to release it")
+	default:
+		h.notice(c, "control: held by %v, ^E r to ask for it, ^E s to steal it", h.writer.addr)
+	}
+}
+
+// controlWriter passes on what a client sends while it holds the token and
+// runs the in-band commands, see -control-token.
+type controlWriter struct {
+	h      *hub
+	c      *client
+	dst    io.Writer
+	escape bool
+	// warned is set once the client was told its input is dropped
+	warned bool
+}
+
+func (w *controlWriter) Write(b []byte) (int, error) {
+	var out []byte
+	for _, ch := range b {
+		if w.escape {
+			w.escape = false
+			if ch == controlEscape {
+				out = append(out, ch)
+				continue
+			}
+			// what came before the command goes out before it
+			if err := w.flush(out); err != nil {
+				return 0, err
+			}
+			out = nil
+			w.command(ch)
+			continue
+		}
+		if ch == controlEscape {
+			w.escape = true
+			continue
+		}
+		out = append(out, ch)
+	}
+	if err := w.flush(out); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// flush writes b to the serial port if the client holds the token.
+func (w *controlWriter) flush(b []byte) error {
+	if len(b) == 0 {
+		return nil
+	}
+	if !w.h.holds(w.c) {
+		w.h.logger.Info("input without control discarded", "addr", w.c.addr, "bytes", len(b))
+		if !w.warned {
+			w.warned = true
+			w.h.controlStatus(w.c)
+		}
+		return nil
+	}
+	w.warned = false
+	_, err := w.dst.Write(b)
+	return err
+}
+
+func (w *controlWriter) command(ch byte) {
+	switch ch {
+	case controlRequest:
+		w.h.takeControl(w.c, false)
+	case controlSteal:
+		w.h.takeControl(w.c, true)
+	case controlRelease:
+		w.h.releaseControl(w.c)
+	case controlStatus:
+		w.h.controlStatus(w.c)
+	}
+}
@@ -0,0 +1,57 @@
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// daemonEnv marks the copy of the process -daemon starts in the
+// background.
+const daemonEnv = "TCP2SERIAL_DAEMON"
+
+// daemonize starts tcp2serial again in its own session without a terminal
+// and reports true in the process that did, which then exits. Go can't
+// fork, so the copy gets the same command line.
+func daemonize() (bool, error) {
+	if os.Getenv(daemonEnv) != "" {
+		return false, nil
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return false, err
+	}
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Env = append(os.Environ(), daemonEnv+"=1")
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	// stdin, stdout and stderr are /dev/null
+	if err := cmd.Start(); err != nil {
+		return false, err
+	}
+	return true, cmd.Process.Release()
+}
+
+// writePidFile writes our pid to path, unless a running process left it
+// there, and returns the function that removes it again.
+func writePidFile(path string) (func(), error) {
+	if b, err := os.ReadFile(path); err == nil {
+		pid, err := strconv.Atoi(strings.TrimSpace(string(b)))
+		if err == nil && pid > 0 && pid != os.Getpid() {
+			if err := unix.Kill(pid, 0); err == nil || err == unix.EPERM {
+				return nil, fmt.Errorf("already running as pid %d, see %v", pid, path)
+			}
+		}
+	}
+	if err := os.WriteFile(path, []byte(strconv.Itoa(os.Getpid())+"\n"), 0644); err != nil {
+		return nil, err
+	}
+	return func() { os.Remove(path) }, nil
+}
@@ -0,0 +1,13 @@
+//go:build windows || plan9
+// +build windows plan9
+
+package main
+
+// -daemon and -pidfile are for unix init scripts, on windows see -service.
+func daemonize() (bool, error) {
+	return false, errUnsupported
+}
+
+func writePidFile(path string) (func(), error) {
+	return nil, errUnsupported
+}
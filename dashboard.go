@@ -0,0 +1,20 @@
+package main
+
+import (
+	"embed"
+	"io/fs"
+	"net/http"
+)
+
+//go:embed web
+var webFiles embed.FS
+
+// dashboardHandler serves the web UI, it reads everything it shows from
+// the management api.
+func dashboardHandler() http.Handler {
+	sub, err := fs.Sub(webFiles, "web/dashboard")
+	if err != nil {
+		panic(err)
+	}
+	return http.FileServer(http.FS(sub))
+}
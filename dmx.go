@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	modeDMX = "dmx"
+
+	dmxSlots = 512
+	// the line of -mode dmx, 8N2 is forced at this rate
+	dmxBaud = 250000
+	// what the transmitters of the consoles send, the receivers need at
+	// least 88 and 8 microseconds
+	dmxBreak = 176 * time.Microsecond
+	dmxMAB   = 12 * time.Microsecond
+	// a packet with all the slots takes about 23ms
+	dmxMaxRate = 44
+
+	artNetPort = 6454
+	artOpDmx   = 0x5000
+	sacnPort   = 5568
+	// the vectors of the root, the framing and the DMP layer of E1.31 data
+	sacnVectorRoot    = 0x00000004
+	sacnVectorFraming = 0x00000002
+	sacnVectorDMP     = 0x02
+	sacnOptPreview    = 0x80
+	sacnOptTerminated = 0x40
+)
+
+var (
+	artNetID = []byte("Art-Net\x00")
+	sacnID   = []byte("ASC-E1.17\x00\x00\x00")
+)
+
+// parseArtDmx returns the port address and the slots of an Art-Net ArtDmx
+// packet.
+func parseArtDmx(p []byte) (universe int, slots []byte, ok bool) {
+	if len(p) < 18 || !bytes.Equal(p[:8], artNetID) || binary.LittleEndian.Uint16(p[8:]) != artOpDmx {
+		return 0, nil, false
+	}
+	universe = int(p[15]&0x7f)<<8 | int(p[14])
+	n := int(binary.BigEndian.Uint16(p[16:]))
+	if n < 2 || n > dmxSlots || len(p) < 18+n {
+		return 0, nil, false
+	}
+	return universe, p[18 : 18+n], true
+}
+
+// parseSACN returns the universe and the slots of an E1.31 data packet
+// with the null start code. Preview data and the packet that ends a
+// stream aren't levels to output.
+func parseSACN(p []byte) (universe int, slots []byte, ok bool) {
+	if len(p) < 126 || !bytes.Equal(p[4:16], sacnID) ||
+		binary.BigEndian.Uint32(p[18:]) != sacnVectorRoot ||
+		binary.BigEndian.Uint32(p[40:]) != sacnVectorFraming ||
+		p[117] != sacnVectorDMP || p[118] != 0xa1 {
+		return 0, nil, false
+	}
+	if p[112]&(sacnOptPreview|sacnOptTerminated) != 0 {
+		return 0, nil, false
+	}
+	universe = int(binary.BigEndian.Uint16(p[113:]))
+	// the count includes the start code
+	n := int(binary.BigEndian.Uint16(p[123:]))
+	if n < 1 || n > 1+dmxSlots || len(p) < 125+n || p[125] != 0 {
+		return 0, nil, false
+	}
+	return universe, p[126 : 125+n], true
+}
+
+// parseDMX takes an Art-Net or an sACN packet.
+func parseDMX(p []byte) (universe int, slots []byte, ok bool) {
+	if universe, slots, ok = parseArtDmx(p); ok {
+		return
+	}
+	return parseSACN(p)
+}
+
+// sacnGroup is the multicast group sACN sends universe to.
+func sacnGroup(universe int) net.IP {
+	return net.IPv4(239, 255, byte(universe>>8), byte(universe))
+}
+
+// dmxOutput keeps sending the last levels of -dmx-universe it was given,
+// a DMX512 receiver wants them refreshed all the time, see -mode dmx.
+type dmxOutput struct {
+	port     *serialPort
+	universe int
+	mu       sync.Mutex
+	// the start code, always 0, and the slots
+	packet [1 + dmxSlots]byte
+}
+
+// update takes the levels of a network packet, those of the other
+// universes are dropped.
+func (d *dmxOutput) update(p []byte) bool {
+	universe, slots, ok := parseDMX(p)
+	if !ok || universe != d.universe {
+		return false
+	}
+	d.mu.Lock()
+	copy(d.packet[1:], slots)
+	d.mu.Unlock()
+	return true
+}
+
+// refresh sends the packet rate times a second until ctx is done or the
+// port fails.
+func (d *dmxOutput) refresh(ctx context.Context, rate int, stats *trafficStats) error {
+	ticker := time.NewTicker(time.Second / time.Duration(rate))
+	defer ticker.Stop()
+	for {
+		d.mu.Lock()
+		packet := d.packet
+		d.mu.Unlock()
+		if err := d.port.sendDMX(packet[:]); err != nil {
+			return err
+		}
+		stats.add(true, len(packet))
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// sendDMX sends a DMX512 packet: the break, the mark after break, then the
+// start code and the slots of packet, and waits until they are out so the
+// next break can't cut them off.
+func (s *serialPort) sendDMX(packet []byte) error {
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+	port, lost := s.state()
+	if lost != nil {
+		// nowhere to send it until the port is back
+		return nil
+	}
+	err := port.SetBreak(true)
+	if err == nil {
+		time.Sleep(dmxBreak)
+		err = port.SetBreak(false)
+	}
+	if err == nil {
+		time.Sleep(dmxMAB)
+		_, err = port.Write(packet)
+	}
+	if err == nil {
+		if err = port.Drain(); err == errUnsupported {
+			time.Sleep(charTime(s.Config(), len(packet)))
+			err = nil
+		}
+	}
+	if err != nil && s.failed(port, err) {
+		// reopened underneath us, the next packet goes to the new port
+		return nil
+	}
+	return err
+}
+
+// listenDMX opens the udp socket the Art-Net or sACN packets come to. On
+// the sACN port it also joins the multicast group of the universe.
+func (b *bridge) listenDMX() (*net.UDPConn, error) {
+	laddr, err := net.ResolveUDPAddr("udp", b.conf.Listen)
+	if err != nil {
+		b.logger.Error("udp address error", "addr", b.conf.Listen, "err", err)
+		return nil, err
+	}
+	var conn *net.UDPConn
+	if laddr.Port == sacnPort {
+		conn, err = net.ListenMulticastUDP("udp4", nil, &net.UDPAddr{IP: sacnGroup(b.conf.DMXUniverse), Port: sacnPort})
+	} else {
+		conn, err = net.ListenUDP("udp", laddr)
+	}
+	if err != nil {
+		b.logger.Error("listen error", "addr", b.conf.Listen, "err", err)
+		return nil, err
+	}
+	return conn, nil
+}
+
+// serveDMX feeds the packets of conn to d until conn fails.
+func (b *bridge) serveDMX(conn *net.UDPConn, d *dmxOutput) error {
+	buf := make([]byte, 1024)
+	var source string
+	for {
+		n, addr, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			return err
+		}
+		if !b.allowed(addr) {
+			b.logger.Warn("rejected by allow/deny list", "addr", addr)
+			continue
+		}
+		if !d.update(buf[:n]) {
+			b.logger.Debug("dmx packet dropped", "addr", addr, "bytes", n)
+			continue
+		}
+		if addr.String() != source {
+			source = addr.String()
+			b.logger.Info("dmx source changed", "addr", addr)
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+const dumpWidth = 16
+
+// hexDump formats b, which starts at offset off of its stream, as the lines
+// of a classic dump. mode "hex" shows the hex column, "ascii" the text
+// column and "mixed" both.
+func hexDump(mode string, off int, b []byte) []string {
+	var lines []string
+	for i := 0; i < len(b); i += dumpWidth {
+		row := b[i:]
+		if len(row) > dumpWidth {
+			row = row[:dumpWidth]
+		}
+
+		var sb strings.Builder
+		fmt.Fprintf(&sb, "%08x ", off+i)
+		if mode != "ascii" {
+			for j := 0; j < dumpWidth; j++ {
+				if j >= len(row) && mode == "hex" {
+					break
+				}
+				if j == dumpWidth/2 {
+					sb.WriteByte(' ')
+				}
+				if j < len(row) {
+					fmt.Fprintf(&sb, " %02x", row[j])
+				} else if mode == "mixed" {
+					sb.WriteString("   ")
+				}
+			}
+		}
+		if mode == "mixed" {
+			sb.WriteByte(' ')
+		}
+		if mode != "hex" {
+			sb.WriteString(" |")
+			for _, c := range row {
+				if c < 0x20 || c > 0x7e {
+					c = '.'
+				}
+				sb.WriteByte(c)
+			}
+			sb.WriteByte('|')
+		}
+		lines = append(lines, sb.String())
+	}
+	return lines
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"sync"
+	"time"
+)
+
+const (
+	modeELM327 = "elm327"
+
+	// the adapter is ready for the next command when it prints the prompt
+	elmPrompt     = '>'
+	elmMaxCommand = 256
+	// the most of an answer kept, a monitor command prints without end
+	elmMaxAnswer = 64 * 1024
+)
+
+var (
+	errELMTimeout = errors.New("elm327 prompt timeout")
+	errELMCommand = errors.New("elm327 command too long")
+	errELMDown    = errors.New("elm327 serial port is down")
+)
+
+// elm327Mux shares one ELM327 adapter between the clients, see -mode
+// elm327. The commands go out one at a time and what the adapter prints
+// up to its prompt is the answer for the client that sent the command.
+type elm327Mux struct {
+	port    *serialPort
+	timeout time.Duration
+	logger  *Logger
+
+	// mu is held for a whole command
+	mu sync.Mutex
+
+	amu    sync.Mutex
+	answer []byte
+	more   chan struct{}
+}
+
+func newELM327Mux(port *serialPort, timeout time.Duration, logger *Logger) *elm327Mux {
+	return &elm327Mux{port: port, timeout: timeout, logger: logger, more: make(chan struct{}, 1)}
+}
+
+// Write takes what the adapter prints.
+func (m *elm327Mux) Write(b []byte) (int, error) {
+	m.amu.Lock()
+	m.answer = append(m.answer, b...)
+	if len(m.answer) > elmMaxAnswer {
+		m.answer = m.answer[len(m.answer)-elmMaxAnswer:]
+	}
+	m.amu.Unlock()
+	select {
+	case m.more <- struct{}{}:
+	default:
+	}
+	return len(b), nil
+}
+
+// transact sends cmd with its CR and returns what the adapter printed up
+// to and with the prompt. After the timeout it returns what came so far
+// and errELMTimeout.
+func (m *elm327Mux) transact(cmd []byte) ([]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.port.IsOpen() {
+		return nil, errELMDown
+	}
+	// a late answer to the last command isn't this one's
+	m.amu.Lock()
+	m.answer = nil
+	m.amu.Unlock()
+	if _, err := m.port.Write(append(cmd, '\r')); err != nil {
+		return nil, err
+	}
+
+	timer := time.NewTimer(m.timeout)
+	defer timer.Stop()
+	for {
+		m.amu.Lock()
+		if i := bytes.IndexByte(m.answer, elmPrompt); i >= 0 {
+			answer := append([]byte(nil), m.answer[:i+1]...)
+			m.answer = m.answer[i+1:]
+			m.amu.Unlock()
+			return answer, nil
+		}
+		m.amu.Unlock()
+		select {
+		case <-m.more:
+		case <-timer.C:
+			m.amu.Lock()
+			defer m.amu.Unlock()
+			return append([]byte(nil), m.answer...), errELMTimeout
+		}
+	}
+}
+
+// serveELM327 sends the commands of c to the adapter and c the answers.
+func (b *bridge) serveELM327(c *client) error {
+	b.mu.Lock()
+	m := b.elm327
+	b.mu.Unlock()
+	if m == nil {
+		return errELMDown
+	}
+
+	var pending, last []byte
+	buf := make([]byte, 512)
+	for {
+		n, err := c.conn.Read(buf)
+		if err != nil {
+			return err
+		}
+		c.stats.add(true, n)
+		pending = append(pending, buf[:n]...)
+		for {
+			i := bytes.IndexByte(pending, '\r')
+			if i < 0 {
+				break
+			}
+			cmd := bytes.TrimSpace(pending[:i])
+			pending = pending[i+1:]
+			if len(cmd) == 0 {
+				// a bare CR repeats the last command, which has to be
+				// this client's own
+				if last == nil {
+					continue
+				}
+				cmd = last
+			}
+			last = append([]byte(nil), cmd...)
+			answer, err := m.transact(cmd)
+			if err == errELMTimeout {
+				b.logger.Warn("elm327 timeout", "addr", c.addr, "command", string(cmd))
+				if len(answer) == 0 {
+					answer = []byte("NO DATA\r")
+				}
+				// the client still gets a prompt to go on with
+				answer = append(answer, "\r>"...)
+			} else if err != nil {
+				return err
+			}
+			if !b.clients.send(c, answer) {
+				return io.EOF
+			}
+		}
+		if len(pending) > elmMaxCommand {
+			return errELMCommand
+		}
+	}
+}
@@ -0,0 +1,457 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/tarm/serial"
+)
+
+// endpointOptions are the options each kind of endpoint takes, the serial
+// ones by openSerialEndpoint.
+var endpointOptions = map[string][]string{
+	"TCP-LISTEN": {"bind", "fork", "reuseaddr"},
+	"UDP-LISTEN": {"bind"},
+	"PTY":        {"link", "raw", "echo"},
+	"RFC2217":    {},
+}
+
+// endpoint is one of the two addresses of the socat style invocation,
+// e.g. tcp2serial TCP-LISTEN:1234 /dev/ttyUSB0,b115200,raw.
+type endpoint struct {
+	kind    string
+	network string
+	arg     string
+	opts    map[string]string
+}
+
+func parseEndpoint(s string) (*endpoint, error) {
+	parts := strings.Split(s, ",")
+	e := &endpoint{opts: make(map[string]string)}
+	for _, opt := range parts[1:] {
+		k, v := opt, ""
+		if i := strings.IndexByte(opt, '='); i >= 0 {
+			k, v = opt[:i], opt[i+1:]
+		}
+		e.opts[strings.ToLower(k)] = v
+	}
+	head := parts[0]
+	switch {
+	case head == "-" || strings.EqualFold(head, "STDIO"):
+		e.kind = "STDIO"
+	case strings.HasPrefix(head, "/") || strings.HasPrefix(strings.ToUpper(head), "COM"):
+		e.kind, e.arg = "SERIAL", head
+	default:
+		e.kind = strings.ToUpper(head)
+		if i := strings.IndexByte(head, ':'); i >= 0 {
+			e.kind, e.arg = strings.ToUpper(head[:i]), head[i+1:]
+		}
+	}
+
+	// TCP4-LISTEN and the like pick the address family
+	kind := e.kind
+	for _, family := range []string{"TCP", "UDP"} {
+		for _, v := range []string{"4", "6", ""} {
+			if strings.HasPrefix(kind, family+v) {
+				e.network = strings.ToLower(family) + v
+				e.kind = family + strings.TrimPrefix(kind, family+v)
+				break
+			}
+		}
+		if e.network != "" {
+			break
+		}
+	}
+	if e.kind == "TCP-CONNECT" {
+		e.kind = "TCP"
+	}
+	switch e.kind {
+	case "RFC2217":
+		e.network = "tcp"
+		if e.arg == "" {
+			return nil, fmt.Errorf("%v needs an argument: %v", e.kind, s)
+		}
+	case "TCP-LISTEN", "UDP-LISTEN", "TCP", "UDP", "SERIAL", "EXEC", "SYSTEM":
+		if e.arg == "" {
+			return nil, fmt.Errorf("%v needs an argument: %v", e.kind, s)
+		}
+	case "PTY", "STDIO":
+	default:
+		return nil, fmt.Errorf("unknown address type: %v", s)
+	}
+	if e.kind != "SERIAL" {
+		for k := range e.opts {
+			if !contains(endpointOptions[e.kind], k) {
+				return nil, fmt.Errorf("unknown option %v for %v", k, e.kind)
+			}
+		}
+	}
+	return e, nil
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// forks reports whether every connection of a TCP-LISTEN gets its own
+// instance of the other endpoint.
+func (e *endpoint) forks() bool {
+	_, ok := e.opts["fork"]
+	return e.kind == "TCP-LISTEN" && ok
+}
+
+func (e *endpoint) listen() (net.Listener, error) {
+	return net.Listen(e.network, net.JoinHostPort(e.opts["bind"], e.arg))
+}
+
+// open connects to the endpoint, a TCP-LISTEN waits for one connection.
+func (e *endpoint) open() (io.ReadWriteCloser, error) {
+	switch e.kind {
+	case "TCP-LISTEN":
+		l, err := e.listen()
+		if err != nil {
+			return nil, err
+		}
+		defer l.Close()
+		conn, err := l.Accept()
+		if err != nil {
+			return nil, err
+		}
+		stdLogger.Info("connected", "addr", conn.RemoteAddr())
+		return conn, nil
+	case "TCP", "UDP":
+		return net.Dial(e.network, e.arg)
+	case "RFC2217":
+		conn, err := net.Dial(e.network, e.arg)
+		if err != nil {
+			return nil, err
+		}
+		return newTelnetClient(conn, stdLogger), nil
+	case "UDP-LISTEN":
+		laddr, err := net.ResolveUDPAddr(e.network, net.JoinHostPort(e.opts["bind"], e.arg))
+		if err != nil {
+			return nil, err
+		}
+		conn, err := net.ListenUDP(e.network, laddr)
+		if err != nil {
+			return nil, err
+		}
+		return &udpEndpoint{UDPConn: conn}, nil
+	case "SERIAL":
+		return openSerialEndpoint(e.arg, e.opts)
+	case "PTY":
+		p, err := openPty()
+		if err != nil {
+			return nil, err
+		}
+		link := e.opts["link"]
+		if link != "" {
+			os.Remove(link)
+			if err := os.Symlink(p.slave, link); err != nil {
+				p.Close()
+				return nil, err
+			}
+		}
+		stdLogger.Info("pty", "device", p.slave, "link", link)
+		return &ptyEndpoint{pty: p, link: link}, nil
+	case "EXEC":
+		args := strings.Fields(e.arg)
+		if len(args) == 0 {
+			return nil, fmt.Errorf("EXEC needs a command")
+		}
+		return startCommand(exec.Command(args[0], args[1:]...))
+	case "SYSTEM":
+		return startCommand(exec.Command("/bin/sh", "-c", e.arg))
+	}
+	return stdioEndpoint{}, nil
+}
+
+// openSerialEndpoint opens the device with the line of the flags and the
+// socat options: b115200, cs7, parenb, parodd, cstopb, crtscts, ixon.
+func openSerialEndpoint(device string, opts map[string]string) (io.ReadWriteCloser, error) {
+	conf := serialConfig(&flagConfig, stdLogger)
+	conf.Name, conf.ReadTimeout = device, 0
+	flow := "none"
+	parity := false
+	for k, v := range opts {
+		switch {
+		case len(k) > 1 && k[0] == 'b' && isDigits(k[1:]):
+			conf.Baud, _ = strconv.Atoi(k[1:])
+		case k == "cs5" || k == "cs6" || k == "cs7" || k == "cs8":
+			conf.Size = k[2] - '0'
+		case k == "parenb":
+			parity = v != "0"
+		case k == "parodd", k == "raw", k == "echo", k == "clocal", k == "sane":
+		case k == "cstopb":
+			conf.StopBits = serial.Stop1
+			if v != "0" {
+				conf.StopBits = serial.Stop2
+			}
+		case k == "crtscts":
+			flow = "rtscts"
+		case k == "ixon" || k == "ixoff":
+			flow = "xonxoff"
+		default:
+			return nil, fmt.Errorf("unknown option %v for SERIAL", k)
+		}
+	}
+	if parity {
+		conf.Parity = serial.ParityEven
+		if v, ok := opts["parodd"]; ok && v != "0" {
+			conf.Parity = serial.ParityOdd
+		}
+	} else if _, ok := opts["parenb"]; ok {
+		conf.Parity = serial.ParityNone
+	}
+	open, ok := serialBackends[flagConfig.SerialBackend]
+	if !ok {
+		return nil, fmt.Errorf("unknown serial backend: %v", flagConfig.SerialBackend)
+	}
+	port, err := open(*conf)
+	if err != nil {
+		return nil, err
+	}
+	if flow != "none" {
+		if err := port.SetFlow(flow); err != nil {
+			port.Close()
+			return nil, err
+		}
+	}
+	return port, nil
+}
+
+func isDigits(s string) bool {
+	for _, r := range s {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return s != ""
+}
+
+// udpEndpoint answers whoever sent the last datagram.
+type udpEndpoint struct {
+	*net.UDPConn
+	mu   sync.Mutex
+	peer *net.UDPAddr
+}
+
+func (u *udpEndpoint) Read(b []byte) (int, error) {
+	n, addr, err := u.ReadFromUDP(b)
+	if err == nil {
+		u.mu.Lock()
+		u.peer = addr
+		u.mu.Unlock()
+	}
+	return n, err
+}
+
+func (u *udpEndpoint) Write(b []byte) (int, error) {
+	u.mu.Lock()
+	peer := u.peer
+	u.mu.Unlock()
+	if peer == nil {
+		// nobody to send to yet
+		return len(b), nil
+	}
+	return u.WriteToUDP(b, peer)
+}
+
+// ptyEndpoint removes the link to the pty again.
+type ptyEndpoint struct {
+	*pty
+	link string
+}
+
+func (p *ptyEndpoint) Close() error {
+	if p.link != "" {
+		os.Remove(p.link)
+	}
+	return p.pty.Close()
+}
+
+// cmdEndpoint is the stdin and stdout of a command.
+type cmdEndpoint struct {
+	io.WriteCloser
+	io.Reader
+	cmd *exec.Cmd
+}
+
+func startCommand(cmd *exec.Cmd) (*cmdEndpoint, error) {
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	cmd.Stderr = os.Stderr
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	return &cmdEndpoint{WriteCloser: stdin, Reader: stdout, cmd: cmd}, nil
+}
+
+func (c *cmdEndpoint) Close() error {
+	c.WriteCloser.Close()
+	c.cmd.Process.Kill()
+	return c.cmd.Wait()
+}
+
+func (c *cmdEndpoint) CloseWrite() error {
+	return c.WriteCloser.Close()
+}
+
+type stdioEndpoint struct{}
+
+func (stdioEndpoint) Read(b []byte) (int, error)  { return os.Stdin.Read(b) }
+func (stdioEndpoint) Write(b []byte) (int, error) { return os.Stdout.Write(b) }
+func (stdioEndpoint) Close() error                { return nil }
+
+// how often a pty is looked at for new line settings
+const ptyLinePoll = 200 * time.Millisecond
+
+// followLine passes the rate, the stop bits and the flow control the
+// programs set on the pty a on to the RFC 2217 server b, until done is
+// closed. The settings the pty had when it was opened aren't sent.
+func followLine(a, b io.ReadWriteCloser, done <-chan struct{}) {
+	p, ok := a.(*ptyEndpoint)
+	t, ok2 := b.(*telnetConn)
+	if !ok || !ok2 {
+		return
+	}
+	last, lastFlow, err := p.line()
+	if err != nil {
+		stdLogger.Warn("pty line error", "err", err)
+		return
+	}
+	ticker := time.NewTicker(ptyLinePoll)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+		conf, flow, err := p.line()
+		if err != nil || (conf == last && flow == lastFlow) {
+			continue
+		}
+		last, lastFlow = conf, flow
+		stdLogger.Info("pty line changed", "baudRate", conf.Baud, "stopBits", conf.StopBits, "flow", flow)
+		t.setLine(conf, flow)
+	}
+}
+
+// how long the other direction may go on after one side ended, socat's -t
+const endpointLinger = 500 * time.Millisecond
+
+// relayEndpoints copies both ways until one side ends. A side that can be
+// half closed is told there is no more, and the other direction gets
+// endpointLinger to finish before both are closed.
+func relayEndpoints(a, b io.ReadWriteCloser) error {
+	type result struct {
+		dst io.ReadWriteCloser
+		err error
+	}
+	done := make(chan result, 2)
+	go func() {
+		_, err := io.Copy(a, b)
+		done <- result{a, err}
+	}()
+	go func() {
+		_, err := io.Copy(b, a)
+		done <- result{b, err}
+	}()
+	r := <-done
+	if cw, ok := r.dst.(interface{ CloseWrite() error }); ok && r.err == nil {
+		cw.CloseWrite()
+		select {
+		case <-done:
+		case <-time.After(endpointLinger):
+		}
+	}
+	a.Close()
+	b.Close()
+	if errors.Is(r.err, net.ErrClosed) || errors.Is(r.err, os.ErrClosed) {
+		return nil
+	}
+	return r.err
+}
+
+// runEndpoints bridges the two socat style addresses first and second.
+func runEndpoints(first, second string) error {
+	a, err := parseEndpoint(first)
+	if err != nil {
+		return err
+	}
+	b, err := parseEndpoint(second)
+	if err != nil {
+		return err
+	}
+
+	if a.forks() {
+		l, err := a.listen()
+		if err != nil {
+			return err
+		}
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return err
+			}
+			stdLogger.Info("connected", "addr", conn.RemoteAddr())
+			go func() {
+				other, err := b.open()
+				if err != nil {
+					stdLogger.Error("open error", "address", second, "err", err)
+					conn.Close()
+					return
+				}
+				if err := relayEndpoints(conn, other); err != nil {
+					stdLogger.Warn("relay error", "addr", conn.RemoteAddr(), "err", err)
+				}
+				stdLogger.Info("disconnected", "addr", conn.RemoteAddr())
+			}()
+		}
+	}
+
+	ra, err := a.open()
+	if err != nil {
+		return fmt.Errorf("%v: %w", first, err)
+	}
+	rb, err := b.open()
+	if err != nil {
+		ra.Close()
+		return fmt.Errorf("%v: %w", second, err)
+	}
+	done := make(chan struct{})
+	defer close(done)
+	go followLine(ra, rb, done)
+	go followLine(rb, ra, done)
+	// closing ends the relay, so that a pty link is removed
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-stop
+		ra.Close()
+		rb.Close()
+	}()
+	return relayEndpoints(ra, rb)
+}
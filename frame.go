@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"io"
+	"time"
+)
+
+// chunkReader reads src in the background, so that what it reads next can
+// be waited for with a timeout.
+type chunkReader struct {
+	chunks chan []byte
+	done   chan struct{}
+	err    error
+}
+
+func newChunkReader(ctx context.Context, src io.Reader) *chunkReader {
+	r := &chunkReader{chunks: make(chan []byte, 16), done: make(chan struct{})}
+	go r.readLoop(ctx, src)
+	return r
+}
+
+func (r *chunkReader) readLoop(ctx context.Context, src io.Reader) {
+	defer close(r.done)
+	defer close(r.chunks)
+	for {
+		buf := make([]byte, 4096)
+		n, err := src.Read(buf)
+		if n > 0 {
+			select {
+			case r.chunks <- buf[:n]:
+			case <-ctx.Done():
+				r.err = ctx.Err()
+				return
+			}
+		}
+		if err != nil {
+			r.err = err
+			return
+		}
+	}
+}
+
+// next returns what src read next, or nil once timeout has passed. With a
+// zero timeout it waits as long as it takes.
+func (r *chunkReader) next(timeout time.Duration) ([]byte, error) {
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+	select {
+	case chunk, ok := <-r.chunks:
+		if !ok {
+			return nil, r.err
+		}
+		return chunk, nil
+	case <-expired:
+		return nil, nil
+	}
+}
+
+// discard drops what was read and not asked for yet.
+func (r *chunkReader) discard() {
+	for {
+		select {
+		case _, ok := <-r.chunks:
+			if !ok {
+				return
+			}
+		default:
+			return
+		}
+	}
+}
+
+// wait returns the error that stopped the reading.
+func (r *chunkReader) wait() error {
+	<-r.done
+	return r.err
+}
+
+// gapFramer cuts what the serial port sends into frames at the pauses of
+// at least gap, see -frame-gap. Every Read returns one frame, or as much of
+// it as fits.
+type gapFramer struct {
+	Conn
+	gap     time.Duration
+	rx      *chunkReader
+	pending []byte
+}
+
+func newGapFramer(ctx context.Context, src Conn, gap time.Duration) *gapFramer {
+	return &gapFramer{Conn: src, gap: gap, rx: newChunkReader(ctx, src)}
+}
+
+func (f *gapFramer) Read(b []byte) (int, error) {
+	if len(f.pending) == 0 {
+		chunk, err := f.rx.next(0)
+		if chunk == nil {
+			return 0, err
+		}
+		f.pending = chunk
+	}
+	n := 0
+	for {
+		c := copy(b[n:], f.pending)
+		n += c
+		f.pending = f.pending[c:]
+		if n == len(b) {
+			return n, nil
+		}
+		// the error, if any, comes with the next Read
+		chunk, _ := f.rx.next(f.gap)
+		if chunk == nil {
+			return n, nil
+		}
+		f.pending = chunk
+	}
+}
@@ -0,0 +1,621 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+	"sync/atomic"
+)
+
+// the -framing names
+const (
+	framingLine   = "line"
+	framingLength = "length"
+	framingSTX    = "stx"
+	framingCOBS   = "cobs"
+	framingHex    = "hex"
+	framingBase64 = "base64"
+)
+
+// newFramer wraps dst, the writer for what the serial port sends, into the
+// -framing of conf, without one dst is returned as it is.
+func (b *bridge) newFramer(conf *bridgeConfig, dst io.Writer) io.Writer {
+	count := &b.frames.fromSerial
+	switch conf.Framing {
+	case framingLine:
+		delim, _ := unescape(conf.LineDelimiter)
+		return newLineWriter(dst, delim, conf.BufferSize, count)
+	case framingLength:
+		return &lengthWriter{dst: dst, size: conf.LengthSize, count: count}
+	case framingSTX:
+		return newSTXWriter(conf, dst, b.logger, count)
+	case framingCOBS:
+		return &cobsWriter{dst: dst, max: conf.COBSMax, count: count}
+	case framingHex:
+		return &textWriter{dst: dst, encode: encodeHexLine, count: count}
+	case framingBase64:
+		return &textWriter{dst: dst, encode: encodeBase64Line, count: count}
+	}
+	return dst
+}
+
+// newDeframer wraps dst, the writer for what a client sends to the serial
+// port, into the -framing of conf, without one dst is returned as it is.
+// Its state belongs to one client.
+func (b *bridge) newDeframer(conf *bridgeConfig, dst io.Writer) io.Writer {
+	count := &b.frames.toSerial
+	switch conf.Framing {
+	case framingLine:
+		if conf.LineInput {
+			delim, _ := unescape(conf.LineDelimiter)
+			return newLineWriter(dst, delim, conf.BufferSize, count)
+		}
+	case framingLength:
+		return &lengthReader{dst: dst, size: conf.LengthSize, max: conf.BufferSize, logger: b.logger, count: count}
+	case framingSTX:
+		return newSTXWriter(conf, dst, b.logger, count)
+	case framingCOBS:
+		return &cobsReader{dst: dst, max: conf.COBSMax, logger: b.logger, count: count}
+	case framingHex:
+		return &textReader{dst: dst, decode: parseHexLine, name: conf.Framing,
+			max: hexLineSize(conf.BufferSize), logger: b.logger, count: count}
+	case framingBase64:
+		return &textReader{dst: dst, decode: parseBase64Line, name: conf.Framing,
+			max: base64.StdEncoding.EncodedLen(conf.BufferSize) + 1, logger: b.logger, count: count}
+	}
+	return dst
+}
+
+// partialFrame is a deframer that can tell what it holds of an unfinished
+// frame, which is dropped when its client goes.
+type partialFrame interface {
+	buffered() int
+}
+
+// lineWriter passes on whole lines, up to and with the delimiter, one per
+// Write to dst, see -framing line. A line longer than max is passed on as
+// far as it came.
+type lineWriter struct {
+	dst     io.Writer
+	delim   []byte
+	max     int
+	count   *frameCount
+	pending []byte
+}
+
+func newLineWriter(dst io.Writer, delim []byte, max int, count *frameCount) *lineWriter {
+	return &lineWriter{dst: dst, delim: delim, max: max, count: count}
+}
+
+func (w *lineWriter) Write(b []byte) (int, error) {
+	// a delimiter may have started at the end of the last Write
+	from := len(w.pending) - len(w.delim) + 1
+	if from < 0 {
+		from = 0
+	}
+	w.pending = append(w.pending, b...)
+	for {
+		i := bytes.Index(w.pending[from:], w.delim)
+		if i < 0 {
+			break
+		}
+		end := from + i + len(w.delim)
+		line := w.pending[:end:end]
+		w.pending = w.pending[end:]
+		from = 0
+		w.count.passed()
+		if _, err := w.dst.Write(line); err != nil {
+			return len(b), err
+		}
+	}
+	if len(w.pending) >= w.max {
+		line := w.pending
+		w.pending = nil
+		w.count.passed()
+		if _, err := w.dst.Write(line); err != nil {
+			return len(b), err
+		}
+	}
+	return len(b), nil
+}
+
+// buffered is how many bytes of an unfinished line wait for the rest.
+func (w *lineWriter) buffered() int {
+	return len(w.pending)
+}
+
+// lengthWriter puts a big endian length of size bytes, 2 or 4, in front of
+// every Write to dst, see -framing length. What doesn't fit in the 2 byte
+// length goes in several frames.
+type lengthWriter struct {
+	dst   io.Writer
+	size  int
+	count *frameCount
+}
+
+func (w *lengthWriter) Write(b []byte) (int, error) {
+	n := len(b)
+	for len(b) > 0 {
+		chunk := b
+		if w.size == 2 && len(chunk) > 0xffff {
+			chunk = chunk[:0xffff]
+		}
+		b = b[len(chunk):]
+		out := make([]byte, w.size, w.size+len(chunk))
+		if w.size == 2 {
+			binary.BigEndian.PutUint16(out, uint16(len(chunk)))
+		} else {
+			binary.BigEndian.PutUint32(out, uint32(len(chunk)))
+		}
+		w.count.passed()
+		if _, err := w.dst.Write(append(out, chunk...)); err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// lengthReader takes the frames of lengthWriter apart and writes every
+// payload to dst whole. A frame longer than max is skipped, empty ones
+// are ignored.
+type lengthReader struct {
+	dst    io.Writer
+	size   int
+	max    int
+	logger *Logger
+	count  *frameCount
+
+	head []byte
+	// want is what is left of the payload after head, it's 64 bits for the
+	// 4 byte lengths on 32 bit systems, skip is set when it is dropped
+	want    int64
+	skip    bool
+	pending []byte
+}
+
+func (r *lengthReader) Write(b []byte) (int, error) {
+	n := len(b)
+	for len(b) > 0 {
+		if len(r.head) < r.size {
+			c := r.size - len(r.head)
+			if c > len(b) {
+				c = len(b)
+			}
+			r.head = append(r.head, b[:c]...)
+			b = b[c:]
+			if len(r.head) < r.size {
+				break
+			}
+			if r.size == 2 {
+				r.want = int64(binary.BigEndian.Uint16(r.head))
+			} else {
+				r.want = int64(binary.BigEndian.Uint32(r.head))
+			}
+			if r.skip = r.want > int64(r.max); r.skip {
+				r.count.dropped()
+				r.logger.Debug("length frame too long, skipped", "bytes", r.want)
+			}
+		}
+		c := len(b)
+		if r.want < int64(c) {
+			c = int(r.want)
+		}
+		if !r.skip {
+			r.pending = append(r.pending, b[:c]...)
+		}
+		b = b[c:]
+		if r.want -= int64(c); r.want > 0 {
+			break
+		}
+		frame := r.pending
+		r.head, r.pending = r.head[:0], nil
+		if len(frame) == 0 {
+			continue
+		}
+		r.count.passed()
+		if _, err := r.dst.Write(frame); err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+func (r *lengthReader) buffered() int {
+	return len(r.head) + len(r.pending)
+}
+
+// stxWriter passes on whole frames, from the start byte to the end byte
+// and the -stx-trailer bytes after it, one per Write to dst, see -framing
+// stx. In a frame the escape byte goes before a data byte that is one of
+// the three, a frame with another escape, a second start or more than max
+// bytes is dropped, and so is what comes between the frames.
+type stxWriter struct {
+	dst        io.Writer
+	logger     *Logger
+	count      *frameCount
+	start, end byte
+	// escape is empty without escaping
+	escape  []byte
+	trailer int
+	max     int
+
+	pending []byte
+	// inFrame is set once the start of pending came, escaped after an
+	// escape byte, tail counts down the trailer
+	inFrame bool
+	escaped bool
+	tail    int
+	// junk is what came between the frames since it was last logged
+	junk int
+}
+
+func newSTXWriter(conf *bridgeConfig, dst io.Writer, logger *Logger, count *frameCount) *stxWriter {
+	start, _ := unescape(conf.STXStart)
+	end, _ := unescape(conf.STXEnd)
+	escape, _ := unescape(conf.STXEscape)
+	return &stxWriter{dst: dst, logger: logger, count: count, start: start[0], end: end[0],
+		escape: escape, trailer: conf.STXTrailer, max: conf.BufferSize}
+}
+
+func (w *stxWriter) Write(b []byte) (int, error) {
+	for _, ch := range b {
+		switch {
+		case w.tail > 0:
+			w.pending = append(w.pending, ch)
+			if w.tail--; w.tail == 0 {
+				if err := w.flush(); err != nil {
+					return len(b), err
+				}
+			}
+		case !w.inFrame:
+			if ch != w.start {
+				w.junk++
+				continue
+			}
+			if w.junk > 0 {
+				w.logger.Debug("stx bytes between frames dropped", "bytes", w.junk)
+				w.junk = 0
+			}
+			w.pending, w.inFrame = append(w.pending[:0], ch), true
+		case w.escaped:
+			w.escaped = false
+			if ch != w.start && ch != w.end && !w.isEscape(ch) {
+				w.drop("bad escape")
+				continue
+			}
+			w.pending = append(w.pending, ch)
+		case w.isEscape(ch):
+			w.pending = append(w.pending, ch)
+			w.escaped = true
+		case ch == w.start:
+			w.count.dropped()
+			w.logger.Debug("stx frame dropped", "why", "start in frame", "bytes", len(w.pending))
+			w.pending = append(w.pending[:0], ch)
+		case ch == w.end:
+			w.pending = append(w.pending, ch)
+			if w.tail = w.trailer; w.tail == 0 {
+				if err := w.flush(); err != nil {
+					return len(b), err
+				}
+			}
+		default:
+			w.pending = append(w.pending, ch)
+		}
+		if w.inFrame && len(w.pending) > w.max {
+			w.drop("too long")
+		}
+	}
+	return len(b), nil
+}
+
+func (w *stxWriter) isEscape(ch byte) bool {
+	return len(w.escape) > 0 && ch == w.escape[0]
+}
+
+// flush writes the frame in pending.
+func (w *stxWriter) flush() error {
+	frame := w.pending
+	w.pending, w.inFrame = nil, false
+	w.count.passed()
+	_, err := w.dst.Write(frame)
+	return err
+}
+
+func (w *stxWriter) drop(why string) {
+	w.count.dropped()
+	w.logger.Debug("stx frame dropped", "why", why, "bytes", len(w.pending))
+	w.pending, w.inFrame, w.escaped, w.tail = w.pending[:0], false, false, 0
+}
+
+func (w *stxWriter) buffered() int {
+	return len(w.pending)
+}
+
+// frameCount counts the frames of one direction that a -framing passed
+// on and those it dropped, for the management API.
+type frameCount struct {
+	frames uint64
+	errors uint64
+}
+
+func (c *frameCount) passed() {
+	atomic.AddUint64(&c.frames, 1)
+}
+
+func (c *frameCount) dropped() {
+	atomic.AddUint64(&c.errors, 1)
+}
+
+func (c *frameCount) load() (frames, errors uint64) {
+	return atomic.LoadUint64(&c.frames), atomic.LoadUint64(&c.errors)
+}
+
+// frameStats are the frame counts of a bridge. It has an allocation of its
+// own, which the atomics of 32-bit platforms find 64-bit aligned.
+type frameStats struct {
+	fromSerial frameCount
+	toSerial   frameCount
+}
+
+// cobsWriter sends every Write to dst as a COBS frame and its 0x00, see
+// -framing cobs. What is longer than max goes in several frames.
+type cobsWriter struct {
+	dst   io.Writer
+	max   int
+	count *frameCount
+}
+
+func (w *cobsWriter) Write(b []byte) (int, error) {
+	n := len(b)
+	for len(b) > 0 {
+		chunk := b
+		if len(chunk) > w.max {
+			chunk = chunk[:w.max]
+		}
+		b = b[len(chunk):]
+		w.count.passed()
+		if _, err := w.dst.Write(append(cobsEncode(chunk), 0)); err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// cobsReader decodes the COBS frames a client sends, each ends with a 0x00,
+// and writes each one to dst whole. A frame that doesn't decode or is
+// longer than max is dropped, empty ones are ignored.
+type cobsReader struct {
+	dst    io.Writer
+	max    int
+	logger *Logger
+	count  *frameCount
+
+	pending []byte
+	// skip is set when the frame in pending got too long, the rest of it
+	// up to the 0x00 is dropped too
+	skip bool
+}
+
+func (r *cobsReader) Write(b []byte) (int, error) {
+	n := len(b)
+	for len(b) > 0 {
+		i := bytes.IndexByte(b, 0)
+		if i < 0 {
+			r.add(b)
+			break
+		}
+		r.add(b[:i])
+		b = b[i+1:]
+		frame, skip := r.pending, r.skip
+		r.pending, r.skip = nil, false
+		if skip || len(frame) == 0 {
+			continue
+		}
+		data, ok := cobsDecode(frame)
+		if !ok || len(data) > r.max {
+			r.count.dropped()
+			r.logger.Debug("cobs frame dropped", "bytes", len(frame))
+			continue
+		}
+		r.count.passed()
+		if _, err := r.dst.Write(data); err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// add keeps b for the frame in pending. The encoding takes at most one
+// byte for every 254, more than that can't decode to max bytes.
+func (r *cobsReader) add(b []byte) {
+	if r.skip {
+		return
+	}
+	r.pending = append(r.pending, b...)
+	if len(r.pending) > r.max+r.max/254+1 {
+		r.count.dropped()
+		r.logger.Debug("cobs frame dropped", "bytes", len(r.pending))
+		r.pending, r.skip = nil, true
+	}
+}
+
+func (r *cobsReader) buffered() int {
+	return len(r.pending)
+}
+
+// cobsEncode returns b with its zeros taken out by COBS, without the 0x00
+// after it.
+func cobsEncode(b []byte) []byte {
+	out := make([]byte, 1, len(b)+len(b)/254+2)
+	code, at := byte(1), 0
+	for i, ch := range b {
+		if ch != 0 {
+			out = append(out, ch)
+			code++
+		}
+		// a full block at the end needs no empty one after it
+		if ch == 0 || (code == 0xff && i < len(b)-1) {
+			out[at] = code
+			code, at = 1, len(out)
+			out = append(out, 0)
+		}
+	}
+	out[at] = code
+	return out
+}
+
+// cobsDecode undoes cobsEncode, it reports whether b was valid COBS.
+func cobsDecode(b []byte) ([]byte, bool) {
+	out := make([]byte, 0, len(b))
+	for i := 0; i < len(b); {
+		code := int(b[i])
+		if code == 0 || i+code > len(b) {
+			return nil, false
+		}
+		out = append(out, b[i+1:i+code]...)
+		if i += code; code < 0xff && i < len(b) {
+			out = append(out, 0)
+		}
+	}
+	return out, true
+}
+
+// textWriter writes every Write to dst as a line of text, see -framing hex
+// and base64.
+type textWriter struct {
+	dst    io.Writer
+	encode func([]byte) []byte
+	count  *frameCount
+}
+
+func (w *textWriter) Write(b []byte) (int, error) {
+	if len(b) == 0 {
+		return 0, nil
+	}
+	w.count.passed()
+	if _, err := w.dst.Write(append(w.encode(b), '\n')); err != nil {
+		return len(b), err
+	}
+	return len(b), nil
+}
+
+// textReader turns the lines of text a client sends into bytes and writes
+// each line to dst at once. A line that doesn't decode or is longer than
+// max is dropped, empty ones are ignored.
+type textReader struct {
+	dst    io.Writer
+	decode func([]byte) ([]byte, error)
+	// name is the -framing, for the log
+	name   string
+	max    int
+	logger *Logger
+	count  *frameCount
+
+	pending []byte
+	// skip is set when the line in pending got too long
+	skip bool
+}
+
+func (r *textReader) Write(b []byte) (int, error) {
+	n := len(b)
+	for len(b) > 0 {
+		i := bytes.IndexByte(b, '\n')
+		if i < 0 {
+			r.add(b)
+			break
+		}
+		r.add(b[:i])
+		b = b[i+1:]
+		line, skip := r.pending, r.skip
+		r.pending, r.skip = nil, false
+		if skip {
+			continue
+		}
+		data, err := r.decode(line)
+		if err != nil {
+			r.count.dropped()
+			r.logger.Debug(r.name+" line dropped", "line", string(line), "err", err)
+			continue
+		}
+		if len(data) == 0 {
+			continue
+		}
+		r.count.passed()
+		if _, err := r.dst.Write(data); err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+func (r *textReader) add(b []byte) {
+	if r.skip {
+		return
+	}
+	r.pending = append(r.pending, b...)
+	if len(r.pending) > r.max {
+		r.count.dropped()
+		r.logger.Debug(r.name+" line dropped", "bytes", len(r.pending))
+		r.pending, r.skip = nil, true
+	}
+}
+
+func (r *textReader) buffered() int {
+	return len(r.pending)
+}
+
+// hexLineSize is how long a line of -framing hex with n bytes gets.
+func hexLineSize(n int) int {
+	return 3 * n
+}
+
+const hexDigits = "0123456789ABCDEF"
+
+// encodeHexLine writes b as 3A 01 04.
+func encodeHexLine(b []byte) []byte {
+	line := make([]byte, 0, hexLineSize(len(b)))
+	for i, ch := range b {
+		if i > 0 {
+			line = append(line, ' ')
+		}
+		line = append(line, hexDigits[ch>>4], hexDigits[ch&0x0f])
+	}
+	return line
+}
+
+// parseHexLine reads 3A 01 04, 3a0104 or 0x3A 0x01 0x04.
+func parseHexLine(line []byte) ([]byte, error) {
+	var out []byte
+	for _, field := range bytes.Fields(line) {
+		if len(field) > 2 && field[0] == '0' && (field[1] == 'x' || field[1] == 'X') {
+			field = field[2:]
+		}
+		data := make([]byte, hex.DecodedLen(len(field)))
+		if _, err := hex.Decode(data, field); err != nil {
+			return nil, err
+		}
+		out = append(out, data...)
+	}
+	return out, nil
+}
+
+func encodeBase64Line(b []byte) []byte {
+	line := make([]byte, base64.StdEncoding.EncodedLen(len(b)))
+	base64.StdEncoding.Encode(line, b)
+	return line
+}
+
+// parseBase64Line reads a line of standard base64, the padding may be left
+// out.
+func parseBase64Line(line []byte) ([]byte, error) {
+	line = bytes.TrimSpace(line)
+	enc := base64.StdEncoding
+	if len(line)%4 != 0 {
+		enc = base64.RawStdEncoding
+	}
+	data := make([]byte, enc.DecodedLen(len(line)))
+	n, err := enc.Decode(data, line)
+	return data[:n], err
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+// run is n bytes counting up from first.
+func run(first byte, n int) []byte {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = first + byte(i)
+	}
+	return b
+}
+
+func join(parts ...[]byte) []byte {
+	return bytes.Join(parts, nil)
+}
+
+func TestCOBS(t *testing.T) {
+	tests := []struct {
+		name      string
+		data, enc []byte
+	}{
+		{"zero", []byte{0x00}, []byte{0x01, 0x01}},
+		{"two zeros", []byte{0x00, 0x00}, []byte{0x01, 0x01, 0x01}},
+		{"zero in the middle", []byte{0x11, 0x22, 0x00, 0x33}, []byte{0x03, 0x11, 0x22, 0x02, 0x33}},
+		{"no zero", []byte{0x11, 0x22, 0x33, 0x44}, []byte{0x05, 0x11, 0x22, 0x33, 0x44}},
+		{"trailing zeros", []byte{0x11, 0x00, 0x00, 0x00}, []byte{0x02, 0x11, 0x01, 0x01, 0x01}},
+		{"254 non-zero", run(0x01, 254), join([]byte{0xff}, run(0x01, 254))},
+		{"zero and 254 non-zero", join([]byte{0x00}, run(0x01, 254)), join([]byte{0x01, 0xff}, run(0x01, 254))},
+		{"255 non-zero", run(0x01, 255), join([]byte{0xff}, run(0x01, 254), []byte{0x02, 0xff})},
+		{"254 non-zero and a zero", join(run(0x02, 254), []byte{0x00}), join([]byte{0xff}, run(0x02, 254), []byte{0x01, 0x01})},
+		{"253 non-zero, a zero and one", join(run(0x03, 253), []byte{0x00, 0x01}), join([]byte{0xfe}, run(0x03, 253), []byte{0x02, 0x01})},
+	}
+	for _, tt := range tests {
+		if got := cobsEncode(tt.data); !bytes.Equal(got, tt.enc) {
+			t.Errorf("%v: cobsEncode = % x, want % x", tt.name, got, tt.enc)
+		}
+		got, ok := cobsDecode(tt.enc)
+		if !ok || !bytes.Equal(got, tt.data) {
+			t.Errorf("%v: cobsDecode = % x, %v", tt.name, got, ok)
+		}
+	}
+
+	for _, enc := range [][]byte{{0x03, 0x11}, {0x00, 0x11}, {0x02, 0x11, 0x05}} {
+		if got, ok := cobsDecode(enc); ok {
+			t.Errorf("cobsDecode(% x) = % x, want an error", enc, got)
+		}
+	}
+}
+
+func TestCOBSMax(t *testing.T) {
+	const max = 300
+	var serial bytes.Buffer
+	count := &frameCount{}
+	r := &cobsReader{dst: &serial, max: max, logger: stdLogger, count: count}
+	frames := [][]byte{run(0x01, max), run(0x01, max+1), []byte("ok"), bytes.Repeat([]byte{0x55}, 4*max), []byte("end")}
+	var stream []byte
+	for _, f := range frames {
+		stream = append(append(stream, cobsEncode(f)...), 0)
+	}
+	// an empty frame and a broken one
+	stream = append(stream, 0x00, 0x05, 0x11, 0x00)
+	r.Write(stream)
+	if want := join(frames[0], frames[2], frames[4]); !bytes.Equal(serial.Bytes(), want) {
+		t.Errorf("serial got %v bytes, want %v", serial.Len(), len(want))
+	}
+	if frames, errors := count.load(); frames != 3 || errors != 3 {
+		t.Errorf("counted %v frames and %v errors, want 3 and 3", frames, errors)
+	}
+	if r.buffered() != 0 {
+		t.Errorf("%v bytes left over", r.buffered())
+	}
+
+	var clients bytes.Buffer
+	w := &cobsWriter{dst: &clients, max: max, count: count}
+	data := run(0x01, 2*max+10)
+	w.Write(data)
+	parts := bytes.Split(bytes.TrimSuffix(clients.Bytes(), []byte{0}), []byte{0})
+	if len(parts) != 3 {
+		t.Fatalf("%v frames to the clients, want 3", len(parts))
+	}
+	var got []byte
+	for _, p := range parts {
+		b, ok := cobsDecode(p)
+		if !ok || len(b) > max {
+			t.Errorf("frame of %v bytes, %v", len(b), ok)
+		}
+		got = append(got, b...)
+	}
+	if !bytes.Equal(got, data) {
+		t.Errorf("the clients got % x", got)
+	}
+}
@@ -0,0 +1,413 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	modeGpsd = "gpsd"
+
+	// the gpsd protocol version the clients are told
+	gpsdProtoMajor = 3
+	gpsdProtoMinor = 11
+
+	gpsdTimeFormat = "2006-01-02T15:04:05.000Z"
+	gpsdMaxRequest = 1024
+	knotsToMPS     = 1852.0 / 3600
+)
+
+var (
+	errGpsdRequest = errors.New("gpsd request too long")
+	errGpsdDown    = errors.New("gpsd serial port is down")
+)
+
+// gpsdWatch is what a client asked for with ?WATCH.
+type gpsdWatch struct {
+	Class  string `json:"class"`
+	Enable bool   `json:"enable"`
+	JSON   bool   `json:"json"`
+	NMEA   bool   `json:"nmea"`
+}
+
+type gpsdTPV struct {
+	Class  string   `json:"class"`
+	Device string   `json:"device"`
+	Mode   int      `json:"mode"`
+	Time   string   `json:"time,omitempty"`
+	Lat    *float64 `json:"lat,omitempty"`
+	Lon    *float64 `json:"lon,omitempty"`
+	Alt    *float64 `json:"alt,omitempty"`
+	Speed  *float64 `json:"speed,omitempty"`
+	Track  *float64 `json:"track,omitempty"`
+}
+
+type gpsdSatellite struct {
+	PRN  int     `json:"PRN"`
+	El   float64 `json:"el"`
+	Az   float64 `json:"az"`
+	SS   float64 `json:"ss"`
+	Used bool    `json:"used"`
+}
+
+type gpsdSKY struct {
+	Class      string          `json:"class"`
+	Device     string          `json:"device"`
+	HDOP       *float64        `json:"hdop,omitempty"`
+	VDOP       *float64        `json:"vdop,omitempty"`
+	PDOP       *float64        `json:"pdop,omitempty"`
+	Satellites []gpsdSatellite `json:"satellites"`
+}
+
+// gpsdServer keeps the fix the NMEA sentences of the serial port make up and
+// reports it to the clients that watch it in the JSON of gpsd, see -mode
+// gpsd.
+type gpsdServer struct {
+	clients *hub
+	device  string
+	baud    int
+	started time.Time
+
+	mu       sync.Mutex
+	watchers map[*client]gpsdWatch
+	tpv      gpsdTPV
+	sky      gpsdSKY
+	date     string
+	gsaMode  int
+	used     map[int]bool
+	// sats are the satellites in view by talker, in the GSV group of a
+	// talker that is still coming in
+	sats    map[string][]gpsdSatellite
+	pending map[string][]gpsdSatellite
+}
+
+func newGpsdServer(clients *hub, device string, baud int) *gpsdServer {
+	return &gpsdServer{
+		clients:  clients,
+		device:   device,
+		baud:     baud,
+		started:  time.Now(),
+		watchers: make(map[*client]gpsdWatch),
+		tpv:      gpsdTPV{Class: "TPV", Device: device, Mode: 1},
+		sky:      gpsdSKY{Class: "SKY", Device: device, Satellites: []gpsdSatellite{}},
+		used:     make(map[int]bool),
+		sats:     make(map[string][]gpsdSatellite),
+		pending:  make(map[string][]gpsdSatellite),
+	}
+}
+
+// Write takes one sentence with a good checksum, as nmeaWriter passes them.
+func (g *gpsdServer) Write(b []byte) (int, error) {
+	line := bytes.TrimRight(b, "\r\n")
+	star := bytes.LastIndexByte(line, '*')
+	if star < 0 {
+		return len(b), nil
+	}
+	fields := strings.Split(string(line[1:star]), ",")
+	if len(fields[0]) != 5 {
+		return len(b), nil
+	}
+	talker, kind := fields[0][:2], fields[0][2:]
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	var report interface{}
+	switch kind {
+	case "RMC":
+		report = g.rmc(fields)
+	case "GGA":
+		report = g.gga(fields)
+	case "GSA":
+		g.gsa(fields)
+	case "GSV":
+		report = g.gsv(talker, fields)
+	}
+
+	var msg []byte
+	if report != nil {
+		msg = gpsdJSON(report)
+	}
+	for c, w := range g.watchers {
+		if !w.Enable {
+			continue
+		}
+		if w.NMEA {
+			g.clients.send(c, append([]byte(nil), b...))
+		}
+		if w.JSON && msg != nil {
+			g.clients.send(c, msg)
+		}
+	}
+	return len(b), nil
+}
+
+// rmc: time, status, lat, N/S, lon, E/W, knots, track, date
+func (g *gpsdServer) rmc(f []string) interface{} {
+	if len(f) < 10 {
+		return nil
+	}
+	g.date = f[9]
+	if f[2] != "A" {
+		return g.noFix(gpsdTime(g.date, f[1]))
+	}
+	g.tpv.Time = gpsdTime(g.date, f[1])
+	g.tpv.Lat = nmeaCoord(f[3], f[4])
+	g.tpv.Lon = nmeaCoord(f[5], f[6])
+	if v := nmeaFloat(f[7]); v != nil {
+		*v *= knotsToMPS
+		g.tpv.Speed = v
+	}
+	g.tpv.Track = nmeaFloat(f[8])
+	g.tpv.Mode = g.fixMode(2)
+	return g.tpv
+}
+
+// gga: time, lat, N/S, lon, E/W, quality, satellites, hdop, altitude
+func (g *gpsdServer) gga(f []string) interface{} {
+	if len(f) < 10 {
+		return nil
+	}
+	if f[6] == "0" || f[6] == "" {
+		return g.noFix(g.tpv.Time)
+	}
+	if g.date != "" {
+		g.tpv.Time = gpsdTime(g.date, f[1])
+	}
+	g.tpv.Lat = nmeaCoord(f[2], f[3])
+	g.tpv.Lon = nmeaCoord(f[4], f[5])
+	g.tpv.Alt = nmeaFloat(f[9])
+	g.sky.HDOP = nmeaFloat(f[8])
+	mode := 2
+	if g.tpv.Alt != nil {
+		mode = 3
+	}
+	g.tpv.Mode = g.fixMode(mode)
+	return g.tpv
+}
+
+// gsa: selection, fix mode, 12 satellites used, pdop, hdop, vdop
+func (g *gpsdServer) gsa(f []string) {
+	if len(f) < 18 {
+		return
+	}
+	g.gsaMode, _ = strconv.Atoi(f[2])
+	g.used = make(map[int]bool)
+	for _, s := range f[3:15] {
+		if prn, err := strconv.Atoi(s); err == nil {
+			g.used[prn] = true
+		}
+	}
+	g.sky.PDOP = nmeaFloat(f[15])
+	g.sky.HDOP = nmeaFloat(f[16])
+	g.sky.VDOP = nmeaFloat(f[17])
+}
+
+// gsv: sentences in the group, this sentence, satellites in view, then
+// prn, elevation, azimuth and snr of up to 4 of them
+func (g *gpsdServer) gsv(talker string, f []string) interface{} {
+	if len(f) < 4 {
+		return nil
+	}
+	total, _ := strconv.Atoi(f[1])
+	num, _ := strconv.Atoi(f[2])
+	if num == 1 {
+		g.pending[talker] = nil
+	}
+	// NMEA 4.1 adds the signal id after the last satellite
+	for i := 4; i+4 <= len(f); i += 4 {
+		prn, err := strconv.Atoi(f[i])
+		if err != nil {
+			continue
+		}
+		sat := gpsdSatellite{PRN: prn}
+		sat.El, _ = strconv.ParseFloat(f[i+1], 64)
+		sat.Az, _ = strconv.ParseFloat(f[i+2], 64)
+		sat.SS, _ = strconv.ParseFloat(f[i+3], 64)
+		g.pending[talker] = append(g.pending[talker], sat)
+	}
+	if num != total {
+		return nil
+	}
+	g.sats[talker] = g.pending[talker]
+	delete(g.pending, talker)
+
+	sats := []gpsdSatellite{}
+	for _, ts := range g.sats {
+		for _, sat := range ts {
+			sat.Used = g.used[sat.PRN]
+			sats = append(sats, sat)
+		}
+	}
+	sort.Slice(sats, func(i, j int) bool { return sats[i].PRN < sats[j].PRN })
+	g.sky.Satellites = sats
+	return g.sky
+}
+
+// noFix forgets the position, the receiver lost it.
+func (g *gpsdServer) noFix(at string) gpsdTPV {
+	g.tpv = gpsdTPV{Class: "TPV", Device: g.device, Mode: 1, Time: at}
+	return g.tpv
+}
+
+// fixMode is the mode of the last GSA, or mode without one.
+func (g *gpsdServer) fixMode(mode int) int {
+	if g.gsaMode >= 1 && g.gsaMode <= 3 {
+		return g.gsaMode
+	}
+	return mode
+}
+
+// gpsdTime joins the ddmmyy date and hhmmss.ss time of the sentences, it
+// is empty when either is missing.
+func gpsdTime(date, clock string) string {
+	if len(date) != 6 || len(clock) < 6 {
+		return ""
+	}
+	t, err := time.Parse("020106150405", date+clock[:6])
+	if err != nil {
+		return ""
+	}
+	if frac, err := strconv.ParseFloat("0"+clock[6:], 64); err == nil {
+		t = t.Add(time.Duration(frac * float64(time.Second)))
+	}
+	return t.Format(gpsdTimeFormat)
+}
+
+// nmeaCoord turns ddmm.mmmm with its hemisphere into degrees.
+func nmeaCoord(v, hemisphere string) *float64 {
+	f := nmeaFloat(v)
+	if f == nil {
+		return nil
+	}
+	deg := math.Floor(*f / 100)
+	*f = deg + (*f-deg*100)/60
+	if hemisphere == "S" || hemisphere == "W" {
+		*f = -*f
+	}
+	return f
+}
+
+func nmeaFloat(v string) *float64 {
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		return nil
+	}
+	return &f
+}
+
+func gpsdJSON(v interface{}) []byte {
+	b, _ := json.Marshal(v)
+	return append(b, '\r', '\n')
+}
+
+func (g *gpsdServer) version() []byte {
+	return gpsdJSON(map[string]interface{}{
+		"class": "VERSION", "release": "tcp2serial", "rev": "tcp2serial",
+		"proto_major": gpsdProtoMajor, "proto_minor": gpsdProtoMinor,
+	})
+}
+
+func (g *gpsdServer) devices() []byte {
+	return gpsdJSON(map[string]interface{}{
+		"class": "DEVICES",
+		"devices": []interface{}{map[string]interface{}{
+			"class": "DEVICE", "path": g.device, "driver": "NMEA0183",
+			"activated": g.started.UTC().Format(gpsdTimeFormat), "bps": g.baud,
+		}},
+	})
+}
+
+// request answers one ?COMMAND of c.
+func (g *gpsdServer) request(c *client, req string) []byte {
+	name, arg := req, ""
+	if i := strings.IndexByte(req, '='); i >= 0 {
+		name, arg = req[:i], req[i+1:]
+	}
+	switch name {
+	case "?VERSION":
+		return g.version()
+	case "?DEVICES":
+		return g.devices()
+	case "?WATCH":
+		g.mu.Lock()
+		w := g.watchers[c]
+		if arg != "" {
+			if err := json.Unmarshal([]byte(arg), &w); err != nil {
+				g.mu.Unlock()
+				return gpsdJSON(map[string]string{"class": "ERROR", "message": "Invalid WATCH: " + err.Error()})
+			}
+		} else {
+			w.Enable = true
+		}
+		if w.Enable && !w.JSON && !w.NMEA {
+			w.JSON = true
+		}
+		w.Class = "WATCH"
+		g.watchers[c] = w
+		g.mu.Unlock()
+		return append(g.devices(), gpsdJSON(w)...)
+	case "?POLL":
+		g.mu.Lock()
+		defer g.mu.Unlock()
+		return gpsdJSON(map[string]interface{}{
+			"class": "POLL", "time": time.Now().UTC().Format(gpsdTimeFormat), "active": 1,
+			"tpv": []gpsdTPV{g.tpv}, "sky": []gpsdSKY{g.sky},
+		})
+	}
+	return gpsdJSON(map[string]string{"class": "ERROR", "message": "Unrecognized request '" + name + "'"})
+}
+
+// serveGpsd answers the requests of c until it goes away, the position
+// reports reach it from Write.
+func (b *bridge) serveGpsd(c *client) error {
+	b.mu.Lock()
+	g := b.gpsd
+	b.mu.Unlock()
+	if g == nil {
+		return errGpsdDown
+	}
+	defer func() {
+		g.mu.Lock()
+		delete(g.watchers, c)
+		g.mu.Unlock()
+	}()
+	if !b.clients.send(c, g.version()) {
+		return io.EOF
+	}
+
+	var pending []byte
+	buf := make([]byte, 512)
+	for {
+		n, err := c.conn.Read(buf)
+		if err != nil {
+			return err
+		}
+		c.stats.add(true, n)
+		pending = append(pending, buf[:n]...)
+		for {
+			i := bytes.IndexAny(pending, ";\n")
+			if i < 0 {
+				break
+			}
+			req := strings.TrimSpace(string(pending[:i]))
+			pending = pending[i+1:]
+			if req == "" {
+				continue
+			}
+			if !b.clients.send(c, g.request(c, req)) {
+				return io.EOF
+			}
+		}
+		if len(pending) > gpsdMaxRequest {
+			return errGpsdRequest
+		}
+	}
+}
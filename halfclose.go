@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"time"
+)
+
+// halfCloser is the connection under conn that can be half closed, nil if
+// there is none, e.g. for a websocket.
+func halfCloser(conn Conn) interface{ CloseWrite() error } {
+	for {
+		switch c := conn.(type) {
+		case interface{ CloseWrite() error }:
+			return c
+		case *telnetConn:
+			conn = c.Conn
+		case *proxyConn:
+			conn = c.Conn
+		default:
+			return nil
+		}
+	}
+}
+
+// lingers reports whether a client that half closed still gets the serial
+// output in mode, the modes that answer the requests themselves are done.
+func lingers(mode string) bool {
+	switch mode {
+	case modeModbusGateway, modeGpsd, modeIEC104, modeELM327:
+		return false
+	}
+	return true
+}
+
+// linger keeps c in the hub after it shut down its sending side, once what
+// it sent is out on the wire, until the serial port was quiet for quiet.
+// The end of a transfer marked with a FIN gets its answer that way.
+func (b *bridge) linger(ctx context.Context, c *client, quiet time.Duration) {
+	if err := b.serial.sync(); err != nil {
+		b.logger.Warn("serial drain error", "addr", c.addr, "err", err)
+	}
+	_, last := c.stats.load()
+	step := quiet / 10
+	for since := time.Now(); time.Since(since) < quiet; {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(step):
+		}
+		if _, from := c.stats.load(); from != last {
+			last, since = from, time.Now()
+		}
+	}
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+type bridgeHealth struct {
+	Name      string `json:"name"`
+	Serial    bool   `json:"serial"`
+	Listening bool   `json:"listening"`
+}
+
+type healthReport struct {
+	Status  string         `json:"status"`
+	Bridges []bridgeHealth `json:"bridges"`
+}
+
+// serveHealth answers /healthz with 200 when every bridge has its serial
+// port open and its listener accepting, 503 otherwise.
+func (s *supervisor) serveHealth(addr string) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		report := healthReport{Status: "ok", Bridges: []bridgeHealth{}}
+		for _, b := range s.list() {
+			serialOpen, listening := b.health()
+			report.Bridges = append(report.Bridges, bridgeHealth{Name: b.conf.Name, Serial: serialOpen, Listening: listening})
+			if !serialOpen || !listening {
+				report.Status = "fail"
+			}
+		}
+		if len(report.Bridges) == 0 {
+			report.Status = "fail"
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if report.Status != "ok" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		json.NewEncoder(w).Encode(report)
+	})
+	return http.ListenAndServe(addr, mux)
+}
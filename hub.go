@@ -0,0 +1,483 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const clientQueueSize = 64
+
+// client is a connected tcp client with its own write queue, so a slow
+// client doesn't hold up the serial port or the other clients.
+type client struct {
+	id    uint64
+	conn  Conn
+	addr  string
+	since time.Time
+	queue chan []byte
+	stats *trafficStats
+	// observer only gets the serial data, what it sends is discarded
+	observer bool
+
+	// record is the transcript of the session, nil without -record
+	record *recorder
+}
+
+// lastClientID numbers the clients for the admin API.
+var lastClientID uint64
+
+func newClient(conn Conn) *client {
+	c := &client{id: atomic.AddUint64(&lastClientID, 1), conn: conn, since: time.Now(), queue: make(chan []byte, clientQueueSize), stats: newTrafficStats()}
+	if tcpConn, ok := conn.(net.Conn); ok {
+		c.addr = tcpConn.RemoteAddr().String()
+	}
+	return c
+}
+
+func (c *client) writeLoop(logger *Logger) {
+	defer c.conn.Close()
+	if c.record != nil {
+		// the last chunks from the serial port are written here
+		defer c.record.Close()
+	}
+	for b := range c.queue {
+		if tcpConn, ok := c.conn.(net.Conn); ok {
+			tcpConn.SetWriteDeadline(time.Now().Add(3 * time.Second))
+		}
+		if _, err := c.conn.Write(b); err != nil {
+			logger.Warn("write error", "addr", c.addr, "err", err)
+			// makes the read side fail too, which removes the client
+			c.conn.Close()
+			return
+		}
+		c.stats.add(false, len(b))
+		if c.record != nil {
+			if err := c.record.write(false, b); err != nil {
+				logger.Warn("record error", "addr", c.addr, "err", err)
+			}
+		}
+	}
+	// the FIN right after the last of the data, before the close
+	if hc := halfCloser(c.conn); hc != nil {
+		hc.CloseWrite()
+	}
+}
+
+// hub is the registry of connected clients. Writing to it broadcasts to
+// all of them.
+type hub struct {
+	mu         sync.Mutex
+	clients    map[*client]struct{}
+	maxClients int
+	takeover   string
+	logger     *Logger
+
+	// controlToken is -control-token, only writer may write then
+	controlToken bool
+	writer       *client
+
+	// replay keeps the last replaySize bytes from the serial port for the
+	// clients that connect, see -replay
+	replaySize int
+	replay     []byte
+	// store keeps the serial data while nobody is connected, nil without
+	// -store
+	store *store
+
+	// writers are the running write loops, for shutdown
+	writers sync.WaitGroup
+}
+
+func newHub(maxClients int, takeover string, logger *Logger) *hub {
+	return &hub{
+		clients:    make(map[*client]struct{}),
+		maxClients: maxClients,
+		takeover:   takeover,
+		logger:     logger,
+	}
+}
+
+// admit adds c to the hub if the -max-clients limit allows it, with
+// -takeover kick the oldest clients are dropped to make room. Observers
+// don't count against the limit.
+func (h *hub) admit(c *client) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for !c.observer && h.maxClients > 0 && h.active() >= h.maxClients {
+		if h.takeover != "kick" {
+			return false
+		}
+		var oldest *client
+		for o := range h.clients {
+			if !o.observer && (oldest == nil || o.since.Before(oldest.since)) {
+				oldest = o
+			}
+		}
+		h.logger.Info("taken over", "addr", oldest.addr, "by", c.addr)
+		h.drop(oldest)
+	}
+	h.clients[c] = struct{}{}
+	// ahead of what the port sends next. What was stored since the last
+	// client left is the end of the replay too, it isn't sent twice.
+	if stored := h.take(); len(stored) > 0 {
+		h.logger.Info("stored data delivered", "addr", c.addr, "bytes", len(stored))
+		c.queue <- stored
+	} else if len(h.replay) > 0 {
+		c.queue <- append([]byte(nil), h.replay...)
+	}
+	if h.controlToken && h.writer == nil && !c.observer {
+		h.setWriter(c)
+	}
+	return true
+}
+
+// drop removes c, its write loop closes the connection once the queue
+// is drained. h.mu must be held.
+func (h *hub) drop(c *client) {
+	if _, ok := h.clients[c]; ok {
+		delete(h.clients, c)
+		close(c.queue)
+	}
+	if h.writer == c {
+		h.setWriter(nil)
+	}
+}
+
+func (h *hub) remove(c *client) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.drop(c)
+}
+
+// list returns the clients, the oldest first.
+func (h *hub) list() []*client {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var cs []*client
+	for c := range h.clients {
+		cs = append(cs, c)
+	}
+	sort.Slice(cs, func(i, j int) bool { return cs[i].since.Before(cs[j].since) })
+	return cs
+}
+
+// disconnect drops the client with the id, it reports whether there was
+// one.
+func (h *hub) disconnect(id uint64) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for c := range h.clients {
+		if c.id == id {
+			h.logger.Info("disconnected by admin", "addr", c.addr)
+			h.drop(c)
+			return true
+		}
+	}
+	return false
+}
+
+func (h *hub) setLimit(maxClients int, takeover string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.maxClients = maxClients
+	h.takeover = takeover
+}
+
+func (h *hub) count() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.clients)
+}
+
+// active is the number of clients that aren't observers. h.mu must be
+// held.
+func (h *hub) active() int {
+	n := 0
+	for c := range h.clients {
+		if !c.observer {
+			n++
+		}
+	}
+	return n
+}
+
+func (h *hub) Write(b []byte) (int, error) {
+	if h.replaySize > 0 || h.store != nil {
+		h.mu.Lock()
+		if h.replaySize > 0 {
+			h.replay = append(h.replay, b...)
+			if len(h.replay) > h.replaySize {
+				h.replay = h.replay[len(h.replay)-h.replaySize:]
+			}
+		}
+		if h.store != nil && len(h.clients) == 0 {
+			h.store.add(b)
+		}
+		h.mu.Unlock()
+	}
+	h.broadcast(nil, b)
+	return len(b), nil
+}
+
+// take empties the store. h.mu must be held.
+func (h *hub) take() []byte {
+	if h.store == nil {
+		return nil
+	}
+	return h.store.take()
+}
+
+// broadcast queues b for all the clients but from.
+func (h *hub) broadcast(from *client, b []byte) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for c := range h.clients {
+		if c == from {
+			continue
+		}
+		buf := make([]byte, len(b))
+		copy(buf, b)
+		select {
+		case c.queue <- buf:
+		default:
+			h.logger.Warn("too slow, disconnecting", "addr", c.addr)
+			h.drop(c)
+		}
+	}
+}
+
+// send queues b for c alone, it reports whether c is still connected.
+func (h *hub) send(c *client, b []byte) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, ok := h.clients[c]; !ok {
+		return false
+	}
+	select {
+	case c.queue <- b:
+	default:
+		h.logger.Warn("too slow, disconnecting", "addr", c.addr)
+		h.drop(c)
+		return false
+	}
+	return true
+}
+
+// closeAll disconnects every client.
+func (h *hub) closeAll() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for c := range h.clients {
+		h.drop(c)
+	}
+}
+
+// serveClient relays what the client sends to the serial port until it
+// goes away. Serial data reaches it through the hub.
+func (b *bridge) serveClient(ctx context.Context, c *client) {
+	h := b.clients
+	conf := b.config()
+	if !b.waitGate(ctx) {
+		c.conn.Close()
+		return
+	}
+	if !c.observer {
+		// after the -close-send of the last session
+		b.closing.Lock()
+		b.closing.Unlock()
+	}
+	if conf.FlushOnConnect && !c.observer {
+		h.mu.Lock()
+		idle := h.active() == 0
+		h.mu.Unlock()
+		// what came while nobody was connected goes
+		if idle {
+			if err := b.serial.Flush(); err != nil {
+				h.logger.Warn("serial flush error", "addr", c.addr, "err", err)
+			}
+		}
+	}
+	if banner := b.banner(c, conf); banner != nil {
+		// c isn't in the hub yet, the banner comes before anything else
+		c.queue <- banner
+	}
+	if !h.admit(c) {
+		h.logger.Warn("rejected, too many clients", "addr", c.addr, "clients", h.count())
+		if conf.Mode == "raw" {
+			b.sendReject(c, conf)
+		}
+		c.conn.Close()
+		return
+	}
+	if conf.Record != "" {
+		record, err := newRecorder(conf.Record, conf.RecordMode, conf.Name, c.addr)
+		if err != nil {
+			// no transcript, no session
+			h.logger.Error("record error", "addr", c.addr, "err", err)
+			h.remove(c)
+			c.conn.Close()
+			b.ended(exitFailed)
+			return
+		}
+		c.record = record
+	}
+	h.writers.Add(1)
+	go func() {
+		defer h.writers.Done()
+		c.writeLoop(h.logger)
+	}()
+	if timeout := conf.idleTimeout(); timeout > 0 {
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		go b.watchIdle(ctx, c, timeout, conf.Mode == "raw")
+	}
+
+	if c.observer {
+		h.logger.Info("observing", "addr", c.addr)
+		b.discardInput(c)
+		h.remove(c)
+		h.logger.Info("disconnected", "addr", c.addr)
+		return
+	}
+
+	if conf.ConnectReset > 0 {
+		pulse := time.Duration(conf.ConnectReset) * time.Millisecond
+		if err := b.serial.pulseDTR(conf.ConnectResetLevel == "on", pulse); err != nil {
+			h.logger.Warn("connect reset error", "addr", c.addr, "err", err)
+		}
+	}
+	if conf.InitSend != "" {
+		data, _ := unescape(conf.InitSend)
+		if _, err := b.serial.Write(data); err != nil {
+			h.logger.Warn("init send error", "addr", c.addr, "err", err)
+		}
+	}
+
+	// the first client gets the modem dialled, the others share the call
+	h.mu.Lock()
+	first := h.active() == 1
+	h.mu.Unlock()
+	if conf.Chat != "" && first {
+		script, _ := parseChat(conf.Chat)
+		if err := b.runChat(ctx, script, time.Duration(conf.ChatTimeout)*time.Second); err != nil {
+			h.logger.Warn("chat error", "addr", c.addr, "err", err)
+			h.remove(c)
+			b.ended(exitSerial)
+			return
+		}
+		h.logger.Info("chat done", "addr", c.addr)
+	}
+
+	interval := time.Duration(conf.Stats) * time.Second
+	if interval > 0 {
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		go c.stats.report(ctx, h.logger.with("addr", c.addr), "session stats", interval)
+	}
+	relayCtx, relaySpan := startSpan(ctx, "relay", spanKindInternal, "net.peer.address", c.addr)
+	var err error
+	switch conf.Mode {
+	case modeModbusGateway:
+		err = b.serveModbus(c)
+	case modeGpsd:
+		err = b.serveGpsd(c)
+	case modeIEC104:
+		err = b.serveIEC104(c)
+	case modeELM327:
+		err = b.serveELM327(c)
+	case modeNMEA:
+		err = b.connRelay(relayCtx, c.conn, newNMEAWriter(nmeaInjector{b, c}, h.logger), c)
+	case modeKISS, modeSlip:
+		err = b.connRelay(relayCtx, c.conn, newKISSWriter(b.serial, h.logger), c)
+	case modeSlcan:
+		b.mu.Lock()
+		slcan := b.slcan
+		b.mu.Unlock()
+		err = b.connRelay(relayCtx, c.conn, &canTextWriter{a: slcan}, c)
+	default:
+		framed := b.newDeframer(&conf, b.serial)
+		dst := framed
+		if conf.ControlToken {
+			dst = &controlWriter{h: h, c: c, dst: framed}
+		}
+		err = b.connRelay(relayCtx, c.conn, dst, c)
+		if p, ok := framed.(partialFrame); ok && p.buffered() > 0 {
+			h.logger.Debug("unfinished frame dropped", "addr", c.addr, "bytes", p.buffered())
+		}
+	}
+	to, from := c.stats.load()
+	relaySpan.setAttributes("to_serial_bytes", to, "from_serial_bytes", from)
+	if err == io.EOF && conf.Linger > 0 && lingers(conf.Mode) && halfCloser(c.conn) != nil {
+		h.logger.Info("half closed", "addr", c.addr)
+		b.linger(ctx, c, time.Duration(conf.Linger)*time.Millisecond)
+	}
+	relaySpan.end(spanError(ctx, err))
+	h.remove(c)
+	h.logger.Info("disconnected", "addr", c.addr)
+	if interval > 0 {
+		c.stats.summary(h.logger.with("addr", c.addr), "session summary")
+	}
+	if conf.CloseSend != "" {
+		b.sendClose(conf)
+	}
+	b.ended(b.sessionCode(err))
+}
+
+// sendReject tells a client turned away by -max-clients why, with
+// -reject-message or the default.
+func (b *bridge) sendReject(c *client, conf bridgeConfig) {
+	msg := []byte(fmt.Sprintf("\r\n[tcp2serial: busy, client limit %v reached]\r\n", conf.MaxClients))
+	if conf.RejectMessage != "" {
+		msg, _ = unescape(conf.RejectMessage)
+	}
+	if tcpConn, ok := c.conn.(net.Conn); ok {
+		tcpConn.SetWriteDeadline(time.Now().Add(3 * time.Second))
+	}
+	if _, err := c.conn.Write(msg); err != nil {
+		b.logger.Info("reject message error", "addr", c.addr, "err", err)
+	}
+}
+
+// sendClose writes -close-send once the last client is gone and waits
+// until it is out and -close-delay passed.
+func (b *bridge) sendClose(conf bridgeConfig) {
+	b.closing.Lock()
+	defer b.closing.Unlock()
+	h := b.clients
+	h.mu.Lock()
+	last := h.active() == 0
+	h.mu.Unlock()
+	if !last {
+		return
+	}
+	data, _ := unescape(conf.CloseSend)
+	if _, err := b.serial.Write(data); err != nil {
+		h.logger.Warn("close send error", "err", err)
+		return
+	}
+	if err := b.serial.drain(len(data)); err != nil {
+		h.logger.Warn("serial drain error", "err", err)
+	}
+	time.Sleep(time.Duration(conf.CloseDelay) * time.Millisecond)
+}
+
+// discardInput reads what an observer sends until it goes away, the bytes
+// are logged and dropped.
+func (b *bridge) discardInput(c *client) {
+	buf := make([]byte, 1024)
+	for {
+		n, err := c.conn.Read(buf)
+		if n > 0 {
+			b.logger.Info("observer input discarded", "addr", c.addr, "bytes", n, "data", buf[:n])
+		}
+		if err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"time"
+)
+
+// idleCheck is how often at most the traffic of a client is looked at
+// for -idle-timeout.
+const idleCheck = time.Second
+
+// watchIdle disconnects c once it has neither sent nor received anything
+// for timeout, until ctx is done. With notify it is told why first.
+func (b *bridge) watchIdle(ctx context.Context, c *client, timeout time.Duration, notify bool) {
+	check := timeout / 4
+	if check > idleCheck {
+		check = idleCheck
+	}
+	ticker := time.NewTicker(check)
+	defer ticker.Stop()
+
+	lastTo, lastFrom := c.stats.load()
+	active := time.Now()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			to, from := c.stats.load()
+			if to != lastTo || from != lastFrom {
+				lastTo, lastFrom, active = to, from, now
+				continue
+			}
+			if now.Sub(active) < timeout {
+				continue
+			}
+		}
+		b.logger.Info("idle timeout", "addr", c.addr, "idle", timeout)
+		h := b.clients
+		h.mu.Lock()
+		if notify {
+			h.notice(c, "tcp2serial: idle for %v, disconnecting", timeout)
+		}
+		h.drop(c)
+		h.mu.Unlock()
+		return
+	}
+}
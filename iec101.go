@@ -0,0 +1,480 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	modeIEC104 = "iec104"
+
+	// the FT 1.2 frames of IEC 60870-5-101
+	ft12Ack   = 0xe5
+	ft12Fixed = 0x10
+	ft12Var   = 0x68
+	ft12End   = 0x16
+
+	// the control field, DIR is set on the frames of the controlling
+	// station, which the gateway is
+	iecDIR = 0x80
+	iecPRM = 0x40
+	iecFCB = 0x20
+	iecFCV = 0x10
+
+	// the primary functions of the balanced link
+	iecResetLink   = 0
+	iecResetUser   = 1
+	iecTestLink    = 2
+	iecUserData    = 3
+	iecUserNoReply = 4
+	iecLinkStatus  = 9
+	// the secondary functions
+	iecAck     = 0
+	iecNack    = 1
+	iecStatus  = 11
+	iecNotImpl = 15
+
+	iec101Retries = 3
+	// how often an idle link is tested
+	iec101TestInterval = 15 * time.Second
+	// how many of the clients' ASDUs wait for the link
+	iec101Queue = 32
+)
+
+var (
+	errIEC101Timeout = errors.New("iec101 station doesn't answer")
+	errASDU          = errors.New("bad asdu")
+)
+
+// asduSizes are the octets of the cause of transmission, the common
+// address and the information object address of an ASDU.
+type asduSizes struct {
+	cot, ca, ioa int
+}
+
+// iec104Sizes are fixed by IEC 60870-5-104.
+var iec104Sizes = asduSizes{cot: 2, ca: 2, ioa: 3}
+
+// iecElementSizes are the octets of one information element, without the
+// address, of the ASDU types the gateway converts.
+var iecElementSizes = map[byte]int{
+	1: 1, 2: 4, 3: 1, 4: 4, 5: 2, 6: 5, 7: 5, 8: 8, 9: 3, 10: 6,
+	11: 3, 12: 6, 13: 5, 14: 8, 15: 5, 16: 8, 17: 6, 18: 7, 19: 7, 20: 5,
+	21: 2, 30: 8, 31: 8, 32: 9, 33: 12, 34: 10, 35: 10, 36: 12, 37: 12, 38: 10,
+	39: 11, 40: 11, 45: 1, 46: 1, 47: 1, 48: 3, 49: 3, 50: 5, 51: 4, 58: 8,
+	59: 8, 60: 8, 61: 10, 62: 10, 63: 12, 64: 11, 70: 1, 100: 1, 101: 1, 102: 0,
+	103: 7, 104: 2, 105: 1, 106: 2, 107: 9, 110: 3, 111: 3, 112: 5, 113: 1,
+}
+
+// parseIEC101Sizes parses -iec101-sizes, the octets of the link address,
+// the cause of transmission, the common address and the information
+// object address, e.g. 1:1:1:2.
+func parseIEC101Sizes(s string) (link int, sizes asduSizes, err error) {
+	parts := strings.Split(s, ":")
+	if len(parts) != 4 {
+		return 0, sizes, fmt.Errorf("invalid iec101 sizes: %v", s)
+	}
+	var n [4]int
+	for i, p := range parts {
+		if n[i], err = strconv.Atoi(p); err != nil {
+			return 0, sizes, fmt.Errorf("invalid iec101 sizes: %v", s)
+		}
+	}
+	if n[0] < 0 || n[0] > 2 || n[1] < 1 || n[1] > 2 || n[2] < 1 || n[2] > 2 || n[3] < 1 || n[3] > 3 {
+		return 0, sizes, fmt.Errorf("invalid iec101 sizes: %v", s)
+	}
+	return n[0], asduSizes{cot: n[1], ca: n[2], ioa: n[3]}, nil
+}
+
+func maxAddress(octets int) uint32 {
+	return uint32(1)<<(8*octets) - 1
+}
+
+func getAddress(b []byte, octets int) uint32 {
+	var v uint32
+	for i := 0; i < octets; i++ {
+		v |= uint32(b[i]) << (8 * i)
+	}
+	return v
+}
+
+// putAddress appends v, which was an address of from octets, in to octets.
+// The broadcast address stays one.
+func putAddress(out []byte, v uint32, from, to int, broadcast bool) ([]byte, error) {
+	if broadcast && v == maxAddress(from) {
+		v = maxAddress(to)
+	} else if v > maxAddress(to) {
+		return nil, fmt.Errorf("address %d doesn't fit in %d octets", v, to)
+	}
+	for i := 0; i < to; i++ {
+		out = append(out, byte(v>>(8*i)))
+	}
+	return out, nil
+}
+
+// convertASDU writes the ASDU a with the field sizes of from in those of to.
+func convertASDU(a []byte, from, to asduSizes) ([]byte, error) {
+	head := 2 + from.cot + from.ca
+	if len(a) < head {
+		return nil, errASDU
+	}
+	size, ok := iecElementSizes[a[0]]
+	if !ok {
+		return nil, fmt.Errorf("unsupported asdu type %d", a[0])
+	}
+	n, sq := int(a[1]&0x7f), a[1]&0x80 != 0
+	objects := a[head:]
+	want := n * (from.ioa + size)
+	if sq {
+		// one address for a sequence of elements
+		want = from.ioa + n*size
+	}
+	if n == 0 || len(objects) != want {
+		return nil, errASDU
+	}
+
+	out := []byte{a[0], a[1], a[2]}
+	if to.cot == 2 {
+		// the originator address
+		var orig byte
+		if from.cot == 2 {
+			orig = a[3]
+		}
+		out = append(out, orig)
+	}
+	out, err := putAddress(out, getAddress(a[2+from.cot:], from.ca), from.ca, to.ca, true)
+	if err != nil {
+		return nil, err
+	}
+	for len(objects) > 0 {
+		if out, err = putAddress(out, getAddress(objects, from.ioa), from.ioa, to.ioa, false); err != nil {
+			return nil, err
+		}
+		objects = objects[from.ioa:]
+		elements := size
+		if sq {
+			elements = len(objects)
+		}
+		out = append(out, objects[:elements]...)
+		objects = objects[elements:]
+	}
+	return out, nil
+}
+
+// iecFrame is an FT 1.2 frame, single is the E5 that acks a request.
+type iecFrame struct {
+	single  bool
+	control byte
+	address uint32
+	asdu    []byte
+}
+
+// iec101Link is the balanced IEC 60870-5-101 link to the station on the
+// serial port, see -mode iec104. It writes the ASDUs of the clients as
+// confirmed user data, one at a time, and hands those of the station to
+// deliver.
+type iec101Link struct {
+	port     *serialPort
+	address  uint32
+	linkSize int
+	timeout  time.Duration
+	deliver  func(asdu []byte)
+	logger   *Logger
+	out      chan []byte
+	acks     chan iecFrame
+	pending  []byte
+
+	// fcb is the next FCB of the requests, only run touches it
+	fcb bool
+
+	mu sync.Mutex
+	up bool
+	// the last FCB of the station's requests, a repeat isn't delivered
+	// twice
+	stationFCB      bool
+	stationFCBKnown bool
+}
+
+func newIEC101Link(port *serialPort, conf *bridgeConfig, logger *Logger) *iec101Link {
+	linkSize, _, _ := parseIEC101Sizes(conf.IEC101Sizes)
+	return &iec101Link{port: port, address: uint32(conf.IEC101Address), linkSize: linkSize,
+		timeout: time.Duration(conf.IEC101Timeout) * time.Millisecond, logger: logger,
+		out: make(chan []byte, iec101Queue), acks: make(chan iecFrame, 1)}
+}
+
+// frame is the fixed length frame with control c, or the variable length
+// one when there is an asdu.
+func (l *iec101Link) frame(c byte, asdu []byte) []byte {
+	body := []byte{c}
+	for i := 0; i < l.linkSize; i++ {
+		body = append(body, byte(l.address>>(8*i)))
+	}
+	body = append(body, asdu...)
+	var sum byte
+	for _, v := range body {
+		sum += v
+	}
+	var f []byte
+	if len(asdu) == 0 {
+		f = append([]byte{ft12Fixed}, body...)
+	} else {
+		f = append([]byte{ft12Var, byte(len(body)), byte(len(body)), ft12Var}, body...)
+	}
+	return append(f, sum, ft12End)
+}
+
+// frameLength is the length of the frame p starts with, 0 while that
+// isn't known yet and -1 if p doesn't start with a frame.
+func (l *iec101Link) frameLength(p []byte) int {
+	switch p[0] {
+	case ft12Ack:
+		return 1
+	case ft12Fixed:
+		return 4 + l.linkSize
+	case ft12Var:
+		if len(p) < 4 {
+			return 0
+		}
+		if p[1] != p[2] || p[3] != ft12Var || int(p[1]) < 1+l.linkSize {
+			return -1
+		}
+		return int(p[1]) + 6
+	}
+	return -1
+}
+
+// parse checks the checksum and the end of the frame f.
+func (l *iec101Link) parse(f []byte) (iecFrame, bool) {
+	if f[0] == ft12Ack {
+		return iecFrame{single: true}, true
+	}
+	body := f[1 : len(f)-2]
+	if f[0] == ft12Var {
+		body = f[4 : len(f)-2]
+	}
+	var sum byte
+	for _, v := range body {
+		sum += v
+	}
+	if sum != f[len(f)-2] || f[len(f)-1] != ft12End {
+		return iecFrame{}, false
+	}
+	frame := iecFrame{control: body[0], address: getAddress(body[1:], l.linkSize)}
+	if f[0] == ft12Var {
+		frame.asdu = append([]byte(nil), body[1+l.linkSize:]...)
+	}
+	return frame, true
+}
+
+// Write takes what the station sends.
+func (l *iec101Link) Write(b []byte) (int, error) {
+	l.pending = append(l.pending, b...)
+	for len(l.pending) > 0 {
+		n := l.frameLength(l.pending)
+		if n == 0 || n > len(l.pending) {
+			break
+		}
+		if n > 0 {
+			if f, ok := l.parse(l.pending[:n]); ok {
+				l.pending = l.pending[n:]
+				l.received(f)
+				continue
+			}
+		}
+		// not a frame, look for one at the next byte
+		l.pending = l.pending[1:]
+	}
+	return len(b), nil
+}
+
+func (l *iec101Link) received(f iecFrame) {
+	if f.single || f.control&iecPRM == 0 {
+		if !f.single && f.address != l.address {
+			return
+		}
+		// the answer to a request of run
+		select {
+		case l.acks <- f:
+		default:
+		}
+		return
+	}
+	if f.address != l.address || f.control&iecDIR != 0 {
+		// another station, or the echo of the gateway's own frame
+		return
+	}
+
+	repeat := false
+	if f.control&iecFCV != 0 {
+		fcb := f.control&iecFCB != 0
+		l.mu.Lock()
+		repeat = l.stationFCBKnown && l.stationFCB == fcb
+		l.stationFCB, l.stationFCBKnown = fcb, true
+		l.mu.Unlock()
+	}
+	switch f.control & 0x0f {
+	case iecResetLink:
+		l.mu.Lock()
+		l.stationFCBKnown = false
+		l.mu.Unlock()
+		l.respond(iecAck)
+	case iecResetUser, iecTestLink:
+		l.respond(iecAck)
+	case iecLinkStatus:
+		l.respond(iecStatus)
+	case iecUserData:
+		l.respond(iecAck)
+		if !repeat {
+			l.deliver(f.asdu)
+		}
+	case iecUserNoReply:
+		l.deliver(f.asdu)
+	default:
+		l.respond(iecNotImpl)
+	}
+}
+
+// respond answers a request of the station.
+func (l *iec101Link) respond(fn byte) {
+	if _, err := l.port.Write(l.frame(iecDIR|fn, nil)); err != nil {
+		l.logger.Warn("iec101 write error", "err", err)
+	}
+}
+
+// request sends a primary frame until the station answers, the FCB stays
+// the same for the repeats. It returns the function of the answer.
+func (l *iec101Link) request(ctx context.Context, fn byte, asdu []byte) (byte, error) {
+	c := byte(iecDIR|iecPRM) | fn
+	fcv := fn == iecTestLink || fn == iecUserData
+	if fcv {
+		c |= iecFCV
+		if l.fcb {
+			c |= iecFCB
+		}
+	}
+	frame := l.frame(c, asdu)
+	for try := 0; try <= iec101Retries; try++ {
+		select {
+		case <-l.acks:
+		default:
+		}
+		if _, err := l.port.Write(frame); err != nil {
+			return 0, err
+		}
+		timer := time.NewTimer(l.timeout)
+		select {
+		case f := <-l.acks:
+			timer.Stop()
+			if fcv {
+				l.fcb = !l.fcb
+			}
+			if f.single {
+				return iecAck, nil
+			}
+			return f.control & 0x0f, nil
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return 0, ctx.Err()
+		}
+	}
+	return 0, errIEC101Timeout
+}
+
+// connect asks for the status of the station's link and resets it.
+func (l *iec101Link) connect(ctx context.Context) error {
+	fn, err := l.request(ctx, iecLinkStatus, nil)
+	if err != nil {
+		return err
+	}
+	if fn != iecStatus {
+		return fmt.Errorf("iec101 link status answered with function %d", fn)
+	}
+	if fn, err = l.request(ctx, iecResetLink, nil); err != nil {
+		return err
+	}
+	if fn != iecAck {
+		return fmt.Errorf("iec101 link reset answered with function %d", fn)
+	}
+	// the first user data after the reset has FCB set
+	l.fcb = true
+	return nil
+}
+
+// run keeps the link up and sends the ASDUs of the clients until ctx is
+// done.
+func (l *iec101Link) run(ctx context.Context) {
+	for ctx.Err() == nil {
+		if err := l.connect(ctx); err != nil {
+			if ctx.Err() == nil {
+				l.logger.Warn("iec101 link down", "err", err)
+			}
+			select {
+			case <-time.After(l.timeout):
+			case <-ctx.Done():
+			}
+			continue
+		}
+		l.logger.Info("iec101 link up")
+		l.setUp(true)
+		err := l.serve(ctx)
+		l.setUp(false)
+		if ctx.Err() == nil {
+			l.logger.Warn("iec101 link lost", "err", err)
+		}
+	}
+}
+
+func (l *iec101Link) serve(ctx context.Context) error {
+	for {
+		select {
+		case asdu := <-l.out:
+			fn, err := l.request(ctx, iecUserData, asdu)
+			if err != nil {
+				return err
+			}
+			if fn != iecAck {
+				l.logger.Warn("iec101 asdu refused", "function", fn)
+			}
+		case <-time.After(iec101TestInterval):
+			if _, err := l.request(ctx, iecTestLink, nil); err != nil {
+				return err
+			}
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func (l *iec101Link) setUp(up bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.up = up
+	if !up {
+		// what was queued goes nowhere
+		for len(l.out) > 0 {
+			<-l.out
+		}
+	}
+}
+
+// send queues asdu for the station, it reports false when the link is
+// down or too far behind.
+func (l *iec101Link) send(asdu []byte) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.up {
+		return false
+	}
+	select {
+	case l.out <- asdu:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	iec104Start = 0x68
+	// the longest APDU after the length octet, and the longest ASDU in it
+	iec104MaxAPDU = 253
+	iec104MaxASDU = iec104MaxAPDU - 4
+
+	// the I frames sent before the master has to ack them, and the ones
+	// received before the gateway acks them
+	iec104K = 12
+	iec104W = 8
+	// how long the gateway waits to ack fewer than w I frames
+	iec104T2 = 10 * time.Second
+	// the ASDUs that may wait for a master's window before it's dropped
+	iec104Backlog = 256
+
+	// the U frames
+	iecStartDTAct = 0x07
+	iecStartDTCon = 0x0b
+	iecStopDTAct  = 0x13
+	iecStopDTCon  = 0x23
+	iecTestFRAct  = 0x43
+	iecTestFRCon  = 0x83
+
+	// the causes of transmission the gateway answers with itself
+	iecCotAct         = 6
+	iecCotDeact       = 8
+	iecCotUnknownType = 44
+	iecCotNegative    = 0x40
+)
+
+var (
+	errIEC104Down = errors.New("iec104 gateway is down")
+	errIEC104APDU = errors.New("bad iec104 apdu")
+)
+
+// iec104Session is the APCI state of one master.
+type iec104Session struct {
+	c *client
+	// started by STARTDT, only then the ASDUs of the station are sent
+	started bool
+	// the next N(S) to send, the next one expected and the oldest sent
+	// one the master hasn't acked
+	vs, vr, acked uint16
+	// the I frames received since the gateway last acked
+	unacked int
+	backlog [][]byte
+	t2      *time.Timer
+}
+
+// iec104Server speaks IEC 60870-5-104 to the clients and passes the ASDUs
+// on to and from the IEC 101 link, see -mode iec104.
+type iec104Server struct {
+	clients *hub
+	link    *iec101Link
+	sizes   asduSizes
+	logger  *Logger
+
+	mu       sync.Mutex
+	sessions map[*client]*iec104Session
+}
+
+func newIEC104Server(clients *hub, link *iec101Link, conf *bridgeConfig, logger *Logger) *iec104Server {
+	_, sizes, _ := parseIEC101Sizes(conf.IEC101Sizes)
+	return &iec104Server{clients: clients, link: link, sizes: sizes, logger: logger,
+		sessions: make(map[*client]*iec104Session)}
+}
+
+// seqDiff is how far a is ahead of b in the 15 bit sequence numbers.
+func seqDiff(a, b uint16) int {
+	return int((a - b) & 0x7fff)
+}
+
+func iec104APDU(control [4]byte, asdu []byte) []byte {
+	apdu := append([]byte{iec104Start, byte(4 + len(asdu))}, control[:]...)
+	return append(apdu, asdu...)
+}
+
+func iec104IFrame(ns, nr uint16, asdu []byte) []byte {
+	var control [4]byte
+	binary.LittleEndian.PutUint16(control[0:], ns<<1)
+	binary.LittleEndian.PutUint16(control[2:], nr<<1)
+	return iec104APDU(control, asdu)
+}
+
+func iec104SFrame(nr uint16) []byte {
+	control := [4]byte{0x01}
+	binary.LittleEndian.PutUint16(control[2:], nr<<1)
+	return iec104APDU(control, nil)
+}
+
+func iec104UFrame(fn byte) []byte {
+	return iec104APDU([4]byte{fn}, nil)
+}
+
+// deliver sends an ASDU of the station to every started master.
+func (s *iec104Server) deliver(asdu []byte) {
+	a, err := convertASDU(asdu, s.sizes, iec104Sizes)
+	if err == nil && len(a) > iec104MaxASDU {
+		err = errASDU
+	}
+	if err != nil {
+		s.logger.Debug("iec101 asdu dropped", "err", err, "data", asdu)
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, ss := range s.sessions {
+		if !ss.started {
+			continue
+		}
+		if len(ss.backlog) >= iec104Backlog {
+			s.logger.Warn("too slow, disconnecting", "addr", ss.c.addr)
+			s.clients.remove(ss.c)
+			ss.started, ss.backlog = false, nil
+			continue
+		}
+		ss.backlog = append(ss.backlog, a)
+		s.flush(ss)
+	}
+}
+
+// flush sends what the window of the master allows. s.mu must be held.
+func (s *iec104Server) flush(ss *iec104Session) {
+	for len(ss.backlog) > 0 && seqDiff(ss.vs, ss.acked) < iec104K {
+		s.clients.send(ss.c, iec104IFrame(ss.vs, ss.vr, ss.backlog[0]))
+		ss.backlog = ss.backlog[1:]
+		ss.vs = (ss.vs + 1) & 0x7fff
+		// the I frame acks what was received
+		ss.unacked = 0
+	}
+}
+
+// ack takes the N(R) of the master. s.mu must be held.
+func (s *iec104Server) ack(ss *iec104Session, nr uint16) error {
+	if seqDiff(nr, ss.acked) > seqDiff(ss.vs, ss.acked) {
+		return fmt.Errorf("iec104 ack of unsent frame %d", nr)
+	}
+	ss.acked = nr
+	s.flush(ss)
+	return nil
+}
+
+// reply mirrors a command of the master back to it with the negative
+// cause cot.
+func (s *iec104Server) reply(ss *iec104Session, a []byte, cot byte) {
+	r := append([]byte(nil), a...)
+	r[2] = r[2]&0x80 | iecCotNegative | cot
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ss.backlog = append(ss.backlog, r)
+	s.flush(ss)
+}
+
+// command passes an ASDU of the master to the station.
+func (s *iec104Server) command(ss *iec104Session, a []byte) {
+	if len(a) < 3 {
+		return
+	}
+	asdu, err := convertASDU(a, iec104Sizes, s.sizes)
+	if err != nil {
+		s.logger.Debug("iec104 asdu dropped", "addr", ss.c.addr, "err", err, "data", a)
+		if _, ok := iecElementSizes[a[0]]; !ok {
+			s.reply(ss, a, iecCotUnknownType)
+		}
+		return
+	}
+	if !s.link.send(asdu) {
+		s.logger.Warn("iec101 link down, asdu dropped", "addr", ss.c.addr)
+		// a command is refused with its confirmation
+		if cot := a[2] & 0x3f; cot == iecCotAct || cot == iecCotDeact {
+			s.reply(ss, a, cot+1)
+		}
+	}
+}
+
+// received takes the control field of an I frame. It acks the frames of
+// the master after w of them, or t2 after the first.
+func (s *iec104Server) received(ss *iec104Session, control []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ns := binary.LittleEndian.Uint16(control[0:]) >> 1
+	if ns != ss.vr {
+		return fmt.Errorf("iec104 sequence error: got %d, want %d", ns, ss.vr)
+	}
+	ss.vr = (ss.vr + 1) & 0x7fff
+	if err := s.ack(ss, binary.LittleEndian.Uint16(control[2:])>>1); err != nil {
+		return err
+	}
+	if ss.unacked++; ss.unacked >= iec104W {
+		s.clients.send(ss.c, iec104SFrame(ss.vr))
+		ss.unacked = 0
+	} else if ss.unacked == 1 {
+		ss.t2.Reset(iec104T2)
+	}
+	return nil
+}
+
+// handle takes an APDU of the master, the start and the length stripped.
+func (s *iec104Server) handle(ss *iec104Session, apdu []byte) error {
+	control := apdu[:4]
+	if control[0]&0x01 == 0 {
+		if err := s.received(ss, control); err != nil {
+			return err
+		}
+		s.command(ss, apdu[4:])
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if control[0]&0x03 == 0x01 {
+		return s.ack(ss, binary.LittleEndian.Uint16(control[2:])>>1)
+	}
+	switch control[0] {
+	case iecStartDTAct:
+		ss.started = true
+		s.clients.send(ss.c, iec104UFrame(iecStartDTCon))
+	case iecStopDTAct:
+		ss.started, ss.backlog = false, nil
+		s.clients.send(ss.c, iec104UFrame(iecStopDTCon))
+	case iecTestFRAct:
+		s.clients.send(ss.c, iec104UFrame(iecTestFRCon))
+	}
+	return nil
+}
+
+// serveIEC104 serves a master until it disconnects.
+func (b *bridge) serveIEC104(c *client) error {
+	b.mu.Lock()
+	s := b.iec104
+	b.mu.Unlock()
+	if s == nil {
+		return errIEC104Down
+	}
+
+	ss := &iec104Session{c: c}
+	ss.t2 = time.AfterFunc(iec104T2, func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if ss.unacked > 0 {
+			s.clients.send(c, iec104SFrame(ss.vr))
+			ss.unacked = 0
+		}
+	})
+	ss.t2.Stop()
+	s.mu.Lock()
+	s.sessions[c] = ss
+	s.mu.Unlock()
+	defer func() {
+		ss.t2.Stop()
+		s.mu.Lock()
+		delete(s.sessions, c)
+		s.mu.Unlock()
+	}()
+
+	var pending []byte
+	buf := make([]byte, 1024)
+	for {
+		n, err := c.conn.Read(buf)
+		if err != nil {
+			return err
+		}
+		c.stats.add(true, n)
+		pending = append(pending, buf[:n]...)
+		for len(pending) >= 2 {
+			if pending[0] != iec104Start || pending[1] < 4 || pending[1] > iec104MaxAPDU {
+				return errIEC104APDU
+			}
+			end := 2 + int(pending[1])
+			if len(pending) < end {
+				break
+			}
+			apdu := pending[2:end]
+			pending = pending[end:]
+			if err := s.handle(ss, apdu); err != nil {
+				return err
+			}
+		}
+	}
+}
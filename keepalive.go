@@ -0,0 +1,27 @@
+package main
+
+import (
+	"net"
+	"time"
+)
+
+// setKeepalive turns keepalive off with a negative -keepalive, otherwise
+// it sets the idle time before the first probe, the time between the
+// probes and how many may go unanswered, those left at 0 keep the defaults.
+func setKeepalive(conn *net.TCPConn, conf *bridgeConfig) error {
+	if conf.Keepalive < 0 {
+		return conn.SetKeepAlive(false)
+	}
+	if err := conn.SetKeepAlive(true); err != nil {
+		return err
+	}
+	if conf.Keepalive > 0 {
+		if err := conn.SetKeepAlivePeriod(time.Duration(conf.Keepalive) * time.Second); err != nil {
+			return err
+		}
+	}
+	if conf.KeepaliveInterval == 0 && conf.KeepaliveCount == 0 {
+		return nil
+	}
+	return setKeepaliveProbes(conn, conf.KeepaliveInterval, conf.KeepaliveCount)
+}
@@ -0,0 +1,15 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"errors"
+	"net"
+)
+
+// the probe interval and count are only set on linux, elsewhere the
+// system defaults apply.
+func setKeepaliveProbes(conn *net.TCPConn, interval, count int) error {
+	return errors.New("keepalive-interval and keepalive-count are only supported on linux")
+}
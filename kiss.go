@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"io"
+)
+
+const (
+	modeKISS = "kiss"
+
+	kissFEND  = 0xc0
+	kissFESC  = 0xdb
+	kissTFEND = 0xdc
+	kissTFESC = 0xdd
+
+	// an AX.25 frame with 256 bytes of info and the digipeaters, escaped
+	kissMaxFrame = 2 * 400
+)
+
+// validKISS reports whether the escapes of frame, without the FENDs, are
+// the two the protocol knows.
+func validKISS(frame []byte) bool {
+	for i := 0; i < len(frame); i++ {
+		if frame[i] != kissFESC {
+			continue
+		}
+		if i++; i == len(frame) || (frame[i] != kissTFEND && frame[i] != kissTFESC) {
+			return false
+		}
+	}
+	return true
+}
+
+// kissWriter passes on whole KISS frames, FEND to FEND, one per Write to
+// dst, so the frames of the TNC and of the clients never get mixed up, see
+// -mode kiss.
+type kissWriter struct {
+	dst     io.Writer
+	logger  *Logger
+	pending []byte
+	// inFrame is set once the FEND before pending came
+	inFrame bool
+}
+
+func newKISSWriter(dst io.Writer, logger *Logger) *kissWriter {
+	return &kissWriter{dst: dst, logger: logger}
+}
+
+func (w *kissWriter) Write(b []byte) (int, error) {
+	n := len(b)
+	for len(b) > 0 {
+		i := bytes.IndexByte(b, kissFEND)
+		if i < 0 {
+			if w.inFrame {
+				w.pending = append(w.pending, b...)
+			}
+			break
+		}
+		if w.inFrame {
+			w.pending = append(w.pending, b[:i]...)
+		}
+		b = b[i+1:]
+		frame := w.pending
+		w.pending, w.inFrame = nil, true
+		// back to back FENDs are idle fill
+		if len(frame) == 0 {
+			continue
+		}
+		if !validKISS(frame) || len(frame) > kissMaxFrame {
+			w.logger.Debug("kiss frame dropped", "bytes", len(frame))
+			continue
+		}
+		out := make([]byte, 0, len(frame)+2)
+		out = append(append(append(out, kissFEND), frame...), kissFEND)
+		if _, err := w.dst.Write(out); err != nil {
+			return n, err
+		}
+	}
+	if len(w.pending) > kissMaxFrame {
+		w.logger.Debug("kiss frame dropped", "bytes", len(w.pending))
+		w.pending, w.inFrame = nil, false
+	}
+	return n, nil
+}
@@ -0,0 +1,103 @@
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// uucpLockDir is where minicom, cu and friends look for LCK..<tty> files.
+const uucpLockDir = "/var/lock"
+
+// lockDevice takes the locks of -lock on the device and returns the
+// function that drops them again.
+func lockDevice(name string, kinds []string) (unlock func(), err error) {
+	var unlocks []func()
+	unlock = func() {
+		for i := len(unlocks) - 1; i >= 0; i-- {
+			unlocks[i]()
+		}
+	}
+	for _, kind := range kinds {
+		var u func()
+		var err error
+		switch kind {
+		case "uucp":
+			u, err = uucpLock(name)
+		case "flock":
+			u, err = flockDevice(name)
+		default:
+			continue
+		}
+		if err != nil {
+			unlock()
+			return nil, err
+		}
+		unlocks = append(unlocks, u)
+	}
+	return unlock, nil
+}
+
+// uucpLock creates the LCK..<tty> file with our pid, after removing one
+// left behind by a process that is gone.
+func uucpLock(name string) (func(), error) {
+	if real, err := filepath.EvalSymlinks(name); err == nil {
+		name = real
+	}
+	path := filepath.Join(uucpLockDir, "LCK.."+filepath.Base(name))
+	for tries := 0; ; tries++ {
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if err == nil {
+			_, err = fmt.Fprintf(f, "%10d\n", os.Getpid())
+			f.Close()
+			if err != nil {
+				os.Remove(path)
+				return nil, err
+			}
+			return func() { os.Remove(path) }, nil
+		}
+		if !os.IsExist(err) || tries > 0 {
+			return nil, err
+		}
+
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		pid, err := strconv.Atoi(strings.TrimSpace(string(b)))
+		if err == nil && pid > 0 {
+			if err := unix.Kill(pid, 0); err == nil || err == unix.EPERM {
+				return nil, fmt.Errorf("%v is locked by pid %d, see %v", name, pid, path)
+			}
+		}
+		// stale
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// flockDevice takes an exclusive flock on the device node, through an fd
+// of its own so that it works with every backend.
+func flockDevice(name string) (func(), error) {
+	f, err := os.OpenFile(name, os.O_RDONLY|unix.O_NOCTTY|unix.O_NONBLOCK, 0)
+	if err != nil {
+		return nil, err
+	}
+	if err := unix.Flock(int(f.Fd()), unix.LOCK_EX|unix.LOCK_NB); err != nil {
+		f.Close()
+		if errors.Is(err, unix.EWOULDBLOCK) {
+			return nil, fmt.Errorf("%v is in use by another program holding a flock", name)
+		}
+		return nil, err
+	}
+	return func() { f.Close() }, nil
+}
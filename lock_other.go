@@ -0,0 +1,9 @@
+//go:build windows || plan9
+// +build windows plan9
+
+package main
+
+// lockDevice has nothing to do on windows, COM ports are opened exclusive.
+func lockDevice(name string, kinds []string) (unlock func(), err error) {
+	return func() {}, nil
+}
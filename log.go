@@ -0,0 +1,249 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+type logLevel int
+
+const (
+	levelDebug logLevel = iota
+	levelInfo
+	levelWarn
+	levelError
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+func parseLogLevel(s string) (logLevel, error) {
+	for i, name := range levelNames {
+		if strings.EqualFold(s, name) {
+			return logLevel(i), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown log level: %v", s)
+}
+
+// levelWriter is an output that keeps the level of every line itself, like
+// syslog. It gets the text lines without the timestamp.
+type levelWriter interface {
+	writeLevel(level logLevel, line []byte) error
+}
+
+// Logger writes leveled messages with key value pairs attached, as text
+// lines or as one json object per line.
+type Logger struct {
+	mu     *sync.Mutex
+	out    io.Writer
+	level  logLevel
+	json   bool
+	prefix string
+	fields []interface{}
+}
+
+const logHistorySize = 200
+
+// logHistory keeps the last lines logged for the dashboard.
+var logHistory = &logRing{lines: make([]string, logHistorySize)}
+
+type logRing struct {
+	mu    sync.Mutex
+	lines []string
+	next  int
+	full  bool
+	// watchers get the lines as they are logged, see watch
+	watchers map[chan string]bool
+}
+
+func (r *logRing) add(line string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.lines[r.next] = line
+	r.next = (r.next + 1) % len(r.lines)
+	if r.next == 0 {
+		r.full = true
+	}
+	for ch := range r.watchers {
+		select {
+		case ch <- line:
+		default:
+			// a watcher that falls behind misses lines
+		}
+	}
+}
+
+// watch returns a channel with the lines logged from now on, until stop is
+// called.
+func (r *logRing) watch() (lines <-chan string, stop func()) {
+	ch := make(chan string, logHistorySize)
+	r.mu.Lock()
+	if r.watchers == nil {
+		r.watchers = make(map[chan string]bool)
+	}
+	r.watchers[ch] = true
+	r.mu.Unlock()
+	return ch, func() {
+		r.mu.Lock()
+		delete(r.watchers, ch)
+		r.mu.Unlock()
+	}
+}
+
+// recent returns the kept lines, the oldest first.
+func (r *logRing) recent() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.full {
+		return append([]string{}, r.lines[:r.next]...)
+	}
+	return append(append([]string{}, r.lines[r.next:]...), r.lines[:r.next]...)
+}
+
+// stdLogger is the process wide logger, main sets it up from the flags and
+// every bridge derives its own from it.
+var stdLogger = &Logger{mu: &sync.Mutex{}, out: os.Stderr, level: levelInfo}
+
+func newLogger(out io.Writer, level, format string) (*Logger, error) {
+	l := &Logger{mu: &sync.Mutex{}, out: out}
+	var err error
+	if l.level, err = parseLogLevel(level); err != nil {
+		return nil, err
+	}
+	switch format {
+	case "text":
+	case "json":
+		l.json = true
+	default:
+		return nil, fmt.Errorf("unknown log format: %v", format)
+	}
+	return l, nil
+}
+
+// named returns a logger for the bridge name, text lines get a [name]
+// prefix and json objects a bridge field.
+func (l *Logger) named(name string) *Logger {
+	if name == "" {
+		return l
+	}
+	n := l.with("bridge", name)
+	n.prefix = "[" + name + "] "
+	return n
+}
+
+// with returns a logger that adds kv to every message.
+func (l *Logger) with(kv ...interface{}) *Logger {
+	n := *l
+	n.fields = append(append([]interface{}{}, l.fields...), kv...)
+	return &n
+}
+
+func (l *Logger) Debug(msg string, kv ...interface{}) { l.log(levelDebug, msg, kv) }
+func (l *Logger) Info(msg string, kv ...interface{})  { l.log(levelInfo, msg, kv) }
+func (l *Logger) Warn(msg string, kv ...interface{})  { l.log(levelWarn, msg, kv) }
+func (l *Logger) Error(msg string, kv ...interface{}) { l.log(levelError, msg, kv) }
+
+func (l *Logger) enabled(level logLevel) bool {
+	return level >= l.level
+}
+
+func (l *Logger) log(level logLevel, msg string, kv []interface{}) {
+	if !l.enabled(level) {
+		return
+	}
+	now := time.Now()
+	if len(l.fields) > 0 {
+		kv = append(append([]interface{}{}, l.fields...), kv...)
+	}
+
+	lw, isLevelWriter := l.out.(levelWriter)
+	var buf bytes.Buffer
+	if l.json {
+		buf.WriteString(`{"time":`)
+		writeJSON(&buf, now.Format(time.RFC3339Nano))
+		buf.WriteString(`,"level":`)
+		writeJSON(&buf, levelNames[level])
+		buf.WriteString(`,"msg":`)
+		writeJSON(&buf, msg)
+		for i := 0; i+1 < len(kv); i += 2 {
+			buf.WriteByte(',')
+			writeJSON(&buf, fmt.Sprint(kv[i]))
+			buf.WriteByte(':')
+			writeJSON(&buf, jsonValue(kv[i+1]))
+		}
+		buf.WriteString("}\n")
+	} else {
+		if !isLevelWriter {
+			buf.WriteString(now.Format("2006/01/02 15:04:05 "))
+			buf.WriteString(strings.ToUpper(levelNames[level]))
+			buf.WriteByte(' ')
+		}
+		buf.WriteString(l.prefix)
+		buf.WriteString(msg)
+		for i := 0; i+1 < len(kv); i += 2 {
+			if kv[i] == "bridge" && l.prefix != "" {
+				continue
+			}
+			fmt.Fprintf(&buf, " %v=%v", kv[i], textValue(kv[i+1]))
+		}
+		buf.WriteByte('\n')
+	}
+
+	logHistory.add(strings.TrimSuffix(buf.String(), "\n"))
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if isLevelWriter {
+		lw.writeLevel(level, buf.Bytes())
+	} else {
+		l.out.Write(buf.Bytes())
+	}
+}
+
+func writeJSON(buf *bytes.Buffer, v interface{}) {
+	var b bytes.Buffer
+	enc := json.NewEncoder(&b)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(v); err != nil {
+		b.Reset()
+		enc.Encode(fmt.Sprint(v))
+	}
+	buf.Write(bytes.TrimSuffix(b.Bytes(), []byte("\n")))
+}
+
+// jsonValue turns the values json doesn't show well into strings, []byte
+// becomes hex instead of base64.
+func jsonValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case error:
+		return v.Error()
+	case []byte:
+		return hex.EncodeToString(v)
+	case fmt.Stringer:
+		return v.String()
+	}
+	return v
+}
+
+func textValue(v interface{}) string {
+	var s string
+	switch v := v.(type) {
+	case error:
+		s = v.Error()
+	case string:
+		s = v
+	default:
+		return fmt.Sprint(v)
+	}
+	if s == "" || strings.ContainsAny(s, " \t\n\"=") {
+		return fmt.Sprintf("%q", s)
+	}
+	return s
+}
@@ -2,37 +2,74 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
 	"flag"
 	"io"
-	"log"
 	"net"
 	"os"
-	"reflect"
+	"os/signal"
+	"strings"
+	"sync/atomic"
+	"syscall"
 	"time"
-	"unsafe"
-
-	"github.com/tarm/serial"
 )
 
 var (
-	tcpAddress     = flag.String("l", "0.0.0.0:1234", "tcp listening address")
-	serialDevice   = flag.String("s", "/dev/ttyS1", "serial device name")
-	serialBaudRate = flag.Int("baudRate", 9600, "serial baudRate")
-	serialDataBits = flag.Int("dataBits", 8, "serial dataBits(7 or 8)")
-	serialStopBits = flag.String("stopBits", "1", "serial stopBits(1, 1.5 or 2)")
-	serialParity   = flag.String("parity", "None", "serial Parity(None, Odd, Even, Mark or Space)")
-	verbose        = flag.Bool("verbose", true, "log socket messages")
+	configPath     = flag.String("config", "", "json file defining one or more bridges, the flags are their defaults, or a ser2net.conf")
+	logLevelName   = flag.String("log-level", "info", "lowest level logged(debug, info, warn or error)")
+	logFormat      = flag.String("log-format", "text", "log output format(text or json)")
+	syslogTarget   = flag.String("syslog", "", "log to syslog instead of stderr, local or udp://host:514 or tcp://host:514")
+	syslogFacility = flag.String("syslog-facility", "daemon", "syslog facility, e.g. daemon, auth or local0")
+	otlpEndpoint   = flag.String("otlp-endpoint", "", "export OpenTelemetry traces to this OTLP/HTTP collector, e.g. http://localhost:4318")
+	healthAddr     = flag.String("health", "", "serve the /healthz http endpoint on this address, e.g. 127.0.0.1:8080")
+	adminAddr      = flag.String("admin", "", "serve the management http api on this address, e.g. 127.0.0.1:8081")
+	adminToken     = flag.String("admin-token", "", "bearer token the management api requires")
+	selectAddr     = flag.String("select", "", "serve a listener where the client picks the bridge by name or number, e.g. :7000")
+	muxAddr        = flag.String("mux", "", "serve a listener where one yamux session carries streams to every bridge, the management api and the logs, e.g. :7100")
+	listPortsFlag  = flag.Bool("list-ports", false, "print the serial ports and the usb names for -s, then exit")
+	serviceAction  = flag.String("service", "", "install or uninstall tcp2serial as a windows service with the other flags, run is what the service manager starts")
+	serviceName    = flag.String("service-name", "tcp2serial", "name of the windows service, for several instances")
+	daemonFlag     = flag.Bool("daemon", false, "detach from the terminal and run in the background")
+	pidFilePath    = flag.String("pidfile", "", "write the pid to this file, e.g. /run/tcp2serial.pid")
+	logFilePath    = flag.String("logfile", "", "log to this file instead of stderr, SIGHUP opens it again after logrotate")
+	userName       = flag.String("user", "", "switch to this user once the serial ports are open and the listeners bound")
+	groupName      = flag.String("group", "", "switch to this group once the serial ports are open and the listeners bound, the primary group of -user by default")
+	oneshotFlag    = flag.Bool("oneshot", false, "exit after the first client session, the exit code tells how it ended")
 )
 
 type Conn io.ReadWriteCloser
 
-func newTcpConn() (conn Conn, err error) {
-	l, err := net.Listen("tcp", *tcpAddress)
+// newTcpListener listens on addr, -l or -observe.
+func (b *bridge) newTcpListener(addr string) (l net.Listener, err error) {
+	conf := &b.conf
+	if strings.HasPrefix(addr, unixPrefix) {
+		l, err = newUnixListener(strings.TrimPrefix(addr, unixPrefix), conf.SocketMode, conf.SocketOwner)
+	} else if strings.HasPrefix(addr, pipePrefix) {
+		l, err = newPipeListener(addr, conf.PipeSDDL)
+	} else {
+		l, err = listenTCPAddrs(addr, conf, b.logger)
+	}
 	if err != nil {
-		log.Println("listen error:", err)
+		b.logger.Error("listen error", "addr", addr, "err", err)
 		return nil, err
 	}
+	// the balancer sends the header before the tls handshake
+	if conf.ProxyProtocol {
+		l = newProxyListener(l, b.logger)
+	}
+	if conf.TLSCert != "" || conf.TLSKey != "" || conf.TLSClientCA != "" {
+		tlsConf, err := tlsConfig(conf)
+		if err != nil {
+			b.logger.Error("tls config error", "err", err)
+			l.Close()
+			return nil, err
+		}
+		l = tls.NewListener(l, tlsConf)
+	}
+	return l, nil
+}
 
+func (b *bridge) newTcpConn(l net.Listener) (conn net.Conn, err error) {
 retry:
 	tcpConn, err := l.Accept()
 	if err != nil {
@@ -41,153 +78,456 @@ retry:
 		}
 		return nil, err
 	}
-	addr := tcpConn.RemoteAddr().String()
-	log.Printf("%v connected", addr)
-	return tcpConn, nil
-}
-
-func DisableiZeroReadIsEOF(conn Conn) {
-	serialPort, ok := conn.(*serial.Port)
-	if !ok {
-		return
-	}
-	p := reflect.ValueOf(serialPort)
-	if !p.IsValid() {
-		return
-	}
-	f := p.Elem().FieldByName("f")
-	if !f.IsValid() {
-		return
-	}
-	fd := f.Elem().FieldByName("pfd")
-	if !fd.IsValid() {
-		return
-	}
-	zeof := fd.FieldByName("ZeroReadIsEOF")
-	if zeof.IsValid() {
-		if zeof.CanSet() {
-			zeof.SetBool(false)
-		} else {
-			ptr := (*bool)(unsafe.Pointer(zeof.UnsafeAddr()))
-			*ptr = false
-		}
-		log.Println("serial fd.ZeroReadIsEOF is", zeof.Bool())
+	addr := tcpConn.RemoteAddr()
+	if !b.allowed(addr) {
+		b.logger.Warn("rejected by allow/deny list", "addr", addr)
+		tcpConn.Close()
+		goto retry
 	}
+	b.logger.Info("connected", "addr", addr)
+	return tcpConn, nil
 }
 
-func newSerialConn() (conn Conn, err error) {
-	var stopBits serial.StopBits
-	var parity serial.Parity
-
-	if *serialStopBits == "1" {
-		stopBits = serial.Stop1
-	} else if *serialStopBits == "1.5" {
-		stopBits = serial.Stop1Half
-		log.Printf("Serial-StopBits 1.5 is not unsupported")
-	} else if *serialStopBits == "2" {
-		stopBits = serial.Stop2
-	}
-	if *serialParity == "None" {
-		parity = serial.ParityNone
-	} else if *serialParity == "Odd" {
-		parity = serial.ParityOdd
-	} else if *serialParity == "Even" {
-		parity = serial.ParityEven
-	} else if *serialParity == "Mark" {
-		parity = serial.ParityMark
-	} else if *serialParity == "Space" {
-		parity = serial.ParitySpace
-	}
-	sconf := &serial.Config{
-		Name:        *serialDevice,
-		Baud:        *serialBaudRate,
-		ReadTimeout: time.Second * 5,
-		Size:        byte(*serialDataBits),
-		Parity:      parity,
-		StopBits:    stopBits,
-	}
-
-	sconn, err := serial.OpenPort(sconf)
-	if err != nil {
-		log.Println("serial OpenPort error:", err)
-		return nil, err
-	}
-	DisableiZeroReadIsEOF(sconn)
-
-	log.Println("Serial Port is connected")
-	return sconn, nil
-}
+// the bounds of -buffer-size
+const (
+	minBufferSize = 16
+	maxBufferSize = 1 << 20
+)
 
-func connRelay(ctx context.Context, src Conn, dst Conn) (err error) {
-	var n int
+// connRelay copies src to dst, -buffer-size bytes at a time. The bytes are
+// in the transcript of session when it isn't nil, and those dst took are
+// counted in the bridge stats and its stats. The reads block until there
+// is data, so an idle relay costs nothing; what stops it is src being
+// closed: a client by its writeLoop once the hub dropped it, the serial
+// port by run when ctx is done.
+func (b *bridge) connRelay(ctx context.Context, src Conn, dst io.Writer, session *client) (err error) {
+	var n, off int
 	var serr error
-	var buf [4096]byte
+	conf := b.config()
+	buf := make([]byte, conf.BufferSize)
+	writeTimeout := time.Duration(conf.WriteTimeout) * time.Millisecond
 
 	ctx, cancelCtx := context.WithCancel(ctx)
 	defer cancelCtx()
 
+	logger, dir, marker := b.logger, "serial->tcp", "< "
+	c, toSerial := src.(net.Conn)
+	if toSerial {
+		dir, marker = "tcp->serial", "> "
+		if addr := c.RemoteAddr(); addr != nil {
+			logger = b.logger.with("addr", addr)
+		}
+	}
+
 	for {
-		n, serr = src.Read(buf[0:])
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+		}
+
+		if !toSerial {
+			atomic.StoreInt64(&b.relayBeat, time.Now().UnixNano())
+		}
+		n, serr = src.Read(buf)
 
 		if serr != nil {
-			if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
+			if nerr, ok := serr.(net.Error); ok && nerr.Timeout() {
 				// tcp socket read timeout
 				continue
-			} else if os.IsTimeout(err) {
+			} else if os.IsTimeout(serr) {
 				// windows serial port read timeout
 				continue
+			} else if ctx.Err() != nil {
+				// closed because the bridge stops
+				return ctx.Err()
 			} else {
-				log.Println("recv error:", serr)
+				if serr == io.EOF {
+					logger.Info("recv error", "dir", dir, "err", serr)
+				} else {
+					logger.Warn("recv error", "dir", dir, "err", serr)
+				}
 				return serr
 			}
 		}
 
+		if b.stripXon() {
+			n = stripXonXoff(buf[:n])
+		}
 		if n <= 0 {
 			continue
 		}
+		if !toSerial && b.autobaud != nil && !b.autobaud.isLocked() {
+			b.autobaud.feed(buf[:n])
+			continue
+		}
+		if !toSerial {
+			if chat := b.chatting(); chat != nil {
+				chat.feed(buf[:n])
+				continue
+			}
+		}
 
-		if *verbose {
-			if _, ok := src.(net.Conn); ok {
-				log.Println("tcp recv:", buf[:n])
-			} else {
-				log.Println("serial recv:", buf[:n])
+		if mode := b.dumpMode(); mode != "" {
+			for _, line := range hexDump(mode, off, buf[:n]) {
+				logger.Info(marker + line)
+			}
+		} else if b.verbose() {
+			logger.Info("recv", "dir", dir, "bytes", n, "data", buf[:n])
+		}
+		off += n
+		if session != nil && session.record != nil {
+			if err := session.record.write(toSerial, buf[:n]); err != nil {
+				logger.Warn("record error", "err", err)
 			}
 		}
 
-		if tcpConn, ok := dst.(net.Conn); ok {
-			tcpConn.SetWriteDeadline(time.Now().Add(3 * time.Second))
+		if b.capture != nil {
+			var comment string
+			if toSerial && c.RemoteAddr() != nil {
+				comment = c.RemoteAddr().String()
+			}
+			if err := b.capture.packet(toSerial, comment, buf[:n]); err != nil {
+				logger.Warn("capture error", "err", err)
+			}
 		}
 
-		wn, derr := dst.Write(buf[:n])
+		wn, derr := writeAll(dst, buf[:n], writeTimeout)
+		// what a failed write didn't take isn't traffic
+		b.stats.add(toSerial, wn)
+		if session != nil {
+			session.stats.add(toSerial, wn)
+		}
 		if derr != nil {
-			log.Println("write error:", derr)
+			logger.Warn("write error", "dir", dir, "sent", wn, "bytes", n, "err", derr)
+			if toSerial {
+				return serialError{derr}
+			}
 			return derr
 		}
-		if wn != n {
-			log.Println("io error: send", wn, "recv", n)
+	}
+}
+
+// how long writeAll waits before it asks a writer that took nothing again
+const writeRetryDelay = 10 * time.Millisecond
+
+// writeAll writes all of b to dst, after a short write the rest goes again
+// until it is out or dst fails. A net.Conn gets timeout as the deadline of
+// the whole, another writer that takes nothing is asked again until the
+// timeout passed. A zero timeout waits as long as a write takes, but
+// gives up on a writer that takes nothing.
+func writeAll(dst io.Writer, b []byte, timeout time.Duration) (int, error) {
+	var deadline time.Time
+	if timeout > 0 {
+		deadline = time.Now().Add(timeout)
+		if conn, ok := dst.(net.Conn); ok {
+			conn.SetWriteDeadline(deadline)
 		}
 	}
+	written := 0
+	for written < len(b) {
+		n, err := dst.Write(b[written:])
+		written += n
+		if err != nil {
+			return written, err
+		}
+		if n > 0 {
+			continue
+		}
+		if timeout == 0 {
+			return written, io.ErrShortWrite
+		}
+		if time.Now().After(deadline) {
+			return written, os.ErrDeadlineExceeded
+		}
+		time.Sleep(writeRetryDelay)
+	}
+	return written, nil
 }
 
-func main() {
-	flag.Parse()
+// handleConn sets up a freshly accepted client and serves it, an observer
+// only watches.
+func (b *bridge) handleConn(ctx context.Context, tcpConn net.Conn, observer bool) {
+	ctx, sessionSpan := startSpan(ctx, "session", spanKindServer,
+		"bridge", b.conf.Name, "net.peer.address", tcpConn.RemoteAddr())
+	defer sessionSpan.end(nil)
 
-	serialConn, err1 := newSerialConn()
-	if err1 != nil {
+	var err error
+	if _, ok := tcpConn.(*tls.Conn); ok {
+		_, tlsSpan := startSpan(ctx, "tls.handshake", spanKindInternal)
+		err = tlsHandshake(tcpConn, b.logger)
+		tlsSpan.end(err)
+	}
+	if err != nil {
+		b.logger.Warn("tls handshake error", "addr", tcpConn.RemoteAddr(), "err", err)
+		tcpConn.Close()
+		b.ended(exitAuth)
 		return
 	}
-	tcpConn, err2 := newTcpConn()
-	if err2 != nil {
+
+	var conn Conn = tcpConn
+	if b.conf.RFC2217 && !observer {
+		t := newTelnetConn(tcpConn, b.serial, b.logger)
+		t.coalesce = time.Duration(b.conf.RFC2217Coalesce) * time.Millisecond
+		conn = t
+	} else if b.conf.RFC2217 || b.conf.Telnet {
+		// an observer doesn't get the COM port control
+		conn = newTelnetConn(tcpConn, nil, b.logger)
+	}
+	_, authSpan := startSpan(ctx, "authenticate", spanKindInternal)
+	err = authenticate(conn, b.secret())
+	authSpan.end(err)
+	if err != nil {
+		b.logger.Warn("authentication error", "addr", tcpConn.RemoteAddr(), "err", err)
+		conn.Close()
+		b.ended(exitAuth)
 		return
 	}
+	c := newClient(conn)
+	c.observer = observer
+	b.serveClient(ctx, c)
+}
+
+func (b *bridge) acceptLoop(ctx context.Context, l net.Listener, observer bool) error {
+	for {
+		tcpConn, err := b.newTcpConn(l)
+		if err != nil {
+			return err
+		}
+		go b.handleConn(ctx, tcpConn, observer)
+	}
+}
 
-	ctx := context.Background()
+func main() {
+	os.Exit(mainCode())
+}
 
-	go connRelay(ctx, tcpConn, serialConn)
-	go connRelay(ctx, serialConn, tcpConn)
+// mainCode is main, the deferred clean up runs before the exit code is
+// returned.
+func mainCode() int {
+	if err := setFlagsFromEnv(); err != nil {
+		stdLogger.Error("environment error", "err", err)
+		return exitFailed
+	}
+	flag.Parse()
 
-	select {
-	case <-ctx.Done():
-		return
+	if *listPortsFlag {
+		if err := listPorts(os.Stdout); err != nil {
+			stdLogger.Error("list ports error", "err", err)
+			return exitFailed
+		}
+		return exitClean
+	}
+
+	if *serviceAction == "install" || *serviceAction == "uninstall" {
+		if err := serviceCommand(*serviceAction, *serviceName); err != nil {
+			stdLogger.Error("service error", "action", *serviceAction, "err", err)
+			return exitFailed
+		}
+		return exitClean
+	} else if *serviceAction != "" && *serviceAction != "run" {
+		stdLogger.Error("unknown service action, want install, uninstall or run", "action", *serviceAction)
+		return exitFailed
+	}
+
+	if *daemonFlag {
+		started, err := daemonize()
+		if err != nil {
+			stdLogger.Error("daemon error", "err", err)
+			return exitFailed
+		}
+		if started {
+			return exitClean
+		}
+	}
+
+	var out io.Writer = os.Stderr
+	if *logFilePath != "" {
+		var err error
+		if logOutput, err = openLogFile(*logFilePath); err != nil {
+			stdLogger.Error("log file error", "err", err)
+			return exitFailed
+		}
+		out = logOutput
+	}
+	if *syslogTarget != "" {
+		var err error
+		if out, err = newSyslogOutput(*syslogTarget, *syslogFacility); err != nil {
+			stdLogger.Error("syslog error", "err", err)
+			return exitFailed
+		}
+	} else if *serviceAction == "run" {
+		// a service has no stderr
+		var err error
+		if out, err = newEventLogOutput(*serviceName); err != nil {
+			stdLogger.Error("event log error", "err", err)
+			return exitFailed
+		}
+	}
+	l, err := newLogger(out, *logLevelName, *logFormat)
+	if err != nil {
+		stdLogger.Error("log config error", "err", err)
+		return exitFailed
+	}
+	stdLogger = l
+
+	if *pidFilePath != "" {
+		remove, err := writePidFile(*pidFilePath)
+		if err != nil {
+			stdLogger.Error("pid file error", "err", err)
+			return exitFailed
+		}
+		defer remove()
+	}
+
+	if *otlpEndpoint != "" {
+		defaultTracer = newTracer(*otlpEndpoint)
+		defer defaultTracer.shutdown()
+	}
+
+	// two addresses instead of -s and -l, like socat
+	if flag.NArg() > 0 {
+		if flag.NArg() != 2 {
+			stdLogger.Error("want two addresses, e.g. TCP-LISTEN:1234 /dev/ttyUSB0,b115200", "args", flag.Args())
+			return exitFailed
+		}
+		if err := runEndpoints(flag.Arg(0), flag.Arg(1)); err != nil {
+			stdLogger.Error("relay error", "err", err)
+			return exitFailed
+		}
+		return exitClean
+	}
+
+	if *serviceAction == "run" {
+		if err := runService(*serviceName, serve); err != nil {
+			stdLogger.Error("service error", "err", err)
+			return exitFailed
+		}
+		return exitClean
+	}
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	return serve(stop)
+}
+
+// serve runs the bridges of the flags or the -config file until they are
+// all gone or stop delivers a signal.
+func serve(stop <-chan os.Signal) int {
+	confs, err := expandDevices(flagConfig)
+	if err != nil {
+		stdLogger.Error("config error", "err", err)
+		return exitFailed
+	}
+	if *configPath != "" {
+		if confs, err = loadConfig(*configPath, flagConfig); err != nil {
+			stdLogger.Error("config error", "err", err)
+			return exitFailed
+		}
+	}
+
+	s := newSupervisor()
+	if *oneshotFlag {
+		s.oneshot = make(chan int, 1)
+	}
+	if *userName != "" || *groupName != "" {
+		s.gate = make(chan struct{})
+	}
+	if *healthAddr != "" {
+		go func() {
+			stdLogger.Error("health endpoint error", "err", s.serveHealth(*healthAddr))
+		}()
+	}
+	if *adminAddr != "" {
+		go func() {
+			stdLogger.Error("admin api error", "err", s.serveAdmin(*adminAddr, *adminToken))
+		}()
+	}
+	if *selectAddr != "" {
+		go func() {
+			stdLogger.Error("select listener error", "err", s.serveSelect(*selectAddr))
+		}()
+	}
+	if *muxAddr != "" {
+		go func() {
+			stdLogger.Error("mux listener error", "err", s.serveMux(*muxAddr, *adminToken))
+		}()
+	}
+	for _, conf := range confs {
+		if err := s.start(conf); err != nil {
+			stdLogger.Error("bridge error", "bridge", conf.Name, "err", err)
+			return exitFailed
+		}
+	}
+	if s.gate != nil {
+		// the clients wait at the gate until root is given up
+		for !s.started() {
+			time.Sleep(100 * time.Millisecond)
+		}
+		if err := dropPrivileges(*userName, *groupName); err != nil {
+			stdLogger.Error("privilege drop error", "user", *userName, "group", *groupName, "err", err)
+			s.shutdown()
+			return exitFailed
+		}
+		stdLogger.Info("privileges dropped", "uid", os.Getuid(), "gid", os.Getgid())
+		close(s.gate)
+	}
+
+	go s.notifyReady()
+	if interval := watchdogInterval(); interval > 0 {
+		go s.feedWatchdog(interval)
+	}
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	for {
+		select {
+		case sig := <-stop:
+			// a second one kills the process if the shutdown hangs
+			signal.Reset(os.Interrupt, syscall.SIGTERM)
+			stdLogger.Info("shutting down", "signal", sig)
+			sdNotify("STOPPING=1")
+			s.shutdown()
+			return exitClean
+		case <-hup:
+			if logOutput != nil {
+				if err := logOutput.reopen(); err != nil {
+					stdLogger.Error("log file error", "err", err)
+				}
+				if *configPath == "" {
+					continue
+				}
+			}
+			if *configPath == "" {
+				stdLogger.Warn("SIGHUP ignored, there is no -config to reload")
+				continue
+			}
+			confs, err := loadConfig(*configPath, flagConfig)
+			if err != nil {
+				stdLogger.Error("config reload error", "err", err)
+				continue
+			}
+			stdLogger.Info("reloading", "config", *configPath)
+			sdNotify("RELOADING=1")
+			s.reload(confs)
+			sdNotify("READY=1")
+			if len(s.bridges) == 0 {
+				return exitClean
+			}
+		case code := <-s.oneshot:
+			stdLogger.Info("oneshot session over, exiting", "code", code)
+			s.shutdown()
+			return code
+		case r := <-s.exited:
+			if s.exit(r) {
+				// with -oneshot the code says why the last one failed
+				select {
+				case code := <-s.oneshot:
+					return code
+				default:
+				}
+				return exitFailed
+			}
+		}
 	}
 }
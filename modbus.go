@@ -0,0 +1,432 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const modeModbusGateway = "modbus-gateway"
+
+// Modbus limits and the exception codes of a gateway, see the Modbus
+// application protocol specification.
+const (
+	mbapHeaderSize = 7
+	modbusMaxPDU   = 253
+	modbusMaxRTU   = 256
+	// the colon, twice the hex digits of an RTU frame less its CRC plus
+	// the LRC, and CR LF
+	modbusMaxASCII = 1 + 2*(modbusMaxRTU-1) + 2
+
+	modbusPathUnavailable = 0x0a
+	modbusTargetFailed    = 0x0b
+
+	// how long the slaves get to act on a broadcast before the next request
+	modbusBroadcastDelay = 100 * time.Millisecond
+)
+
+var (
+	errModbusTimeout  = errors.New("no response from the modbus slave")
+	errModbusFraming  = errors.New("bad modbus tcp frame")
+	errModbusNoRoute  = errors.New("modbus route to a bridge that isn't serving")
+	errModbusPortDown = errors.New("modbus serial port is down")
+)
+
+// modbusGateway turns the Modbus TCP requests of the clients into Modbus RTU
+// or ASCII on the serial port and the responses back, one transaction at a
+// time.
+type modbusGateway struct {
+	mu      sync.Mutex
+	port    *serialPort
+	rx      *chunkReader
+	ascii   bool
+	timeout time.Duration
+	// gap ends the frames of the functions whose length isn't known
+	gap   time.Duration
+	idle  time.Time
+	stats *trafficStats
+
+	// blocks is -modbus-poll, read requests they cover are answered from
+	// them for maxAge
+	cacheMu sync.Mutex
+	blocks  []*modbusBlock
+	maxAge  time.Duration
+}
+
+func newModbusGateway(ctx context.Context, port *serialPort, conf *bridgeConfig, stats *trafficStats) (*modbusGateway, error) {
+	blocks, err := parseModbusPolls(conf.ModbusPoll)
+	if err != nil {
+		return nil, err
+	}
+	g := &modbusGateway{
+		port:    port,
+		rx:      newChunkReader(ctx, port),
+		ascii:   conf.ModbusFraming == "ascii",
+		timeout: time.Duration(conf.ModbusTimeout) * time.Millisecond,
+		gap:     time.Duration(conf.FrameGap) * time.Millisecond,
+		stats:   stats,
+		blocks:  blocks,
+		maxAge:  2 * time.Duration(conf.ModbusPollInterval) * time.Millisecond,
+	}
+	if g.gap == 0 {
+		g.gap = rtuSilence(port)
+	}
+	return g, nil
+}
+
+// rtuSilence is the 3.5 character times between two RTU frames, fixed
+// above 19200 baud.
+func rtuSilence(port *serialPort) time.Duration {
+	conf := port.Config()
+	if conf.Baud > 19200 {
+		return 1750 * time.Microsecond
+	}
+	return charTime(conf, 7) / 2
+}
+
+// crc16 is the CRC of Modbus RTU, sent low byte first.
+func crc16(b []byte) uint16 {
+	crc := uint16(0xffff)
+	for _, c := range b {
+		crc ^= uint16(c)
+		for i := 0; i < 8; i++ {
+			if crc&1 != 0 {
+				crc = crc>>1 ^ 0xa001
+			} else {
+				crc >>= 1
+			}
+		}
+	}
+	return crc
+}
+
+// rtuLength is the length of the RTU response that starts with b, 0 while
+// that isn't known yet and -1 for the functions only the gap ends.
+func rtuLength(b []byte) int {
+	if len(b) < 2 {
+		return 0
+	}
+	fc := b[1]
+	if fc&0x80 != 0 {
+		return 5
+	}
+	switch fc {
+	case 1, 2, 3, 4, 12, 17, 20, 21, 23:
+		if len(b) < 3 {
+			return 0
+		}
+		return 5 + int(b[2])
+	case 5, 6, 8, 11, 15, 16:
+		return 8
+	case 7:
+		return 5
+	case 22:
+		return 10
+	case 24:
+		if len(b) < 4 {
+			return 0
+		}
+		return 6 + int(binary.BigEndian.Uint16(b[2:]))
+	}
+	return -1
+}
+
+// lrc is the checksum of Modbus ASCII, the two's complement of the sum.
+func lrc(b []byte) byte {
+	var sum byte
+	for _, c := range b {
+		sum += c
+	}
+	return -sum
+}
+
+// encode frames the request pdu for unit as RTU or ASCII.
+func (g *modbusGateway) encode(unit byte, pdu []byte) []byte {
+	frame := append([]byte{unit}, pdu...)
+	if g.ascii {
+		frame = append(frame, lrc(frame))
+		return []byte(":" + strings.ToUpper(hex.EncodeToString(frame)) + "\r\n")
+	}
+	crc := crc16(frame)
+	return append(frame, byte(crc), byte(crc>>8))
+}
+
+// decode checks the response frame and returns its unit and pdu.
+func (g *modbusGateway) decode(frame []byte) (byte, []byte, error) {
+	if g.ascii {
+		b, err := hex.DecodeString(string(bytes.TrimSpace(frame[1:])))
+		if err != nil || len(b) < 3 {
+			return 0, nil, fmt.Errorf("modbus ascii error in %q", frame)
+		}
+		if lrc(b[:len(b)-1]) != b[len(b)-1] {
+			return 0, nil, fmt.Errorf("modbus lrc error in %q", frame)
+		}
+		return b[0], b[1 : len(b)-1], nil
+	}
+	if len(frame) < 4 || crc16(frame[:len(frame)-2]) != binary.LittleEndian.Uint16(frame[len(frame)-2:]) {
+		return 0, nil, fmt.Errorf("modbus crc error in % x", frame)
+	}
+	return frame[0], frame[1 : len(frame)-2], nil
+}
+
+// transact sends the request pdu to the slave unit and returns the pdu it
+// answered with, nil for a broadcast to unit 0.
+func (g *modbusGateway) transact(unit byte, pdu []byte) ([]byte, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if !g.port.IsOpen() {
+		return nil, errModbusPortDown
+	}
+	frame := g.encode(unit, pdu)
+
+	if d := time.Until(g.idle); d > 0 {
+		time.Sleep(d)
+	}
+	// whatever came in since the last transaction can't be the answer
+	g.rx.discard()
+	if _, err := g.port.Write(frame); err != nil {
+		return nil, err
+	}
+	g.stats.add(true, len(frame))
+	g.invalidate(unit, pdu[0])
+	sent := charTime(g.port.Config(), len(frame))
+	if unit == 0 {
+		g.idle = time.Now().Add(sent + modbusBroadcastDelay)
+		return nil, nil
+	}
+
+	read := g.readRTU
+	if g.ascii {
+		read = g.readASCII
+	}
+	resp, err := read(time.Now().Add(sent + g.timeout))
+	g.idle = time.Now().Add(g.gap)
+	if err != nil {
+		return nil, err
+	}
+	g.stats.add(false, len(resp))
+	respUnit, respPDU, err := g.decode(resp)
+	if err != nil {
+		return nil, err
+	}
+	if respUnit != unit || len(respPDU) == 0 || respPDU[0]&^0x80 != pdu[0] {
+		return nil, fmt.Errorf("modbus response % x doesn't match the request", resp)
+	}
+	return respPDU, nil
+}
+
+// readASCII collects one ASCII frame from the port, from the colon to the
+// line feed.
+func (g *modbusGateway) readASCII(deadline time.Time) ([]byte, error) {
+	var frame []byte
+	for {
+		if i := bytes.IndexByte(frame, ':'); i > 0 {
+			frame = frame[i:]
+		} else if i < 0 {
+			frame = frame[:0]
+		}
+		if i := bytes.IndexByte(frame, '\n'); i >= 0 {
+			return frame[:i+1], nil
+		}
+		wait := time.Until(deadline)
+		if wait <= 0 {
+			return nil, errModbusTimeout
+		}
+		chunk, err := g.rx.next(wait)
+		if err != nil {
+			return nil, err
+		}
+		if chunk == nil {
+			return nil, errModbusTimeout
+		}
+		frame = append(frame, chunk...)
+		if len(frame) > modbusMaxASCII {
+			return nil, fmt.Errorf("modbus response longer than %v bytes", modbusMaxASCII)
+		}
+	}
+}
+
+// readRTU collects one RTU frame from the port.
+func (g *modbusGateway) readRTU(deadline time.Time) ([]byte, error) {
+	var frame []byte
+	for {
+		want := rtuLength(frame)
+		if want > 0 && len(frame) >= want {
+			return frame[:want], nil
+		}
+		wait := time.Until(deadline)
+		if want < 0 {
+			wait = g.gap
+		}
+		if wait <= 0 {
+			return nil, errModbusTimeout
+		}
+		chunk, err := g.rx.next(wait)
+		if err != nil {
+			return nil, err
+		}
+		if chunk == nil {
+			if want < 0 {
+				return frame, nil
+			}
+			return nil, errModbusTimeout
+		}
+		frame = append(frame, chunk...)
+		if len(frame) > modbusMaxRTU {
+			return nil, fmt.Errorf("modbus response longer than %v bytes", modbusMaxRTU)
+		}
+	}
+}
+
+// parseModbusRoutes parses the -modbus-route map of unit ids, or ranges of
+// them, to bridge names, e.g. 1-10=ttyUSB0,11=ttyUSB1.
+func parseModbusRoutes(s string) (map[byte]string, error) {
+	routes := make(map[byte]string)
+	if s == "" {
+		return routes, nil
+	}
+	for _, entry := range strings.Split(s, ",") {
+		kv := strings.SplitN(entry, "=", 2)
+		if len(kv) != 2 || kv[1] == "" {
+			return nil, fmt.Errorf("invalid modbus route: %v", entry)
+		}
+		lo, hi := kv[0], kv[0]
+		if i := strings.IndexByte(kv[0], '-'); i >= 0 {
+			lo, hi = kv[0][:i], kv[0][i+1:]
+		}
+		first, err1 := strconv.ParseUint(lo, 10, 8)
+		last, err2 := strconv.ParseUint(hi, 10, 8)
+		if err1 != nil || err2 != nil || first == 0 || first > last {
+			return nil, fmt.Errorf("invalid modbus route: %v", entry)
+		}
+		for unit := first; unit <= last; unit++ {
+			routes[byte(unit)] = kv[1]
+		}
+	}
+	return routes, nil
+}
+
+func (b *bridge) modbusGateway() *modbusGateway {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.modbus
+}
+
+// routeModbus returns the gateways unit is reached through: the one of the
+// bridge -modbus-route names, or the own one. A broadcast goes through all
+// of them. A nil gateway means the bridge isn't there or not serving.
+func (b *bridge) routeModbus(unit byte) []*modbusGateway {
+	if unit == 0 {
+		gateways := []*modbusGateway{b.modbusGateway()}
+		seen := map[string]bool{b.conf.Name: true}
+		for _, name := range b.modbusRoutes {
+			if !seen[name] {
+				seen[name] = true
+				gateways = append(gateways, b.peerGateway(name))
+			}
+		}
+		return gateways
+	}
+	name, ok := b.modbusRoutes[unit]
+	if !ok {
+		return []*modbusGateway{b.modbusGateway()}
+	}
+	return []*modbusGateway{b.peerGateway(name)}
+}
+
+func (b *bridge) peerGateway(name string) *modbusGateway {
+	if name == b.conf.Name {
+		return b.modbusGateway()
+	}
+	if b.peer == nil {
+		return nil
+	}
+	peer := b.peer(name)
+	if peer == nil {
+		return nil
+	}
+	return peer.modbusGateway()
+}
+
+// transactModbus sends the request to unit through the gateways of
+// routeModbus, a broadcast still reaches the others when one fails.
+func (b *bridge) transactModbus(unit byte, pdu []byte) ([]byte, error) {
+	var resp []byte
+	var err error
+	for _, g := range b.routeModbus(unit) {
+		if g == nil {
+			err = errModbusNoRoute
+			continue
+		}
+		if r := g.cached(unit, pdu); r != nil {
+			resp = r
+			continue
+		}
+		r, gerr := g.transact(unit, pdu)
+		if gerr != nil {
+			err = gerr
+			continue
+		}
+		resp = r
+	}
+	if err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// serveModbus answers the Modbus TCP requests of c until it goes away.
+func (b *bridge) serveModbus(c *client) error {
+	logger := b.logger.with("addr", c.addr)
+	var hdr [mbapHeaderSize]byte
+	for {
+		if _, err := io.ReadFull(c.conn, hdr[:]); err != nil {
+			return err
+		}
+		length := int(binary.BigEndian.Uint16(hdr[4:]))
+		if binary.BigEndian.Uint16(hdr[2:]) != 0 || length < 2 || length > modbusMaxPDU+1 {
+			logger.Warn("modbus tcp error", "header", hdr[:])
+			return errModbusFraming
+		}
+		pdu := make([]byte, length-1)
+		if _, err := io.ReadFull(c.conn, pdu); err != nil {
+			return err
+		}
+		c.stats.add(true, len(hdr)+len(pdu))
+
+		unit := hdr[6]
+		start := time.Now()
+		resp, err := b.transactModbus(unit, pdu)
+		if err != nil {
+			logger.Warn("modbus error", "unit", unit, "function", pdu[0], "err", err)
+			code := byte(modbusTargetFailed)
+			if errors.Is(err, errModbusNoRoute) || errors.Is(err, errModbusPortDown) {
+				code = modbusPathUnavailable
+			}
+			resp = []byte{pdu[0] | 0x80, code}
+		} else if b.verbose() {
+			logger.Info("modbus", "unit", unit, "function", pdu[0], "bytes", len(resp), "time", time.Since(start))
+		}
+		if unit == 0 {
+			// a broadcast has no answer, not even an exception
+			continue
+		}
+
+		adu := make([]byte, mbapHeaderSize, mbapHeaderSize+len(resp))
+		copy(adu, hdr[:4])
+		binary.BigEndian.PutUint16(adu[4:], uint16(len(resp)+1))
+		adu[6] = unit
+		if !b.clients.send(c, append(adu, resp...)) {
+			return io.EOF
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+)
+
+func unhex(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestCRC16(t *testing.T) {
+	tests := []struct {
+		frame string
+		// the two bytes on the wire, low byte first
+		crc string
+	}{
+		{"010300000001", "840a"},
+		{"01030000000a", "c5cd"},
+		// the read holding registers example of the serial line spec
+		{"1103006b0003", "7687"},
+		{"010600010003", "980b"},
+		{"", "ffff"},
+	}
+	for _, tt := range tests {
+		crc := crc16(unhex(t, tt.frame))
+		if got := []byte{byte(crc), byte(crc >> 8)}; !bytes.Equal(got, unhex(t, tt.crc)) {
+			t.Errorf("crc16(%v) = % x, want %v", tt.frame, got, tt.crc)
+		}
+	}
+}
+
+func TestLRC(t *testing.T) {
+	tests := []struct {
+		frame string
+		lrc   byte
+	}{
+		// the LRC example of the serial line spec
+		{"1103006b0003", 0x7e},
+		{"010300000001", 0xfb},
+		{"00", 0x00},
+		{"ff01", 0x00},
+	}
+	for _, tt := range tests {
+		if got := lrc(unhex(t, tt.frame)); got != tt.lrc {
+			t.Errorf("lrc(%v) = %#02x, want %#02x", tt.frame, got, tt.lrc)
+		}
+	}
+}
+
+func TestRTULength(t *testing.T) {
+	tests := []struct {
+		name  string
+		start string
+		want  int
+	}{
+		{"too short", "01", 0},
+		{"read registers without count", "0103", 0},
+		{"read 2 registers", "010304", 9},
+		{"read coils", "010101", 6},
+		{"write single register", "0106", 8},
+		{"write multiple registers", "0110", 8},
+		{"exception to read", "0183", 5},
+		{"exception to write multiple", "0190", 5},
+		{"read fifo without count", "011800", 0},
+		{"read fifo", "01180006", 12},
+		{"unknown function", "0141", -1},
+	}
+	for _, tt := range tests {
+		if got := rtuLength(unhex(t, tt.start)); got != tt.want {
+			t.Errorf("%v: rtuLength(%v) = %v, want %v", tt.name, tt.start, got, tt.want)
+		}
+	}
+}
+
+func TestModbusEncodeDecode(t *testing.T) {
+	pdu := unhex(t, "03006b0003")
+	tests := []struct {
+		ascii bool
+		frame string
+	}{
+		{false, "\x11\x03\x00\x6b\x00\x03\x76\x87"},
+		{true, ":1103006B00037E\r\n"},
+	}
+	for _, tt := range tests {
+		g := &modbusGateway{ascii: tt.ascii}
+		frame := g.encode(0x11, pdu)
+		if string(frame) != tt.frame {
+			t.Errorf("ascii %v: encode = %q, want %q", tt.ascii, frame, tt.frame)
+		}
+		unit, got, err := g.decode(frame)
+		if err != nil || unit != 0x11 || !bytes.Equal(got, pdu) {
+			t.Errorf("ascii %v: decode(%q) = %v, % x, %v", tt.ascii, frame, unit, got, err)
+		}
+		frame[len(frame)-3] ^= 1
+		if _, _, err := g.decode(frame); err == nil {
+			t.Errorf("ascii %v: decode(%q) took a bad checksum", tt.ascii, frame)
+		}
+	}
+}
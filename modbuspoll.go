@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// modbusBlock is one range of -modbus-poll with the values it last read.
+type modbusBlock struct {
+	unit     byte
+	function byte
+	address  uint16
+	count    uint16
+
+	data    []byte
+	at      time.Time
+	failing bool
+}
+
+// size is the length of the values of the block in a read response.
+func (bl *modbusBlock) size() int {
+	if bl.function >= 3 {
+		return 2 * int(bl.count)
+	}
+	return (int(bl.count) + 7) / 8
+}
+
+// parseModbusPolls parses -modbus-poll, unit:function:address:count ranges
+// to read with the functions 1 to 4, e.g. 1:3:0:10,2:4:100:2.
+func parseModbusPolls(s string) ([]*modbusBlock, error) {
+	var blocks []*modbusBlock
+	if s == "" {
+		return blocks, nil
+	}
+	for _, entry := range strings.Split(s, ",") {
+		fields := strings.Split(entry, ":")
+		if len(fields) != 4 {
+			return nil, fmt.Errorf("invalid modbus poll: %v", entry)
+		}
+		var v [4]uint64
+		for i, f := range fields {
+			var err error
+			if v[i], err = strconv.ParseUint(f, 10, 16); err != nil {
+				return nil, fmt.Errorf("invalid modbus poll: %v", entry)
+			}
+		}
+		bl := &modbusBlock{unit: byte(v[0]), function: byte(v[1]), address: uint16(v[2]), count: uint16(v[3])}
+		max := uint16(2000)
+		if bl.function >= 3 {
+			max = 125
+		}
+		if v[0] < 1 || v[0] > 247 || bl.function < 1 || bl.function > 4 || bl.count < 1 || bl.count > max ||
+			v[2]+v[3] > 1<<16 {
+			return nil, fmt.Errorf("invalid modbus poll: %v", entry)
+		}
+		blocks = append(blocks, bl)
+	}
+	return blocks, nil
+}
+
+// poll reads the -modbus-poll blocks every interval until ctx is done.
+func (g *modbusGateway) poll(ctx context.Context, interval time.Duration, logger *Logger) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		for _, bl := range g.blocks {
+			pdu := []byte{bl.function, 0, 0, 0, 0}
+			binary.BigEndian.PutUint16(pdu[1:], bl.address)
+			binary.BigEndian.PutUint16(pdu[3:], bl.count)
+			resp, err := g.transact(bl.unit, pdu)
+			if err == nil && (len(resp) != 2+bl.size() || resp[0] != bl.function) {
+				err = fmt.Errorf("modbus response % x doesn't match the request", resp)
+			}
+
+			g.cacheMu.Lock()
+			if err == nil {
+				bl.data = resp[2:]
+				bl.at = time.Now()
+			}
+			changed := bl.failing != (err != nil)
+			bl.failing = err != nil
+			g.cacheMu.Unlock()
+
+			if changed && err != nil {
+				logger.Warn("modbus poll error", "unit", bl.unit, "function", bl.function, "address", bl.address, "err", err)
+			} else if changed {
+				logger.Info("modbus poll ok", "unit", bl.unit, "function", bl.function, "address", bl.address)
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// cached answers the read request pdu for unit from the -modbus-poll
+// blocks, it returns nil when none covers it or the values are too old.
+func (g *modbusGateway) cached(unit byte, pdu []byte) []byte {
+	if len(pdu) != 5 || pdu[0] < 1 || pdu[0] > 4 {
+		return nil
+	}
+	address := int(binary.BigEndian.Uint16(pdu[1:]))
+	count := int(binary.BigEndian.Uint16(pdu[3:]))
+
+	g.cacheMu.Lock()
+	defer g.cacheMu.Unlock()
+	for _, bl := range g.blocks {
+		first := int(bl.address)
+		if bl.unit != unit || bl.function != pdu[0] || address < first || address+count > first+int(bl.count) ||
+			count == 0 || time.Since(bl.at) > g.maxAge {
+			continue
+		}
+		off := address - first
+		if bl.function >= 3 {
+			data := bl.data[2*off : 2*(off+count)]
+			return append([]byte{pdu[0], byte(len(data))}, data...)
+		}
+		// coils and inputs come 8 to a byte, the lowest address first
+		bits := make([]byte, (count+7)/8)
+		for i := 0; i < count; i++ {
+			if n := off + i; bl.data[n/8]&(1<<(n%8)) != 0 {
+				bits[i/8] |= 1 << (i % 8)
+			}
+		}
+		return append([]byte{pdu[0], byte(len(bits))}, bits...)
+	}
+	return nil
+}
+
+// invalidate drops the cached values of unit after a write to it.
+func (g *modbusGateway) invalidate(unit byte, function byte) {
+	switch function {
+	case 5, 6, 15, 16, 22, 23:
+	default:
+		return
+	}
+	g.cacheMu.Lock()
+	defer g.cacheMu.Unlock()
+	for _, bl := range g.blocks {
+		if bl.unit == unit || unit == 0 {
+			bl.at = time.Time{}
+		}
+	}
+}
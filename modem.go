@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"time"
+)
+
+// modem status lines, in the bit layout of RFC 2217 NOTIFY-MODEMSTATE
+const (
+	modemCTS = 0x10
+	modemDSR = 0x20
+	modemRI  = 0x40
+	modemDCD = 0x80
+
+	modemDeltaCTS   = 0x01
+	modemDeltaDSR   = 0x02
+	modemTrailingRI = 0x04
+	modemDeltaDCD   = 0x08
+)
+
+// modemDeltas returns the delta bits for a change from old to state.
+func modemDeltas(old, state byte) byte {
+	var d byte
+	changed := old ^ state
+	if changed&modemCTS != 0 {
+		d |= modemDeltaCTS
+	}
+	if changed&modemDSR != 0 {
+		d |= modemDeltaDSR
+	}
+	if changed&modemRI != 0 && state&modemRI == 0 {
+		d |= modemTrailingRI
+	}
+	if changed&modemDCD != 0 {
+		d |= modemDeltaDCD
+	}
+	return d
+}
+
+func (b *bridge) modemState() (state byte, known bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.modem, b.modemKnown
+}
+
+// monitorModem polls the modem status lines, logs their changes and tells
+// the RFC 2217 clients. With -dcd-drop the clients are disconnected when
+// the carrier goes away.
+func (b *bridge) monitorModem(ctx context.Context, port *serialPort, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	failing := false
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		state, err := port.ModemStatus()
+		if err == errUnsupported {
+			b.logger.Warn("modem status is not supported")
+			return
+		}
+		if err != nil {
+			// the port may be reopening, say so once and keep polling
+			if !failing {
+				b.logger.Error("modem status error", "err", err)
+			}
+			failing = true
+			continue
+		}
+		failing = false
+
+		b.mu.Lock()
+		old, known := b.modem, b.modemKnown
+		b.modem, b.modemKnown = state, true
+		dropOnDCD := b.conf.DCDDrop
+		b.mu.Unlock()
+		if known && old == state {
+			continue
+		}
+
+		b.logger.Info("modem status", "cts", state&modemCTS != 0, "dsr", state&modemDSR != 0,
+			"dcd", state&modemDCD != 0, "ri", state&modemRI != 0)
+		if !known {
+			continue
+		}
+		deltas := modemDeltas(old, state)
+		for _, c := range b.clients.list() {
+			if t, ok := c.conn.(*telnetConn); ok {
+				t.notifyModemState(state | deltas)
+			}
+		}
+		if dropOnDCD && old&modemDCD != 0 && state&modemDCD == 0 {
+			b.logger.Warn("carrier lost, disconnecting the clients")
+			b.clients.closeAll()
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"sync"
+)
+
+// splitAddrs splits a -l or -observe value with several comma separated
+// addresses, e.g. [::1]:1234,10.0.0.5:1234.
+func splitAddrs(addr string) []string {
+	var addrs []string
+	for _, a := range strings.Split(addr, ",") {
+		if a = strings.TrimSpace(a); a != "" {
+			addrs = append(addrs, a)
+		}
+	}
+	return addrs
+}
+
+// listenTCPAddrs listens on every address of addr, several make one
+// multiListener.
+func listenTCPAddrs(addr string, conf *bridgeConfig, logger *Logger) (net.Listener, error) {
+	addrs := splitAddrs(addr)
+	if len(addrs) == 1 {
+		return listenTCP(addrs[0], conf, logger)
+	}
+	var ls []net.Listener
+	for _, a := range addrs {
+		l, err := listenTCP(a, conf, logger)
+		if err != nil {
+			for _, l := range ls {
+				l.Close()
+			}
+			return nil, err
+		}
+		ls = append(ls, l)
+	}
+	return newMultiListener(ls), nil
+}
+
+// multiListener accepts on several listeners at once, for the dual-stack
+// and multi-homed hosts that listen on some addresses but not all.
+type multiListener struct {
+	listeners []net.Listener
+	conns     chan net.Conn
+	errs      chan error
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+func newMultiListener(ls []net.Listener) *multiListener {
+	m := &multiListener{listeners: ls, conns: make(chan net.Conn), errs: make(chan error), closed: make(chan struct{})}
+	for _, l := range ls {
+		go m.acceptLoop(l)
+	}
+	return m
+}
+
+func (m *multiListener) acceptLoop(l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			select {
+			case m.errs <- err:
+			case <-m.closed:
+				return
+			}
+			if neterr, ok := err.(net.Error); ok && neterr.Temporary() {
+				continue
+			}
+			return
+		}
+		select {
+		case m.conns <- conn:
+		case <-m.closed:
+			conn.Close()
+			return
+		}
+	}
+}
+
+// Accept returns the next connection of any of the listeners, or the
+// error one of them stopped with.
+func (m *multiListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-m.conns:
+		return conn, nil
+	case err := <-m.errs:
+		return nil, err
+	case <-m.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (m *multiListener) Close() error {
+	m.closeOnce.Do(func() { close(m.closed) })
+	var err error
+	for _, l := range m.listeners {
+		if cerr := l.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// Addr is that of the first listener.
+func (m *multiListener) Addr() net.Addr {
+	return m.listeners[0].Addr()
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/yamux"
+)
+
+const (
+	// the first line of a -mux stream names what it is for
+	muxAdmin   = "admin"
+	muxEvents  = "events"
+	muxObserve = "observe"
+)
+
+// serveMux serves the -mux listener, every connection is a yamux session
+// and every stream the client opens in it starts with a line: the name of
+// a bridge for its data, observe and the name to only watch it, admin for
+// the management API or events for the log lines as they are logged.
+func (s *supervisor) serveMux(addr, adminToken string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+	if flagConfig.TLSCert != "" || flagConfig.TLSKey != "" || flagConfig.TLSClientCA != "" {
+		tlsConf, err := tlsConfig(&flagConfig)
+		if err != nil {
+			return err
+		}
+		l = tls.NewListener(l, tlsConf)
+	}
+
+	admin := newStreamListener(l.Addr())
+	defer admin.Close()
+	go http.Serve(admin, s.adminHandler(adminToken))
+
+	conf := yamux.DefaultConfig()
+	conf.LogOutput = muxLogWriter{}
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if neterr, ok := err.(net.Error); ok && neterr.Temporary() {
+				continue
+			}
+			return err
+		}
+		session, err := yamux.Server(conn, conf)
+		if err != nil {
+			conn.Close()
+			return err
+		}
+		stdLogger.Info("mux session", "addr", conn.RemoteAddr())
+		go s.serveMuxSession(session, admin)
+	}
+}
+
+func (s *supervisor) serveMuxSession(session *yamux.Session, admin *streamListener) {
+	defer session.Close()
+	for {
+		stream, err := session.AcceptStream()
+		if err != nil {
+			stdLogger.Info("mux session closed", "addr", session.RemoteAddr(), "err", err)
+			return
+		}
+		go s.muxStream(stream, admin)
+	}
+}
+
+func (s *supervisor) muxStream(stream *yamux.Stream, admin *streamListener) {
+	stream.SetReadDeadline(time.Now().Add(30 * time.Second))
+	name, err := readLine(stream, 64)
+	stream.SetReadDeadline(time.Time{})
+	if err != nil {
+		stream.Close()
+		return
+	}
+	switch name {
+	case muxAdmin:
+		admin.add(stream)
+	case muxEvents:
+		streamEvents(stream)
+	default:
+		observer := strings.HasPrefix(name, muxObserve+" ")
+		b := s.lookup(strings.TrimPrefix(name, muxObserve+" "))
+		if b == nil || b.config().Proto != "tcp" {
+			fmt.Fprint(stream, "no such port\r\n")
+			stream.Close()
+			return
+		}
+		if err := b.attach(stream, observer); err != nil {
+			fmt.Fprintf(stream, "%v\r\n", err)
+			stream.Close()
+		}
+	}
+}
+
+// streamEvents writes the log lines to stream until it is closed.
+func streamEvents(stream *yamux.Stream) {
+	defer stream.Close()
+	lines, stop := logHistory.watch()
+	defer stop()
+	closed := make(chan struct{})
+	go func() {
+		var b [64]byte
+		for {
+			if _, err := stream.Read(b[:]); err != nil {
+				close(closed)
+				return
+			}
+		}
+	}()
+	for {
+		select {
+		case line := <-lines:
+			if _, err := fmt.Fprintf(stream, "%s\n", line); err != nil {
+				return
+			}
+		case <-closed:
+			return
+		}
+	}
+}
+
+// streamListener hands the admin streams of all sessions to one
+// http.Serve.
+type streamListener struct {
+	addr      net.Addr
+	conns     chan net.Conn
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+func newStreamListener(addr net.Addr) *streamListener {
+	return &streamListener{addr: addr, conns: make(chan net.Conn), closed: make(chan struct{})}
+}
+
+func (l *streamListener) add(conn net.Conn) {
+	select {
+	case l.conns <- conn:
+	case <-l.closed:
+		conn.Close()
+	}
+}
+
+func (l *streamListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *streamListener) Close() error {
+	l.closeOnce.Do(func() { close(l.closed) })
+	return nil
+}
+
+func (l *streamListener) Addr() net.Addr {
+	return l.addr
+}
+
+// muxLogWriter passes on what yamux logs, e.g. [ERR] yamux: keepalive
+// failed.
+type muxLogWriter struct{}
+
+func (muxLogWriter) Write(b []byte) (int, error) {
+	stdLogger.Warn("mux", "msg", strings.TrimSpace(string(b)))
+	return len(b), nil
+}
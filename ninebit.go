@@ -0,0 +1,88 @@
+package main
+
+import (
+	"github.com/tarm/serial"
+)
+
+// with -nine-bit the clients mark the address bytes of a 9-bit multidrop
+// bus the way linux PARMRK marks parity errors: 0xff 0x00 c is c with the
+// 9th bit set, 0xff 0xff is a 0xff data byte.
+const nineBitEscape = 0xff
+
+// nineBitState is where the escape sequence stopped at the end of the last
+// write.
+type nineBitState int
+
+const (
+	nineBitData nineBitState = iota
+	nineBitEscaped
+	nineBitAddress
+)
+
+// sendNineBit writes b with Space parity except for the marked address
+// bytes, which go out alone with Mark parity. s.wmu must be held.
+func (s *serialPort) sendNineBit(port serialDevice, b []byte) (int, error) {
+	var data []byte
+	flush := func() error {
+		if len(data) == 0 {
+			return nil
+		}
+		_, err := port.Write(data)
+		data = data[:0]
+		return err
+	}
+	for _, c := range b {
+		switch s.nineBit {
+		case nineBitEscaped:
+			switch c {
+			case 0:
+				s.nineBit = nineBitAddress
+				continue
+			case nineBitEscape:
+				data = append(data, c)
+			default:
+				data = append(data, nineBitEscape, c)
+			}
+			s.nineBit = nineBitData
+		case nineBitAddress:
+			s.nineBit = nineBitData
+			if err := flush(); err != nil {
+				return 0, err
+			}
+			if err := s.sendAddress(port, c); err != nil {
+				return 0, err
+			}
+		default:
+			if c == nineBitEscape {
+				s.nineBit = nineBitEscaped
+			} else {
+				data = append(data, c)
+			}
+		}
+	}
+	if err := flush(); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// sendAddress sends c with Mark parity and goes back to Space parity once
+// it has been sent.
+func (s *serialPort) sendAddress(port serialDevice, c byte) error {
+	conf := s.Config()
+	if err := port.Drain(); err != nil {
+		return err
+	}
+	conf.Parity = serial.ParityMark
+	if err := port.SetConfig(conf); err != nil {
+		return err
+	}
+	if _, err := port.Write([]byte{c}); err != nil {
+		return err
+	}
+	if err := port.Drain(); err != nil {
+		return err
+	}
+	conf.Parity = serial.ParitySpace
+	return port.SetConfig(conf)
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"strconv"
+)
+
+const (
+	modeNMEA = "nmea"
+
+	// longer than the 82 characters of the standard, for the talkers
+	// that don't keep to it
+	nmeaMaxSentence = 256
+)
+
+// nmeaChecksum is the xor of the characters between the $ or ! and the *.
+func nmeaChecksum(body []byte) byte {
+	var sum byte
+	for _, c := range body {
+		sum ^= c
+	}
+	return sum
+}
+
+// validNMEA reports whether line, without CR LF, is a sentence that ends in
+// the checksum of it.
+func validNMEA(line []byte) bool {
+	if len(line) < 4 || (line[0] != '$' && line[0] != '!') {
+		return false
+	}
+	star := len(line) - 3
+	if line[star] != '*' {
+		return false
+	}
+	sum, err := strconv.ParseUint(string(line[star+1:]), 16, 8)
+	return err == nil && byte(sum) == nmeaChecksum(line[1:star])
+}
+
+// nmeaWriter passes on whole sentences with a good checksum, one per Write
+// to dst, and drops the rest, see -mode nmea.
+type nmeaWriter struct {
+	dst     io.Writer
+	logger  *Logger
+	pending []byte
+}
+
+func newNMEAWriter(dst io.Writer, logger *Logger) *nmeaWriter {
+	return &nmeaWriter{dst: dst, logger: logger}
+}
+
+func (w *nmeaWriter) Write(b []byte) (int, error) {
+	w.pending = append(w.pending, b...)
+	for {
+		i := bytes.IndexByte(w.pending, '\n')
+		if i < 0 {
+			break
+		}
+		line := bytes.TrimRight(w.pending[:i], "\r")
+		w.pending = w.pending[i+1:]
+		// noise before the start of the sentence
+		if start := bytes.IndexAny(line, "$!"); start > 0 {
+			line = line[start:]
+		}
+		if len(line) == 0 {
+			continue
+		}
+		if !validNMEA(line) {
+			w.logger.Debug("nmea sentence dropped", "data", string(line))
+			continue
+		}
+		sentence := make([]byte, 0, len(line)+2)
+		sentence = append(append(sentence, line...), '\r', '\n')
+		if _, err := w.dst.Write(sentence); err != nil {
+			return len(b), err
+		}
+	}
+	if len(w.pending) > nmeaMaxSentence {
+		w.logger.Debug("nmea sentence dropped", "data", string(w.pending))
+		w.pending = nil
+	}
+	return len(b), nil
+}
+
+// nmeaInjector sends the sentences of client c to the serial port and the
+// other clients.
+type nmeaInjector struct {
+	b *bridge
+	c *client
+}
+
+func (j nmeaInjector) Write(p []byte) (int, error) {
+	j.b.clients.broadcast(j.c, p)
+	return j.b.serial.Write(p)
+}
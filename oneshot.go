@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+)
+
+// the exit codes, with -oneshot they tell how the session ended
+const (
+	exitClean   = 0
+	exitFailed  = 1
+	exitSerial  = 2
+	exitNetwork = 3
+	exitAuth    = 4
+)
+
+// serialError is a write to the serial port that failed in a relay, as
+// opposed to the client side of it.
+type serialError struct {
+	err error
+}
+
+func (e serialError) Error() string { return e.err.Error() }
+func (e serialError) Unwrap() error { return e.err }
+
+// ended hands code to serve with -oneshot, the first one counts.
+func (b *bridge) ended(code int) {
+	select {
+	case b.oneshot <- code:
+	default:
+	}
+}
+
+// sessionCode is the exit code for a session the relay ended with err.
+// Closed by us, an idle timeout, a kick from the admin api or a shutdown,
+// counts as clean.
+func (b *bridge) sessionCode(err error) int {
+	var serr serialError
+	switch {
+	case b.serial.Err() != nil || errors.As(err, &serr):
+		return exitSerial
+	case err == nil || err == io.EOF || errors.Is(err, net.ErrClosed) || errors.Is(err, context.Canceled):
+		return exitClean
+	}
+	return exitNetwork
+}
+
+// failCode is the exit code for a bridge that stopped before its session
+// did: the serial port didn't open or failed, or the listener did.
+func (b *bridge) failCode() int {
+	b.mu.Lock()
+	serial := b.serial
+	b.mu.Unlock()
+	if serial == nil || serial.Err() != nil {
+		return exitSerial
+	}
+	return exitNetwork
+}
@@ -0,0 +1,73 @@
+package main
+
+import "time"
+
+// a paced write goes to the driver in pieces that take about this long on
+// the line, so it never holds much more than that
+const paceChunk = 20 * time.Millisecond
+
+// paced reports whether the writes go through sendPaced, for -pace,
+// -tx-char-delay or -tx-line-delay.
+func (s *serialPort) paced() bool {
+	return s.pace > 0 || s.charDelay > 0 || s.lineDelay > 0
+}
+
+// sendPaced hands b to send no faster than -pace percent of the line rate
+// allows, with -tx-char-delay after every byte and -tx-line-delay after
+// every line on the wire. s.wmu must be held.
+func (s *serialPort) sendPaced(port serialDevice, b []byte, send func(serialDevice, []byte) (int, error)) (int, error) {
+	perByte := charTime(s.Config(), 1)
+	chunk := len(b)
+	if s.pace > 0 {
+		perByte = perByte * 100 / time.Duration(s.pace)
+		if perByte > 0 {
+			chunk = int(paceChunk / perByte)
+		}
+	}
+	if s.charDelay > 0 || chunk < 1 {
+		chunk = 1
+	}
+	written := 0
+	for written < len(b) {
+		if d := time.Until(s.paceNext); d > 0 {
+			time.Sleep(d)
+		}
+		end := written + chunk
+		if end > len(b) {
+			end = len(b)
+		}
+		gap := s.charDelay
+		if s.lineDelay > 0 {
+			if i := lineEnd(b[written:end]); i >= 0 {
+				end = written + i + 1
+			}
+			// a \r\n gets the delay after the \n
+			last := b[end-1]
+			crlf := last == '\r' && end < len(b) && b[end] == '\n'
+			if (last == '\n' || last == '\r') && !crlf {
+				gap += s.lineDelay
+			}
+		}
+		n, err := send(port, b[written:end])
+		written += n
+		// the line is busy until what it was given is out, and for the gap
+		if now := time.Now(); s.paceNext.Before(now) {
+			s.paceNext = now
+		}
+		s.paceNext = s.paceNext.Add(time.Duration(n)*perByte + gap)
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+// lineEnd is the index of the first \n or \r in b, -1 if there is none.
+func lineEnd(b []byte) int {
+	for i, c := range b {
+		if c == '\n' || c == '\r' {
+			return i
+		}
+	}
+	return -1
+}
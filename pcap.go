@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/binary"
+	"os"
+	"sync"
+	"time"
+)
+
+// pcapng block types and options, see
+// https://www.ietf.org/archive/id/draft-tuexen-opsawg-pcapng-05.html
+const (
+	pcapngSectionHeader    = 0x0a0d0d0a
+	pcapngInterfaceDesc    = 0x00000001
+	pcapngEnhancedPacket   = 0x00000006
+	pcapngByteOrderMagic   = 0x1a2b3c4d
+	pcapngOptEnd           = 0
+	pcapngOptComment       = 1
+	pcapngOptIfName        = 2
+	pcapngOptEpbFlags      = 2
+	pcapngFlagInbound      = 1
+	pcapngFlagOutbound     = 2
+	pcapngLinkTypeUser0    = 147
+	pcapngDefaultTimestamp = 1000 * 1000
+)
+
+// pcapWriter records the traffic of a bridge as a pcapng file with one
+// DLT_USER0 interface, the serial port. Data read from the port is
+// inbound, data written to it outbound with the client address as the
+// packet comment.
+type pcapWriter struct {
+	mu sync.Mutex
+	f  *os.File
+}
+
+func newPcapWriter(path, device string) (*pcapWriter, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	p := &pcapWriter{f: f}
+
+	var shb []byte
+	shb = appendUint32(shb, pcapngByteOrderMagic)
+	shb = appendUint16(shb, 1)
+	shb = appendUint16(shb, 0)
+	// unknown section length
+	shb = appendUint64(shb, ^uint64(0))
+
+	var idb []byte
+	idb = appendUint16(idb, pcapngLinkTypeUser0)
+	idb = appendUint16(idb, 0)
+	idb = appendUint32(idb, 0)
+	idb = pcapngOption(idb, pcapngOptIfName, []byte(device))
+	idb = pcapngOption(idb, pcapngOptEnd, nil)
+
+	b := pcapngBlock(nil, pcapngSectionHeader, shb)
+	b = pcapngBlock(b, pcapngInterfaceDesc, idb)
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return p, nil
+}
+
+// packet appends one enhanced packet block.
+func (p *pcapWriter) packet(outbound bool, comment string, data []byte) error {
+	ts := uint64(time.Now().UnixNano() / (1e9 / pcapngDefaultTimestamp))
+	flags := uint32(pcapngFlagInbound)
+	if outbound {
+		flags = pcapngFlagOutbound
+	}
+
+	var epb []byte
+	epb = appendUint32(epb, 0)
+	epb = appendUint32(epb, uint32(ts>>32))
+	epb = appendUint32(epb, uint32(ts))
+	epb = appendUint32(epb, uint32(len(data)))
+	epb = appendUint32(epb, uint32(len(data)))
+	epb = append(epb, data...)
+	epb = append(epb, make([]byte, pad4(len(data)))...)
+	epb = pcapngOption(epb, pcapngOptEpbFlags, appendUint32(nil, flags))
+	if comment != "" {
+		epb = pcapngOption(epb, pcapngOptComment, []byte(comment))
+	}
+	epb = pcapngOption(epb, pcapngOptEnd, nil)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	_, err := p.f.Write(pcapngBlock(nil, pcapngEnhancedPacket, epb))
+	return err
+}
+
+func (p *pcapWriter) Close() error {
+	return p.f.Close()
+}
+
+func pad4(n int) int {
+	return (4 - n%4) % 4
+}
+
+func pcapngBlock(b []byte, blockType uint32, body []byte) []byte {
+	length := uint32(12 + len(body))
+	b = appendUint32(b, blockType)
+	b = appendUint32(b, length)
+	b = append(b, body...)
+	return appendUint32(b, length)
+}
+
+func pcapngOption(b []byte, code uint16, value []byte) []byte {
+	b = appendUint16(b, code)
+	b = appendUint16(b, uint16(len(value)))
+	b = append(b, value...)
+	return append(b, make([]byte, pad4(len(value)))...)
+}
+
+func appendUint16(b []byte, v uint16) []byte {
+	var buf [2]byte
+	binary.LittleEndian.PutUint16(buf[:], v)
+	return append(b, buf[:]...)
+}
+
+func appendUint32(b []byte, v uint32) []byte {
+	var buf [4]byte
+	binary.LittleEndian.PutUint32(buf[:], v)
+	return append(b, buf[:]...)
+}
+
+func appendUint64(b []byte, v uint64) []byte {
+	var buf [8]byte
+	binary.LittleEndian.PutUint64(buf[:], v)
+	return append(b, buf[:]...)
+}
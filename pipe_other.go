@@ -0,0 +1,10 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import "net"
+
+func newPipeListener(path string, sddl string) (net.Listener, error) {
+	return nil, errUnsupported
+}
@@ -0,0 +1,15 @@
+package main
+
+import (
+	"net"
+
+	"github.com/Microsoft/go-winio"
+)
+
+func newPipeListener(path string, sddl string) (net.Listener, error) {
+	return winio.ListenPipe(path, &winio.PipeConfig{
+		SecurityDescriptor: sddl,
+		InputBufferSize:    4096,
+		OutputBufferSize:   4096,
+	})
+}
@@ -0,0 +1,10 @@
+//go:build windows || plan9
+// +build windows plan9
+
+package main
+
+// -user and -group are for unix, a windows service has the account the
+// service manager gives it.
+func dropPrivileges(userName, groupName string) error {
+	return errUnsupported
+}
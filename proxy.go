@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// a v1 header is one line of at most 107 bytes
+	proxyV1MaxLine = 107
+	// how long a connection gets to send its header
+	proxyHeaderTimeout = 5 * time.Second
+)
+
+var (
+	proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+	errProxyHeader = errors.New("bad proxy protocol header")
+)
+
+// proxyListener reads the HAProxy PROXY protocol header, v1 or v2, of
+// every connection before Accept returns it, so that the allow/deny list
+// and the logs see the client rather than the load balancer. The headers
+// are read off the accept loop, a slow one doesn't hold up the others.
+type proxyListener struct {
+	net.Listener
+	logger *Logger
+	conns  chan net.Conn
+
+	// err is why the listener stopped, set before stopped is closed
+	err       error
+	stopped   chan struct{}
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+func newProxyListener(l net.Listener, logger *Logger) *proxyListener {
+	p := &proxyListener{Listener: l, logger: logger, conns: make(chan net.Conn),
+		stopped: make(chan struct{}), closed: make(chan struct{})}
+	go p.acceptLoop()
+	return p
+}
+
+func (p *proxyListener) acceptLoop() {
+	defer close(p.stopped)
+	for {
+		conn, err := p.Listener.Accept()
+		if err != nil {
+			if neterr, ok := err.(net.Error); ok && neterr.Temporary() {
+				continue
+			}
+			p.err = err
+			return
+		}
+		go p.handshake(conn)
+	}
+}
+
+func (p *proxyListener) handshake(conn net.Conn) {
+	pc, err := readProxyHeader(conn)
+	if err != nil {
+		p.logger.Warn("proxy header error", "addr", conn.RemoteAddr(), "err", err)
+		conn.Close()
+		return
+	}
+	select {
+	case p.conns <- pc:
+	case <-p.closed:
+		pc.Close()
+	}
+}
+
+func (p *proxyListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-p.conns:
+		return conn, nil
+	case <-p.stopped:
+		return nil, p.err
+	}
+}
+
+func (p *proxyListener) Close() error {
+	p.closeOnce.Do(func() { close(p.closed) })
+	return p.Listener.Close()
+}
+
+// proxyConn is a connection with the addresses its PROXY header gave.
+type proxyConn struct {
+	net.Conn
+	r      *bufio.Reader
+	remote net.Addr
+	local  net.Addr
+}
+
+func (c *proxyConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+	if c.remote != nil {
+		return c.remote
+	}
+	return c.Conn.RemoteAddr()
+}
+
+func (c *proxyConn) LocalAddr() net.Addr {
+	if c.local != nil {
+		return c.local
+	}
+	return c.Conn.LocalAddr()
+}
+
+// readProxyHeader reads the header at the start of conn. The health checks
+// of the balancer, v1 UNKNOWN and v2 LOCAL, keep the addresses of conn.
+func readProxyHeader(conn net.Conn) (*proxyConn, error) {
+	conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+	c := &proxyConn{Conn: conn, r: bufio.NewReader(conn)}
+	start, err := c.r.Peek(5)
+	if err != nil {
+		return nil, err
+	}
+	if string(start) == "PROXY" {
+		err = c.readV1()
+	} else {
+		err = c.readV2()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// readV1 reads PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n.
+func (c *proxyConn) readV1() error {
+	var line []byte
+	for {
+		b, err := c.r.ReadByte()
+		if err != nil {
+			return err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+		if len(line) >= proxyV1MaxLine {
+			return errProxyHeader
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return errProxyHeader
+	}
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return fmt.Errorf("%w: %q", errProxyHeader, line)
+	}
+	src, dst := net.ParseIP(fields[2]), net.ParseIP(fields[3])
+	srcPort, err1 := strconv.ParseUint(fields[4], 10, 16)
+	dstPort, err2 := strconv.ParseUint(fields[5], 10, 16)
+	if src == nil || dst == nil || err1 != nil || err2 != nil {
+		return fmt.Errorf("%w: %q", errProxyHeader, line)
+	}
+	c.remote = &net.TCPAddr{IP: src, Port: int(srcPort)}
+	c.local = &net.TCPAddr{IP: dst, Port: int(dstPort)}
+	return nil
+}
+
+// readV2 reads the binary header, the TLVs after the addresses are
+// skipped.
+func (c *proxyConn) readV2() error {
+	var head [16]byte
+	if _, err := io.ReadFull(c.r, head[:]); err != nil {
+		return err
+	}
+	if !bytes.Equal(head[:12], proxyV2Signature) || head[12]>>4 != 2 {
+		return errProxyHeader
+	}
+	body := make([]byte, binary.BigEndian.Uint16(head[14:]))
+	if _, err := io.ReadFull(c.r, body); err != nil {
+		return err
+	}
+	switch head[12] & 0x0f {
+	case 0x0:
+		// LOCAL
+		return nil
+	case 0x1:
+		// PROXY
+	default:
+		return errProxyHeader
+	}
+	var size int
+	switch head[13] >> 4 {
+	case 0x1:
+		size = net.IPv4len
+	case 0x2:
+		size = net.IPv6len
+	default:
+		// unix sockets and unspecified keep the addresses of the connection
+		return nil
+	}
+	if len(body) < 2*size+4 {
+		return errProxyHeader
+	}
+	src := net.IP(append([]byte(nil), body[:size]...))
+	dst := net.IP(append([]byte(nil), body[size:2*size]...))
+	srcPort := binary.BigEndian.Uint16(body[2*size:])
+	dstPort := binary.BigEndian.Uint16(body[2*size+2:])
+	if head[13]&0x0f == 0x2 {
+		c.remote = &net.UDPAddr{IP: src, Port: int(srcPort)}
+		c.local = &net.UDPAddr{IP: dst, Port: int(dstPort)}
+	} else {
+		c.remote = &net.TCPAddr{IP: src, Port: int(srcPort)}
+		c.local = &net.TCPAddr{IP: dst, Port: int(dstPort)}
+	}
+	return nil
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+// readHeader has readProxyHeader read data off a pipe, which is closed
+// after it when eof is set.
+func readHeader(t *testing.T, data []byte, eof bool) (*proxyConn, error) {
+	t.Helper()
+	client, server := net.Pipe()
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	go func() {
+		client.Write(data)
+		if eof {
+			client.Close()
+		}
+	}()
+	return readProxyHeader(server)
+}
+
+func proxyV2(command, family byte, body []byte) []byte {
+	b := append([]byte(nil), proxyV2Signature...)
+	b = append(b, command, family, byte(len(body)>>8), byte(len(body)))
+	return append(b, body...)
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	v4 := []byte{192, 0, 2, 1, 198, 51, 100, 1, 0xdc, 0x04, 0x01, 0xbb}
+	v6 := append(append(net.ParseIP("2001:db8::1").To16(), net.ParseIP("2001:db8::2").To16()...), 0xdc, 0x04, 0x01, 0xbb)
+	tests := []struct {
+		name   string
+		header []byte
+		// remote and local are empty when the pipe keeps its addresses
+		remote, local string
+	}{
+		{"v1 tcp4", []byte("PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n"), "192.0.2.1:56324", "198.51.100.1:443"},
+		{"v1 tcp6", []byte("PROXY TCP6 2001:db8::1 2001:db8::2 56324 443\r\n"), "[2001:db8::1]:56324", "[2001:db8::2]:443"},
+		{"v1 unknown", []byte("PROXY UNKNOWN\r\n"), "", ""},
+		{"v1 unknown with addresses", []byte("PROXY UNKNOWN ffff::1 ffff::2 1 2\r\n"), "", ""},
+		{"v2 proxy tcp4", proxyV2(0x21, 0x11, v4), "192.0.2.1:56324", "198.51.100.1:443"},
+		{"v2 proxy tcp6", proxyV2(0x21, 0x21, v6), "[2001:db8::1]:56324", "[2001:db8::2]:443"},
+		{"v2 proxy udp4", proxyV2(0x21, 0x12, v4), "192.0.2.1:56324", "198.51.100.1:443"},
+		{"v2 proxy tcp4 with tlvs", proxyV2(0x21, 0x11, append(v4, 0x04, 0x00, 0x01, 0x00)), "192.0.2.1:56324", "198.51.100.1:443"},
+		{"v2 local", proxyV2(0x20, 0x00, nil), "", ""},
+		{"v2 local with addresses", proxyV2(0x20, 0x11, v4), "", ""},
+		{"v2 proxy unix", proxyV2(0x21, 0x31, make([]byte, 216)), "", ""},
+	}
+	for _, tt := range tests {
+		c, err := readHeader(t, append(append([]byte(nil), tt.header...), "hello"...), false)
+		if err != nil {
+			t.Errorf("%v: %v", tt.name, err)
+			continue
+		}
+		remote, local := tt.remote, tt.local
+		if remote == "" {
+			remote, local = "pipe", "pipe"
+		}
+		if got := c.RemoteAddr().String(); got != remote {
+			t.Errorf("%v: remote %v, want %v", tt.name, got, remote)
+		}
+		if got := c.LocalAddr().String(); got != local {
+			t.Errorf("%v: local %v, want %v", tt.name, got, local)
+		}
+		if _, ok := c.RemoteAddr().(*net.UDPAddr); ok != (tt.header[13] == 0x12) {
+			t.Errorf("%v: remote is a %T", tt.name, c.RemoteAddr())
+		}
+		data := make([]byte, 5)
+		if _, err := io.ReadFull(c, data); err != nil || string(data) != "hello" {
+			t.Errorf("%v: data after the header %q, %v", tt.name, data, err)
+		}
+	}
+}
+
+func TestReadProxyHeaderRejects(t *testing.T) {
+	v4 := []byte{192, 0, 2, 1, 198, 51, 100, 1, 0xdc, 0x04, 0x01, 0xbb}
+	tests := []struct {
+		name   string
+		header []byte
+		// the header is cut off by the end of the connection
+		eof bool
+	}{
+		{"v1 oversize", []byte("PROXY TCP4 " + strings.Repeat("1", proxyV1MaxLine) + "\r\n"), false},
+		{"v1 without cr", []byte("PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\n"), false},
+		{"v1 bad protocol", []byte("PROXY UDP4 192.0.2.1 198.51.100.1 56324 443\r\n"), false},
+		{"v1 missing port", []byte("PROXY TCP4 192.0.2.1 198.51.100.1 56324\r\n"), false},
+		{"v1 bad address", []byte("PROXY TCP4 192.0.2.256 198.51.100.1 56324 443\r\n"), false},
+		{"v1 port out of range", []byte("PROXY TCP4 192.0.2.1 198.51.100.1 65536 443\r\n"), false},
+		{"v1 truncated", []byte("PROXY TCP4 192.0.2.1"), true},
+		{"v2 bad signature", append([]byte("\r\n\r\n\x00\r\nQUIX\n"), 0x21, 0x11, 0, 12), false},
+		{"v2 bad version", proxyV2(0x11, 0x11, v4), false},
+		{"v2 bad command", proxyV2(0x22, 0x11, v4), false},
+		{"v2 addresses too short", proxyV2(0x21, 0x11, v4[:8]), false},
+		{"v2 truncated head", proxyV2(0x21, 0x11, v4)[:14], true},
+		{"v2 truncated body", proxyV2(0x21, 0x11, v4)[:20], true},
+	}
+	for _, tt := range tests {
+		c, err := readHeader(t, tt.header, tt.eof)
+		if err == nil {
+			t.Errorf("%v: accepted, remote %v", tt.name, c.RemoteAddr())
+			continue
+		}
+		if !tt.eof && !errors.Is(err, errProxyHeader) {
+			t.Errorf("%v: %v, want %v", tt.name, err, errProxyHeader)
+		}
+	}
+}
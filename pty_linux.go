@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/tarm/serial"
+	"golang.org/x/sys/unix"
+)
+
+// pty is a pseudo terminal in raw mode, the programs open slave as if it
+// was a serial port and the master end is read and written here.
+type pty struct {
+	*os.File
+	slave string
+	// held open so that reading the master doesn't fail while no program
+	// has the slave open
+	hold *os.File
+}
+
+func openPty() (*pty, error) {
+	fd, err := unix.Open("/dev/ptmx", unix.O_RDWR|unix.O_NOCTTY|unix.O_NONBLOCK|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: "/dev/ptmx", Err: err}
+	}
+	master := os.NewFile(uintptr(fd), "/dev/ptmx")
+	if err := unix.IoctlSetPointerInt(fd, unix.TIOCSPTLCK, 0); err != nil {
+		master.Close()
+		return nil, os.NewSyscallError("TIOCSPTLCK", err)
+	}
+	n, err := unix.IoctlGetInt(fd, unix.TIOCGPTN)
+	if err != nil {
+		master.Close()
+		return nil, os.NewSyscallError("TIOCGPTN", err)
+	}
+	slave := fmt.Sprintf("/dev/pts/%d", n)
+	hold, err := os.OpenFile(slave, os.O_RDWR|unix.O_NOCTTY, 0)
+	if err != nil {
+		master.Close()
+		return nil, err
+	}
+	if err := makeRaw(int(hold.Fd())); err != nil {
+		hold.Close()
+		master.Close()
+		return nil, err
+	}
+	return &pty{File: master, slave: slave, hold: hold}, nil
+}
+
+// makeRaw is cfmakeraw, the bytes go through the line discipline as they
+// are.
+func makeRaw(fd int) error {
+	t, err := unix.IoctlGetTermios(fd, unix.TCGETS)
+	if err != nil {
+		return err
+	}
+	t.Iflag &^= unix.IGNBRK | unix.BRKINT | unix.PARMRK | unix.ISTRIP | unix.INLCR | unix.IGNCR | unix.ICRNL | unix.IXON
+	t.Oflag &^= unix.OPOST
+	t.Lflag &^= unix.ECHO | unix.ECHONL | unix.ICANON | unix.ISIG | unix.IEXTEN
+	t.Cflag &^= unix.CSIZE | unix.PARENB
+	t.Cflag |= unix.CS8
+	t.Cc[unix.VMIN], t.Cc[unix.VTIME] = 1, 0
+	return unix.IoctlSetTermios(fd, unix.TCSETS, t)
+}
+
+// line is what the programs set on the slave with tcsetattr. The pty
+// driver keeps the slave at CS8 without parity, so Size and Parity are left
+// unset.
+func (p *pty) line() (conf serial.Config, flow string, err error) {
+	t, err := unix.IoctlGetTermios(int(p.hold.Fd()), tcgets2)
+	if err != nil {
+		return conf, "", err
+	}
+	conf.Baud = int(t.Ospeed)
+	conf.StopBits = serial.Stop1
+	if t.Cflag&unix.CSTOPB != 0 {
+		conf.StopBits = serial.Stop2
+	}
+	flow = "none"
+	if t.Cflag&unix.CRTSCTS != 0 {
+		flow = "rtscts"
+	} else if t.Iflag&(unix.IXON|unix.IXOFF) != 0 {
+		flow = "xonxoff"
+	}
+	return conf, flow, nil
+}
+
+func (p *pty) Close() error {
+	p.hold.Close()
+	return p.File.Close()
+}
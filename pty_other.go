@@ -0,0 +1,24 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"os"
+
+	"github.com/tarm/serial"
+)
+
+// pty is only there on linux.
+type pty struct {
+	*os.File
+	slave string
+}
+
+func openPty() (*pty, error) {
+	return nil, errUnsupported
+}
+
+func (p *pty) line() (serial.Config, string, error) {
+	return serial.Config{}, "", errUnsupported
+}
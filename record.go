@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// recorder writes the transcript of one client session. Interleaved mode
+// writes both directions to one file, a line per chunk with its time and
+// direction; split mode writes the raw bytes to <name>.in.log (from the
+// client) and <name>.out.log (from the serial port).
+type recorder struct {
+	mu  sync.Mutex
+	f   *os.File
+	in  *os.File
+	out *os.File
+}
+
+func newRecorder(dir, mode, bridgeName, addr string) (*recorder, error) {
+	if bridgeName == "" {
+		bridgeName = "tcp2serial"
+	}
+	base := filepath.Join(dir, fmt.Sprintf("%v-%v-%v", bridgeName,
+		time.Now().Format("20060102-150405.000"), sanitizeFileName(addr)))
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	r := &recorder{}
+	var err error
+	if mode == "split" {
+		if r.in, err = os.OpenFile(base+".in.log", os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600); err != nil {
+			return nil, err
+		}
+		if r.out, err = os.OpenFile(base+".out.log", os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600); err != nil {
+			r.in.Close()
+			return nil, err
+		}
+	} else {
+		if r.f, err = os.OpenFile(base+".log", os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600); err != nil {
+			return nil, err
+		}
+		fmt.Fprintf(r.f, "%v session %v\n", time.Now().Format(time.RFC3339Nano), addr)
+	}
+	return r, nil
+}
+
+func sanitizeFileName(s string) string {
+	if s == "" {
+		return "local"
+	}
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case ':', '/', '\\', '[', ']', '@', '%', ' ':
+			return '_'
+		}
+		return r
+	}, s)
+}
+
+func (r *recorder) write(toSerial bool, b []byte) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.f == nil {
+		f := r.out
+		if toSerial {
+			f = r.in
+		}
+		_, err := f.Write(b)
+		return err
+	}
+	marker := "<"
+	if toSerial {
+		marker = ">"
+	}
+	_, err := fmt.Fprintf(r.f, "%v %v %q\n", time.Now().Format(time.RFC3339Nano), marker, b)
+	return err
+}
+
+func (r *recorder) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.f == nil {
+		r.in.Close()
+		return r.out.Close()
+	}
+	fmt.Fprintf(r.f, "%v closed\n", time.Now().Format(time.RFC3339Nano))
+	return r.f.Close()
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"sync"
+)
+
+// restartKey clears the settings update can apply to a running bridge,
+// bridges whose keys differ have to be restarted.
+func restartKey(c bridgeConfig) bridgeConfig {
+	c.Verbose = false
+	c.Dump = ""
+	c.MaxClients = 0
+	c.Takeover = ""
+	c.BaudRate = 0
+	c.DataBits = 0
+	c.StopBits = ""
+	c.Parity = ""
+	c.Flow = ""
+	c.StripXon = false
+	c.DTR = ""
+	c.RTS = ""
+	c.DCDDrop = false
+	c.Allow = ""
+	c.Deny = ""
+	c.Token = ""
+	c.TokenFile = ""
+	return c
+}
+
+// update applies conf to the running bridge without dropping its
+// sessions, conf must have the same restartKey.
+func (b *bridge) update(conf bridgeConfig) error {
+	if err := conf.validate(); err != nil {
+		return err
+	}
+	allowNets, err := parseNets(conf.Allow)
+	if err != nil {
+		return err
+	}
+	denyNets, err := parseNets(conf.Deny)
+	if err != nil {
+		return err
+	}
+	secret, err := loadAuthSecret(conf.Token, conf.TokenFile)
+	if err != nil {
+		return err
+	}
+
+	b.mu.Lock()
+	old := b.conf
+	b.conf.Verbose = conf.Verbose
+	b.conf.Dump = conf.Dump
+	b.conf.MaxClients = conf.MaxClients
+	b.conf.Takeover = conf.Takeover
+	b.conf.BaudRate = conf.BaudRate
+	b.conf.DataBits = conf.DataBits
+	b.conf.StopBits = conf.StopBits
+	b.conf.Parity = conf.Parity
+	b.conf.Flow = conf.Flow
+	b.conf.StripXon = conf.StripXon
+	b.conf.DTR = conf.DTR
+	b.conf.RTS = conf.RTS
+	b.conf.DCDDrop = conf.DCDDrop
+	b.conf.Allow = conf.Allow
+	b.conf.Deny = conf.Deny
+	b.conf.Token = conf.Token
+	b.conf.TokenFile = conf.TokenFile
+	b.allowNets = allowNets
+	b.denyNets = denyNets
+	b.authSecret = secret
+	serialConn := b.serial
+	b.mu.Unlock()
+
+	b.clients.setLimit(conf.MaxClients, conf.Takeover)
+	if serialConn != nil && (old.DTR != conf.DTR || old.RTS != conf.RTS) {
+		if err := serialConn.setInitialLines(&conf); err != nil {
+			return err
+		}
+	}
+	if serialConn != nil && old.Flow != conf.Flow {
+		if err := serialConn.SetFlow(conf.Flow); err != nil {
+			return err
+		}
+	}
+	if serialConn != nil && (old.BaudRate != conf.BaudRate || old.DataBits != conf.DataBits ||
+		old.StopBits != conf.StopBits || old.Parity != conf.Parity) {
+		return serialConn.SetConfig(serialConfig(&conf, b.logger))
+	}
+	return nil
+}
+
+type runningBridge struct {
+	b      *bridge
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// supervisor starts, stops and reloads the bridges of the process.
+type supervisor struct {
+	bridges map[string]*runningBridge
+	exited  chan *runningBridge
+
+	// mu guards known, the bridges /healthz reports on. Unlike bridges it
+	// keeps the ones that failed.
+	mu    sync.Mutex
+	known map[string]*bridge
+
+	// gate is closed once -user and -group took effect, nil without them
+	gate chan struct{}
+	// oneshot gets the exit code of the first session with -oneshot
+	oneshot chan int
+}
+
+func newSupervisor() *supervisor {
+	return &supervisor{
+		bridges: make(map[string]*runningBridge),
+		exited:  make(chan *runningBridge),
+		known:   make(map[string]*bridge),
+	}
+}
+
+// list returns the known bridges sorted by name.
+func (s *supervisor) list() []*bridge {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var bs []*bridge
+	for _, b := range s.known {
+		bs = append(bs, b)
+	}
+	sort.Slice(bs, func(i, j int) bool { return bs[i].conf.Name < bs[j].conf.Name })
+	return bs
+}
+
+func (s *supervisor) start(conf bridgeConfig) error {
+	b, err := newBridge(conf)
+	if err != nil {
+		return err
+	}
+	b.peer = s.lookup
+	b.gate = s.gate
+	b.oneshot = s.oneshot
+	ctx, cancel := context.WithCancel(context.Background())
+	r := &runningBridge{b: b, cancel: cancel, done: make(chan struct{})}
+	s.bridges[conf.Name] = r
+	s.mu.Lock()
+	s.known[conf.Name] = b
+	s.mu.Unlock()
+
+	go func() {
+		if err := b.run(ctx); err != nil && ctx.Err() == nil {
+			b.logger.Error("bridge stopped", "err", err)
+			b.ended(b.failCode())
+		}
+		close(r.done)
+		s.exited <- r
+	}()
+	return nil
+}
+
+// started reports whether every bridge has its serial port open and its
+// listeners bound, or has given up.
+func (s *supervisor) started() bool {
+	for _, r := range s.bridges {
+		select {
+		case <-r.done:
+			continue
+		default:
+		}
+		serialOpen, listening := r.b.health()
+		if !serialOpen || !listening && r.b.config().Connect == "" {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *supervisor) stop(name string) {
+	r := s.bridges[name]
+	delete(s.bridges, name)
+	s.mu.Lock()
+	delete(s.known, name)
+	s.mu.Unlock()
+	r.cancel()
+	<-r.done
+	r.b.logger.Info("bridge stopped")
+}
+
+// reload makes the running bridges match confs.
+func (s *supervisor) reload(confs []bridgeConfig) {
+	names := make(map[string]bool)
+	for _, conf := range confs {
+		names[conf.Name] = true
+		r, ok := s.bridges[conf.Name]
+		if ok {
+			old := r.b.config()
+			if old == conf {
+				continue
+			}
+			if restartKey(old) == restartKey(conf) {
+				if err := r.b.update(conf); err != nil {
+					r.b.logger.Error("update error", "err", err)
+				} else {
+					r.b.logger.Info("bridge updated")
+				}
+				continue
+			}
+			s.stop(conf.Name)
+		}
+		if err := s.start(conf); err != nil {
+			stdLogger.Error("bridge error", "bridge", conf.Name, "err", err)
+		}
+	}
+	for name := range s.bridges {
+		if !names[name] {
+			s.stop(name)
+		}
+	}
+}
+
+// exit handles a bridge that stopped, it reports whether no bridge is
+// left running.
+func (s *supervisor) exit(r *runningBridge) bool {
+	if s.bridges[r.b.conf.Name] == r {
+		delete(s.bridges, r.b.conf.Name)
+	}
+	return len(s.bridges) == 0
+}
@@ -0,0 +1,343 @@
+package main
+
+import (
+	"encoding/binary"
+	"time"
+
+	"github.com/tarm/serial"
+)
+
+// RFC 2217 COM-PORT-OPTION commands, the server answers with cmd+100.
+const (
+	comPortSignature          = 0
+	comPortSetBaudRate        = 1
+	comPortSetDataSize        = 2
+	comPortSetParity          = 3
+	comPortSetStopSize        = 4
+	comPortSetControl         = 5
+	comPortNotifyLineState    = 6
+	comPortNotifyModemState   = 7
+	comPortFlowControlSuspend = 8
+	comPortFlowControlResume  = 9
+	comPortSetLineStateMask   = 10
+	comPortSetModemStateMask  = 11
+	comPortPurgeData          = 12
+
+	comPortServerOffset = 100
+)
+
+var rfc2217Parity = []serial.Parity{
+	1: serial.ParityNone,
+	2: serial.ParityOdd,
+	3: serial.ParityEven,
+	4: serial.ParityMark,
+	5: serial.ParitySpace,
+}
+
+var rfc2217StopBits = []serial.StopBits{
+	1: serial.Stop1,
+	2: serial.Stop2,
+	3: serial.Stop1Half,
+}
+
+func (t *telnetConn) comPortReply(cmd byte, data ...byte) {
+	t.subnegotiation(telnetOptComPort, append([]byte{cmd + comPortServerOffset}, data...)...)
+}
+
+func (t *telnetConn) comPortCommand(cmd byte, data []byte) {
+	port := t.port
+	switch cmd {
+	case comPortSignature:
+		if len(data) > 0 {
+			t.logger.Debug("rfc2217 client signature", "signature", string(data))
+		} else {
+			t.comPortReply(cmd, []byte("tcp2serial")...)
+		}
+
+	case comPortSetBaudRate:
+		if len(data) < 4 {
+			return
+		}
+		if baud := binary.BigEndian.Uint32(data); baud != 0 {
+			if err := port.SetBaudRate(int(baud)); err != nil {
+				t.logger.Warn("rfc2217 set baudRate error", "err", err)
+			}
+		}
+		var b [4]byte
+		binary.BigEndian.PutUint32(b[:], uint32(port.Config().Baud))
+		t.comPortReply(cmd, b[:]...)
+
+	case comPortSetDataSize:
+		if len(data) < 1 {
+			return
+		}
+		if data[0] != 0 {
+			if err := port.SetDataBits(data[0]); err != nil {
+				t.logger.Warn("rfc2217 set dataBits error", "err", err)
+			}
+		}
+		size := port.Config().Size
+		if size == 0 {
+			size = serial.DefaultSize
+		}
+		t.comPortReply(cmd, size)
+
+	case comPortSetParity:
+		if len(data) < 1 {
+			return
+		}
+		if v := int(data[0]); v > 0 && v < len(rfc2217Parity) {
+			if err := port.SetParity(rfc2217Parity[v]); err != nil {
+				t.logger.Warn("rfc2217 set parity error", "err", err)
+			}
+		}
+		parity := port.Config().Parity
+		var v byte = 1
+		for i, p := range rfc2217Parity {
+			if i > 0 && p == parity {
+				v = byte(i)
+			}
+		}
+		t.comPortReply(cmd, v)
+
+	case comPortSetStopSize:
+		if len(data) < 1 {
+			return
+		}
+		if v := int(data[0]); v > 0 && v < len(rfc2217StopBits) {
+			if err := port.SetStopBits(rfc2217StopBits[v]); err != nil {
+				t.logger.Warn("rfc2217 set stopBits error", "err", err)
+			}
+		}
+		stopBits := port.Config().StopBits
+		var v byte = 1
+		for i, s := range rfc2217StopBits {
+			if i > 0 && s == stopBits {
+				v = byte(i)
+			}
+		}
+		t.comPortReply(cmd, v)
+
+	case comPortSetControl:
+		if len(data) < 1 {
+			return
+		}
+		t.comPortReply(cmd, t.comPortControl(data[0]))
+
+	case comPortFlowControlSuspend:
+		t.setSuspended(true)
+
+	case comPortFlowControlResume:
+		t.setSuspended(false)
+
+	case comPortSetLineStateMask:
+		if len(data) < 1 {
+			return
+		}
+		t.lineStateMask = data[0]
+		t.comPortReply(cmd, data[0])
+
+	case comPortSetModemStateMask:
+		if len(data) < 1 {
+			return
+		}
+		t.modemStateMask = data[0]
+		t.comPortReply(cmd, data[0])
+
+	case comPortPurgeData:
+		if len(data) < 1 {
+			return
+		}
+		if err := port.Flush(); err != nil {
+			t.logger.Warn("rfc2217 purge error", "err", err)
+		}
+		t.comPortReply(cmd, data[0])
+
+	default:
+		t.logger.Debug("rfc2217 unknown command", "cmd", cmd)
+	}
+}
+
+// notifyModemState sends NOTIFY-MODEMSTATE with the lines the client
+// asked for in SET-MODEMSTATE-MASK.
+func (t *telnetConn) notifyModemState(state byte) {
+	if t.port == nil || !t.remote[telnetOptComPort] {
+		return
+	}
+	t.comPortReply(comPortNotifyModemState, state&t.modemStateMask)
+}
+
+// comPortControl handles SET-CONTROL and returns the value to report back.
+func (t *telnetConn) comPortControl(v byte) byte {
+	port := t.port
+	var err error
+	switch v {
+	case 0:
+		// request the outbound flow control setting
+	case 1:
+		err = port.SetFlow("none")
+	case 3:
+		err = port.SetFlow("rtscts")
+	case 2:
+		err = port.SetFlow("xonxoff")
+	case 4:
+		return 6
+	case 5:
+		err = port.SetBreak(true)
+	case 6:
+		err = port.SetBreak(false)
+	case 8, 9:
+		if t.coalesce > 0 {
+			t.queueLine(false, v == 8)
+		} else {
+			err = port.SetDTR(v == 8)
+		}
+	case 11, 12:
+		if t.coalesce > 0 {
+			t.queueLine(true, v == 11)
+		} else {
+			err = port.SetRTS(v == 11)
+		}
+	case 13, 14:
+		return 14
+	}
+	if err != nil {
+		t.logger.Warn("rfc2217 set control error", "control", v, "err", err)
+	}
+
+	dtr, rts := t.lines()
+	switch v {
+	case 0, 1, 2, 3:
+		switch port.Flow() {
+		case "xonxoff":
+			return 2
+		case "rtscts":
+			return 3
+		}
+		return 1
+	case 7, 8, 9:
+		if dtr {
+			return 8
+		}
+		return 9
+	case 10, 11, 12:
+		if rts {
+			return 11
+		}
+		return 12
+	}
+	return v
+}
+
+// pendingLines are the DTR and RTS changes -rfc2217-coalesce holds back.
+type pendingLines struct {
+	dtr, rts       bool
+	setDTR, setRTS bool
+}
+
+// queueLine holds back a DTR or RTS change until the client has sent no
+// other for t.coalesce. esptool switches the two lines one after the other
+// to reset an ESP32 into its bootloader, which only works when both change
+// at about the same time.
+func (t *telnetConn) queueLine(rts bool, on bool) {
+	t.lineMu.Lock()
+	defer t.lineMu.Unlock()
+	if rts {
+		t.pending.rts, t.pending.setRTS = on, true
+	} else {
+		t.pending.dtr, t.pending.setDTR = on, true
+	}
+	if t.lineTimer == nil {
+		t.lineTimer = time.AfterFunc(t.coalesce, t.applyLines)
+	} else {
+		t.lineTimer.Reset(t.coalesce)
+	}
+}
+
+// applyLines sets the held back lines together.
+func (t *telnetConn) applyLines() {
+	t.lineMu.Lock()
+	p := t.pending
+	t.pending = pendingLines{}
+	t.lineMu.Unlock()
+	if p.setDTR {
+		if err := t.port.SetDTR(p.dtr); err != nil {
+			t.logger.Warn("rfc2217 set control error", "control", "dtr", "err", err)
+		}
+	}
+	if p.setRTS {
+		if err := t.port.SetRTS(p.rts); err != nil {
+			t.logger.Warn("rfc2217 set control error", "control", "rts", "err", err)
+		}
+	}
+}
+
+// lines is the state of DTR and RTS with the held back changes.
+func (t *telnetConn) lines() (dtr, rts bool) {
+	dtr, rts = t.port.Lines()
+	t.lineMu.Lock()
+	defer t.lineMu.Unlock()
+	if t.pending.setDTR {
+		dtr = t.pending.dtr
+	}
+	if t.pending.setRTS {
+		rts = t.pending.rts
+	}
+	return dtr, rts
+}
+
+// comPortServer takes what a remote server sends, see newTelnetClient.
+func (t *telnetConn) comPortServer(cmd byte, data []byte) {
+	switch cmd {
+	case comPortSignature + comPortServerOffset:
+		if len(data) > 0 {
+			t.logger.Debug("rfc2217 server signature", "signature", string(data))
+		} else {
+			t.comPortRequest(comPortSignature, []byte("tcp2serial")...)
+		}
+	case comPortFlowControlSuspend + comPortServerOffset:
+		t.setSuspended(true)
+	case comPortFlowControlResume + comPortServerOffset:
+		t.setSuspended(false)
+	case comPortNotifyLineState + comPortServerOffset, comPortNotifyModemState + comPortServerOffset:
+	default:
+		t.logger.Debug("rfc2217 server reply", "cmd", cmd, "data", data)
+	}
+}
+
+func (t *telnetConn) comPortRequest(cmd byte, data ...byte) {
+	t.subnegotiation(telnetOptComPort, append([]byte{cmd}, data...)...)
+}
+
+// setLine asks the remote server for the rate, the framing and the flow
+// control of conf and flow, a zero Size or Parity is left as it is. It does
+// nothing if the server refused the COM-PORT-OPTION.
+func (t *telnetConn) setLine(conf serial.Config, flow string) {
+	if !t.local[telnetOptComPort] {
+		return
+	}
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], uint32(conf.Baud))
+	t.comPortRequest(comPortSetBaudRate, b[:]...)
+	if conf.Size != 0 {
+		t.comPortRequest(comPortSetDataSize, conf.Size)
+	}
+	for i, p := range rfc2217Parity {
+		if i > 0 && p == conf.Parity {
+			t.comPortRequest(comPortSetParity, byte(i))
+		}
+	}
+	for i, s := range rfc2217StopBits {
+		if i > 0 && s == conf.StopBits {
+			t.comPortRequest(comPortSetStopSize, byte(i))
+		}
+	}
+	var control byte = 1
+	switch flow {
+	case "xonxoff":
+		control = 2
+	case "rtscts":
+		control = 3
+	}
+	t.comPortRequest(comPortSetControl, control)
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"errors"
+	"time"
+
+	"github.com/tarm/serial"
+)
+
+var errRS485RTS = errors.New("RTS switches the RS-485 transmitter")
+
+// rs485Config is how the transmitter of a half-duplex RS-485 transceiver
+// is switched on for sending, see -rs485.
+type rs485Config struct {
+	// mode is "rts" to toggle RTS around every write ourselves or
+	// "kernel" to have the driver do it.
+	mode   string
+	before time.Duration
+	after  time.Duration
+	// rtsLow means the transmitter is on while RTS is off.
+	rtsLow bool
+}
+
+func rs485FromConfig(c *bridgeConfig) rs485Config {
+	return rs485Config{
+		mode:   c.RS485,
+		before: time.Duration(c.RS485Before) * time.Millisecond,
+		after:  time.Duration(c.RS485After) * time.Millisecond,
+		rtsLow: c.RS485RTSLow,
+	}
+}
+
+// charTime is how long n characters take on the line with conf.
+func charTime(conf serial.Config, n int) time.Duration {
+	size := int(conf.Size)
+	if size == 0 {
+		size = serial.DefaultSize
+	}
+	// start bit, data bits and stop bits, 1.5 rounded up
+	bits := 1 + size + 1
+	if conf.StopBits != serial.Stop1 && conf.StopBits != 0 {
+		bits++
+	}
+	if conf.Parity != serial.ParityNone && conf.Parity != 0 {
+		bits++
+	}
+	if conf.Baud <= 0 {
+		return 0
+	}
+	return time.Duration(n*bits) * time.Second / time.Duration(conf.Baud)
+}
+
+// sendRS485 turns the transmitter on with RTS for as long as b takes to
+// go out. s.wmu must be held.
+func (s *serialPort) sendRS485(port serialDevice, b []byte) (int, error) {
+	rs := s.rs485
+	if err := port.SetRTS(!rs.rtsLow); err != nil {
+		return 0, err
+	}
+	time.Sleep(rs.before)
+	n, err := s.send(port, b)
+	if err == nil {
+		err = port.Drain()
+		if err == errUnsupported {
+			// no tcdrain, wait for the bytes to be clocked out instead
+			time.Sleep(charTime(s.Config(), n))
+			err = nil
+		}
+	}
+	time.Sleep(rs.after)
+	if rerr := port.SetRTS(rs.rtsLow); err == nil {
+		err = rerr
+	}
+	return n, err
+}
+
+// setRS485 turns on the direction control of rs, the transmitter starts
+// switched off.
+func (s *serialPort) setRS485(rs rs485Config) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.rs485 = rs
+	return s.applyRS485()
+}
+
+// applyRS485 puts the port into the -rs485 mode. s.mu must be held.
+func (s *serialPort) applyRS485() error {
+	switch s.rs485.mode {
+	case "rts":
+		if err := s.port.SetRTS(s.rs485.rtsLow); err != nil {
+			return err
+		}
+		s.rts = s.rs485.rtsLow
+	case "kernel":
+		return s.port.SetRS485(s.rs485)
+	}
+	return nil
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// relayStall is how much longer than -read-timeout the serial relay may
+// go without coming round before the systemd watchdog is no longer fed.
+const relayStall = 30 * time.Second
+
+// sdNotify sends state to systemd, it does nothing when tcp2serial wasn't
+// started by a unit with Type=notify.
+func sdNotify(state string) error {
+	name := os.Getenv("NOTIFY_SOCKET")
+	if name == "" {
+		return nil
+	}
+	if name[0] == '@' {
+		// abstract socket
+		name = "\x00" + name[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: name, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// watchdogInterval is WatchdogSec= of the unit, 0 without one.
+func watchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond
+}
+
+// notifyReady tells systemd READY=1 once the serial ports of all bridges
+// are open, with -open-retry that can be a while after the start.
+func (s *supervisor) notifyReady() {
+	for !s.serialOpen() {
+		time.Sleep(100 * time.Millisecond)
+	}
+	if err := sdNotify("READY=1\nSTATUS=serial ports open"); err != nil {
+		stdLogger.Warn("sd_notify error", "err", err)
+	}
+}
+
+func (s *supervisor) serialOpen() bool {
+	bs := s.list()
+	for _, b := range bs {
+		if serialOpen, _ := b.health(); !serialOpen {
+			return false
+		}
+	}
+	return len(bs) > 0
+}
+
+// feedWatchdog sends WATCHDOG=1 every half interval as long as no relay
+// loop is stuck, otherwise systemd restarts the unit.
+func (s *supervisor) feedWatchdog(interval time.Duration) {
+	ticker := time.NewTicker(interval / 2)
+	defer ticker.Stop()
+	for range ticker.C {
+		if b := s.stalled(); b != nil {
+			b.logger.Error("serial relay stalled, watchdog not fed")
+			continue
+		}
+		if err := sdNotify("WATCHDOG=1"); err != nil {
+			stdLogger.Warn("sd_notify error", "err", err)
+		}
+	}
+}
+
+// stalled is a bridge whose serial relay hasn't come round for
+// -read-timeout and relayStall, nil if there is none. Without a read
+// timeout a quiet port blocks the relay, it can't be told from a stuck one.
+func (s *supervisor) stalled() *bridge {
+	for _, b := range s.list() {
+		conf := b.config()
+		beat := atomic.LoadInt64(&b.relayBeat)
+		if conf.ReadTimeout == 0 || beat == 0 {
+			continue
+		}
+		if serialOpen, _ := b.health(); !serialOpen {
+			continue
+		}
+		limit := time.Duration(conf.ReadTimeout)*time.Millisecond + relayStall
+		if time.Since(time.Unix(0, beat)) > limit {
+			return b
+		}
+	}
+	return nil
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+)
+
+// serveSelect serves the -select listener, the client gets the list of
+// bridges and picks one by name or number on the first line.
+func (s *supervisor) serveSelect(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if neterr, ok := err.(net.Error); ok && neterr.Temporary() {
+				continue
+			}
+			return err
+		}
+		go s.selectBridge(conn)
+	}
+}
+
+func (s *supervisor) selectBridge(conn net.Conn) {
+	conn.SetDeadline(time.Now().Add(30 * time.Second))
+	var bridges []*bridge
+	for _, b := range s.list() {
+		if b.config().Proto == "tcp" {
+			bridges = append(bridges, b)
+		}
+	}
+	for i, b := range bridges {
+		name := b.config().Name
+		if name == "" {
+			name = adminName
+		}
+		fmt.Fprintf(conn, "%d %s %s\r\n", i+1, name, b.config().Device)
+	}
+
+	var target *bridge
+	for tries := 0; target == nil && tries < 3; tries++ {
+		fmt.Fprint(conn, "port? ")
+		line, err := readLine(conn, 64)
+		if err != nil {
+			conn.Close()
+			return
+		}
+		if b := s.lookup(line); b != nil && b.config().Proto == "tcp" {
+			target = b
+		} else if i, err := strconv.Atoi(line); err == nil && i >= 1 && i <= len(bridges) {
+			target = bridges[i-1]
+		} else {
+			fmt.Fprint(conn, "no such port\r\n")
+		}
+	}
+	if target == nil {
+		conn.Close()
+		return
+	}
+	conn.SetDeadline(time.Time{})
+	if err := target.attach(conn, false); err != nil {
+		fmt.Fprintf(conn, "%v\r\n", err)
+		conn.Close()
+	}
+}
+
+// attach serves conn, accepted by the -select listener, like a client of
+// the bridge's own listener or of its -observe one.
+func (b *bridge) attach(conn net.Conn, observer bool) error {
+	b.mu.Lock()
+	ctx := b.serveCtx
+	b.mu.Unlock()
+	if ctx == nil {
+		return errors.New("port is not open")
+	}
+	addr := conn.RemoteAddr()
+	if !b.allowed(addr) {
+		b.logger.Warn("rejected by allow/deny list", "addr", addr)
+		return errors.New("not allowed")
+	}
+	b.logger.Info("connected", "addr", addr, "via", "select")
+	go b.handleConn(ctx, conn, observer)
+	return nil
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// ser2netParities are the parity options of ser2net.conf.
+var ser2netParities = map[string]string{
+	"NONE": "None", "EVEN": "Even", "ODD": "Odd", "MARK": "Mark", "SPACE": "Space",
+}
+
+// isSer2netKeyword reports whether field starts a BANNER:, TRACEFILE: and
+// the like line rather than a port.
+func isSer2netKeyword(field string) bool {
+	if field == "" {
+		return false
+	}
+	for _, r := range field {
+		if r < 'A' || r > 'Z' {
+			return false
+		}
+	}
+	return true
+}
+
+// ser2netLines joins the lines ending in \ with the next and drops the
+// comments and the empty lines, the numbers are those of the first lines.
+func ser2netLines(data string) (lines []string, numbers []int) {
+	var joined strings.Builder
+	first := 0
+	for i, line := range strings.Split(data, "\n") {
+		line = strings.TrimRight(line, "\r")
+		if joined.Len() == 0 {
+			first = i + 1
+		}
+		if strings.HasSuffix(line, "\\") {
+			joined.WriteString(strings.TrimSuffix(line, "\\"))
+			continue
+		}
+		joined.WriteString(line)
+		line = strings.TrimSpace(joined.String())
+		joined.Reset()
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		lines = append(lines, line)
+		numbers = append(numbers, first)
+	}
+	return lines, numbers
+}
+
+// parseSer2net reads the port lines of a ser2net.conf,
+// [proto,][address,]port:state:timeout:device:options, into bridges that
+// start out with defaults. Like ser2net, a port takes one client unless
+// its options say otherwise.
+func parseSer2net(path, data string, defaults bridgeConfig) ([]bridgeConfig, error) {
+	names := make(map[string]bool)
+	var confs []bridgeConfig
+	lines, numbers := ser2netLines(data)
+	for i, line := range lines {
+		fields := strings.SplitN(line, ":", 5)
+		if isSer2netKeyword(fields[0]) {
+			stdLogger.Warn("ser2net line ignored", "config", path, "line", numbers[i], "keyword", fields[0])
+			continue
+		}
+		if len(fields) < 4 {
+			return nil, fmt.Errorf("%v:%v: want port:state:timeout:device:options", path, numbers[i])
+		}
+		conf := defaults
+		conf.MaxClients = 1
+		if err := conf.setSer2netPort(fields[0]); err != nil {
+			return nil, fmt.Errorf("%v:%v: %v", path, numbers[i], err)
+		}
+		switch fields[1] {
+		case "raw":
+		case "rawlp":
+			stdLogger.Warn("ser2net rawlp served as raw", "config", path, "line", numbers[i])
+		case "telnet":
+			conf.Telnet = true
+		case "off":
+			continue
+		default:
+			return nil, fmt.Errorf("%v:%v: unknown ser2net state: %v", path, numbers[i], fields[1])
+		}
+		if timeout, err := strconv.Atoi(fields[2]); err != nil {
+			return nil, fmt.Errorf("%v:%v: invalid ser2net timeout: %v", path, numbers[i], fields[2])
+		} else if timeout != 0 {
+			stdLogger.Warn("ser2net timeout ignored", "config", path, "line", numbers[i], "timeout", timeout)
+		}
+		conf.Device = fields[3]
+		if len(fields) == 5 {
+			for _, opt := range strings.FieldsFunc(fields[4], func(r rune) bool { return r == ' ' || r == '\t' || r == ',' }) {
+				if !conf.setSer2netOption(opt) {
+					stdLogger.Warn("ser2net option ignored", "config", path, "line", numbers[i], "option", opt)
+				}
+			}
+		}
+
+		conf.Name = filepath.Base(conf.Device)
+		if names[conf.Name] {
+			return nil, fmt.Errorf("%v:%v: duplicate bridge name %v", path, numbers[i], conf.Name)
+		}
+		names[conf.Name] = true
+		confs = append(confs, conf)
+	}
+	if len(confs) == 0 {
+		return nil, fmt.Errorf("%v: no bridges", path)
+	}
+	return confs, nil
+}
+
+// setSer2netPort sets the listener of a port field, 2000, localhost,2000
+// or udp,2000.
+func (c *bridgeConfig) setSer2netPort(field string) error {
+	parts := strings.Split(field, ",")
+	switch parts[0] {
+	case "tcp", "udp":
+		c.Proto = parts[0]
+		parts = parts[1:]
+	case "ipv4", "ipv6":
+		parts = parts[1:]
+	}
+	host := ""
+	if len(parts) == 2 {
+		host, parts = parts[0], parts[1:]
+	}
+	if len(parts) != 1 {
+		return fmt.Errorf("invalid ser2net port: %v", field)
+	}
+	if _, err := strconv.Atoi(parts[0]); err != nil {
+		return fmt.Errorf("invalid ser2net port: %v", field)
+	}
+	c.Listen = net.JoinHostPort(host, parts[0])
+	return nil
+}
+
+// setSer2netOption applies one of the options of a port line, it reports
+// false for those tcp2serial doesn't have.
+func (c *bridgeConfig) setSer2netOption(opt string) bool {
+	upper := strings.ToUpper(opt)
+	if baud, err := strconv.Atoi(opt); err == nil {
+		c.BaudRate = baud
+		return true
+	}
+	if parity, ok := ser2netParities[upper]; ok {
+		c.Parity = parity
+		return true
+	}
+	if strings.HasPrefix(upper, "MAX-CONNECTIONS=") {
+		n, err := strconv.Atoi(opt[len("max-connections="):])
+		if err != nil {
+			return false
+		}
+		c.MaxClients = n
+		return true
+	}
+	switch upper {
+	case "1STOPBIT":
+		c.StopBits = "1"
+	case "2STOPBITS":
+		c.StopBits = "2"
+	case "5DATABITS", "6DATABITS", "7DATABITS", "8DATABITS":
+		c.DataBits = int(upper[0] - '0')
+	case "XONXOFF":
+		c.Flow = "xonxoff"
+	case "RTSCTS":
+		c.Flow = "rtscts"
+	case "-XONXOFF", "-RTSCTS":
+		if c.Flow == strings.ToLower(upper[1:]) {
+			c.Flow = "none"
+		}
+	case "REMCTL":
+		c.RFC2217 = true
+	case "KICKOLDUSER":
+		c.Takeover = "kick"
+	case "LOCAL", "-LOCAL":
+		// the modem lines aren't watched unless -dcd-drop asks for it
+	default:
+		return false
+	}
+	return true
+}
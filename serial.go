@@ -0,0 +1,727 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tarm/serial"
+)
+
+var errUnsupported = errors.New("not supported on this platform")
+
+var errDeviceGone = errors.New("serial device is gone")
+
+// errSerialLost is what a write gets with -reconnect-error while the port
+// is being reconnected.
+var errSerialLost = errors.New("serial port lost, reconnecting")
+
+var errHangup = errors.New("serial line hung up")
+
+// the software flow control characters, ^Q and ^S
+const (
+	xon  = 0x11
+	xoff = 0x13
+)
+
+// stripXonXoff removes the flow control characters from b in place and
+// returns the number of bytes left.
+func stripXonXoff(b []byte) int {
+	n := 0
+	for _, c := range b {
+		if c != xon && c != xoff {
+			b[n] = c
+			n++
+		}
+	}
+	return n
+}
+
+// serialDevice is a port opened by one of the serial backends.
+type serialDevice interface {
+	io.ReadWriteCloser
+	// Flush discards both the received and the not yet transmitted data.
+	Flush() error
+	SetDTR(on bool) error
+	SetRTS(on bool) error
+	SetBreak(on bool) error
+	// SetFlow switches the flow control to none, rtscts or xonxoff.
+	SetFlow(flow string) error
+	// ModemStatus returns the CTS, DSR, RI and DCD lines as modem* bits.
+	ModemStatus() (byte, error)
+	// SetConfig changes the rate and the framing without closing the
+	// port, errUnsupported means it has to be reopened instead.
+	SetConfig(conf serial.Config) error
+	// Drain waits until everything written was sent.
+	Drain() error
+	// SetRS485 has the driver switch the RS-485 transmitter with RTS.
+	SetRS485(rs rs485Config) error
+}
+
+// serialBackends are the -serial-backend choices.
+var serialBackends = map[string]func(conf serial.Config) (serialDevice, error){
+	"tarm":  openTarm,
+	"bugst": openBugst,
+}
+
+// deviceGone reports whether the device node was removed, e.g. with the
+// USB adapter unplugged. A hung up tty reads zero bytes instead of failing.
+func deviceGone(name string) bool {
+	if runtime.GOOS == "windows" || !filepath.IsAbs(name) {
+		return false
+	}
+	_, err := os.Stat(name)
+	return os.IsNotExist(err)
+}
+
+// serialPort wraps a serialDevice so that it can be reconfigured (which
+// means reopened) while the relay goroutines use it.
+type serialPort struct {
+	wmu    sync.Mutex
+	mu     sync.Mutex
+	conf   serial.Config
+	open   func(conf serial.Config) (serialDevice, error)
+	port   serialDevice
+	device string
+	locks  []string
+	unlock func()
+	dtr    bool
+	rts    bool
+	flow   string
+	rs485  rs485Config
+	closed bool
+	err    error
+	// dead is closed once err is set
+	dead   chan struct{}
+	logger *Logger
+
+	// with -reconnect a failed port is opened again every retry, lost is
+	// closed once it is back and onLost tells the bridge about both.
+	retry  time.Duration
+	lost   chan struct{}
+	quit   chan struct{}
+	onLost func(lost bool)
+	// what is written meanwhile is dropped and handed to onDrop, lostDrops
+	// counts it for the outage log and is guarded by mu. With lostError
+	// the write fails instead of pretending it went out.
+	onDrop    func(n int)
+	lostDrops int
+	lostError bool
+
+	// a write waits until turnaround has passed since lastRead.
+	turnaround time.Duration
+	lastRead   time.Time
+
+	// multidrop is -nine-bit, nineBit is guarded by wmu.
+	multidrop bool
+	nineBit   nineBitState
+
+	// pace is -pace, charDelay and lineDelay -tx-char-delay and
+	// -tx-line-delay, paceNext is when the line is free again, guarded by
+	// wmu.
+	pace      int
+	charDelay time.Duration
+	lineDelay time.Duration
+	paceNext  time.Time
+}
+
+func openSerialPort(conf *serial.Config, backend string, locks []string, logger *Logger) (*serialPort, error) {
+	open, ok := serialBackends[backend]
+	if !ok {
+		return nil, fmt.Errorf("unknown serial backend: %v", backend)
+	}
+	s := &serialPort{conf: *conf, open: open, locks: locks, dtr: true, rts: true, flow: "none",
+		logger: logger, quit: make(chan struct{}), dead: make(chan struct{})}
+	port, err := s.openDevice(*conf)
+	if err != nil {
+		return nil, err
+	}
+	s.port = port
+	return s, nil
+}
+
+// openDevice opens conf with the backend, after looking up the current
+// name of a usb: or usbserial: device and taking the -lock locks. s.mu
+// must be held.
+func (s *serialPort) openDevice(conf serial.Config) (serialDevice, error) {
+	name, err := resolveDevice(conf.Name)
+	if err != nil {
+		return nil, err
+	}
+	if name != conf.Name && name != s.device {
+		s.logger.Info("serial device found", "device", conf.Name, "name", name)
+	}
+	// lock again every time, the device node may be a new one
+	if s.unlock != nil {
+		s.unlock()
+		s.unlock = nil
+	}
+	unlock, err := lockDevice(name, s.locks)
+	if err != nil {
+		return nil, err
+	}
+	conf.Name = name
+	port, err := s.open(conf)
+	if err != nil {
+		unlock()
+		return nil, err
+	}
+	s.device = name
+	s.unlock = unlock
+	return port, nil
+}
+
+// drain waits until what was written is out, or for as long as n bytes
+// take when the backend can't tell.
+func (s *serialPort) drain(n int) error {
+	port := s.current()
+	if port == nil {
+		return os.ErrClosed
+	}
+	err := port.Drain()
+	if err == errUnsupported {
+		time.Sleep(charTime(s.Config(), n))
+		return nil
+	}
+	return err
+}
+
+func (s *serialPort) current() serialDevice {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.port
+}
+
+func (s *serialPort) state() (serialDevice, chan struct{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.port, s.lost
+}
+
+func (s *serialPort) Read(b []byte) (int, error) {
+	for {
+		port, lost := s.state()
+		if lost != nil {
+			<-lost
+			continue
+		}
+		n, err := port.Read(b)
+		if n == 0 && err == nil && deviceGone(s.deviceName()) {
+			err = errDeviceGone
+		}
+		if n > 0 && s.turnaround > 0 {
+			s.mu.Lock()
+			s.lastRead = time.Now()
+			s.mu.Unlock()
+		}
+		if err != nil && s.failed(port, err) {
+			// reopened with new settings underneath us
+			continue
+		}
+		return n, err
+	}
+}
+
+// Write is safe to call from several clients, each write goes out whole.
+func (s *serialPort) Write(b []byte) (int, error) {
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+	s.waitTurnaround()
+	for {
+		port, lost := s.state()
+		if lost != nil {
+			// nowhere to send it until the port is back
+			return s.drop(len(b))
+		}
+		send := s.send
+		if s.rs485.mode == "rts" {
+			send = s.sendRS485
+		}
+		var n int
+		var err error
+		if s.paced() {
+			n, err = s.sendPaced(port, b, send)
+		} else {
+			n, err = send(port, b)
+		}
+		if err != nil && s.failed(port, err) {
+			continue
+		}
+		return n, err
+	}
+}
+
+// drop throws away n bytes written while the port is lost, the first
+// ones of an outage are logged.
+func (s *serialPort) drop(n int) (int, error) {
+	s.mu.Lock()
+	if s.lostDrops == 0 && n > 0 {
+		s.logger.Warn("serial port lost, dropping writes until it is back")
+	}
+	s.lostDrops += n
+	s.mu.Unlock()
+	if s.onDrop != nil {
+		s.onDrop(n)
+	}
+	if s.lostError {
+		return 0, errSerialLost
+	}
+	return n, nil
+}
+
+// waitTurnaround holds a write back until the device has had -turnaround
+// to switch from sending to receiving.
+func (s *serialPort) waitTurnaround() {
+	if s.turnaround == 0 {
+		return
+	}
+	s.mu.Lock()
+	last := s.lastRead
+	s.mu.Unlock()
+	if d := time.Until(last.Add(s.turnaround)); d > 0 {
+		time.Sleep(d)
+	}
+}
+
+// send writes b, with the address bytes marked for -nine-bit. s.wmu must
+// be held.
+func (s *serialPort) send(port serialDevice, b []byte) (int, error) {
+	if s.multidrop {
+		return s.sendNineBit(port, b)
+	}
+	return port.Write(b)
+}
+
+// failed records err unless port was replaced in the meantime, in which
+// case the caller should retry and true is returned.
+func (s *serialPort) failed(port serialDevice, err error) (retry bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.port != port || s.lost != nil {
+		return true
+	}
+	if s.closed {
+		return false
+	}
+	if s.retry > 0 {
+		s.logger.Error("serial port lost, reconnecting", "err", err, "retry", s.retry)
+		s.port.Close()
+		s.lost = make(chan struct{})
+		s.lostDrops = 0
+		go s.reconnect(s.lost)
+		return true
+	}
+	if s.err == nil {
+		s.err = err
+		close(s.dead)
+	}
+	return false
+}
+
+// reconnect opens the port again until that works or the port is closed.
+func (s *serialPort) reconnect(lost chan struct{}) {
+	defer close(lost)
+	if s.onLost != nil {
+		s.onLost(true)
+	}
+	for {
+		select {
+		case <-s.quit:
+		case <-time.After(s.retry):
+		}
+		s.mu.Lock()
+		if s.closed {
+			s.lost = nil
+			s.mu.Unlock()
+			return
+		}
+		port, err := s.openDevice(s.conf)
+		if err == nil {
+			s.port = port
+			s.lost = nil
+			s.restoreLines()
+			dropped := s.lostDrops
+			s.mu.Unlock()
+			s.logger.Info("serial port reconnected", "dropped_bytes", dropped)
+			if s.onLost != nil {
+				s.onLost(false)
+			}
+			return
+		}
+		s.mu.Unlock()
+		s.logger.Debug("serial reconnect error", "err", err)
+	}
+}
+
+// Err returns the first read or write error of the port.
+func (s *serialPort) Err() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
+
+// failure is closed once a read or a write failed for good, the port is
+// no use to either direction then.
+func (s *serialPort) failure() <-chan struct{} {
+	return s.dead
+}
+
+// IsOpen reports whether the port is open and hasn't failed.
+func (s *serialPort) IsOpen() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return !s.closed && s.err == nil && s.lost == nil
+}
+
+func (s *serialPort) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.closed {
+		close(s.quit)
+	}
+	s.closed = true
+	err := s.port.Close()
+	if s.unlock != nil {
+		s.unlock()
+		s.unlock = nil
+	}
+	return err
+}
+
+// Flush discards both the received and the not yet transmitted data.
+func (s *serialPort) Flush() error {
+	return s.current().Flush()
+}
+
+// deviceName is what the port was opened as, with a usb: name resolved.
+func (s *serialPort) deviceName() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.device
+}
+
+func (s *serialPort) Config() serial.Config {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.conf
+}
+
+// reconfigure changes the settings once what was written before is sent,
+// on the open port where the backend can and by reopening it otherwise.
+func (s *serialPort) reconfigure(update func(c *serial.Config)) error {
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed || s.lost != nil {
+		return os.ErrClosed
+	}
+
+	conf := s.conf
+	update(&conf)
+	if conf == s.conf {
+		return nil
+	}
+	if err := s.port.Drain(); err != nil && err != errUnsupported {
+		s.logger.Warn("serial drain error", "err", err)
+	}
+	err := s.port.SetConfig(conf)
+	if err == errUnsupported {
+		err = s.reopen(conf)
+	} else if err == nil {
+		s.conf = conf
+	}
+	if err != nil {
+		return err
+	}
+	s.logger.Info("serial port reconfigured", "baudRate", conf.Baud, "dataBits", conf.Size,
+		"parity", string(conf.Parity), "stopBits", conf.StopBits)
+	return nil
+}
+
+// Reopen closes and opens the port again with the same settings.
+func (s *serialPort) Reopen() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed || s.lost != nil {
+		return os.ErrClosed
+	}
+	if err := s.reopen(s.conf); err != nil {
+		return err
+	}
+	s.logger.Info("serial port reopened")
+	return nil
+}
+
+// reopen replaces the port with one opened with conf, or with the old
+// settings again when that fails. s.mu must be held.
+func (s *serialPort) reopen(conf serial.Config) error {
+	s.port.Close()
+	port, err := s.openDevice(conf)
+	if err != nil {
+		s.logger.Error("serial reconfigure error", "err", err)
+		// go back to the settings that worked
+		conf = s.conf
+		var rerr error
+		port, rerr = s.openDevice(conf)
+		if rerr != nil {
+			s.logger.Error("serial reopen error", "err", rerr)
+			s.closed = true
+			if s.err == nil {
+				close(s.dead)
+			}
+			s.err = rerr
+			return rerr
+		}
+	}
+	s.port = port
+	s.conf = conf
+	s.restoreLines()
+	return err
+}
+
+// restoreLines applies the flow control and the DTR/RTS state again after
+// the port was reopened.
+func (s *serialPort) restoreLines() {
+	if s.flow != "none" {
+		if err := s.port.SetFlow(s.flow); err != nil {
+			s.logger.Error("serial flow control error", "flow", s.flow, "err", err)
+		}
+	}
+	if !s.dtr {
+		s.port.SetDTR(false)
+	}
+	if !s.rts {
+		s.port.SetRTS(false)
+	}
+	if err := s.applyRS485(); err != nil {
+		s.logger.Error("serial rs485 error", "err", err)
+	}
+}
+
+func (s *serialPort) SetBaudRate(baud int) error {
+	return s.reconfigure(func(c *serial.Config) { c.Baud = baud })
+}
+
+func (s *serialPort) SetDataBits(size byte) error {
+	return s.reconfigure(func(c *serial.Config) { c.Size = size })
+}
+
+func (s *serialPort) SetParity(parity serial.Parity) error {
+	return s.reconfigure(func(c *serial.Config) { c.Parity = parity })
+}
+
+func (s *serialPort) SetStopBits(stopBits serial.StopBits) error {
+	return s.reconfigure(func(c *serial.Config) { c.StopBits = stopBits })
+}
+
+func (s *serialPort) SetDTR(on bool) error {
+	err := s.current().SetDTR(on)
+	if err == nil {
+		s.mu.Lock()
+		s.dtr = on
+		s.mu.Unlock()
+	}
+	return err
+}
+
+// pulseDTR switches DTR to level for d and then the other way, see
+// -connect-reset.
+func (s *serialPort) pulseDTR(level bool, d time.Duration) error {
+	if err := s.SetDTR(level); err != nil {
+		return err
+	}
+	time.Sleep(d)
+	return s.SetDTR(!level)
+}
+
+func (s *serialPort) SetRTS(on bool) error {
+	s.mu.Lock()
+	rs485 := s.rs485.mode
+	s.mu.Unlock()
+	if rs485 != "" {
+		return errRS485RTS
+	}
+	err := s.current().SetRTS(on)
+	if err == nil {
+		s.mu.Lock()
+		s.rts = on
+		s.mu.Unlock()
+	}
+	return err
+}
+
+// SetFlow switches the flow control to none, rtscts or xonxoff.
+func (s *serialPort) SetFlow(flow string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if flow == s.flow {
+		return nil
+	}
+	if flow == "rtscts" && s.rs485.mode != "" {
+		return errRS485RTS
+	}
+	if err := s.port.SetFlow(flow); err != nil {
+		return err
+	}
+	s.flow = flow
+	return nil
+}
+
+func (s *serialPort) Flow() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.flow
+}
+
+// setInitialLines applies the -dtr and -rts states of c, the port comes up
+// with both on.
+func (s *serialPort) setInitialLines(c *bridgeConfig) error {
+	dtr, rts := s.Lines()
+	if want := c.DTR == "on"; want != dtr {
+		if err := s.SetDTR(want); err != nil {
+			return err
+		}
+	}
+	if want := c.RTS == "on"; want != rts && c.RS485 == "" {
+		if err := s.SetRTS(want); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ModemStatus returns the CTS, DSR, RI and DCD lines as modem* bits.
+func (s *serialPort) ModemStatus() (byte, error) {
+	return s.current().ModemStatus()
+}
+
+func (s *serialPort) SetBreak(on bool) error {
+	return s.current().SetBreak(on)
+}
+
+func (s *serialPort) Lines() (dtr bool, rts bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.dtr, s.rts
+}
+
+// serialConfig turns the serial settings of c into a serial.Config.
+func serialConfig(c *bridgeConfig, logger *Logger) *serial.Config {
+	var stopBits serial.StopBits
+	var parity serial.Parity
+
+	if c.StopBits == "1" {
+		stopBits = serial.Stop1
+	} else if c.StopBits == "1.5" {
+		stopBits = serial.Stop1Half
+		logger.Warn("Serial-StopBits 1.5 is not unsupported")
+	} else if c.StopBits == "2" {
+		stopBits = serial.Stop2
+	}
+	if c.Parity == "None" {
+		parity = serial.ParityNone
+	} else if c.Parity == "Odd" {
+		parity = serial.ParityOdd
+	} else if c.Parity == "Even" {
+		parity = serial.ParityEven
+	} else if c.Parity == "Mark" {
+		parity = serial.ParityMark
+	} else if c.Parity == "Space" {
+		parity = serial.ParitySpace
+	}
+	if c.NineBit {
+		// the data bytes, the address bytes are sent with Mark
+		parity = serial.ParitySpace
+	}
+	baud, size := c.BaudRate, byte(c.DataBits)
+	if c.Mode == modeDMX {
+		baud, size = dmxBaud, 8
+		stopBits, parity = serial.Stop2, serial.ParityNone
+	}
+	return &serial.Config{
+		Name:        c.Device,
+		Baud:        baud,
+		ReadTimeout: time.Duration(c.ReadTimeout) * time.Millisecond,
+		Size:        size,
+		Parity:      parity,
+		StopBits:    stopBits,
+	}
+}
+
+// configNames turns the stop bits and the parity of c back into the
+// names the flags use.
+func configNames(c serial.Config) (stopBits, parity string) {
+	switch c.StopBits {
+	case serial.Stop1Half:
+		stopBits = "1.5"
+	case serial.Stop2:
+		stopBits = "2"
+	default:
+		stopBits = "1"
+	}
+	switch c.Parity {
+	case serial.ParityOdd:
+		parity = "Odd"
+	case serial.ParityEven:
+		parity = "Even"
+	case serial.ParityMark:
+		parity = "Mark"
+	case serial.ParitySpace:
+		parity = "Space"
+	default:
+		parity = "None"
+	}
+	return stopBits, parity
+}
+
+func newSerialConn(c *bridgeConfig, logger *Logger) (conn *serialPort, err error) {
+	sconn, err := openSerialPort(serialConfig(c, logger), c.SerialBackend, strings.Split(c.Lock, ","), logger)
+	if err != nil {
+		logger.Error("serial OpenPort error", "device", c.Device, "err", err)
+		return nil, err
+	}
+
+	if err := sconn.SetFlow(c.Flow); err != nil {
+		logger.Error("serial flow control error", "flow", c.Flow, "err", err)
+		sconn.Close()
+		return nil, err
+	}
+	if err := sconn.setInitialLines(c); err != nil {
+		logger.Error("serial DTR/RTS error", "err", err)
+		sconn.Close()
+		return nil, err
+	}
+	if err := sconn.setRS485(rs485FromConfig(c)); err != nil {
+		logger.Error("serial rs485 error", "rs485", c.RS485, "err", err)
+		sconn.Close()
+		return nil, err
+	}
+
+	sconn.retry = time.Duration(c.Reconnect) * time.Second
+	sconn.lostError = c.ReconnectError
+	sconn.multidrop = c.NineBit
+	sconn.turnaround = time.Duration(c.Turnaround) * time.Millisecond
+	sconn.pace = c.Pace
+	sconn.charDelay = time.Duration(c.TxCharDelay) * time.Millisecond
+	sconn.lineDelay = time.Duration(c.TxLineDelay) * time.Millisecond
+	logger.Info("Serial Port is connected", "device", c.Device)
+	return sconn, nil
+}
+
+// SetConfig applies the line settings of conf, the device name and the
+// read timeout stay as they are.
+func (s *serialPort) SetConfig(conf *serial.Config) error {
+	return s.reconfigure(func(c *serial.Config) {
+		c.Baud = conf.Baud
+		c.Size = conf.Size
+		c.Parity = conf.Parity
+		c.StopBits = conf.StopBits
+	})
+}
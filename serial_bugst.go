@@ -0,0 +1,102 @@
+package main
+
+import (
+	"errors"
+
+	"github.com/tarm/serial"
+	bugst "go.bug.st/serial"
+)
+
+var errBackendUnsupported = errors.New("not supported by the bugst serial backend")
+
+// bugstPort is the go.bug.st/serial backend. It does any baud rate and the
+// modem lines without ioctls of our own, but has no flow control and only
+// timed breaks.
+type bugstPort struct {
+	bugst.Port
+}
+
+func bugstMode(conf serial.Config) *bugst.Mode {
+	mode := &bugst.Mode{BaudRate: conf.Baud, DataBits: int(conf.Size)}
+	if mode.DataBits == 0 {
+		mode.DataBits = serial.DefaultSize
+	}
+	switch conf.Parity {
+	case serial.ParityOdd:
+		mode.Parity = bugst.OddParity
+	case serial.ParityEven:
+		mode.Parity = bugst.EvenParity
+	case serial.ParityMark:
+		mode.Parity = bugst.MarkParity
+	case serial.ParitySpace:
+		mode.Parity = bugst.SpaceParity
+	}
+	switch conf.StopBits {
+	case serial.Stop1Half:
+		mode.StopBits = bugst.OnePointFiveStopBits
+	case serial.Stop2:
+		mode.StopBits = bugst.TwoStopBits
+	}
+	return mode
+}
+
+func openBugst(conf serial.Config) (serialDevice, error) {
+	port, err := bugst.Open(conf.Name, bugstMode(conf))
+	if err != nil {
+		return nil, err
+	}
+	if conf.ReadTimeout > 0 {
+		if err := port.SetReadTimeout(conf.ReadTimeout); err != nil {
+			port.Close()
+			return nil, err
+		}
+	}
+	return &bugstPort{port}, nil
+}
+
+func (b *bugstPort) SetConfig(conf serial.Config) error {
+	return b.SetMode(bugstMode(conf))
+}
+
+func (b *bugstPort) Flush() error {
+	if err := b.ResetInputBuffer(); err != nil {
+		return err
+	}
+	return b.ResetOutputBuffer()
+}
+
+func (b *bugstPort) SetBreak(on bool) error {
+	return errBackendUnsupported
+}
+
+func (b *bugstPort) SetFlow(flow string) error {
+	if flow == "none" {
+		return nil
+	}
+	return errBackendUnsupported
+}
+
+func (b *bugstPort) SetRS485(rs rs485Config) error {
+	return errBackendUnsupported
+}
+
+func (b *bugstPort) ModemStatus() (byte, error) {
+	bits, err := b.GetModemStatusBits()
+	if err != nil {
+		return 0, err
+	}
+	var state byte
+	if bits.CTS {
+		state |= modemCTS
+	}
+	if bits.DSR {
+		state |= modemDSR
+	}
+	if bits.RI {
+		state |= modemRI
+	}
+	if bits.DCD {
+		state |= modemDCD
+	}
+	return state, nil
+}
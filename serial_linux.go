@@ -0,0 +1,238 @@
+package main
+
+import (
+	"os"
+	"sync"
+	"unsafe"
+
+	"github.com/tarm/serial"
+	"golang.org/x/sys/unix"
+)
+
+func setModemBits(f *os.File, bits int, on bool) error {
+	req := uint(unix.TIOCMBIC)
+	if on {
+		req = unix.TIOCMBIS
+	}
+	return unix.IoctlSetPointerInt(int(f.Fd()), req, bits)
+}
+
+func setDTR(f *os.File, on bool) error {
+	return setModemBits(f, unix.TIOCM_DTR, on)
+}
+
+func setRTS(f *os.File, on bool) error {
+	return setModemBits(f, unix.TIOCM_RTS, on)
+}
+
+func setBreak(f *os.File, on bool) error {
+	req := uint(unix.TIOCCBRK)
+	if on {
+		req = unix.TIOCSBRK
+	}
+	return unix.IoctlSetInt(int(f.Fd()), req, 0)
+}
+
+func setFlow(f *os.File, flow string) error {
+	t, err := unix.IoctlGetTermios(int(f.Fd()), unix.TCGETS)
+	if err != nil {
+		return err
+	}
+	t.Cflag &^= unix.CRTSCTS
+	t.Iflag &^= unix.IXON | unix.IXOFF | unix.IXANY
+	switch flow {
+	case "rtscts":
+		t.Cflag |= unix.CRTSCTS
+	case "xonxoff":
+		t.Iflag |= unix.IXON | unix.IXOFF
+		t.Cc[unix.VSTART] = xon
+		t.Cc[unix.VSTOP] = xoff
+	}
+	return unix.IoctlSetTermios(int(f.Fd()), unix.TCSETS, t)
+}
+
+func getModemStatus(f *os.File) (byte, error) {
+	bits, err := unix.IoctlGetInt(int(f.Fd()), unix.TIOCMGET)
+	if err != nil {
+		return 0, err
+	}
+	var state byte
+	if bits&unix.TIOCM_CTS != 0 {
+		state |= modemCTS
+	}
+	if bits&unix.TIOCM_DSR != 0 {
+		state |= modemDSR
+	}
+	if bits&unix.TIOCM_RI != 0 {
+		state |= modemRI
+	}
+	if bits&unix.TIOCM_CD != 0 {
+		state |= modemDCD
+	}
+	return state, nil
+}
+
+// classic termios rates, the ones tarm/serial opens the port with
+var standardBauds = map[int]bool{
+	50: true, 75: true, 110: true, 134: true, 150: true, 200: true, 300: true,
+	600: true, 1200: true, 1800: true, 2400: true, 4800: true, 9600: true,
+	19200: true, 38400: true, 57600: true, 115200: true, 230400: true,
+	460800: true, 500000: true, 576000: true, 921600: true, 1000000: true,
+	1152000: true, 1500000: true, 2000000: true, 2500000: true, 3000000: true,
+	3500000: true, 4000000: true,
+}
+
+func isStandardBaud(baud int) bool {
+	return standardBauds[baud]
+}
+
+// setCustomBaud sets any rate the driver can do with termios2 and BOTHER.
+func setCustomBaud(f *os.File, baud int) error {
+	fd := int(f.Fd())
+	t, err := unix.IoctlGetTermios(fd, tcgets2)
+	if err != nil {
+		return err
+	}
+	t.Cflag &^= unix.CBAUD | unix.CBAUD<<unix.IBSHIFT
+	t.Cflag |= unix.BOTHER | unix.BOTHER<<unix.IBSHIFT
+	t.Ispeed = uint32(baud)
+	t.Ospeed = uint32(baud)
+	return unix.IoctlSetTermios(fd, tcsets2, t)
+}
+
+// setLineConfig changes the rate and the framing of the open port.
+func setLineConfig(f *os.File, conf serial.Config) error {
+	fd := int(f.Fd())
+	t, err := unix.IoctlGetTermios(fd, tcgets2)
+	if err != nil {
+		return err
+	}
+	t.Cflag &^= unix.CBAUD | unix.CBAUD<<unix.IBSHIFT
+	t.Cflag |= unix.BOTHER | unix.BOTHER<<unix.IBSHIFT
+	t.Ispeed = uint32(conf.Baud)
+	t.Ospeed = uint32(conf.Baud)
+
+	t.Cflag &^= unix.CSIZE | unix.CSTOPB | unix.PARENB | unix.PARODD | unix.CMSPAR
+	switch conf.Size {
+	case 5:
+		t.Cflag |= unix.CS5
+	case 6:
+		t.Cflag |= unix.CS6
+	case 7:
+		t.Cflag |= unix.CS7
+	default:
+		t.Cflag |= unix.CS8
+	}
+	if conf.StopBits == serial.Stop2 {
+		t.Cflag |= unix.CSTOPB
+	}
+	switch conf.Parity {
+	case serial.ParityOdd:
+		t.Cflag |= unix.PARENB | unix.PARODD
+	case serial.ParityEven:
+		t.Cflag |= unix.PARENB
+	case serial.ParityMark:
+		t.Cflag |= unix.PARENB | unix.PARODD | unix.CMSPAR
+	case serial.ParitySpace:
+		t.Cflag |= unix.PARENB | unix.CMSPAR
+	}
+	return unix.IoctlSetTermios(fd, tcsets2, t)
+}
+
+// drain waits until everything written was sent, like tcdrain.
+func drain(f *os.File) error {
+	return unix.IoctlSetInt(int(f.Fd()), unix.TCSBRK, 1)
+}
+
+// struct serial_rs485 flags
+const (
+	serRS485Enabled      = 1 << 0
+	serRS485RTSOnSend    = 1 << 1
+	serRS485RTSAfterSend = 1 << 2
+)
+
+// serialRS485 is struct serial_rs485 of linux/serial.h, the delays are
+// in milliseconds.
+type serialRS485 struct {
+	flags          uint32
+	delayRTSBefore uint32
+	delayRTSAfter  uint32
+	padding        [5]uint32
+}
+
+// setRS485 has the driver raise RTS while it sends, for the uarts whose
+// driver supports it.
+func setRS485(f *os.File, rs rs485Config) error {
+	conf := serialRS485{
+		flags:          serRS485Enabled | serRS485RTSOnSend,
+		delayRTSBefore: uint32(rs.before.Milliseconds()),
+		delayRTSAfter:  uint32(rs.after.Milliseconds()),
+	}
+	if rs.rtsLow {
+		conf.flags = serRS485Enabled | serRS485RTSAfterSend
+	}
+	_, _, errno := unix.Syscall(unix.SYS_IOCTL, f.Fd(), unix.TIOCSRS485, uintptr(unsafe.Pointer(&conf)))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// readWaker lets Close end a Read that blocks without a read timeout,
+// which closing the fd doesn't: the Read waits in poll for the port and a
+// pipe that close writes to, and close waits for it before the fd goes.
+type readWaker struct {
+	fd   int
+	r, w int
+
+	mu     sync.RWMutex
+	closed bool
+	once   sync.Once
+}
+
+func newReadWaker(f *os.File) (*readWaker, error) {
+	var p [2]int
+	if err := unix.Pipe2(p[:], unix.O_CLOEXEC|unix.O_NONBLOCK); err != nil {
+		return nil, err
+	}
+	return &readWaker{fd: int(f.Fd()), r: p[0], w: p[1]}, nil
+}
+
+// read calls read once the port has something, which can be a hang up,
+// or fails with os.ErrClosed after close.
+func (w *readWaker) read(read func() (int, error)) (int, error) {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	if w.closed {
+		return 0, os.ErrClosed
+	}
+	fds := []unix.PollFd{{Fd: int32(w.fd), Events: unix.POLLIN}, {Fd: int32(w.r), Events: unix.POLLIN}}
+	for {
+		_, err := unix.Poll(fds, -1)
+		if err == unix.EINTR {
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+		break
+	}
+	if fds[1].Revents != 0 {
+		return 0, os.ErrClosed
+	}
+	return read()
+}
+
+// close wakes the pending reads and waits for them, then closes the port
+// with closePort.
+func (w *readWaker) close(closePort func() error) error {
+	w.once.Do(func() {
+		unix.Write(w.w, []byte{0})
+		w.mu.Lock()
+		defer w.mu.Unlock()
+		w.closed = true
+		unix.Close(w.r)
+		unix.Close(w.w)
+	})
+	return closePort()
+}
@@ -0,0 +1,74 @@
+//go:build !linux && !windows
+// +build !linux,!windows
+
+package main
+
+import (
+	"os"
+
+	"github.com/tarm/serial"
+)
+
+func setDTR(f *os.File, on bool) error {
+	return errUnsupported
+}
+
+func setRTS(f *os.File, on bool) error {
+	return errUnsupported
+}
+
+func setBreak(f *os.File, on bool) error {
+	return errUnsupported
+}
+
+func setFlow(f *os.File, flow string) error {
+	if flow == "none" {
+		return nil
+	}
+	return errUnsupported
+}
+
+func getModemStatus(f *os.File) (byte, error) {
+	return 0, errUnsupported
+}
+
+func isStandardBaud(baud int) bool {
+	switch baud {
+	case 50, 75, 110, 134, 150, 200, 300, 600, 1200, 2400, 4800, 9600,
+		19200, 38400, 57600, 115200:
+		return true
+	}
+	return false
+}
+
+func setCustomBaud(f *os.File, baud int) error {
+	return errUnsupported
+}
+
+func setLineConfig(f *os.File, conf serial.Config) error {
+	return errUnsupported
+}
+
+func drain(f *os.File) error {
+	return errUnsupported
+}
+
+func setRS485(f *os.File, rs rs485Config) error {
+	return errUnsupported
+}
+
+// readWaker is linux only, here tarm/serial reads time out or end when
+// the port is closed.
+type readWaker struct{}
+
+func newReadWaker(f *os.File) (*readWaker, error) {
+	return nil, nil
+}
+
+func (w *readWaker) read(read func() (int, error)) (int, error) {
+	return read()
+}
+
+func (w *readWaker) close(closePort func() error) error {
+	return closePort()
+}
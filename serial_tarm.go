@@ -0,0 +1,218 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"unsafe"
+
+	"github.com/tarm/serial"
+)
+
+// tarmPort is the tarm/serial backend. The library only reads, writes and
+// flushes, everything else is an ioctl on the file it hides.
+type tarmPort struct {
+	*serial.Port
+	f *os.File
+	// wake ends a blocking Read on Close, nil with a read timeout
+	wake *readWaker
+}
+
+// openTarm opens the port with tarm/serial, which only knows the classic
+// rates and no Mark or Space parity on linux. Any other rate is set
+// afterwards with setCustomBaud, the parity with setLineConfig.
+func openTarm(conf serial.Config) (serialDevice, error) {
+	baud := conf.Baud
+	if !isStandardBaud(baud) {
+		conf.Baud = 9600
+	}
+	parity := conf.Parity
+	if parity == serial.ParityMark || parity == serial.ParitySpace {
+		conf.Parity = serial.ParityNone
+	}
+	port, err := serial.OpenPort(&conf)
+	if err != nil {
+		return nil, err
+	}
+	t := &tarmPort{Port: port, f: serialFile(port)}
+	if baud != conf.Baud {
+		if t.f == nil {
+			port.Close()
+			return nil, fmt.Errorf("baud rate %v: %w", baud, errUnsupported)
+		}
+		if err := setCustomBaud(t.f, baud); err != nil {
+			port.Close()
+			return nil, fmt.Errorf("baud rate %v: %w", baud, err)
+		}
+	}
+	if parity != conf.Parity {
+		conf.Baud, conf.Parity = baud, parity
+		if t.f == nil {
+			port.Close()
+			return nil, fmt.Errorf("parity %v: %w", string(parity), errUnsupported)
+		}
+		if err := setLineConfig(t.f, conf); err != nil {
+			port.Close()
+			return nil, fmt.Errorf("parity %v: %w", string(parity), err)
+		}
+	}
+	DisableiZeroReadIsEOF(port)
+	unblockClose(port)
+	if conf.ReadTimeout == 0 && t.f != nil {
+		if t.wake, err = newReadWaker(t.f); err != nil {
+			port.Close()
+			return nil, err
+		}
+	}
+	return t, nil
+}
+
+func (t *tarmPort) Read(b []byte) (int, error) {
+	if t.wake == nil {
+		return t.Port.Read(b)
+	}
+	n, err := t.wake.read(func() (int, error) {
+		return t.Port.Read(b)
+	})
+	if n == 0 && err == nil {
+		// a blocking read only comes back empty when the line hung up
+		err = errHangup
+	}
+	return n, err
+}
+
+func (t *tarmPort) Close() error {
+	if t.wake == nil {
+		return t.Port.Close()
+	}
+	return t.wake.close(t.Port.Close)
+}
+
+func (t *tarmPort) file() (*os.File, error) {
+	if t.f == nil {
+		return nil, errUnsupported
+	}
+	return t.f, nil
+}
+
+func (t *tarmPort) SetDTR(on bool) error {
+	f, err := t.file()
+	if err != nil {
+		return err
+	}
+	return setDTR(f, on)
+}
+
+func (t *tarmPort) SetRTS(on bool) error {
+	f, err := t.file()
+	if err != nil {
+		return err
+	}
+	return setRTS(f, on)
+}
+
+func (t *tarmPort) SetBreak(on bool) error {
+	f, err := t.file()
+	if err != nil {
+		return err
+	}
+	return setBreak(f, on)
+}
+
+func (t *tarmPort) SetFlow(flow string) error {
+	f, err := t.file()
+	if err != nil {
+		return err
+	}
+	return setFlow(f, flow)
+}
+
+func (t *tarmPort) SetConfig(conf serial.Config) error {
+	f, err := t.file()
+	if err != nil {
+		return err
+	}
+	return setLineConfig(f, conf)
+}
+
+func (t *tarmPort) Drain() error {
+	f, err := t.file()
+	if err != nil {
+		return err
+	}
+	return drain(f)
+}
+
+func (t *tarmPort) SetRS485(rs rs485Config) error {
+	f, err := t.file()
+	if err != nil {
+		return err
+	}
+	return setRS485(f, rs)
+}
+
+func (t *tarmPort) ModemStatus() (byte, error) {
+	f, err := t.file()
+	if err != nil {
+		return 0, err
+	}
+	return getModemStatus(f)
+}
+
+func DisableiZeroReadIsEOF(conn Conn) {
+	serialPort, ok := conn.(*serial.Port)
+	if !ok {
+		return
+	}
+	p := reflect.ValueOf(serialPort)
+	if !p.IsValid() {
+		return
+	}
+	f := p.Elem().FieldByName("f")
+	if !f.IsValid() {
+		return
+	}
+	fd := f.Elem().FieldByName("pfd")
+	if !fd.IsValid() {
+		return
+	}
+	zeof := fd.FieldByName("ZeroReadIsEOF")
+	if zeof.IsValid() {
+		if zeof.CanSet() {
+			zeof.SetBool(false)
+		} else {
+			ptr := (*bool)(unsafe.Pointer(zeof.UnsafeAddr()))
+			*ptr = false
+		}
+		stdLogger.Debug("serial fd.ZeroReadIsEOF", "value", zeof.Bool())
+	}
+}
+
+// serialFile returns the *os.File hidden inside a tarm serial.Port, it is
+// needed for the ioctls the library doesn't expose.
+func serialFile(port *serial.Port) *os.File {
+	f := reflect.ValueOf(port).Elem().FieldByName("f")
+	if !f.IsValid() {
+		return nil
+	}
+	return *(**os.File)(unsafe.Pointer(f.UnsafeAddr()))
+}
+
+// unblockClose lets Close return without waiting for a pending Read to
+// time out, the fd is in blocking mode but os.File doesn't know it.
+func unblockClose(port *serial.Port) {
+	p := reflect.ValueOf(port)
+	f := p.Elem().FieldByName("f")
+	if !f.IsValid() {
+		return
+	}
+	fd := f.Elem().FieldByName("pfd")
+	if !fd.IsValid() {
+		return
+	}
+	isBlocking := fd.FieldByName("isBlocking")
+	if isBlocking.IsValid() && isBlocking.Kind() == reflect.Uint32 {
+		ptr := (*uint32)(unsafe.Pointer(isBlocking.UnsafeAddr()))
+		*ptr = 1
+	}
+}
@@ -0,0 +1,11 @@
+//go:build linux && !ppc64 && !ppc64le
+// +build linux,!ppc64,!ppc64le
+
+package main
+
+import "golang.org/x/sys/unix"
+
+const (
+	tcgets2 = unix.TCGETS2
+	tcsets2 = unix.TCSETS2
+)
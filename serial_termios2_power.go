@@ -0,0 +1,13 @@
+//go:build linux && (ppc64 || ppc64le)
+// +build linux
+// +build ppc64 ppc64le
+
+package main
+
+import "golang.org/x/sys/unix"
+
+// the powerpc termios carries the speeds already, there is no termios2
+const (
+	tcgets2 = unix.TCGETS
+	tcsets2 = unix.TCSETS
+)
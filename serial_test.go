@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+)
+
+// lostPort is a serialPort in the middle of a -reconnect outage, whose
+// drops are counted in stats.
+func lostPort(stats *trafficStats, lostError bool) *serialPort {
+	return &serialPort{logger: stdLogger, lost: make(chan struct{}), onDrop: stats.drop, lostError: lostError}
+}
+
+func TestSerialWriteLost(t *testing.T) {
+	for _, lostError := range []bool{false, true} {
+		stats := newTrafficStats()
+		s := lostPort(stats, lostError)
+		var sent int
+		for _, data := range []string{"hello", "", "world!"} {
+			n, err := s.Write([]byte(data))
+			if lostError && (n != 0 || err != errSerialLost) {
+				t.Errorf("reconnect-error: Write(%q) = %v, %v, want 0, %v", data, n, err, errSerialLost)
+			}
+			if !lostError && (n != len(data) || err != nil) {
+				t.Errorf("Write(%q) = %v, %v, want %v, nil", data, n, err, len(data))
+			}
+			sent += n
+		}
+		if got := stats.dropped(); got != 11 {
+			t.Errorf("reconnect-error %v: %v bytes dropped, want 11", lostError, got)
+		}
+		if s.lostDrops != 11 {
+			t.Errorf("reconnect-error %v: %v bytes dropped in the outage, want 11", lostError, s.lostDrops)
+		}
+		if lostError && sent != 0 {
+			t.Errorf("reconnect-error: %v bytes reported as sent", sent)
+		}
+	}
+}
+
+func TestRelayWriteLost(t *testing.T) {
+	b := &bridge{conf: bridgeConfig{BufferSize: 64}, logger: stdLogger, stats: newTrafficStats(), frames: &frameStats{}}
+	s := lostPort(b.stats, true)
+	client, server := net.Pipe()
+	defer client.Close()
+	go client.Write([]byte("hello"))
+
+	err := b.connRelay(context.Background(), server, s, nil)
+	var serr serialError
+	if !errors.As(err, &serr) || !errors.Is(err, errSerialLost) {
+		t.Errorf("connRelay = %v, want the serial port lost", err)
+	}
+	if to, _ := b.stats.load(); to != 0 {
+		t.Errorf("%v bytes counted as sent to the serial port", to)
+	}
+	if got := b.stats.dropped(); got != 5 {
+		t.Errorf("%v bytes dropped, want 5", got)
+	}
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+
+	"github.com/tarm/serial"
+)
+
+var (
+	kernel32               = syscall.NewLazyDLL("kernel32.dll")
+	procEscapeCommFunction = kernel32.NewProc("EscapeCommFunction")
+	procGetCommState       = kernel32.NewProc("GetCommState")
+	procSetCommState       = kernel32.NewProc("SetCommState")
+	procGetCommModemStatus = kernel32.NewProc("GetCommModemStatus")
+	procFlushFileBuffers   = kernel32.NewProc("FlushFileBuffers")
+)
+
+const (
+	winSETRTS   = 3
+	winCLRRTS   = 4
+	winSETDTR   = 5
+	winCLRDTR   = 6
+	winSETBREAK = 8
+	winCLRBREAK = 9
+)
+
+func escapeCommFunction(f *os.File, fn uintptr) error {
+	r, _, err := procEscapeCommFunction.Call(f.Fd(), fn)
+	if r == 0 {
+		return err
+	}
+	return nil
+}
+
+func setDTR(f *os.File, on bool) error {
+	if on {
+		return escapeCommFunction(f, winSETDTR)
+	}
+	return escapeCommFunction(f, winCLRDTR)
+}
+
+func setRTS(f *os.File, on bool) error {
+	if on {
+		return escapeCommFunction(f, winSETRTS)
+	}
+	return escapeCommFunction(f, winCLRRTS)
+}
+
+func setBreak(f *os.File, on bool) error {
+	if on {
+		return escapeCommFunction(f, winSETBREAK)
+	}
+	return escapeCommFunction(f, winCLRBREAK)
+}
+
+// DCB flags, see the DCB structure in the windows docs.
+const (
+	dcbOutxCtsFlow      = 0x0004
+	dcbOutX             = 0x0100
+	dcbInX              = 0x0200
+	dcbRtsControlMask   = 0x3000
+	dcbRtsControlEnable = 0x1000
+	dcbRtsHandshake     = 0x2000
+)
+
+type dcb struct {
+	DCBlength  uint32
+	BaudRate   uint32
+	Flags      uint32
+	wReserved  uint16
+	XonLim     uint16
+	XoffLim    uint16
+	ByteSize   byte
+	Parity     byte
+	StopBits   byte
+	XonChar    byte
+	XoffChar   byte
+	ErrorChar  byte
+	EofChar    byte
+	EvtChar    byte
+	wReserved1 uint16
+}
+
+// updateCommState changes the DCB of the port with update.
+func updateCommState(f *os.File, update func(d *dcb)) error {
+	var d dcb
+	d.DCBlength = uint32(unsafe.Sizeof(d))
+	if r, _, err := procGetCommState.Call(f.Fd(), uintptr(unsafe.Pointer(&d))); r == 0 {
+		return err
+	}
+	update(&d)
+	if r, _, err := procSetCommState.Call(f.Fd(), uintptr(unsafe.Pointer(&d))); r == 0 {
+		return err
+	}
+	return nil
+}
+
+func setFlow(f *os.File, flow string) error {
+	return updateCommState(f, func(d *dcb) {
+		d.Flags &^= dcbOutxCtsFlow | dcbRtsControlMask | dcbOutX | dcbInX
+		if flow == "rtscts" {
+			d.Flags |= dcbOutxCtsFlow | dcbRtsHandshake
+		} else {
+			d.Flags |= dcbRtsControlEnable
+		}
+		if flow == "xonxoff" {
+			d.Flags |= dcbOutX | dcbInX
+			d.XonChar = xon
+			d.XoffChar = xoff
+			d.XonLim = 2048
+			d.XoffLim = 512
+		}
+	})
+}
+
+// GetCommModemStatus bits
+const (
+	winMS_CTS_ON  = 0x10
+	winMS_DSR_ON  = 0x20
+	winMS_RING_ON = 0x40
+	winMS_RLSD_ON = 0x80
+)
+
+func getModemStatus(f *os.File) (byte, error) {
+	var bits uint32
+	if r, _, err := procGetCommModemStatus.Call(f.Fd(), uintptr(unsafe.Pointer(&bits))); r == 0 {
+		return 0, err
+	}
+	var state byte
+	if bits&winMS_CTS_ON != 0 {
+		state |= modemCTS
+	}
+	if bits&winMS_DSR_ON != 0 {
+		state |= modemDSR
+	}
+	if bits&winMS_RING_ON != 0 {
+		state |= modemRI
+	}
+	if bits&winMS_RLSD_ON != 0 {
+		state |= modemDCD
+	}
+	return state, nil
+}
+
+// tarm/serial puts the rate into the DCB as it is, the driver decides
+// what it can do.
+func isStandardBaud(baud int) bool {
+	return true
+}
+
+func setCustomBaud(f *os.File, baud int) error {
+	return updateCommState(f, func(d *dcb) {
+		d.BaudRate = uint32(baud)
+	})
+}
+
+// DCB Parity and StopBits values
+const (
+	winNoParity    = 0
+	winOddParity   = 1
+	winEvenParity  = 2
+	winMarkParity  = 3
+	winSpaceParity = 4
+
+	winOneStopBit   = 0
+	winOne5StopBits = 1
+	winTwoStopBits  = 2
+)
+
+// setLineConfig changes the rate and the framing of the open port.
+func setLineConfig(f *os.File, conf serial.Config) error {
+	return updateCommState(f, func(d *dcb) {
+		d.BaudRate = uint32(conf.Baud)
+		d.ByteSize = conf.Size
+		if d.ByteSize == 0 {
+			d.ByteSize = serial.DefaultSize
+		}
+		switch conf.Parity {
+		case serial.ParityOdd:
+			d.Parity = winOddParity
+		case serial.ParityEven:
+			d.Parity = winEvenParity
+		case serial.ParityMark:
+			d.Parity = winMarkParity
+		case serial.ParitySpace:
+			d.Parity = winSpaceParity
+		default:
+			d.Parity = winNoParity
+		}
+		switch conf.StopBits {
+		case serial.Stop1Half:
+			d.StopBits = winOne5StopBits
+		case serial.Stop2:
+			d.StopBits = winTwoStopBits
+		default:
+			d.StopBits = winOneStopBit
+		}
+	})
+}
+
+// drain waits until everything written was sent.
+func drain(f *os.File) error {
+	if r, _, err := procFlushFileBuffers.Call(f.Fd()); r == 0 {
+		return err
+	}
+	return nil
+}
+
+func setRS485(f *os.File, rs rs485Config) error {
+	return errUnsupported
+}
+
+// readWaker is linux only, here tarm/serial reads time out or end when
+// the port is closed.
+type readWaker struct{}
+
+func newReadWaker(f *os.File) (*readWaker, error) {
+	return nil, nil
+}
+
+func (w *readWaker) read(read func() (int, error)) (int, error) {
+	return read()
+}
+
+func (w *readWaker) close(closePort func() error) error {
+	return closePort()
+}
@@ -0,0 +1,23 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"io"
+	"os"
+)
+
+// the service manager is windows only, elsewhere systemd or an init
+// script start tcp2serial.
+func serviceCommand(action, name string) error {
+	return errUnsupported
+}
+
+func runService(name string, serve func(stop <-chan os.Signal) int) error {
+	return errUnsupported
+}
+
+func newEventLogOutput(name string) (io.Writer, error) {
+	return nil, errUnsupported
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/eventlog"
+	"golang.org/x/sys/windows/svc/mgr"
+)
+
+// serviceCommand installs or uninstalls the service. The service gets the
+// flags of this command line, with -service run instead of install.
+func serviceCommand(action, name string) error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return err
+	}
+	defer m.Disconnect()
+	if action == "uninstall" {
+		s, err := m.OpenService(name)
+		if err != nil {
+			return fmt.Errorf("service %v: %w", name, err)
+		}
+		defer s.Close()
+		if err := s.Delete(); err != nil {
+			return err
+		}
+		eventlog.Remove(name)
+		stdLogger.Info("service uninstalled", "name", name)
+		return nil
+	}
+
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	if exe, err = filepath.Abs(exe); err != nil {
+		return err
+	}
+	if s, err := m.OpenService(name); err == nil {
+		s.Close()
+		return fmt.Errorf("service %v exists already", name)
+	}
+	var args []string
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name != "service" {
+			args = append(args, "-"+f.Name+"="+f.Value.String())
+		}
+	})
+	args = append(append(args, "-service=run"), flag.Args()...)
+	s, err := m.CreateService(name, exe, mgr.Config{
+		DisplayName: name,
+		Description: "serial port to tcp bridge",
+		StartType:   mgr.StartAutomatic,
+	}, args...)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	// the service manager starts it again when it dies
+	restart := mgr.RecoveryAction{Type: mgr.ServiceRestart, Delay: 5 * time.Second}
+	if err := s.SetRecoveryActions([]mgr.RecoveryAction{restart, restart, restart}, 24*60*60); err != nil {
+		stdLogger.Warn("service recovery error", "err", err)
+	}
+	if err := eventlog.InstallAsEventCreate(name, eventlog.Error|eventlog.Warning|eventlog.Info); err != nil {
+		s.Delete()
+		return err
+	}
+	stdLogger.Info("service installed", "name", name, "args", args)
+	return nil
+}
+
+// runService is -service run, serve runs until the service manager stops
+// the service.
+func runService(name string, serve func(stop <-chan os.Signal) int) error {
+	return svc.Run(name, &windowsService{serve: serve})
+}
+
+type windowsService struct {
+	serve func(stop <-chan os.Signal) int
+}
+
+func (w *windowsService) Execute(args []string, r <-chan svc.ChangeRequest, status chan<- svc.Status) (bool, uint32) {
+	status <- svc.Status{State: svc.StartPending}
+	stop := make(chan os.Signal, 1)
+	done := make(chan int, 1)
+	go func() {
+		done <- w.serve(stop)
+	}()
+	status <- svc.Status{State: svc.Running, Accepts: svc.AcceptStop | svc.AcceptShutdown}
+	for {
+		select {
+		case c := <-r:
+			switch c.Cmd {
+			case svc.Interrogate:
+				status <- c.CurrentStatus
+			case svc.Stop, svc.Shutdown:
+				status <- svc.Status{State: svc.StopPending}
+				stop <- os.Interrupt
+				<-done
+				return false, 0
+			}
+		case code := <-done:
+			// the bridges are gone, the exit code of a failure makes the
+			// recovery restart it
+			return false, uint32(code)
+		}
+	}
+}
+
+// eventLogOutput writes the log lines to the windows event log, at the
+// level the line has.
+type eventLogOutput struct {
+	log *eventlog.Log
+}
+
+func newEventLogOutput(name string) (io.Writer, error) {
+	l, err := eventlog.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return &eventLogOutput{log: l}, nil
+}
+
+func (e *eventLogOutput) Write(b []byte) (int, error) {
+	return len(b), e.log.Info(1, string(b))
+}
+
+func (e *eventLogOutput) writeLevel(level logLevel, line []byte) error {
+	msg := string(bytes.TrimRight(line, "\n"))
+	switch level {
+	case levelWarn:
+		return e.log.Warning(1, msg)
+	case levelError:
+		return e.log.Error(1, msg)
+	}
+	return e.log.Info(1, msg)
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// how long the clients get to receive the goodbye and what is still
+// queued for them when a bridge stops
+const shutdownTimeout = 5 * time.Second
+
+// shutdown stops the bridges on SIGINT or SIGTERM, all at once.
+func (s *supervisor) shutdown() {
+	var wg sync.WaitGroup
+	for name := range s.bridges {
+		r := s.bridges[name]
+		delete(s.bridges, name)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r.cancel()
+			<-r.done
+			r.b.logger.Info("bridge stopped")
+		}()
+	}
+	wg.Wait()
+}
+
+// finish is the clean end of a bridge that was stopped rather than
+// failed: the listeners stop taking clients, the clients are told and get
+// what is queued for them, and what was written to the serial port is sent
+// before run closes it.
+func (b *bridge) finish(listeners []io.Closer, serialConn *serialPort) {
+	for _, l := range listeners {
+		l.Close()
+	}
+	var msg []byte
+	if conf := b.config(); conf.Proto == "tcp" && conf.Mode == "raw" {
+		msg = []byte("\r\n[tcp2serial: shutting down]\r\n")
+	}
+	b.clients.shutdown(msg, shutdownTimeout)
+	if err := serialConn.sync(); err != nil {
+		b.logger.Warn("serial drain error", "err", err)
+	}
+}
+
+// shutdown queues msg, if any, to every client and drops them, then waits
+// up to timeout for their write loops to finish.
+func (h *hub) shutdown(msg []byte, timeout time.Duration) {
+	h.mu.Lock()
+	for c := range h.clients {
+		if msg != nil {
+			select {
+			case c.queue <- msg:
+			default:
+			}
+		}
+		h.drop(c)
+	}
+	h.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		h.writers.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		h.logger.Warn("clients not done writing", "timeout", timeout)
+	}
+}
+
+// sync waits for the write in progress and until the port sent what it
+// was given.
+func (s *serialPort) sync() error {
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+	if port, lost := s.state(); port == nil || lost != nil {
+		return nil
+	}
+	return s.drain(0)
+}
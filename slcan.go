@@ -0,0 +1,277 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+const (
+	modeSlcan = "slcan"
+
+	canMaxData = 8
+	// the longest slcan line, an extended frame with 8 bytes and a
+	// timestamp
+	slcanMaxLine = 1 + 8 + 1 + 2*canMaxData + 4
+)
+
+// slcanBitrates are the S commands of the adapters for the CAN bitrates.
+var slcanBitrates = map[int]byte{
+	10000: '0', 20000: '1', 50000: '2', 100000: '3', 125000: '4',
+	250000: '5', 500000: '6', 800000: '7', 1000000: '8',
+}
+
+var errCANFrame = errors.New("bad can frame")
+
+// canFrame is one CAN 2.0 frame, data is empty for a remote frame, which
+// asks for dlc bytes.
+type canFrame struct {
+	id   uint32
+	ext  bool
+	rtr  bool
+	dlc  int
+	data []byte
+}
+
+func (f canFrame) valid() bool {
+	max := uint32(0x7ff)
+	if f.ext {
+		max = 0x1fffffff
+	}
+	return f.id <= max && f.dlc >= 0 && f.dlc <= canMaxData && (f.rtr || len(f.data) == f.dlc)
+}
+
+// parseSlcan parses a frame line of the adapter without the CR: t and r
+// with 3 digits of id, T and R with 8, the length and the data in hex.
+func parseSlcan(line []byte) (canFrame, error) {
+	var f canFrame
+	if len(line) == 0 {
+		return f, errCANFrame
+	}
+	digits := 3
+	switch line[0] {
+	case 't':
+	case 'r':
+		f.rtr = true
+	case 'T':
+		f.ext, digits = true, 8
+	case 'R':
+		f.ext, f.rtr, digits = true, true, 8
+	default:
+		return f, errCANFrame
+	}
+	if len(line) < 2+digits {
+		return f, errCANFrame
+	}
+	id, err := strconv.ParseUint(string(line[1:1+digits]), 16, 32)
+	if err != nil {
+		return f, errCANFrame
+	}
+	f.id = uint32(id)
+	f.dlc = int(line[1+digits] - '0')
+	rest := line[2+digits:]
+	if !f.rtr {
+		if f.dlc < 0 || 2*f.dlc > len(rest) {
+			return f, errCANFrame
+		}
+		if f.data, err = hex.DecodeString(string(rest[:2*f.dlc])); err != nil {
+			return f, errCANFrame
+		}
+		rest = rest[2*f.dlc:]
+	}
+	// a timestamp, if the adapter was told to add them
+	if (len(rest) != 0 && len(rest) != 4) || !f.valid() {
+		return f, errCANFrame
+	}
+	return f, nil
+}
+
+// slcan is the transmit command of f for the adapter.
+func (f canFrame) slcan() []byte {
+	cmd, digits := "t", 3
+	switch {
+	case f.ext && f.rtr:
+		cmd, digits = "R", 8
+	case f.ext:
+		cmd, digits = "T", 8
+	case f.rtr:
+		cmd = "r"
+	}
+	return []byte(fmt.Sprintf("%s%0*X%d%X\r", cmd, digits, f.id, f.dlc, f.data))
+}
+
+// parseCANText parses the frames of the clients, written like those of
+// cansend: 123#11223344, 1F334455#, 123#R or 123#R4.
+func parseCANText(s string) (canFrame, error) {
+	var f canFrame
+	i := strings.IndexByte(s, '#')
+	if i != 3 && i != 8 {
+		return f, errCANFrame
+	}
+	id, err := strconv.ParseUint(s[:i], 16, 32)
+	if err != nil {
+		return f, errCANFrame
+	}
+	f.id, f.ext = uint32(id), i == 8
+	data := s[i+1:]
+	if strings.HasPrefix(data, "R") {
+		f.rtr = true
+		if len(data) > 1 {
+			if f.dlc, err = strconv.Atoi(data[1:]); err != nil {
+				return f, errCANFrame
+			}
+		}
+	} else {
+		if f.data, err = hex.DecodeString(strings.ReplaceAll(data, ".", "")); err != nil {
+			return f, errCANFrame
+		}
+		f.dlc = len(f.data)
+	}
+	if !f.valid() {
+		return f, errCANFrame
+	}
+	return f, nil
+}
+
+// text is f written like parseCANText reads it, with a newline.
+func (f canFrame) text() []byte {
+	digits := 3
+	if f.ext {
+		digits = 8
+	}
+	if f.rtr {
+		return []byte(fmt.Sprintf("%0*X#R%d\n", digits, f.id, f.dlc))
+	}
+	return []byte(fmt.Sprintf("%0*X#%X\n", digits, f.id, f.data))
+}
+
+// slcanAdapter speaks the slcan protocol of a serial CAN adapter, see
+// -mode slcan. The frames it receives go to the clients as text and to the
+// SocketCAN interface, if there is one.
+type slcanAdapter struct {
+	port    *serialPort
+	bitrate int
+	clients io.Writer
+	can     *canSocket
+	logger  *Logger
+	pending []byte
+}
+
+// newSlcanAdapter opens the channel of the adapter on port, clients is set
+// before the first Write.
+func newSlcanAdapter(port *serialPort, bitrate int, logger *Logger) (*slcanAdapter, error) {
+	a := &slcanAdapter{port: port, bitrate: bitrate, logger: logger}
+	if err := a.openChannel(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// openChannel sets the bitrate of the adapter and opens the channel.
+func (a *slcanAdapter) openChannel() error {
+	for _, cmd := range []string{"C\r", "S" + string(slcanBitrates[a.bitrate]) + "\r", "O\r"} {
+		if _, err := a.port.Write([]byte(cmd)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Write takes what the adapter sends.
+func (a *slcanAdapter) Write(b []byte) (int, error) {
+	a.pending = append(a.pending, b...)
+	for {
+		// CR ends a line, BEL is the adapter refusing a command
+		i := bytes.IndexAny(a.pending, "\r\a")
+		if i < 0 {
+			break
+		}
+		line, end := a.pending[:i], a.pending[i]
+		a.pending = a.pending[i+1:]
+		if end == '\a' {
+			a.logger.Warn("slcan command refused")
+			continue
+		}
+		if len(line) == 0 || line[0] == 'z' || line[0] == 'Z' {
+			// the acks of the commands and transmits
+			continue
+		}
+		f, err := parseSlcan(line)
+		if err != nil {
+			a.logger.Debug("slcan line dropped", "data", string(line))
+			continue
+		}
+		if _, err := a.clients.Write(f.text()); err != nil {
+			return len(b), err
+		}
+		if a.can != nil {
+			if err := a.can.write(f); err != nil {
+				a.logger.Warn("socketcan write error", "err", err)
+			}
+		}
+	}
+	if len(a.pending) > slcanMaxLine {
+		a.pending = nil
+	}
+	return len(b), nil
+}
+
+func (a *slcanAdapter) send(f canFrame) error {
+	_, err := a.port.Write(f.slcan())
+	return err
+}
+
+// relayCAN sends the frames of the SocketCAN interface to the adapter until
+// the socket fails.
+func (a *slcanAdapter) relayCAN(ctx context.Context) error {
+	for {
+		f, err := a.can.read()
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return err
+		}
+		if err := a.send(f); err != nil {
+			return err
+		}
+	}
+}
+
+// canTextWriter sends the frames a client writes as text to the adapter.
+type canTextWriter struct {
+	a       *slcanAdapter
+	pending []byte
+}
+
+func (w *canTextWriter) Write(b []byte) (int, error) {
+	w.pending = append(w.pending, b...)
+	for {
+		i := bytes.IndexByte(w.pending, '\n')
+		if i < 0 {
+			break
+		}
+		line := strings.TrimSpace(string(w.pending[:i]))
+		w.pending = w.pending[i+1:]
+		if line == "" {
+			continue
+		}
+		f, err := parseCANText(line)
+		if err != nil {
+			w.a.logger.Debug("can frame dropped", "data", line)
+			continue
+		}
+		if err := w.a.send(f); err != nil {
+			return len(b), err
+		}
+	}
+	if len(w.pending) > slcanMaxLine*2 {
+		w.pending = nil
+	}
+	return len(b), nil
+}
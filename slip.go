@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+)
+
+// SLIP (RFC 1055) frames IP packets with the same END and ESC bytes as
+// KISS, kissWriter keeps them whole.
+const (
+	modeSlip = "slip"
+
+	// the MTU of the TUN interface should stay below it
+	slipMaxPacket = 1500
+)
+
+var (
+	slipEscapes   = []byte{kissFESC, kissTFESC}
+	slipEscaped   = []byte{kissFESC}
+	slipEndEscape = []byte{kissFESC, kissTFEND}
+)
+
+// slipEncode frames packet, the END in front flushes any line noise.
+func slipEncode(packet []byte) []byte {
+	b := make([]byte, 0, len(packet)+8)
+	b = append(b, kissFEND)
+	for _, c := range packet {
+		switch c {
+		case kissFEND:
+			b = append(b, kissFESC, kissTFEND)
+		case kissFESC:
+			b = append(b, kissFESC, kissTFESC)
+		default:
+			b = append(b, c)
+		}
+	}
+	return append(b, kissFEND)
+}
+
+// slipDecode undoes the escapes of a frame that validKISS passed, without
+// the ENDs.
+func slipDecode(frame []byte) []byte {
+	packet := bytes.ReplaceAll(frame, slipEndEscape, []byte{kissFEND})
+	return bytes.ReplaceAll(packet, slipEscapes, slipEscaped)
+}
+
+// slipTun moves the IP packets between the SLIP frames of the serial port
+// and a TUN interface, see -mode slip. The frames of the port go to the
+// clients as they are.
+type slipTun struct {
+	port    *serialPort
+	tun     *os.File
+	clients io.Writer
+	logger  *Logger
+}
+
+// Write takes one frame of the serial port with its ENDs, as kissWriter
+// passes them.
+func (s *slipTun) Write(frame []byte) (int, error) {
+	if _, err := s.clients.Write(frame); err != nil {
+		return len(frame), err
+	}
+	packet := slipDecode(frame[1 : len(frame)-1])
+	if len(packet) > slipMaxPacket {
+		s.logger.Debug("slip packet dropped", "bytes", len(packet))
+		return len(frame), nil
+	}
+	if _, err := s.tun.Write(packet); err != nil {
+		// e.g. not IP at all, the interface is still fine
+		s.logger.Debug("tun write error", "err", err)
+	}
+	return len(frame), nil
+}
+
+// relayTun sends the packets of the TUN interface to the serial port until
+// the interface fails.
+func (s *slipTun) relayTun(ctx context.Context) error {
+	buf := make([]byte, 65536)
+	for {
+		n, err := s.tun.Read(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return err
+		}
+		if _, err := s.port.Write(slipEncode(buf[:n])); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"net"
+	"os"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	canEFFFlag = 0x80000000
+	canRTRFlag = 0x40000000
+	canERRFlag = 0x20000000
+)
+
+// canRawFrame is struct can_frame of linux/can.h.
+type canRawFrame struct {
+	id   uint32
+	dlc  uint8
+	_    [3]byte
+	data [canMaxData]byte
+}
+
+// canSocket is a raw socket on a SocketCAN interface, see -socketcan.
+type canSocket struct {
+	f *os.File
+}
+
+func openCANSocket(name string) (*canSocket, error) {
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return nil, err
+	}
+	fd, err := unix.Socket(unix.AF_CAN, unix.SOCK_RAW|unix.SOCK_NONBLOCK|unix.SOCK_CLOEXEC, unix.CAN_RAW)
+	if err != nil {
+		return nil, os.NewSyscallError("socket", err)
+	}
+	if err := unix.Bind(fd, &unix.SockaddrCAN{Ifindex: iface.Index}); err != nil {
+		unix.Close(fd)
+		return nil, os.NewSyscallError("bind", err)
+	}
+	// non-blocking, so that Close ends a read
+	return &canSocket{f: os.NewFile(uintptr(fd), name)}, nil
+}
+
+func (s *canSocket) read() (canFrame, error) {
+	for {
+		var raw canRawFrame
+		if _, err := s.f.Read((*[unsafe.Sizeof(raw)]byte)(unsafe.Pointer(&raw))[:]); err != nil {
+			return canFrame{}, err
+		}
+		if raw.id&canERRFlag != 0 {
+			continue
+		}
+		f := canFrame{ext: raw.id&canEFFFlag != 0, rtr: raw.id&canRTRFlag != 0, dlc: int(raw.dlc)}
+		if f.dlc > canMaxData {
+			f.dlc = canMaxData
+		}
+		if f.ext {
+			f.id = raw.id & unix.CAN_EFF_MASK
+		} else {
+			f.id = raw.id & unix.CAN_SFF_MASK
+		}
+		if !f.rtr {
+			f.data = append([]byte(nil), raw.data[:f.dlc]...)
+		}
+		return f, nil
+	}
+}
+
+func (s *canSocket) write(f canFrame) error {
+	raw := canRawFrame{id: f.id, dlc: uint8(f.dlc)}
+	if f.ext {
+		raw.id |= canEFFFlag
+	}
+	if f.rtr {
+		raw.id |= canRTRFlag
+	}
+	copy(raw.data[:], f.data)
+	_, err := s.f.Write((*[unsafe.Sizeof(raw)]byte)(unsafe.Pointer(&raw))[:])
+	return err
+}
+
+func (s *canSocket) Close() error {
+	return s.f.Close()
+}
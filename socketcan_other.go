@@ -0,0 +1,23 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+// canSocket is a SocketCAN interface, only linux has them.
+type canSocket struct{}
+
+func openCANSocket(name string) (*canSocket, error) {
+	return nil, errUnsupported
+}
+
+func (s *canSocket) read() (canFrame, error) {
+	return canFrame{}, errUnsupported
+}
+
+func (s *canSocket) write(f canFrame) error {
+	return errUnsupported
+}
+
+func (s *canSocket) Close() error {
+	return nil
+}
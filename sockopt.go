@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"net"
+	"syscall"
+)
+
+// listenTCP listens on addr with the socket options of conf, SO_REUSEADDR
+// on the listener and the others on every connection it accepts.
+func listenTCP(addr string, conf *bridgeConfig, logger *Logger) (net.Listener, error) {
+	lc := net.ListenConfig{Control: func(network, address string, c syscall.RawConn) error {
+		var serr error
+		err := c.Control(func(fd uintptr) {
+			serr = setReuseAddr(fd, conf.ReuseAddr)
+		})
+		if err != nil {
+			return err
+		}
+		return serr
+	}}
+	l, err := lc.Listen(context.Background(), "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return &sockoptListener{Listener: l, conf: conf, logger: logger}, nil
+}
+
+// sockoptListener sets -nodelay, -sndbuf, -rcvbuf and the -keepalive
+// options on the connections it accepts.
+type sockoptListener struct {
+	net.Listener
+	conf   *bridgeConfig
+	logger *Logger
+}
+
+func (l *sockoptListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if tcpConn, ok := conn.(*net.TCPConn); ok {
+		if err := setSockopts(tcpConn, l.conf); err != nil {
+			l.logger.Warn("socket option error", "addr", conn.RemoteAddr(), "err", err)
+		}
+		if err := setKeepalive(tcpConn, l.conf); err != nil {
+			l.logger.Warn("keepalive error", "addr", conn.RemoteAddr(), "err", err)
+		}
+	}
+	return conn, nil
+}
+
+// setSockopts sets TCP_NODELAY and the buffer sizes, a 0 size keeps the
+// system default.
+func setSockopts(conn *net.TCPConn, conf *bridgeConfig) error {
+	if err := conn.SetNoDelay(conf.NoDelay); err != nil {
+		return err
+	}
+	if conf.SndBuf > 0 {
+		if err := conn.SetWriteBuffer(conf.SndBuf); err != nil {
+			return err
+		}
+	}
+	if conf.RcvBuf > 0 {
+		if err := conn.SetReadBuffer(conf.RcvBuf); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,18 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"golang.org/x/sys/unix"
+)
+
+// setReuseAddr sets SO_REUSEADDR on the listening socket fd, go turns it
+// on by itself.
+func setReuseAddr(fd uintptr, on bool) error {
+	v := 0
+	if on {
+		v = 1
+	}
+	return unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEADDR, v)
+}
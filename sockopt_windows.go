@@ -0,0 +1,15 @@
+package main
+
+import (
+	"golang.org/x/sys/windows"
+)
+
+// setReuseAddr sets SO_REUSEADDR on the listening socket fd, on windows it
+// lets another program bind the port too.
+func setReuseAddr(fd uintptr, on bool) error {
+	v := 0
+	if on {
+		v = 1
+	}
+	return windows.SetsockoptInt(windows.Handle(fd), windows.SOL_SOCKET, windows.SO_REUSEADDR, v)
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// sshConn is a session channel of an ssh connection used as a client.
+type sshConn struct {
+	ssh.Channel
+	conn *ssh.ServerConn
+}
+
+func (s *sshConn) LocalAddr() net.Addr                { return s.conn.LocalAddr() }
+func (s *sshConn) RemoteAddr() net.Addr               { return s.conn.RemoteAddr() }
+func (s *sshConn) SetDeadline(t time.Time) error      { return nil }
+func (s *sshConn) SetReadDeadline(t time.Time) error  { return nil }
+func (s *sshConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// loadHostKey reads the -ssh-host-key file, a new ed25519 key is generated
+// and saved there when it doesn't exist yet.
+func loadHostKey(path string, logger *Logger) (ssh.Signer, error) {
+	b, err := os.ReadFile(path)
+	if err == nil {
+		return ssh.ParsePrivateKey(b)
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	b = pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	if err := os.WriteFile(path, b, 0600); err != nil {
+		return nil, err
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		return nil, err
+	}
+	logger.Info("generated ssh host key", "path", path, "fingerprint", ssh.FingerprintSHA256(signer.PublicKey()))
+	return signer, nil
+}
+
+func loadAuthorizedKeys(path string) (map[string]bool, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	keys := make(map[string]bool)
+	for len(bytes.TrimSpace(b)) > 0 {
+		key, _, _, rest, err := ssh.ParseAuthorizedKey(b)
+		if err != nil {
+			return nil, err
+		}
+		keys[string(key.Marshal())] = true
+		b = rest
+	}
+	return keys, nil
+}
+
+func (b *bridge) sshServerConfig() (*ssh.ServerConfig, error) {
+	if b.conf.SSHAuthorizedKeys == "" && b.secret() == "" {
+		return nil, errors.New("-ssh needs -ssh-authorized-keys or -token")
+	}
+	conf := &ssh.ServerConfig{ServerVersion: "SSH-2.0-tcp2serial"}
+
+	if b.conf.SSHAuthorizedKeys != "" {
+		keys, err := loadAuthorizedKeys(b.conf.SSHAuthorizedKeys)
+		if err != nil {
+			return nil, err
+		}
+		conf.PublicKeyCallback = func(c ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if keys[string(key.Marshal())] {
+				return &ssh.Permissions{Extensions: map[string]string{
+					"fingerprint": ssh.FingerprintSHA256(key),
+				}}, nil
+			}
+			return nil, fmt.Errorf("unknown public key for %v", c.User())
+		}
+	}
+	if b.secret() != "" {
+		conf.PasswordCallback = func(c ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			if subtle.ConstantTimeCompare(password, []byte(b.secret())) == 1 {
+				return nil, nil
+			}
+			return nil, errAuthFailed
+		}
+	}
+
+	signer, err := loadHostKey(b.conf.SSHHostKey, b.logger)
+	if err != nil {
+		return nil, err
+	}
+	conf.AddHostKey(signer)
+	return conf, nil
+}
+
+func (b *bridge) serveSSH(ctx context.Context, conf *ssh.ServerConfig, l net.Listener) error {
+	for {
+		tcpConn, err := b.newTcpConn(l)
+		if err != nil {
+			return err
+		}
+		go b.handleSSHConn(ctx, conf, tcpConn)
+	}
+}
+
+func (b *bridge) handleSSHConn(ctx context.Context, conf *ssh.ServerConfig, tcpConn net.Conn) {
+	tcpConn.SetDeadline(time.Now().Add(30 * time.Second))
+	conn, chans, reqs, err := ssh.NewServerConn(tcpConn, conf)
+	if err != nil {
+		b.logger.Warn("ssh handshake error", "addr", tcpConn.RemoteAddr(), "err", err)
+		tcpConn.Close()
+		b.ended(exitAuth)
+		return
+	}
+	tcpConn.SetDeadline(time.Time{})
+	defer conn.Close()
+
+	if conn.Permissions != nil && conn.Permissions.Extensions["fingerprint"] != "" {
+		b.logger.Info("ssh login", "addr", conn.RemoteAddr(), "user", conn.User(), "key", conn.Permissions.Extensions["fingerprint"])
+	} else {
+		b.logger.Info("ssh login", "addr", conn.RemoteAddr(), "user", conn.User())
+	}
+	go ssh.DiscardRequests(reqs)
+
+	for newChan := range chans {
+		if newChan.ChannelType() != "session" {
+			newChan.Reject(ssh.UnknownChannelType, "only session channels are supported")
+			continue
+		}
+		ch, chReqs, err := newChan.Accept()
+		if err != nil {
+			b.logger.Warn("ssh channel error", "addr", conn.RemoteAddr(), "err", err)
+			continue
+		}
+		go handleSSHRequests(chReqs)
+		go b.serveClient(ctx, newClient(&sshConn{Channel: ch, conn: conn}))
+	}
+}
+
+func handleSSHRequests(reqs <-chan *ssh.Request) {
+	for req := range reqs {
+		switch req.Type {
+		case "pty-req", "shell", "env", "window-change":
+			req.Reply(true, nil)
+		default:
+			// exec, subsystem and the like make no sense for a serial console
+			req.Reply(false, nil)
+		}
+	}
+}
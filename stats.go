@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+)
+
+// trafficStats counts the bytes written to and read from the serial port,
+// of a whole bridge or of one client session, and for a bridge those that
+// were dropped while the port was lost.
+type trafficStats struct {
+	toSerial        uint64
+	fromSerial      uint64
+	toSerialDropped uint64
+	since           time.Time
+}
+
+func newTrafficStats() *trafficStats {
+	return &trafficStats{since: time.Now()}
+}
+
+func (s *trafficStats) add(toSerial bool, n int) {
+	if toSerial {
+		atomic.AddUint64(&s.toSerial, uint64(n))
+	} else {
+		atomic.AddUint64(&s.fromSerial, uint64(n))
+	}
+}
+
+func (s *trafficStats) load() (toSerial, fromSerial uint64) {
+	return atomic.LoadUint64(&s.toSerial), atomic.LoadUint64(&s.fromSerial)
+}
+
+func (s *trafficStats) drop(n int) {
+	atomic.AddUint64(&s.toSerialDropped, uint64(n))
+}
+
+func (s *trafficStats) dropped() uint64 {
+	return atomic.LoadUint64(&s.toSerialDropped)
+}
+
+// report logs the totals and the rates of the last interval until ctx is
+// done.
+func (s *trafficStats) report(ctx context.Context, logger *Logger, msg string, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	lastTo, lastFrom := s.load()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		to, from := s.load()
+		logger.Info(msg, "to_serial_bytes", to, "from_serial_bytes", from,
+			"to_serial_rate", rate(to-lastTo, interval), "from_serial_rate", rate(from-lastFrom, interval))
+		lastTo, lastFrom = to, from
+	}
+}
+
+// summary logs the totals and the average rates since the start.
+func (s *trafficStats) summary(logger *Logger, msg string) {
+	d := time.Since(s.since)
+	to, from := s.load()
+	logger.Info(msg, "duration", d.Round(time.Millisecond), "to_serial_bytes", to, "from_serial_bytes", from,
+		"to_serial_rate", rate(to, d), "from_serial_rate", rate(from, d))
+}
+
+// rate is in bytes per second.
+func rate(n uint64, d time.Duration) uint64 {
+	if d <= 0 {
+		return 0
+	}
+	return uint64(float64(n) / d.Seconds())
+}
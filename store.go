@@ -0,0 +1,98 @@
+package main
+
+import "os"
+
+// store keeps what the serial port sends while no client is connected,
+// up to size bytes in memory or in a file, until the next client takes it,
+// see -store.
+type store struct {
+	size   int
+	path   string
+	logger *Logger
+
+	data []byte
+	// n is what the file holds, it outlives a restart
+	n int
+	// full is set once data was dropped, so it is logged once
+	full bool
+}
+
+func newStore(size int, path string, logger *Logger) (*store, error) {
+	s := &store{size: size, path: path, logger: logger}
+	if path == "" {
+		return s, nil
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	s.n = int(fi.Size())
+	if s.n > 0 {
+		logger.Info("store has data", "file", path, "bytes", s.n)
+	}
+	return s, nil
+}
+
+// add keeps b, what doesn't fit any more is dropped and the oldest data
+// is kept.
+func (s *store) add(b []byte) {
+	if room := s.size - s.len(); len(b) > room {
+		if !s.full {
+			s.full = true
+			s.logger.Warn("store full, serial data dropped", "size", s.size)
+		}
+		if room <= 0 {
+			return
+		}
+		b = b[:room]
+	}
+	if s.path == "" {
+		s.data = append(s.data, b...)
+		return
+	}
+	f, err := os.OpenFile(s.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		s.logger.Warn("store error", "file", s.path, "err", err)
+		return
+	}
+	defer f.Close()
+	n, err := f.Write(b)
+	s.n += n
+	if err != nil {
+		s.logger.Warn("store error", "file", s.path, "err", err)
+	}
+}
+
+func (s *store) len() int {
+	if s.path == "" {
+		return len(s.data)
+	}
+	return s.n
+}
+
+// take returns what was stored and empties the store.
+func (s *store) take() []byte {
+	if s.len() == 0 {
+		return nil
+	}
+	s.full = false
+	if s.path == "" {
+		b := s.data
+		s.data = nil
+		return b
+	}
+	b, err := os.ReadFile(s.path)
+	if err == nil {
+		err = os.Truncate(s.path, 0)
+	}
+	if err != nil {
+		s.logger.Warn("store error", "file", s.path, "err", err)
+	}
+	s.n = 0
+	return b
+}
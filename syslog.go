@@ -0,0 +1,80 @@
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/syslog"
+	"strings"
+)
+
+var syslogFacilities = map[string]syslog.Priority{
+	"kern":     syslog.LOG_KERN,
+	"user":     syslog.LOG_USER,
+	"mail":     syslog.LOG_MAIL,
+	"daemon":   syslog.LOG_DAEMON,
+	"auth":     syslog.LOG_AUTH,
+	"syslog":   syslog.LOG_SYSLOG,
+	"lpr":      syslog.LOG_LPR,
+	"news":     syslog.LOG_NEWS,
+	"uucp":     syslog.LOG_UUCP,
+	"cron":     syslog.LOG_CRON,
+	"authpriv": syslog.LOG_AUTHPRIV,
+	"ftp":      syslog.LOG_FTP,
+	"local0":   syslog.LOG_LOCAL0,
+	"local1":   syslog.LOG_LOCAL1,
+	"local2":   syslog.LOG_LOCAL2,
+	"local3":   syslog.LOG_LOCAL3,
+	"local4":   syslog.LOG_LOCAL4,
+	"local5":   syslog.LOG_LOCAL5,
+	"local6":   syslog.LOG_LOCAL6,
+	"local7":   syslog.LOG_LOCAL7,
+}
+
+type syslogOutput struct {
+	w *syslog.Writer
+}
+
+// newSyslogOutput connects to the local syslog daemon for target "local",
+// or to a remote server for udp://host:port and tcp://host:port.
+func newSyslogOutput(target, facility string) (io.Writer, error) {
+	priority, ok := syslogFacilities[facility]
+	if !ok {
+		return nil, fmt.Errorf("unknown syslog facility: %v", facility)
+	}
+	priority |= syslog.LOG_INFO
+
+	var w *syslog.Writer
+	var err error
+	if target == "local" {
+		w, err = syslog.New(priority, "tcp2serial")
+	} else {
+		i := strings.Index(target, "://")
+		if i < 0 {
+			return nil, fmt.Errorf("syslog target must be local, udp://host:port or tcp://host:port: %v", target)
+		}
+		w, err = syslog.Dial(target[:i], target[i+3:], priority, "tcp2serial")
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &syslogOutput{w: w}, nil
+}
+
+func (s *syslogOutput) Write(b []byte) (int, error) {
+	return len(b), s.w.Info(string(b))
+}
+
+func (s *syslogOutput) writeLevel(level logLevel, line []byte) error {
+	switch level {
+	case levelDebug:
+		return s.w.Debug(string(line))
+	case levelWarn:
+		return s.w.Warning(string(line))
+	case levelError:
+		return s.w.Err(string(line))
+	}
+	return s.w.Info(string(line))
+}
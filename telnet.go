@@ -0,0 +1,315 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	telnetSE   = 240
+	telnetSB   = 250
+	telnetWILL = 251
+	telnetWONT = 252
+	telnetDO   = 253
+	telnetDONT = 254
+	telnetIAC  = 255
+
+	telnetOptBinary  = 0
+	telnetOptEcho    = 1
+	telnetOptSGA     = 3
+	telnetOptComPort = 44
+
+	// a subnegotiation of RFC 2217, NAWS or TTYPE is a few bytes, a longer
+	// one is dropped
+	telnetMaxSB = 256
+)
+
+const (
+	telnetStateData = iota
+	telnetStateIAC
+	telnetStateOption
+	telnetStateSB
+	telnetStateSBIAC
+)
+
+// telnetConn strips telnet commands from what the client sends and escapes
+// IAC bytes in what is sent to it. When port is set it also serves the
+// RFC 2217 COM-PORT-OPTION. A client that refuses BINARY gets the CR of
+// the NVT, followed by NUL.
+type telnetConn struct {
+	net.Conn
+	port   *serialPort
+	logger *Logger
+	// client is set when tcp2serial is the client of a remote RFC 2217
+	// server, see newTelnetClient
+	client bool
+
+	state  int
+	cmd    byte
+	sb     []byte
+	local  [256]bool
+	remote [256]bool
+
+	// cr is set after a CR from the client, the NUL of the NVT after it
+	// is dropped
+	cr bool
+
+	wmu       sync.Mutex
+	cond      *sync.Cond
+	suspended bool
+	// nvt is set while the client doesn't take BINARY, guarded by wmu
+	nvt bool
+
+	lineStateMask  byte
+	modemStateMask byte
+
+	// coalesce is -rfc2217-coalesce, the DTR and RTS changes wait in
+	// pending for it
+	coalesce  time.Duration
+	lineMu    sync.Mutex
+	lineTimer *time.Timer
+	pending   pendingLines
+}
+
+func newTelnetConn(conn net.Conn, port *serialPort, logger *Logger) *telnetConn {
+	t := &telnetConn{Conn: conn, port: port, logger: logger, modemStateMask: 255}
+	t.cond = sync.NewCond(&t.wmu)
+
+	t.local[telnetOptBinary] = true
+	t.local[telnetOptSGA] = true
+	t.local[telnetOptEcho] = true
+	t.remote[telnetOptBinary] = true
+	t.remote[telnetOptSGA] = true
+	t.command(telnetWILL, telnetOptBinary)
+	t.command(telnetDO, telnetOptBinary)
+	t.command(telnetWILL, telnetOptSGA)
+	t.command(telnetDO, telnetOptSGA)
+	t.command(telnetWILL, telnetOptEcho)
+	if port != nil {
+		t.remote[telnetOptComPort] = true
+		t.command(telnetDO, telnetOptComPort)
+	}
+	return t
+}
+
+// newTelnetClient speaks telnet to an RFC 2217 server, offering to send it
+// the COM-PORT-OPTION commands of setLine.
+func newTelnetClient(conn net.Conn, logger *Logger) *telnetConn {
+	t := &telnetConn{Conn: conn, logger: logger, client: true}
+	t.cond = sync.NewCond(&t.wmu)
+
+	t.local[telnetOptBinary] = true
+	t.local[telnetOptComPort] = true
+	t.remote[telnetOptBinary] = true
+	t.remote[telnetOptSGA] = true
+	t.command(telnetWILL, telnetOptBinary)
+	t.command(telnetDO, telnetOptBinary)
+	t.command(telnetDO, telnetOptSGA)
+	t.command(telnetWILL, telnetOptComPort)
+	return t
+}
+
+func (t *telnetConn) Read(b []byte) (int, error) {
+	for {
+		n, err := t.Conn.Read(b)
+		n = t.filter(b[:n])
+		if n > 0 {
+			// the lines change before the data that follows the change
+			t.applyLines()
+		}
+		if n > 0 || err != nil {
+			return n, err
+		}
+	}
+}
+
+func (t *telnetConn) Write(b []byte) (int, error) {
+	t.wmu.Lock()
+	defer t.wmu.Unlock()
+	for t.suspended {
+		t.cond.Wait()
+	}
+
+	out := b
+	if bytes.IndexByte(out, telnetIAC) >= 0 {
+		out = bytes.ReplaceAll(out, []byte{telnetIAC}, []byte{telnetIAC, telnetIAC})
+	}
+	if t.nvt && bytes.IndexByte(out, '\r') >= 0 {
+		out = bytes.ReplaceAll(out, []byte("\r"), []byte("\r\x00"))
+		// CR LF stays as it is
+		out = bytes.ReplaceAll(out, []byte("\r\x00\n"), []byte("\r\n"))
+	}
+	if len(out) == len(b) {
+		return t.Conn.Write(b)
+	}
+	_, err := t.Conn.Write(out)
+	if err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (t *telnetConn) writeRaw(b []byte) {
+	t.wmu.Lock()
+	defer t.wmu.Unlock()
+	if _, err := t.Conn.Write(b); err != nil {
+		t.logger.Warn("telnet write error", "err", err)
+	}
+}
+
+func (t *telnetConn) command(cmd byte, opt byte) {
+	t.writeRaw([]byte{telnetIAC, cmd, opt})
+}
+
+func (t *telnetConn) subnegotiation(opt byte, data ...byte) {
+	b := []byte{telnetIAC, telnetSB, opt}
+	b = append(b, bytes.ReplaceAll(data, []byte{telnetIAC}, []byte{telnetIAC, telnetIAC})...)
+	b = append(b, telnetIAC, telnetSE)
+	t.writeRaw(b)
+}
+
+// filter removes the telnet commands from b in place and returns the number
+// of data bytes left.
+func (t *telnetConn) filter(b []byte) int {
+	n := 0
+	for _, c := range b {
+		switch t.state {
+		case telnetStateData:
+			if c == telnetIAC {
+				t.state = telnetStateIAC
+			} else if c == 0 && t.cr && !t.remote[telnetOptBinary] {
+				t.cr = false
+			} else {
+				b[n] = c
+				n++
+				t.cr = c == '\r'
+			}
+		case telnetStateIAC:
+			switch c {
+			case telnetIAC:
+				b[n] = c
+				n++
+				t.state = telnetStateData
+			case telnetWILL, telnetWONT, telnetDO, telnetDONT:
+				t.cmd = c
+				t.state = telnetStateOption
+			case telnetSB:
+				t.sb = t.sb[:0]
+				t.state = telnetStateSB
+			default:
+				// NOP, GA, AYT and friends
+				t.state = telnetStateData
+			}
+		case telnetStateOption:
+			t.negotiate(t.cmd, c)
+			t.state = telnetStateData
+		case telnetStateSB:
+			if c == telnetIAC {
+				t.state = telnetStateSBIAC
+			} else {
+				t.addSB(c)
+			}
+		case telnetStateSBIAC:
+			if c == telnetSE {
+				t.subnegotiate(t.sb)
+				t.state = telnetStateData
+			} else {
+				t.state = telnetStateSB
+				t.addSB(c)
+			}
+		}
+	}
+	return n
+}
+
+// addSB keeps c for the subnegotiation, past telnetMaxSB it is dropped and
+// what follows is data again.
+func (t *telnetConn) addSB(c byte) {
+	if len(t.sb) >= telnetMaxSB {
+		t.logger.Debug("telnet subnegotiation too long, dropped", "option", t.sb[0])
+		t.sb = t.sb[:0]
+		t.state = telnetStateData
+		return
+	}
+	t.sb = append(t.sb, c)
+}
+
+func (t *telnetConn) acceptLocal(opt byte) bool {
+	if t.client {
+		return opt == telnetOptBinary || opt == telnetOptComPort
+	}
+	return opt == telnetOptBinary || opt == telnetOptSGA || opt == telnetOptEcho
+}
+
+func (t *telnetConn) acceptRemote(opt byte) bool {
+	if t.client {
+		return opt == telnetOptBinary || opt == telnetOptSGA || opt == telnetOptEcho
+	}
+	if opt == telnetOptComPort {
+		return t.port != nil
+	}
+	return opt == telnetOptBinary || opt == telnetOptSGA
+}
+
+func (t *telnetConn) negotiate(cmd byte, opt byte) {
+	switch cmd {
+	case telnetWILL:
+		if t.remote[opt] {
+			return
+		}
+		if t.acceptRemote(opt) {
+			t.remote[opt] = true
+			t.command(telnetDO, opt)
+		} else {
+			t.command(telnetDONT, opt)
+		}
+	case telnetWONT:
+		if t.remote[opt] {
+			t.remote[opt] = false
+			t.command(telnetDONT, opt)
+		}
+	case telnetDO:
+		if t.local[opt] {
+			return
+		}
+		if t.acceptLocal(opt) {
+			t.local[opt] = true
+			t.command(telnetWILL, opt)
+		} else {
+			t.command(telnetWONT, opt)
+		}
+	case telnetDONT:
+		if t.local[opt] {
+			t.local[opt] = false
+			t.command(telnetWONT, opt)
+		}
+	}
+	if opt == telnetOptBinary {
+		t.wmu.Lock()
+		t.nvt = !t.local[telnetOptBinary]
+		t.wmu.Unlock()
+	}
+}
+
+func (t *telnetConn) subnegotiate(sb []byte) {
+	if len(sb) == 0 {
+		return
+	}
+	if sb[0] != telnetOptComPort || len(sb) < 2 {
+		return
+	}
+	if t.client {
+		t.comPortServer(sb[1], sb[2:])
+	} else if t.port != nil {
+		t.comPortCommand(sb[1], sb[2:])
+	}
+}
+
+func (t *telnetConn) setSuspended(suspended bool) {
+	t.wmu.Lock()
+	t.suspended = suspended
+	t.wmu.Unlock()
+	t.cond.Broadcast()
+}
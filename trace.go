@@ -0,0 +1,239 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// OTLP span kinds and status codes.
+const (
+	spanKindInternal = 1
+	spanKindServer   = 2
+
+	spanStatusOk    = 1
+	spanStatusError = 2
+)
+
+const (
+	traceBatchSize     = 256
+	traceFlushInterval = 5 * time.Second
+	traceQueueSize     = 4096
+)
+
+// span is a finished or running OpenTelemetry span. A nil *span is a
+// valid no-op span, which is what startSpan returns with tracing off.
+type span struct {
+	tracer   *tracer
+	traceID  [16]byte
+	spanID   [8]byte
+	parentID [8]byte
+	name     string
+	kind     int
+	start    time.Time
+
+	mu    sync.Mutex
+	attrs []interface{}
+}
+
+type spanKey struct{}
+
+// tracer exports spans over OTLP/HTTP with the json encoding, batched in
+// the background.
+type tracer struct {
+	endpoint string
+	client   *http.Client
+	queue    chan []byte
+	done     chan struct{}
+
+	mu     sync.Mutex
+	closed bool
+}
+
+// defaultTracer is set by main when -otlp-endpoint is given.
+var defaultTracer *tracer
+
+func newTracer(endpoint string) *tracer {
+	endpoint = strings.TrimSuffix(endpoint, "/")
+	if !strings.HasSuffix(endpoint, "/v1/traces") {
+		endpoint += "/v1/traces"
+	}
+	t := &tracer{
+		endpoint: endpoint,
+		client:   &http.Client{Timeout: 10 * time.Second},
+		queue:    make(chan []byte, traceQueueSize),
+		done:     make(chan struct{}),
+	}
+	go t.exportLoop()
+	return t
+}
+
+// startSpan starts a span as the child of the one in ctx, kv are its
+// attributes.
+func startSpan(ctx context.Context, name string, kind int, kv ...interface{}) (context.Context, *span) {
+	t := defaultTracer
+	if t == nil {
+		return ctx, nil
+	}
+	s := &span{tracer: t, name: name, kind: kind, start: time.Now(), attrs: kv}
+	if parent, ok := ctx.Value(spanKey{}).(*span); ok && parent != nil {
+		s.traceID = parent.traceID
+		s.parentID = parent.spanID
+	} else {
+		rand.Read(s.traceID[:])
+	}
+	rand.Read(s.spanID[:])
+	return context.WithValue(ctx, spanKey{}, s), s
+}
+
+func (s *span) setAttributes(kv ...interface{}) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.attrs = append(s.attrs, kv...)
+	s.mu.Unlock()
+}
+
+// end finishes the span, a non nil err marks it failed.
+func (s *span) end(err error) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	j := map[string]interface{}{
+		"traceId":           hex.EncodeToString(s.traceID[:]),
+		"spanId":            hex.EncodeToString(s.spanID[:]),
+		"name":              s.name,
+		"kind":              s.kind,
+		"startTimeUnixNano": strconv.FormatInt(s.start.UnixNano(), 10),
+		"endTimeUnixNano":   strconv.FormatInt(time.Now().UnixNano(), 10),
+		"attributes":        otlpAttributes(s.attrs),
+		"status":            map[string]interface{}{"code": spanStatusOk},
+	}
+	if s.parentID != [8]byte{} {
+		j["parentSpanId"] = hex.EncodeToString(s.parentID[:])
+	}
+	if err != nil {
+		j["status"] = map[string]interface{}{"code": spanStatusError, "message": err.Error()}
+	}
+	b, jerr := json.Marshal(j)
+	if jerr != nil {
+		return
+	}
+	s.tracer.enqueue(b)
+}
+
+func (t *tracer) enqueue(b []byte) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed {
+		return
+	}
+	select {
+	case t.queue <- b:
+	default:
+		// the collector can't keep up, losing spans beats blocking the relay
+	}
+}
+
+// spanError is err unless it is just the end of the relay, because the
+// client went away or ctx was done.
+func spanError(ctx context.Context, err error) error {
+	if err == io.EOF || ctx.Err() != nil {
+		return nil
+	}
+	return err
+}
+
+func otlpAttributes(kv []interface{}) []interface{} {
+	attrs := []interface{}{}
+	for i := 0; i+1 < len(kv); i += 2 {
+		var value map[string]interface{}
+		switch v := kv[i+1].(type) {
+		case bool:
+			value = map[string]interface{}{"boolValue": v}
+		case int:
+			value = map[string]interface{}{"intValue": strconv.Itoa(v)}
+		case uint64:
+			value = map[string]interface{}{"intValue": strconv.FormatUint(v, 10)}
+		default:
+			value = map[string]interface{}{"stringValue": fmt.Sprint(v)}
+		}
+		attrs = append(attrs, map[string]interface{}{"key": fmt.Sprint(kv[i]), "value": value})
+	}
+	return attrs
+}
+
+func (t *tracer) exportLoop() {
+	defer close(t.done)
+	ticker := time.NewTicker(traceFlushInterval)
+	defer ticker.Stop()
+
+	var batch []json.RawMessage
+	for {
+		select {
+		case b, ok := <-t.queue:
+			if !ok {
+				t.export(batch)
+				return
+			}
+			batch = append(batch, b)
+			if len(batch) < traceBatchSize {
+				continue
+			}
+		case <-ticker.C:
+		}
+		t.export(batch)
+		batch = nil
+	}
+}
+
+func (t *tracer) export(spans []json.RawMessage) {
+	if len(spans) == 0 {
+		return
+	}
+	body, err := json.Marshal(map[string]interface{}{
+		"resourceSpans": []interface{}{map[string]interface{}{
+			"resource": map[string]interface{}{
+				"attributes": otlpAttributes([]interface{}{"service.name", "tcp2serial"}),
+			},
+			"scopeSpans": []interface{}{map[string]interface{}{
+				"scope": map[string]interface{}{"name": "tcp2serial"},
+				"spans": spans,
+			}},
+		}},
+	})
+	if err != nil {
+		return
+	}
+	resp, err := t.client.Post(t.endpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		stdLogger.Warn("otlp export error", "err", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		stdLogger.Warn("otlp export error", "status", resp.Status)
+	}
+}
+
+// shutdown exports what is still queued, spans ended afterwards are lost.
+func (t *tracer) shutdown() {
+	t.mu.Lock()
+	t.closed = true
+	close(t.queue)
+	t.mu.Unlock()
+	<-t.done
+}
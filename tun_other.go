@@ -0,0 +1,11 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import "os"
+
+// openTun is only there on linux.
+func openTun(name string) (*os.File, error) {
+	return nil, errUnsupported
+}
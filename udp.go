@@ -0,0 +1,90 @@
+package main
+
+import (
+	"net"
+	"sync"
+)
+
+// udpConn exchanges serial data as datagrams with -peer, or with whoever
+// sent the last datagram when no peer is configured.
+type udpConn struct {
+	*net.UDPConn
+	b     *bridge
+	mu    sync.Mutex
+	peer  *net.UDPAddr
+	fixed bool
+}
+
+func (b *bridge) newUdpConn() (*udpConn, error) {
+	laddr, err := net.ResolveUDPAddr("udp", b.conf.Listen)
+	if err != nil {
+		b.logger.Error("udp address error", "addr", b.conf.Listen, "err", err)
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp", laddr)
+	if err != nil {
+		b.logger.Error("listen error", "addr", b.conf.Listen, "err", err)
+		return nil, err
+	}
+
+	u := &udpConn{UDPConn: conn, b: b}
+	if b.conf.UdpPeer != "" {
+		u.peer, err = net.ResolveUDPAddr("udp", b.conf.UdpPeer)
+		if err != nil {
+			b.logger.Error("udp peer error", "peer", b.conf.UdpPeer, "err", err)
+			conn.Close()
+			return nil, err
+		}
+		u.fixed = true
+	}
+	return u, nil
+}
+
+func (u *udpConn) Read(b []byte) (int, error) {
+	for {
+		n, addr, err := u.ReadFromUDP(b)
+		if err != nil {
+			return n, err
+		}
+		if !u.b.allowed(addr) {
+			u.b.logger.Warn("rejected by allow/deny list", "addr", addr)
+			continue
+		}
+		if u.fixed {
+			if !addr.IP.Equal(u.peer.IP) || addr.Port != u.peer.Port {
+				u.b.logger.Warn("not the udp peer, dropped", "addr", addr)
+				continue
+			}
+			return n, nil
+		}
+
+		u.mu.Lock()
+		if u.peer == nil || u.peer.String() != addr.String() {
+			u.b.logger.Info("udp peer changed", "addr", addr)
+		}
+		u.peer = addr
+		u.mu.Unlock()
+		return n, nil
+	}
+}
+
+func (u *udpConn) Write(b []byte) (int, error) {
+	u.mu.Lock()
+	peer := u.peer
+	u.mu.Unlock()
+	if peer == nil {
+		// nobody to send to yet
+		return len(b), nil
+	}
+	return u.WriteToUDP(b, peer)
+}
+
+// RemoteAddr is the current peer, nil until the first datagram.
+func (u *udpConn) RemoteAddr() net.Addr {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.peer == nil {
+		return nil
+	}
+	return u.peer
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+)
+
+const (
+	unixPrefix = "unix:"
+	pipePrefix = `\\.\pipe\`
+)
+
+// newUnixListener listens on a unix domain socket and applies
+// -socket-mode and -socket-owner to the socket file.
+func newUnixListener(path string, mode string, owner string) (net.Listener, error) {
+	// a socket left behind by a previous run
+	if fi, err := os.Stat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := setSocketPerm(path, mode, owner); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+func setSocketPerm(path string, mode string, owner string) error {
+	if mode != "" {
+		m, err := strconv.ParseUint(mode, 8, 32)
+		if err != nil {
+			return err
+		}
+		if err := os.Chmod(path, os.FileMode(m)); err != nil {
+			return err
+		}
+	}
+
+	if owner != "" {
+		uid, gid, err := lookupOwner(owner)
+		if err != nil {
+			return err
+		}
+		if err := os.Chown(path, uid, gid); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// lookupOwner resolves "user", "user:group" or ":group", names or ids, -1
+// keeps the current owner.
+func lookupOwner(owner string) (uid int, gid int, err error) {
+	uid, gid = -1, -1
+	name, group := owner, ""
+	if i := strings.IndexByte(owner, ':'); i >= 0 {
+		name, group = owner[:i], owner[i+1:]
+	}
+
+	if name != "" {
+		u, err := user.Lookup(name)
+		if err != nil {
+			if u, err = user.LookupId(name); err != nil {
+				return 0, 0, err
+			}
+		}
+		if uid, err = strconv.Atoi(u.Uid); err != nil {
+			return 0, 0, errors.New("non numeric uid " + u.Uid)
+		}
+	}
+	if group != "" {
+		g, err := user.LookupGroup(group)
+		if err != nil {
+			if g, err = user.LookupGroupId(group); err != nil {
+				return 0, 0, err
+			}
+		}
+		if gid, err = strconv.Atoi(g.Gid); err != nil {
+			return 0, 0, errors.New("non numeric gid " + g.Gid)
+		}
+	}
+	return uid, gid, nil
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+
+	"go.bug.st/serial/enumerator"
+)
+
+// resolveDevice turns "usb:<vid>:<pid>" and "usbserial:<serial number>"
+// into the name the matching adapter has right now, any other name is
+// returned as it is.
+func resolveDevice(name string) (string, error) {
+	var match func(p *enumerator.PortDetails) bool
+	switch {
+	case strings.HasPrefix(name, "usb:"):
+		ids := strings.Split(strings.TrimPrefix(name, "usb:"), ":")
+		if len(ids) != 2 {
+			return "", fmt.Errorf("%v: want usb:<vid>:<pid>", name)
+		}
+		match = func(p *enumerator.PortDetails) bool {
+			return strings.EqualFold(p.VID, ids[0]) && strings.EqualFold(p.PID, ids[1])
+		}
+	case strings.HasPrefix(name, "usbserial:"):
+		serialNumber := strings.TrimPrefix(name, "usbserial:")
+		match = func(p *enumerator.PortDetails) bool {
+			return p.SerialNumber == serialNumber
+		}
+	default:
+		return name, nil
+	}
+
+	ports, err := enumerator.GetDetailedPortsList()
+	if err != nil {
+		return "", err
+	}
+	var found []string
+	for _, p := range ports {
+		if p.IsUSB && match(p) {
+			found = append(found, p.Name)
+		}
+	}
+	switch len(found) {
+	case 0:
+		return "", fmt.Errorf("%v: no such usb serial adapter", name)
+	case 1:
+		return found[0], nil
+	default:
+		return "", fmt.Errorf("%v: matches %v, pick one with usbserial:", name, strings.Join(found, ", "))
+	}
+}
+
+// listPorts prints the serial ports with the -s names that find them.
+func listPorts(w io.Writer) error {
+	ports, err := enumerator.GetDetailedPortsList()
+	if err != nil {
+		return err
+	}
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	for _, p := range ports {
+		var usbID, usbSerial string
+		if p.IsUSB {
+			usbID = fmt.Sprintf("usb:%s:%s", strings.ToLower(p.VID), strings.ToLower(p.PID))
+			if p.SerialNumber != "" {
+				usbSerial = "usbserial:" + p.SerialNumber
+			}
+		}
+		product := p.Product
+		if product == "" {
+			product = usbProduct(p.Name)
+		}
+		cells := []string{p.Name, usbID, usbSerial, product}
+		for len(cells) > 1 && cells[len(cells)-1] == "" {
+			cells = cells[:len(cells)-1]
+		}
+		fmt.Fprintln(tw, strings.Join(cells, "\t"))
+	}
+	return tw.Flush()
+}
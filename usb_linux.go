@@ -0,0 +1,27 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// usbProduct reads the manufacturer and product strings of the usb device
+// behind a tty from sysfs, the enumerator leaves them out on linux.
+func usbProduct(name string) string {
+	dir, err := filepath.EvalSymlinks(filepath.Join("/sys/class/tty", filepath.Base(name), "device"))
+	if err != nil {
+		return ""
+	}
+	// ttyUSB hangs off a usb-serial port below the interface, ttyACM off the
+	// interface itself, the strings are on the usb device above
+	for i := 0; i < 3; i++ {
+		product, err := os.ReadFile(filepath.Join(dir, "product"))
+		if err == nil {
+			manufacturer, _ := os.ReadFile(filepath.Join(dir, "manufacturer"))
+			return strings.TrimSpace(strings.TrimSpace(string(manufacturer)) + " " + strings.TrimSpace(string(product)))
+		}
+		dir = filepath.Dir(dir)
+	}
+	return ""
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+// usbProduct is only needed on linux, elsewhere the enumerator fills in
+// the product.
+func usbProduct(name string) string {
+	return ""
+}
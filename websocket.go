@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	wsPingPeriod = 30 * time.Second
+	wsPongWait   = 60 * time.Second
+)
+
+// newWsUpgrader takes the WebSockets of the pages of the endpoint itself,
+// of the origins, see -ws-origin, and of the clients that aren't browsers
+// and send no Origin. Any other page a browser has open gets a 403, it
+// would come from an address the allow list lets in.
+func newWsUpgrader(origins []string) *websocket.Upgrader {
+	return &websocket.Upgrader{
+		ReadBufferSize:  4096,
+		WriteBufferSize: 4096,
+		CheckOrigin: func(r *http.Request) bool {
+			origin := r.Header.Get("Origin")
+			if origin == "" {
+				return true
+			}
+			u, err := url.Parse(origin)
+			if err != nil {
+				return false
+			}
+			if strings.EqualFold(u.Host, r.Host) {
+				return true
+			}
+			for _, o := range origins {
+				if strings.EqualFold(o, origin) {
+					return true
+				}
+			}
+			return false
+		},
+	}
+}
+
+// parseWsOrigins reads -ws-origin, e.g. https://tools.example.com.
+func parseWsOrigins(list string) ([]string, error) {
+	var origins []string
+	for _, s := range strings.Split(list, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		u, err := url.Parse(s)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" ||
+			u.Path != "" || u.RawQuery != "" || u.User != nil {
+			return nil, fmt.Errorf("invalid ws origin: %q, want scheme://host[:port]", s)
+		}
+		origins = append(origins, s)
+	}
+	return origins, nil
+}
+
+// wsConn maps binary WebSocket messages to a plain byte stream.
+type wsConn struct {
+	*websocket.Conn
+	r         io.Reader
+	wmu       sync.Mutex
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newWsConn(conn *websocket.Conn) *wsConn {
+	w := &wsConn{Conn: conn, done: make(chan struct{})}
+	conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	})
+	go w.keepalive()
+	return w
+}
+
+func (w *wsConn) keepalive() {
+	ticker := time.NewTicker(wsPingPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			err := w.WriteControl(websocket.PingMessage, nil, time.Now().Add(10*time.Second))
+			if err != nil {
+				return
+			}
+		case <-w.done:
+			return
+		}
+	}
+}
+
+func (w *wsConn) Read(b []byte) (int, error) {
+	for {
+		if w.r == nil {
+			_, r, err := w.NextReader()
+			if err != nil {
+				return 0, err
+			}
+			w.r = r
+		}
+		n, err := w.r.Read(b)
+		if err == io.EOF {
+			w.r = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+func (w *wsConn) Write(b []byte) (int, error) {
+	w.wmu.Lock()
+	defer w.wmu.Unlock()
+	if err := w.WriteMessage(websocket.BinaryMessage, b); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (w *wsConn) SetDeadline(t time.Time) error {
+	if err := w.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return w.SetWriteDeadline(t)
+}
+
+func (w *wsConn) Close() error {
+	w.closeOnce.Do(func() { close(w.done) })
+	return w.Conn.Close()
+}
+
+// serveWebSocket serves the -ws endpoint on l, every WebSocket becomes a
+// client of the hub.
+func (b *bridge) serveWebSocket(ctx context.Context, l net.Listener) error {
+	// validate read them already
+	origins, _ := parseWsOrigins(b.conf.WsOrigin)
+	upgrader := newWsUpgrader(origins)
+	mux := http.NewServeMux()
+	mux.HandleFunc(b.conf.WsPath, func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			b.logger.Warn("websocket upgrade error", "addr", r.RemoteAddr, "err", err)
+			return
+		}
+		if !b.allowed(conn.RemoteAddr()) {
+			b.logger.Warn("rejected by allow/deny list", "addr", r.RemoteAddr)
+			conn.Close()
+			return
+		}
+		b.logger.Info("websocket connected", "addr", r.RemoteAddr)
+		if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+			b.logger.Info("client certificate", "addr", r.RemoteAddr,
+				"cn", r.TLS.PeerCertificates[0].Subject.CommonName)
+		}
+		b.handleConn(ctx, newWsConn(conn), false)
+	})
+	if b.conf.Console {
+		mux.HandleFunc("/console", b.serveConsole)
+	}
+	return http.Serve(l, mux)
+}
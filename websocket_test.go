@@ -0,0 +1,64 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestWsOrigin(t *testing.T) {
+	upgrader := newWsUpgrader([]string{"https://tools.example.com"})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err == nil {
+			conn.Close()
+		}
+	}))
+	defer srv.Close()
+	url := "ws" + strings.TrimPrefix(srv.URL, "http") + "/serial"
+
+	tests := []struct {
+		origin string
+		want   int
+	}{
+		{"", http.StatusSwitchingProtocols},
+		{srv.URL, http.StatusSwitchingProtocols},
+		{"https://tools.example.com", http.StatusSwitchingProtocols},
+		{"HTTPS://TOOLS.EXAMPLE.COM", http.StatusSwitchingProtocols},
+		{"https://evil.example.com", http.StatusForbidden},
+		{"http://tools.example.com", http.StatusForbidden},
+		{"null", http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		header := http.Header{}
+		if tt.origin != "" {
+			header.Set("Origin", tt.origin)
+		}
+		conn, resp, err := websocket.DefaultDialer.Dial(url, header)
+		if conn != nil {
+			conn.Close()
+		}
+		if resp == nil {
+			t.Errorf("origin %q: %v", tt.origin, err)
+			continue
+		}
+		if resp.StatusCode != tt.want {
+			t.Errorf("origin %q: status %v, want %v", tt.origin, resp.StatusCode, tt.want)
+		}
+	}
+}
+
+func TestParseWsOrigins(t *testing.T) {
+	origins, err := parseWsOrigins("https://a.example.com, http://b.example.com:8080")
+	if err != nil || len(origins) != 2 || origins[1] != "http://b.example.com:8080" {
+		t.Errorf("parseWsOrigins = %q, %v", origins, err)
+	}
+	for _, s := range []string{"*", "a.example.com", "https://a.example.com/page", "ftp://a.example.com"} {
+		if _, err := parseWsOrigins(s); err == nil {
+			t.Errorf("parseWsOrigins(%q) took it", s)
+		}
+	}
+}